@@ -3,10 +3,12 @@ package peco
 import (
 	"errors"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 	"unicode"
 
-	"github.com/google/btree"
-	"github.com/nsf/termbox-go"
 	"github.com/peco/peco/keyseq"
 )
 
@@ -19,13 +21,13 @@ var ErrUserCanceled = errors.New("canceled")
 // but most everything is implemented in terms of ActionFunc, which is
 // callback based Action
 type Action interface {
-	Register(string, ...termbox.Key)
+	Register(string, ...Key)
 	RegisterKeySequence(keyseq.KeyList)
-	Execute(*Input, termbox.Event)
+	Execute(*Input, Event)
 }
 
 // ActionFunc is a type of Action that is basically just a callback.
-type ActionFunc func(*Input, termbox.Event)
+type ActionFunc func(*Input, Event)
 
 // This is the global map of canonical action name to actions
 var nameToActions map[string]Action
@@ -33,18 +35,24 @@ var nameToActions map[string]Action
 // This is the default keybinding used by NewKeymap()
 var defaultKeyBinding map[string]Action
 
+// This maps the keys in defaultKeyBinding to the canonical action
+// names, so that we can tell users what each key does
+var defaultKeyBindingNames map[string]string
+
 // Execute fulfills the Action interface for AfterFunc
-func (a ActionFunc) Execute(i *Input, e termbox.Event) {
+func (a ActionFunc) Execute(i *Input, e Event) {
 	a(i, e)
 }
 
 // Register fulfills the Action interface for AfterFunc. Registers `a`
 // into the global action registry by the name `name`, and maps to
 // default keys via `defaultKeys`
-func (a ActionFunc) Register(name string, defaultKeys ...termbox.Key) {
+func (a ActionFunc) Register(name string, defaultKeys ...Key) {
 	nameToActions["peco."+name] = a
 	for _, k := range defaultKeys {
-		a.RegisterKeySequence(keyseq.KeyList{keyseq.NewKeyFromKey(k)})
+		list := keyseq.KeyList{toKeyseqKey(k)}
+		a.RegisterKeySequence(list)
+		defaultKeyBindingNames[list.String()] = "peco." + name
 	}
 }
 
@@ -54,8 +62,8 @@ func (a ActionFunc) RegisterKeySequence(k keyseq.KeyList) {
 	defaultKeyBinding[k.String()] = a
 }
 
-func wrapDeprecated(fn func(*Input, termbox.Event), oldName, newName string) ActionFunc {
-	return ActionFunc(func(i *Input, e termbox.Event) {
+func wrapDeprecated(fn func(*Input, Event), oldName, newName string) ActionFunc {
+	return ActionFunc(func(i *Input, e Event) {
 		i.SendStatusMsg(fmt.Sprintf("%s is deprecated. Use %s", oldName, newName))
 		fn(i, e)
 	})
@@ -65,44 +73,47 @@ func init() {
 	// Build the global maps
 	nameToActions = map[string]Action{}
 	defaultKeyBinding = map[string]Action{}
+	defaultKeyBindingNames = map[string]string{}
 
 	ActionFunc(doInvertSelection).Register("InvertSelection")
-	ActionFunc(doBeginningOfLine).Register("BeginningOfLine", termbox.KeyCtrlA)
-	ActionFunc(doBackwardChar).Register("BackwardChar", termbox.KeyCtrlB)
+	ActionFunc(doBeginningOfLine).Register("BeginningOfLine", KeyCtrlA)
+	ActionFunc(doBackwardChar).Register("BackwardChar", KeyCtrlB)
 	ActionFunc(doBackwardWord).Register("BackwardWord")
-	ActionFunc(doCancel).Register("Cancel", termbox.KeyCtrlC, termbox.KeyEsc)
+	ActionFunc(doCancel).Register("Cancel", KeyCtrlC, KeyEsc)
 	ActionFunc(doDeleteAll).Register("DeleteAll")
+	ActionFunc(doClearQuery).Register("ClearQuery")
 	ActionFunc(doDeleteBackwardChar).Register(
 		"DeleteBackwardChar",
-		termbox.KeyBackspace,
-		termbox.KeyBackspace2,
+		KeyBackspace,
+		KeyBackspace2,
 	)
 	ActionFunc(doDeleteBackwardWord).Register(
 		"DeleteBackwardWord",
-		termbox.KeyCtrlW,
+		KeyCtrlW,
 	)
-	ActionFunc(doDeleteForwardChar).Register("DeleteForwardChar", termbox.KeyCtrlD)
+	ActionFunc(doDeleteForwardChar).Register("DeleteForwardChar", KeyCtrlD)
 	ActionFunc(doDeleteForwardWord).Register("DeleteForwardWord")
 	ActionFunc(doEndOfFile).Register("EndOfFile")
-	ActionFunc(doEndOfLine).Register("EndOfLine", termbox.KeyCtrlE)
-	ActionFunc(doFinish).Register("Finish", termbox.KeyEnter)
-	ActionFunc(doForwardChar).Register("ForwardChar", termbox.KeyCtrlF)
+	ActionFunc(doEndOfLine).Register("EndOfLine", KeyCtrlE)
+	ActionFunc(doFinish).Register("Finish", KeyEnter)
+	ActionFunc(doForwardChar).Register("ForwardChar", KeyCtrlF)
 	ActionFunc(doForwardWord).Register("ForwardWord")
-	ActionFunc(doKillEndOfLine).Register("KillEndOfLine", termbox.KeyCtrlK)
-	ActionFunc(doKillBeginningOfLine).Register("KillBeginningOfLine", termbox.KeyCtrlU)
-	ActionFunc(doRotateFilter).Register("RotateFilter", termbox.KeyCtrlR)
+	ActionFunc(doKillEndOfLine).Register("KillEndOfLine", KeyCtrlK)
+	ActionFunc(doKillBeginningOfLine).Register("KillBeginningOfLine", KeyCtrlU)
+	ActionFunc(doRotateFilter).Register("RotateFilter", KeyCtrlR)
+	ActionFunc(doToggleRegexp).Register("ToggleRegexp")
 	wrapDeprecated(doRotateFilter, "RotateMatcher", "RotateFilter").Register("RotateMatcher")
 
-	ActionFunc(doSelectUp).Register("SelectUp", termbox.KeyArrowUp, termbox.KeyCtrlP)
+	ActionFunc(doSelectUp).Register("SelectUp", KeyArrowUp, KeyCtrlP)
 	wrapDeprecated(doSelectDown, "SelectNext", "SelectUp/SelectDown").Register("SelectNext")
 
-	ActionFunc(doScrollPageDown).Register("ScrollPageDown", termbox.KeyArrowRight)
+	ActionFunc(doScrollPageDown).Register("ScrollPageDown", KeyArrowRight)
 	wrapDeprecated(doScrollPageDown, "SelectNextPage", "ScrollPageDown/ScrollPageUp").Register("SelectNextPage")
 
-	ActionFunc(doSelectDown).Register("SelectDown", termbox.KeyArrowDown, termbox.KeyCtrlN)
+	ActionFunc(doSelectDown).Register("SelectDown", KeyArrowDown, KeyCtrlN)
 	wrapDeprecated(doSelectUp, "SelectPrevious", "SelectUp/SelectDown").Register("SelectPrevious")
 
-	ActionFunc(doScrollPageUp).Register("ScrollPageUp", termbox.KeyArrowLeft)
+	ActionFunc(doScrollPageUp).Register("ScrollPageUp", KeyArrowLeft)
 	wrapDeprecated(doScrollPageUp, "SelectPreviousPage", "ScrollPageDown/ScrollPageUp").Register("SelectPreviousPage")
 
 	ActionFunc(doScrollLeft).Register("ScrollLeft")
@@ -111,11 +122,13 @@ func init() {
 	ActionFunc(doToggleSelection).Register("ToggleSelection")
 	ActionFunc(doToggleSelectionAndSelectNext).Register(
 		"ToggleSelectionAndSelectNext",
-		termbox.KeyCtrlSpace,
+		KeyCtrlSpace,
+		KeyTab,
 	)
+	ActionFunc(doToggleSelectionAndSelectPrevious).Register("ToggleSelectionAndSelectPrevious")
 	ActionFunc(doSelectNone).Register(
 		"SelectNone",
-		termbox.KeyCtrlG,
+		KeyCtrlG,
 	)
 	ActionFunc(doSelectAll).Register("SelectAll")
 	ActionFunc(doSelectVisible).Register("SelectVisible")
@@ -123,20 +136,56 @@ func init() {
 	wrapDeprecated(doCancelRangeMode, "CancelSelectMode", "CancelRangeMode").Register("CancelSelectMode")
 	ActionFunc(doToggleRangeMode).Register("ToggleRangeMode")
 	ActionFunc(doCancelRangeMode).Register("CancelRangeMode")
-	ActionFunc(doToggleQuery).Register("ToggleQuery", termbox.KeyCtrlT)
-	ActionFunc(doRefreshScreen).Register("RefreshScreen", termbox.KeyCtrlL)
+	ActionFunc(doToggleQuery).Register("ToggleQuery", KeyCtrlT)
+	ActionFunc(doRefreshScreen).Register("RefreshScreen", KeyCtrlL)
+	ActionFunc(doForceExecQuery).Register("ForceExecQuery", KeyCtrlS)
+	ActionFunc(doIncrementNumber).Register("IncrementNumber")
+	ActionFunc(doDecrementNumber).Register("DecrementNumber")
+	ActionFunc(doCopyLine).Register("CopyLine")
+	ActionFunc(doCopySelection).Register("CopySelection")
+	ActionFunc(doCopyMatch).Register("CopyMatch")
+	ActionFunc(doSaveBuffer).Register("SaveBuffer")
+	ActionFunc(doSaveRawBuffer).Register("SaveRawBuffer")
+	ActionFunc(doNothing).Register("Nop")
+	ActionFunc(doSelectionHintMode).Register("SelectionHintMode")
+	ActionFunc(doToggleLineNumbers).Register("ToggleLineNumbers")
+	ActionFunc(doReloadSource).Register("ReloadSource")
+	ActionFunc(doToggleUnique).Register("ToggleUnique")
+	ActionFunc(doActionMenu).Register("ActionMenu")
+	ActionFunc(doMoveLineUp).Register("MoveLineUp")
+	ActionFunc(doMoveLineDown).Register("MoveLineDown")
+	ActionFunc(doShowSelectedOnly).Register("ShowSelectedOnly")
+	ActionFunc(doTransposeChars).Register("TransposeChars")
+	ActionFunc(doSetLineAsQuery).Register("SetLineAsQuery")
+	ActionFunc(doAppendLineToQuery).Register("AppendLineToQuery")
+	ActionFunc(doCycleSelectionGroup).Register("CycleSelectionGroup")
+	ActionFunc(doSaveQuery).Register("SaveQuery")
+	ActionFunc(doRestoreQuery).Register("RestoreQuery")
+	ActionFunc(doSwapQuery).Register("SwapQuery")
+	ActionFunc(doShowHelp).Register("ShowHelp")
+	ActionFunc(doFirstPage).Register("FirstPage")
+	ActionFunc(doLastPage).Register("LastPage")
+	ActionFunc(doGotoPage).Register("GotoPage")
+	ActionFunc(doToggleNullSep).Register("ToggleNullSep")
+	ActionFunc(doToggleAnchored).Register("ToggleAnchored")
+	ActionFunc(doCompleteQuery).Register("CompleteQuery")
+	ActionFunc(doFinishWithSelection).Register("FinishWithSelection")
+	ActionFunc(doToggleWrap).Register("ToggleWrap")
+	ActionFunc(doSetScopeQuery).Register("SetScopeQuery")
+	ActionFunc(doClearScopeQuery).Register("ClearScopeQuery")
+	ActionFunc(doFilterBufferThrough).Register("FilterBufferThrough")
 
 	ActionFunc(doKonamiCommand).RegisterKeySequence(
 		keyseq.KeyList{
-			keyseq.Key{Modifier: 0, Key: termbox.KeyCtrlX, Ch: 0},
-			keyseq.Key{Modifier: 0, Key: termbox.KeyArrowUp, Ch: 0},
-			keyseq.Key{Modifier: 0, Key: termbox.KeyArrowUp, Ch: 0},
-			keyseq.Key{Modifier: 0, Key: termbox.KeyArrowDown, Ch: 0},
-			keyseq.Key{Modifier: 0, Key: termbox.KeyArrowDown, Ch: 0},
-			keyseq.Key{Modifier: 0, Key: termbox.KeyArrowLeft, Ch: 0},
-			keyseq.Key{Modifier: 0, Key: termbox.KeyArrowRight, Ch: 0},
-			keyseq.Key{Modifier: 0, Key: termbox.KeyArrowLeft, Ch: 0},
-			keyseq.Key{Modifier: 0, Key: termbox.KeyArrowRight, Ch: 0},
+			toKeyseqKey(KeyCtrlX),
+			toKeyseqKey(KeyArrowUp),
+			toKeyseqKey(KeyArrowUp),
+			toKeyseqKey(KeyArrowDown),
+			toKeyseqKey(KeyArrowDown),
+			toKeyseqKey(KeyArrowLeft),
+			toKeyseqKey(KeyArrowRight),
+			toKeyseqKey(KeyArrowLeft),
+			toKeyseqKey(KeyArrowRight),
 			keyseq.Key{Modifier: 0, Key: 0, Ch: 'b'},
 			keyseq.Key{Modifier: 0, Key: 0, Ch: 'a'},
 		},
@@ -144,12 +193,12 @@ func init() {
 }
 
 // This is a noop action
-func doNothing(_ *Input, _ termbox.Event) {}
+func doNothing(_ *Input, _ Event) {}
 
 // This is an exception to the rule. This does not get registered
 // anywhere. You just call it directly
-func doAcceptChar(i *Input, ev termbox.Event) {
-	if ev.Key == termbox.KeySpace {
+func doAcceptChar(i *Input, ev Event) {
+	if ev.Key == KeySpace {
 		ev.Ch = ' '
 	}
 
@@ -166,7 +215,7 @@ func doAcceptChar(i *Input, ev termbox.Event) {
 	}
 }
 
-func doRotateFilter(i *Input, ev termbox.Event) {
+func doRotateFilter(i *Input, ev Event) {
 	trace("doRotateFitler: START")
 	defer trace("doRotateFitler: END")
 	i.RotateFilter()
@@ -176,20 +225,46 @@ func doRotateFilter(i *Input, ev termbox.Event) {
 	i.SendDrawPrompt()
 }
 
-func doToggleSelection(i *Input, _ termbox.Event) {
-	l, err := i.GetCurrentLineBuffer().LineAt(i.currentLine)
-	if err != nil {
+func doToggleAnchored(i *Input, _ Event) {
+	i.ToggleAnchored()
+	switch {
+	case !i.anchoredOn():
+		i.SendStatusMsgAndClear("Anchored: off", time.Second)
+	case i.IsAnchored():
+		i.SendStatusMsgAndClear("Anchored: on", time.Second)
+	default:
+		i.SendStatusMsgAndClear("Anchored: on (only applies to the Regexp filter)", time.Second)
+	}
+
+	if i.ExecQuery() {
 		return
 	}
+	i.SendDrawPrompt()
+}
 
-	if i.selection.Has(l) {
-		i.selection.Remove(l)
+func doToggleRegexp(i *Input, ev Event) {
+	if err := i.ToggleRegexp(); err != nil {
+		i.SendStatusMsgAndClear(err.Error(), time.Second)
 		return
 	}
-	i.selection.Add(l)
+
+	if f := i.Filter().String(); f == RegexpMatch {
+		i.SendStatusMsgAndClear("Regexp: on", time.Second)
+	} else {
+		i.SendStatusMsgAndClear("Regexp: off ("+f+")", time.Second)
+	}
+
+	if i.ExecQuery() {
+		return
+	}
+	i.SendDrawPrompt()
+}
+
+func doToggleSelection(i *Input, _ Event) {
+	i.SelectionToggle(i.currentLine)
 }
 
-func doToggleRangeMode(i *Input, _ termbox.Event) {
+func doToggleRangeMode(i *Input, _ Event) {
 	trace("doToggleRangeMode: START")
 	defer trace("doToggleRangeMode: END")
 	if i.IsRangeMode() {
@@ -200,64 +275,462 @@ func doToggleRangeMode(i *Input, _ termbox.Event) {
 	}
 }
 
-func doCancelRangeMode(i *Input, _ termbox.Event) {
+func doCancelRangeMode(i *Input, _ Event) {
 	i.selectionRangeStart = invalidSelectionRange
 }
 
-func doSelectNone(i *Input, _ termbox.Event) {
+func doSelectNone(i *Input, _ Event) {
 	i.SelectionClear()
 }
 
-func doSelectAll(i *Input, _ termbox.Event) {
-	b := i.GetCurrentLineBuffer()
-	for x := 0; x < b.Size(); x++ {
-		if l, err := b.LineAt(x); err == nil {
-			i.selection.Add(l)
-		} else {
-			i.selection.Remove(l)
-		}
-	}
+// doSelectAll selects all of the lines, or as many of them as
+// --max-select allows
+func doSelectAll(i *Input, _ Event) {
+	i.SelectionAddLines(i.GetCurrentLineBuffer().Snapshot())
 }
 
-func doSelectVisible(i *Input, _ termbox.Event) {
+func doSelectVisible(i *Input, _ Event) {
 	trace("doSelectVisible: START")
 	defer trace("doSelectVisible: END")
-	b := i.GetCurrentLineBuffer()
-	pc := PageCrop{i.currentPage.perPage, i.currentPage.page}
-	lb := pc.Crop(b)
-	for x := 0; x < lb.Size(); x++ {
-		l, err := lb.LineAt(x)
-		if err != nil {
-			continue
-		}
+	// The page may not start at a multiple of perPage (see ScrollOff)
+	cp := i.currentPage
+	lines := lineRange(i.GetCurrentLineBuffer().Snapshot(), cp.offset, cp.offset+cp.perPage-1)
+	for _, l := range lines {
 		l.SetDirty(true)
-		i.selection.Add(l)
 	}
+	i.SelectionAddLines(lines)
 	i.SendDraw()
 }
 
-func doFinish(i *Input, _ termbox.Event) {
+func doFinish(i *Input, _ Event) {
 	trace("doFinish: START")
 	defer trace("doFinish: END")
 
+	accept(i, i.config.AcceptCursorOnly)
+}
+
+// doToggleWrap toggles the wrapping of the current line, which is
+// then displayed in full over as many rows as needed
+func doToggleWrap(i *Input, _ Event) {
+	if i.ToggleWrap() {
+		i.SendStatusMsgAndClear("Wrap: on", time.Second)
+	} else {
+		i.SendStatusMsgAndClear("Wrap: off", time.Second)
+	}
+	i.SendDraw()
+}
+
+// doSetScopeQuery pins the lines matched by the query, so that the
+// next queries only refine them
+func doSetScopeQuery(i *Input, _ Event) {
+	if err := i.SetScopeQuery(); err != nil {
+		i.SendStatusMsgAndClear(err.Error(), time.Second)
+		return
+	}
+	i.SendStatusMsgAndClear("Scope: "+i.ScopeQuery(), time.Second)
+	i.SendDraw()
+}
+
+// doClearScopeQuery matches the query against all of the lines again
+func doClearScopeQuery(i *Input, _ Event) {
+	if err := i.ClearScopeQuery(); err != nil {
+		i.SendStatusMsgAndClear(err.Error(), time.Second)
+		return
+	}
+	i.SendStatusMsgAndClear("Scope cleared", time.Second)
+	i.SendDraw()
+}
+
+// doFilterBufferThrough replaces the lines shown with the output of
+// FilterBufferCommand, which is given them as its input. The command
+// runs in the background, so the UI is not blocked while it runs, and
+// its output is shown once it is done. It only runs once at a time
+func doFilterBufferThrough(i *Input, _ Event) {
+	command := i.config.FilterBufferCommand
+	if command == "" {
+		i.SendStatusMsgAndClear("FilterBufferCommand is not set", time.Second)
+		return
+	}
+	if i.filtering {
+		i.SendStatusMsgAndClear(fmt.Sprintf("'%s' is still running", command), time.Second)
+		return
+	}
+
+	i.filtering = true
+	i.SendStatusMsg(fmt.Sprintf("Running '%s'...", command))
+	lines := i.GetCurrentLineBuffer().Snapshot()
+	go func() {
+		b, marked, err := i.pipeLinesThrough(command, lines)
+		i.runInLoop(func() {
+			i.filtering = false
+			if err != nil {
+				i.SendStatusMsgAndClear(err.Error(), 2*time.Second)
+				return
+			}
+			i.setFilteredBuffer(command, b, marked)
+			i.SendStatusMsgAndClear(fmt.Sprintf("Filtered the lines through '%s'", command), time.Second)
+			i.SendDraw()
+		})
+	}()
+}
+
+// doFinishWithSelection accepts the selected lines, even if
+// AcceptCursorOnly is set
+func doFinishWithSelection(i *Input, _ Event) {
+	accept(i, false)
+}
+
+// accept exits with the selected lines, or with the line under the
+// cursor if none are selected or if cursorOnly is true
+func accept(i *Input, cursorOnly bool) {
+	if cursorOnly {
+		l, err := i.GetCurrentLineBuffer().LineAt(i.currentLine)
+		if err != nil {
+			acceptNoLines(i)
+			return
+		}
+		if i.config.ConfirmAccept {
+			i.pendingAccept = &pendingAccept{current: l}
+			i.SendStatusMsg(acceptConfirmationMsg(1, l))
+			return
+		}
+		finishWith(i, []Line{l})
+		return
+	}
+
 	// Must end with all the selected lines.
+	addedCurrentLine := false
 	if i.SelectionLen() == 0 {
 		i.SelectionAdd(i.currentLine)
+		addedCurrentLine = i.SelectionLen() > 0
+	}
+
+	// If we still don't have anything, there's no line under the
+	// cursor (i.e. nothing matched)
+	lines := i.SelectionLines()
+	if len(lines) == 0 {
+		acceptNoLines(i)
+		return
+	}
+
+	if i.config.ConfirmAccept {
+		i.pendingAccept = &pendingAccept{addedCurrentLine: addedCurrentLine}
+		i.SendStatusMsg(acceptConfirmationMsg(len(lines), lines[0]))
+		return
+	}
+
+	finish(i)
+}
+
+// acceptNoLines is called when there's no line to accept. Unless
+// --print-query-on-no-match was given, don't emit anything that the
+// user can't see
+func acceptNoLines(i *Input) {
+	if !i.printQueryOnNoMatch {
+		trace("acceptNoLines: no lines to accept")
+		i.SendStatusMsgAndClear("No lines to accept", 500*time.Millisecond)
+		return
+	}
+
+	i.resultCh = make(chan Line, 1)
+	i.resultCh <- NewRawLine(i.QueryString(), false)
+	close(i.resultCh)
+	i.ExitWith(nil)
+}
+
+// pendingAccept holds the state of an accept that is waiting for
+// the user's confirmation (see ConfirmAccept)
+type pendingAccept struct {
+	// true if the line under the cursor was added to the selection
+	// by doFinish, and must be removed if the accept is canceled
+	addedCurrentLine bool
+	// the line under the cursor, if it is accepted instead of the
+	// selection (see AcceptCursorOnly)
+	current Line
+}
+
+// acceptConfirmationMsg asks to confirm accepting n lines, the first
+// of which is given
+func acceptConfirmationMsg(n int, first Line) string {
+	if n == 1 {
+		return fmt.Sprintf("Accept '%s'? (y/n)", first.DisplayString())
+	}
+	return fmt.Sprintf("Accept %d lines? (y/n)", n)
+}
+
+// resolvePendingAccept is called with the key that the user pressed
+// after being asked to confirm an accept. 'y' and Enter accept the
+// selection, anything else cancels it
+func resolvePendingAccept(i *Input, ev Event) {
+	p := i.pendingAccept
+	i.pendingAccept = nil
+
+	if ev.Ch == 'y' || ev.Ch == 'Y' || (ev.Ch == 0 && ev.Key == KeyEnter) {
+		if p.current != nil {
+			finishWith(i, []Line{p.current})
+		} else {
+			finish(i)
+		}
+		return
+	}
+
+	if p.addedCurrentLine {
+		i.SelectionClear()
+	}
+	i.SendStatusMsgAndClear("Accept canceled", 500*time.Millisecond)
+}
+
+// pendingPrompt holds the state of a question asked in the status
+// bar, while the user is typing the answer
+type pendingPrompt struct {
+	message string
+	answer  []rune
+	// done is called with the answer once the user hits Enter
+	done func(i *Input, answer string)
+}
+
+// startPrompt asks the user to type in an answer in the status bar.
+// Until the user hits Enter (or cancels), key events are used to
+// edit the answer instead of being dispatched to actions
+func startPrompt(i *Input, message string, done func(*Input, string)) {
+	i.pendingPrompt = &pendingPrompt{message: message, done: done}
+	i.SendStatusMsg(message)
+}
+
+// resolvePendingPrompt is called with the keys that the user pressed
+// while a prompt is displayed. Enter submits the answer, Esc, C-g and
+// C-c cancel the prompt
+func resolvePendingPrompt(i *Input, ev Event) {
+	p := i.pendingPrompt
+
+	switch {
+	case ev.Ch != 0 && ev.Mod == 0:
+		p.answer = append(p.answer, ev.Ch)
+	case ev.Key == KeySpace:
+		p.answer = append(p.answer, ' ')
+	case ev.Key == KeyBackspace || ev.Key == KeyBackspace2:
+		if len(p.answer) > 0 {
+			p.answer = p.answer[:len(p.answer)-1]
+		}
+	case ev.Key == KeyEnter:
+		i.pendingPrompt = nil
+		p.done(i, string(p.answer))
+		return
+	case ev.Key == KeyEsc || ev.Key == KeyCtrlG || ev.Key == KeyCtrlC:
+		i.pendingPrompt = nil
+		i.SendStatusMsgAndClear("Canceled", 500*time.Millisecond)
+		return
+	default:
+		return
+	}
+
+	i.SendStatusMsg(p.message + string(p.answer))
+}
+
+// doSelectionHintMode labels each line in the page with a key from
+// HintAlphabet. The next key that is pressed picks a line (see
+// resolveHint)
+func doSelectionHintMode(i *Input, _ Event) {
+	if i.GetCurrentLineBuffer().Size() == 0 {
+		return
+	}
+
+	i.hintMode = true
+	i.SendStatusMsg("Press a label to accept the line (M-label to toggle its selection), Esc to cancel")
+	i.SendDraw()
+}
+
+// resolveHint is called with the key that the user pressed while the
+// quick select labels are displayed. A label accepts the line, and a
+// label pressed with Alt toggles its selection. Any other key just
+// hides the labels
+func resolveHint(i *Input, ev Event) {
+	i.hintMode = false
+	defer i.SendDraw()
+
+	n := -1
+	if ev.Ch != 0 {
+		for x, r := range []rune(i.config.HintAlphabet) {
+			if r == ev.Ch {
+				n = x
+				break
+			}
+		}
 	}
 
+	line := i.currentPage.offset + n
+	if n < 0 || n >= i.currentPage.perPage || line >= i.GetCurrentLineBuffer().Size() {
+		i.SendStatusMsgAndClear("Canceled", 500*time.Millisecond)
+		return
+	}
+
+	i.SendStatusMsg("")
+	i.currentLine = line
+	if ev.Mod&ModAlt != 0 {
+		doToggleSelection(i, ev)
+		return
+	}
+	doFinish(i, ev)
+}
+
+// doActionMenu shows the entries of ActionMenu in the status bar,
+// labeled with keys from HintAlphabet. The next key that is pressed
+// picks an entry (see resolveActionMenu)
+func doActionMenu(i *Input, _ Event) {
+	if len(i.config.ActionMenu) == 0 {
+		i.SendStatusMsgAndClear("No entries in ActionMenu", time.Second)
+		return
+	}
+
+	labels := []rune(i.config.HintAlphabet)
+	entries := make([]string, 0, len(i.config.ActionMenu))
+	for n, item := range i.config.ActionMenu {
+		if n >= len(labels) {
+			// There are no keys left for the rest
+			entries = append(entries, fmt.Sprintf("(%d more without a key, see HintAlphabet)", len(i.config.ActionMenu)-n))
+			break
+		}
+		entries = append(entries, fmt.Sprintf("[%c] %s", labels[n], item.Name))
+	}
+
+	i.actionMenu = true
+	i.SendStatusMsg(strings.Join(entries, "  ") + "  (Esc to cancel)")
+}
+
+// doShowHelp displays the key bindings in place of the lines, until a
+// key other than the ones that scroll them is pressed (see resolveHelp)
+func doShowHelp(i *Input, _ Event) {
+	bindings := i.keymap.Bindings()
+	lines := make([]string, 0, len(bindings))
+	for _, b := range bindings {
+		lines = append(lines, fmt.Sprintf("%-20s %s", b.Keys, b.Action))
+	}
+
+	i.setHelp(lines)
+	i.SendStatusMsg("Up/Down/PgUp/PgDn to scroll, any other key to close")
+	i.SendDraw()
+}
+
+// resolveHelp is called with the key that the user pressed while the
+// key bindings are displayed. The arrow keys, C-n, C-p, PgUp and PgDn
+// scroll them, any other key hides them
+func resolveHelp(i *Input, ev Event) {
+	perPage := i.currentPage.perPage
+	lines, offset := i.help()
+	switch ev.Key {
+	case KeyArrowDown, KeyCtrlN:
+		offset++
+	case KeyArrowUp, KeyCtrlP:
+		offset--
+	case KeyPgdn:
+		offset += perPage
+	case KeyPgup:
+		offset -= perPage
+	default:
+		i.setHelp(nil)
+		i.SendStatusMsg("")
+		i.SendDraw()
+		return
+	}
+
+	if max := len(lines) - perPage; offset > max {
+		offset = max
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	i.setHelpOffset(offset)
+	i.SendDraw()
+}
+
+// resolveActionMenu is called with the key that the user pressed
+// while the action menu is displayed. A label runs the command of
+// that entry, any other key closes the menu
+func resolveActionMenu(i *Input, ev Event) {
+	i.actionMenu = false
+
+	n := -1
+	if ev.Ch != 0 {
+		for x, r := range []rune(i.config.HintAlphabet) {
+			if r == ev.Ch {
+				n = x
+				break
+			}
+		}
+	}
+
+	if n < 0 || n >= len(i.config.ActionMenu) {
+		i.SendStatusMsgAndClear("Canceled", 500*time.Millisecond)
+		return
+	}
+	runActionMenuItem(i, i.config.ActionMenu[n])
+}
+
+// runActionMenuItem runs the command of an ActionMenu entry on the
+// selected lines, or the line under the cursor if nothing is
+// selected. The command has the terminal to itself while it runs,
+// after which the screen is drawn again
+func runActionMenuItem(i *Input, item ActionMenuItem) {
+	var line string
+	if l, err := i.GetCurrentLineBuffer().LineAt(i.currentLine); err == nil {
+		line = l.Output()
+	}
+
+	var lines []string
+	for _, l := range i.SelectionLines() {
+		lines = append(lines, l.Output())
+	}
+	if len(lines) == 0 {
+		if i.GetCurrentLineBuffer().Size() == 0 {
+			i.SendStatusMsgAndClear("No lines to run '"+item.Name+"' on", time.Second)
+			return
+		}
+		lines = []string{line}
+	}
+
+	command := expandMenuCommand(item.Command, lines, line, i.QueryString())
+	trace("runActionMenuItem: running %s", command)
+	i.SendStatusMsg(fmt.Sprintf("Running '%s'...", item.Name))
+	go func() {
+		resume := suspendScreen()
+		err := runShellCommand(command)
+		if rerr := resume(); rerr != nil {
+			i.ExitWith(rerr)
+			return
+		}
+		i.SendRefresh()
+
+		if err != nil {
+			i.SendStatusMsgAndClear(err.Error(), 2*time.Second)
+			return
+		}
+		if item.Exit {
+			i.ExitWith(nil)
+			return
+		}
+		i.SendStatusMsgAndClear(fmt.Sprintf("Ran '%s'", item.Name), time.Second)
+	}()
+}
+
+// finish emits the selected lines, and exits
+func finish(i *Input) {
+	finishWith(i, i.selectionOutput())
+}
+
+// finishWith exits, and outputs the given lines
+func finishWith(i *Input, lines []Line) {
 	i.resultCh = make(chan Line)
 	go func() {
-		i.selection.Ascend(func(it btree.Item) bool {
-			i.resultCh <- it.(Line)
-			return true
-		})
+		for _, l := range lines {
+			i.resultCh <- l
+		}
 		close(i.resultCh)
 	}()
 
 	i.ExitWith(nil)
 }
 
-func doCancel(i *Input, ev termbox.Event) {
+func doCancel(i *Input, ev Event) {
 	if i.keymap.Keyseq.InMiddleOfChain() {
 		i.keymap.Keyseq.CancelChain()
 		return
@@ -268,74 +741,108 @@ func doCancel(i *Input, ev termbox.Event) {
 		return
 	}
 
+	// With DoubleEscapeToExit, the first Esc only clears the query
+	if ev.Key == KeyEsc && i.config.DoubleEscapeToExit && !i.secondEscape() {
+		if i.QueryLen() > 0 {
+			i.ClearQuery()
+			i.SendDraw()
+		}
+		i.SendStatusMsgAndClear("Press Esc again to exit", doubleEscapeInterval)
+		return
+	}
+
 	// peco.Cancel -> end program, exit with failure
 	i.ExitWith(ErrUserCanceled)
 }
 
-func doSelectDown(i *Input, ev termbox.Event) {
+func doSelectDown(i *Input, ev Event) {
 	trace("doSelectDown: START")
 	defer trace("doSelectDown: END")
-	i.SendPaging(ToLineBelow)
+	sendAcceleratedPaging(i, ToLineBelow)
+}
+
+func doSelectUp(i *Input, ev Event) {
+	sendAcceleratedPaging(i, ToLineAbove)
+}
+
+func doScrollPageUp(i *Input, ev Event) {
+	sendAcceleratedPaging(i, ToScrollPageUp)
 }
 
-func doSelectUp(i *Input, ev termbox.Event) {
-	i.SendPaging(ToLineAbove)
+func doScrollPageDown(i *Input, ev Event) {
+	sendAcceleratedPaging(i, ToScrollPageDown)
 }
 
-func doScrollPageUp(i *Input, ev termbox.Event) {
-	i.SendPaging(ToScrollPageUp)
+func doScrollLeft(i *Input, ev Event) {
+	sendAcceleratedPaging(i, ToScrollLeft)
 }
 
-func doScrollPageDown(i *Input, ev termbox.Event) {
-	i.SendPaging(ToScrollPageDown)
+func doScrollRight(i *Input, ev Event) {
+	sendAcceleratedPaging(i, ToScrollRight)
 }
 
-func doScrollLeft(i *Input, ev termbox.Event) {
-	i.SendPaging(ToScrollLeft)
+// sendAcceleratedPaging sends the paging request, more than once if
+// the key of the action is held down (see AccelerationConfig)
+func sendAcceleratedPaging(i *Input, p PagingRequest) {
+	for n := i.accelerationStep(p); n > 0; n-- {
+		i.SendPaging(p)
+	}
+}
+
+func doToggleSelectionAndSelectNext(i *Input, ev Event) {
+	toggleSelectionAndMove(i, ev, true)
 }
 
-func doScrollRight(i *Input, ev termbox.Event) {
-	i.SendPaging(ToScrollRight)
+func doToggleSelectionAndSelectPrevious(i *Input, ev Event) {
+	toggleSelectionAndMove(i, ev, false)
 }
 
-func doToggleSelectionAndSelectNext(i *Input, ev termbox.Event) {
+// toggleSelectionAndMove toggles the selection of the current line,
+// and moves the cursor to the next line (or the previous one), which
+// is above it in the bottom-up layout. The cursor stays on the first
+// and the last lines, even if CycleCursor is set, so that a run of
+// lines can be selected without starting over from the other end
+func toggleSelectionAndMove(i *Input, ev Event, next bool) {
 	i.Batch(func() {
 		doToggleSelection(i, ev)
+
+		if next && i.currentLine >= i.GetCurrentLineBuffer().Size()-1 {
+			return
+		}
+		if !next && i.currentLine <= 0 {
+			return
+		}
+
 		// XXX This is sucky. Fix later
-		if i.layoutType == "top-down" {
-			doSelectDown(i, ev)
+		if next == (i.layoutType != LayoutTypeBottomUp) {
+			i.SendPaging(ToLineBelow)
 		} else {
-			doSelectUp(i, ev)
+			i.SendPaging(ToLineAbove)
 		}
 	})
 }
 
-func doInvertSelection(i *Input, _ termbox.Event) {
+// doCycleSelectionGroup makes the lines selected from now on part of
+// the next selection group, so that they are displayed in a different
+// color, and output after the lines of the previous groups
+func doCycleSelectionGroup(i *Input, _ Event) {
+	group := i.CycleSelectionGroup()
+	i.SendStatusMsgAndClear(fmt.Sprintf("Selecting into group %d", group+1), time.Second)
+}
+
+func doInvertSelection(i *Input, _ Event) {
 	trace("doInvertSelection: START")
 	defer trace("doInvertSelection: END")
 
-	old := i.selection
-	i.SelectionClear()
-	b := i.GetCurrentLineBuffer()
-
-	for x := 0; x < b.Size(); x++ {
-		if l, err := b.LineAt(x); err == nil {
-			l.SetDirty(true)
-			i.selection.Add(l)
-		} else {
-			i.selection.Remove(l)
-		}
+	lines := i.GetCurrentLineBuffer().Snapshot()
+	for _, l := range lines {
+		l.SetDirty(true)
 	}
-
-	old.Ascend(func(it btree.Item) bool {
-		i.selection.Delete(it.(Line))
-		return true
-	})
-
+	i.SelectionInvert(lines)
 	i.SendDraw()
 }
 
-func doDeleteBackwardWord(i *Input, _ termbox.Event) {
+func doDeleteBackwardWord(i *Input, _ Event) {
 	if i.CaretPos() == 0 {
 		return
 	}
@@ -374,7 +881,7 @@ func doDeleteBackwardWord(i *Input, _ termbox.Event) {
 	i.DrawPrompt()
 }
 
-func doForwardWord(i *Input, _ termbox.Event) {
+func doForwardWord(i *Input, _ Event) {
 	if i.CaretPos() >= i.QueryLen() {
 		return
 	}
@@ -399,7 +906,7 @@ func doForwardWord(i *Input, _ termbox.Event) {
 	i.SetCaretPos(i.QueryLen())
 }
 
-func doBackwardWord(i *Input, _ termbox.Event) {
+func doBackwardWord(i *Input, _ Event) {
 	if i.CaretPos() == 0 {
 		return
 	}
@@ -441,7 +948,7 @@ SEARCH_PREV_WORD:
 	i.SetCaretPos(0)
 }
 
-func doForwardChar(i *Input, _ termbox.Event) {
+func doForwardChar(i *Input, _ Event) {
 	if i.CaretPos() >= i.QueryLen() {
 		return
 	}
@@ -449,7 +956,7 @@ func doForwardChar(i *Input, _ termbox.Event) {
 	i.DrawPrompt()
 }
 
-func doBackwardChar(i *Input, _ termbox.Event) {
+func doBackwardChar(i *Input, _ Event) {
 	if i.CaretPos() <= 0 {
 		return
 	}
@@ -457,7 +964,7 @@ func doBackwardChar(i *Input, _ termbox.Event) {
 	i.DrawPrompt()
 }
 
-func doDeleteForwardWord(i *Input, _ termbox.Event) {
+func doDeleteForwardWord(i *Input, _ Event) {
 	if i.QueryLen() <= i.CaretPos() {
 		return
 	}
@@ -496,17 +1003,17 @@ func doDeleteForwardWord(i *Input, _ termbox.Event) {
 	}
 }
 
-func doBeginningOfLine(i *Input, _ termbox.Event) {
+func doBeginningOfLine(i *Input, _ Event) {
 	i.SetCaretPos(0)
 	i.DrawPrompt()
 }
 
-func doEndOfLine(i *Input, _ termbox.Event) {
+func doEndOfLine(i *Input, _ Event) {
 	i.SetCaretPos(i.QueryLen())
 	i.DrawPrompt()
 }
 
-func doEndOfFile(i *Input, ev termbox.Event) {
+func doEndOfFile(i *Input, ev Event) {
 	if i.QueryLen() > 0 {
 		doDeleteForwardChar(i, ev)
 	} else {
@@ -514,7 +1021,7 @@ func doEndOfFile(i *Input, ev termbox.Event) {
 	}
 }
 
-func doKillBeginningOfLine(i *Input, _ termbox.Event) {
+func doKillBeginningOfLine(i *Input, _ Event) {
 	i.SetQuery(i.Query()[i.CaretPos():])
 	i.SetCaretPos(0)
 	if i.ExecQuery() {
@@ -523,7 +1030,7 @@ func doKillBeginningOfLine(i *Input, _ termbox.Event) {
 	i.DrawPrompt()
 }
 
-func doKillEndOfLine(i *Input, _ termbox.Event) {
+func doKillEndOfLine(i *Input, _ Event) {
 	if i.QueryLen() <= i.CaretPos() {
 		return
 	}
@@ -535,12 +1042,20 @@ func doKillEndOfLine(i *Input, _ termbox.Event) {
 	i.DrawPrompt()
 }
 
-func doDeleteAll(i *Input, _ termbox.Event) {
+func doDeleteAll(i *Input, _ Event) {
 	i.SetQuery(make([]rune, 0))
 	i.ExecQuery()
 }
 
-func doDeleteForwardChar(i *Input, _ termbox.Event) {
+// doClearQuery empties the query and shows all of the lines again,
+// scrolled all the way to the left
+func doClearQuery(i *Input, _ Event) {
+	i.ClearQuery()
+	i.DrawPrompt()
+	i.SendDraw()
+}
+
+func doDeleteForwardChar(i *Input, _ Event) {
 	if i.QueryLen() <= i.CaretPos() {
 		return
 	}
@@ -558,7 +1073,7 @@ func doDeleteForwardChar(i *Input, _ termbox.Event) {
 	i.DrawPrompt()
 }
 
-func doDeleteBackwardChar(i *Input, ev termbox.Event) {
+func doDeleteBackwardChar(i *Input, ev Event) {
 	trace("doDeleteBackwardChar: START")
 	defer trace("doDeleteBackwardChar: END")
 
@@ -599,11 +1114,327 @@ func doDeleteBackwardChar(i *Input, ev termbox.Event) {
 	i.DrawPrompt()
 }
 
-func doRefreshScreen(i *Input, _ termbox.Event) {
+// doTransposeChars swaps the characters before and after the caret,
+// and moves the caret past them, like readline's transpose-chars.
+// At the start of the query the first two characters are swapped,
+// and at the end of the query the last two
+func doTransposeChars(i *Input, _ Event) {
+	qlen := i.QueryLen()
+	if qlen < 2 {
+		return
+	}
+
+	pos := i.CaretPos()
+	switch {
+	case pos <= 0:
+		pos = 1
+	case pos >= qlen:
+		pos = qlen - 1
+	}
+
+	q := i.Query()
+	i.ReplaceQueryAt(pos-1, pos+1, []rune{q[pos], q[pos-1]})
+	i.SetCaretPos(pos + 1)
+
+	if i.ExecQuery() {
+		return
+	}
+	i.DrawPrompt()
+}
+
+// doSetLineAsQuery replaces the query with the text of the current
+// line, so that a value in the list can be used to drill down
+func doSetLineAsQuery(i *Input, _ Event) {
+	lineToQuery(i, false)
+}
+
+// doAppendLineToQuery appends the text of the current line to the
+// query as an additional term
+func doAppendLineToQuery(i *Input, _ Event) {
+	lineToQuery(i, true)
+}
+
+func lineToQuery(i *Input, appendLine bool) {
+	l, err := i.GetCurrentLineBuffer().LineAt(i.currentLine)
+	if err != nil {
+		return
+	}
+
+	q := []rune(l.DisplayString())
+	if appendLine && i.QueryLen() > 0 {
+		// Copy the query, as Query() returns the underlying slice
+		q = append(append(append([]rune{}, i.Query()...), ' '), q...)
+	}
+	i.SetQuery(q)
+	i.SetCaretPos(len(q))
+
+	if i.ExecQuery() {
+		return
+	}
+	i.DrawPrompt()
+}
+
+func doRefreshScreen(i *Input, _ Event) {
+	i.SendRefresh()
 	i.ExecQuery()
 }
 
-func doToggleQuery(i *Input, _ termbox.Event) {
+// doForceExecQuery runs the query without waiting for
+// QueryExecutionDelay, and waits until the filter picks it up
+func doForceExecQuery(i *Input, _ Event) {
+	i.Batch(func() {
+		if i.ForceExecQuery() {
+			return
+		}
+		i.DrawPrompt()
+	})
+}
+
+func doIncrementNumber(i *Input, _ Event) {
+	addToNumber(i, 1)
+}
+
+func doDecrementNumber(i *Input, _ Event) {
+	addToNumber(i, -1)
+}
+
+// addToNumber adds `delta` to the number under the caret, or the
+// first number after the caret, much like vim's C-a/C-x do. The
+// caret is left on the last digit of the number, so that it can
+// be repeatedly adjusted
+func addToNumber(i *Input, delta int64) {
+	q := i.Query()
+	start, end, ok := numberSpan(q, i.CaretPos())
+	if !ok {
+		return
+	}
+
+	n, err := strconv.ParseInt(string(q[start:end]), 10, 64)
+	if err != nil {
+		// Probably out of range. Leave it alone
+		return
+	}
+
+	r := []rune(strconv.FormatInt(n+delta, 10))
+	i.ReplaceQueryAt(start, end, r)
+	i.SetCaretPos(start + len(r) - 1)
+
+	if i.ExecQuery() {
+		return
+	}
+	i.DrawPrompt()
+}
+
+// numberSpan finds the number that contains q[pos], or the first
+// number that follows it. If the caret is at the end of the query,
+// the number right before it is used. A '-' immediately preceding
+// the digits is considered to be part of the number
+func numberSpan(q []rune, pos int) (int, int, bool) {
+	if pos >= len(q) {
+		pos = len(q) - 1
+	}
+	if pos < 0 {
+		return 0, 0, false
+	}
+
+	start := pos
+	if q[start] == '-' && start+1 < len(q) && isDigit(q[start+1]) {
+		start++
+	}
+	for ; start < len(q) && !isDigit(q[start]); start++ {
+	}
+	if start >= len(q) {
+		return 0, 0, false
+	}
+
+	for start > 0 && isDigit(q[start-1]) {
+		start--
+	}
+	end := start
+	for end < len(q) && isDigit(q[end]) {
+		end++
+	}
+	if start > 0 && q[start-1] == '-' {
+		start--
+	}
+	return start, end, true
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func doCopyLine(i *Input, _ Event) {
+	l, err := i.GetCurrentLineBuffer().LineAt(i.currentLine)
+	if err != nil {
+		return
+	}
+	copyLinesToClipboard(i, []Line{l})
+}
+
+// doCopySelection copies the selected lines. If nothing is selected,
+// the line under the cursor is copied, just like peco.Finish would
+// emit it
+func doCopySelection(i *Input, ev Event) {
+	if i.SelectionLen() == 0 {
+		doCopyLine(i, ev)
+		return
+	}
+
+	copyLinesToClipboard(i, i.SelectionLines())
+}
+
+// doCopyMatch copies the portion of the current line that matched
+// the query. If the query contains a capture group (Regexp filter),
+// only the first capture group that matched is copied
+func doCopyMatch(i *Input, _ Event) {
+	l, err := i.GetCurrentLineBuffer().LineAt(i.currentLine)
+	if err != nil {
+		return
+	}
+
+	text, ok := matchedText(l)
+	if !ok {
+		i.SendStatusMsgAndClear("No match to copy", time.Second)
+		return
+	}
+
+	if err := CopyToClipboard(i.config.ClipboardCommand, text); err != nil {
+		trace("doCopyMatch: %s", err)
+		i.SendStatusMsgAndClear(err.Error(), 2*time.Second)
+		return
+	}
+	i.SendStatusMsgAndClear(fmt.Sprintf("Copied '%s'", text), time.Second)
+}
+
+// matchedText returns the first capture group of the first match in
+// `l`, or the entire match if there are no capture groups
+func matchedText(l Line) (string, bool) {
+	ml, ok := l.(*MatchedLine)
+	if !ok {
+		return "", false
+	}
+
+	m := ml.Match()
+	switch {
+	case len(m) >= 4 && m[2] >= 0:
+		return l.DisplayString()[m[2]:m[3]], true
+	case len(m) >= 2:
+		return l.DisplayString()[m[0]:m[1]], true
+	}
+	return "", false
+}
+
+func copyLinesToClipboard(i *Input, lines []Line) {
+	outputs := make([]string, len(lines))
+	for n, l := range lines {
+		outputs[n] = l.Output()
+	}
+
+	if err := CopyToClipboard(i.config.ClipboardCommand, strings.Join(outputs, "\n")); err != nil {
+		trace("copyLinesToClipboard: %s", err)
+		i.SendStatusMsgAndClear(err.Error(), 2*time.Second)
+		return
+	}
+
+	if len(lines) == 1 {
+		i.SendStatusMsgAndClear("Copied 1 line", time.Second)
+		return
+	}
+	i.SendStatusMsgAndClear(fmt.Sprintf("Copied %d lines", len(lines)), time.Second)
+}
+
+func doFirstPage(i *Input, _ Event) {
+	moveToPage(i, 1)
+}
+
+func doLastPage(i *Input, _ Event) {
+	moveToPage(i, i.currentPage.maxPage)
+}
+
+// doGotoPage asks for the number of a page, and moves to it
+func doGotoPage(i *Input, _ Event) {
+	message := fmt.Sprintf("Go to page (1-%d): ", i.currentPage.maxPage)
+	startPrompt(i, message, func(i *Input, answer string) {
+		page, err := strconv.Atoi(strings.TrimSpace(answer))
+		if err != nil {
+			i.SendStatusMsgAndClear(fmt.Sprintf("Invalid page number '%s'", answer), time.Second)
+			return
+		}
+		i.SendStatusMsg("")
+		moveToPage(i, page)
+	})
+}
+
+// moveToPage puts the cursor on the first line of the given page,
+// counting from 1. Pages past either end go to the first or last page
+func moveToPage(i *Input, page int) {
+	cp := i.currentPage
+	if page > cp.maxPage {
+		page = cp.maxPage
+	}
+	if page < 1 {
+		page = 1
+	}
+	i.currentLine = (page - 1) * cp.perPage
+	i.SendDraw()
+}
+
+// doSaveBuffer asks for a filename, and saves the lines that
+// currently match the query to that file
+func doSaveBuffer(i *Input, _ Event) {
+	startPrompt(i, "Save matched lines to: ", func(i *Input, name string) {
+		saveLines(i, name, i.GetCurrentLineBuffer().Snapshot())
+	})
+}
+
+// doSaveRawBuffer asks for a filename, and saves all the lines that
+// have been read so far to that file, regardless of the query
+func doSaveRawBuffer(i *Input, _ Event) {
+	startPrompt(i, "Save all lines to: ", func(i *Input, name string) {
+		saveLines(i, name, i.lineOrder.Sorted(i.rawLineBuffer.Snapshot()))
+	})
+}
+
+// saveLines writes `lines` to the file `name` in the background. An
+// existing file is only overwritten if `name` ends with a '!'
+func saveLines(i *Input, name string, lines []Line) {
+	overwrite := strings.HasSuffix(name, "!")
+	name = strings.TrimSpace(strings.TrimSuffix(name, "!"))
+	if name == "" {
+		i.SendStatusMsgAndClear("No filename given", time.Second)
+		return
+	}
+
+	if _, err := os.Stat(name); err == nil && !overwrite {
+		i.SendStatusMsgAndClear(fmt.Sprintf("'%s' exists (add '!' to overwrite)", name), 2*time.Second)
+		return
+	}
+
+	i.SendStatusMsg(fmt.Sprintf("Saving to '%s'...", name))
+	go func() {
+		if err := WriteLines(name, lines, overwrite); err != nil {
+			i.SendStatusMsgAndClear(err.Error(), 2*time.Second)
+			return
+		}
+		i.SendStatusMsgAndClear(fmt.Sprintf("Saved %d lines to '%s'", len(lines), name), time.Second)
+	}()
+}
+
+func doToggleLineNumbers(i *Input, _ Event) {
+	i.config.ShowLineNumbers = !i.config.ShowLineNumbers
+	i.SendDraw()
+}
+
+func doReloadSource(i *Input, _ Event) {
+	if err := i.ReloadSource(); err != nil {
+		i.SendStatusMsgAndClear(err.Error(), 2*time.Second)
+		return
+	}
+	i.SendStatusMsgAndClear("Reloading input", time.Second)
+}
+
+func doToggleQuery(i *Input, _ Event) {
 	q := i.Query()
 	if len(q) == 0 {
 		sq := i.SavedQuery()
@@ -623,12 +1454,88 @@ func doToggleQuery(i *Input, _ termbox.Event) {
 	i.DrawPrompt()
 }
 
-func doKonamiCommand(i *Input, ev termbox.Event) {
+// doSaveQuery remembers the query, so that it can be brought back by
+// peco.RestoreQuery once the query was changed
+func doSaveQuery(i *Input, _ Event) {
+	i.SetSavedQuery(append([]rune{}, i.Query()...))
+	i.SendStatusMsgAndClear("Query saved", time.Second)
+	i.DrawPrompt()
+}
+
+// doRestoreQuery replaces the query with the saved one. The saved
+// query is kept, so that it can be restored again
+func doRestoreQuery(i *Input, _ Event) {
+	setQueryAndExec(i, append([]rune{}, i.SavedQuery()...))
+}
+
+// doSwapQuery replaces the query with the saved one, and saves the
+// query in its place
+func doSwapQuery(i *Input, _ Event) {
+	q := append([]rune{}, i.Query()...)
+	sq := append([]rune{}, i.SavedQuery()...)
+	i.SetSavedQuery(q)
+	setQueryAndExec(i, sq)
+}
+
+// setQueryAndExec replaces the query, moves the caret to its end, and
+// executes it. An empty query shows all of the lines again
+func setQueryAndExec(i *Input, q []rune) {
+	if len(q) == 0 {
+		i.ClearQuery()
+		i.SendDraw()
+		return
+	}
+
+	i.SetQuery(q)
+	if i.ExecQuery() {
+		return
+	}
+	i.DrawPrompt()
+}
+
+// doCompleteQuery replaces the query with the longest prefix that all
+// of the lines shown have in common, if it is longer than the query
+func doCompleteQuery(i *Input, _ Event) {
+	prefix := commonPrefix(i.GetCurrentLineBuffer())
+	if len(prefix) <= i.QueryLen() {
+		i.SendStatusMsgAndClear("No completion", time.Second)
+		return
+	}
+	setQueryAndExec(i, prefix)
+}
+
+// commonPrefix returns the longest prefix that all of the lines in
+// the buffer have in common
+func commonPrefix(b LineBuffer) []rune {
+	var prefix []rune
+	for n := 0; n < b.Size(); n++ {
+		l, err := b.LineAt(n)
+		if err != nil {
+			break
+		}
+		s := []rune(l.DisplayString())
+		if n == 0 {
+			prefix = s
+			continue
+		}
+
+		length := 0
+		for length < len(prefix) && length < len(s) && prefix[length] == s[length] {
+			length++
+		}
+		if prefix = prefix[:length]; length == 0 {
+			break
+		}
+	}
+	return prefix
+}
+
+func doKonamiCommand(i *Input, ev Event) {
 	i.SendStatusMsg("All your filters are belongs to us")
 }
 
 func makeCombinedAction(actions ...Action) ActionFunc {
-	return ActionFunc(func(i *Input, ev termbox.Event) {
+	return ActionFunc(func(i *Input, ev Event) {
 		i.Batch(func() {
 			for _, a := range actions {
 				a.Execute(i, ev)
@@ -636,3 +1543,65 @@ func makeCombinedAction(actions ...Action) ActionFunc {
 		})
 	})
 }
+
+func doToggleUnique(i *Input, _ Event) {
+	i.ToggleHideDuplicates()
+	if i.hideDuplicates {
+		i.SendStatusMsgAndClear("Unique: on", time.Second)
+	} else {
+		i.SendStatusMsgAndClear("Unique: off", time.Second)
+	}
+	i.SendDraw()
+}
+
+func doToggleNullSep(i *Input, _ Event) {
+	i.ToggleNullSep()
+	if i.nullSepOn() {
+		i.SendStatusMsgAndClear("Null separator: on", time.Second)
+	} else {
+		i.SendStatusMsgAndClear("Null separator: off", time.Second)
+	}
+
+	// The lines without a query are the ones that were split again,
+	// but the lines that matched the query have to be matched again
+	if i.QueryLen() > 0 {
+		i.ForceExecQuery()
+	}
+	i.SendDraw()
+}
+
+func doMoveLineUp(i *Input, _ Event) {
+	moveLine(i, -1)
+}
+
+func doMoveLineDown(i *Input, _ Event) {
+	moveLine(i, 1)
+}
+
+// moveLine moves the current line `delta` lines down the screen,
+// which is up the buffer in the bottom-up layout
+func moveLine(i *Input, delta int) {
+	if i.layoutType == LayoutTypeBottomUp {
+		delta = -delta
+	}
+	if err := i.MoveCurrentLine(delta); err != nil {
+		if err != ErrBufferOutOfRange {
+			i.SendStatusMsgAndClear(err.Error(), time.Second)
+		}
+		return
+	}
+	i.SendDraw()
+}
+
+func doShowSelectedOnly(i *Input, _ Event) {
+	if err := i.ToggleSelectedOnly(); err != nil {
+		i.SendStatusMsgAndClear(err.Error(), time.Second)
+		return
+	}
+	if i.IsSelectedOnly() {
+		i.SendStatusMsgAndClear("Showing the selected lines only", time.Second)
+	} else {
+		i.SendStatusMsgAndClear("Showing all lines", time.Second)
+	}
+	i.SendDraw()
+}
@@ -1,19 +1,24 @@
 package peco
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 	"unicode/utf8"
-
-	"github.com/nsf/termbox-go"
 )
 
 func TestActionFunc(t *testing.T) {
 	called := 0
-	af := ActionFunc(func(_ *Input, _ termbox.Event) {
+	af := ActionFunc(func(_ *Input, _ Event) {
 		called++
 	})
-	af.Execute(nil, termbox.Event{})
+	af.Execute(nil, Event{})
 	if called != 1 {
 		t.Errorf("Expected ActionFunc to be called once, but it got called %d times", called)
 	}
@@ -78,19 +83,19 @@ func TestDoDeleteForwardChar(t *testing.T) {
 
 	ctx.SetQuery([]rune("Hello, World!"))
 	ctx.SetCaretPos(5)
-	doDeleteForwardChar(input, termbox.Event{})
+	doDeleteForwardChar(input, Event{})
 
 	expectQueryString(t, ctx, "Hello World!")
 	expectCaretPos(t, ctx, 5)
 
 	ctx.SetCaretPos(ctx.QueryLen())
-	doDeleteForwardChar(input, termbox.Event{})
+	doDeleteForwardChar(input, Event{})
 
 	expectQueryString(t, ctx, "Hello World!")
 	expectCaretPos(t, ctx, ctx.QueryLen())
 
 	ctx.SetCaretPos(0)
-	doDeleteForwardChar(input, termbox.Event{})
+	doDeleteForwardChar(input, Event{})
 
 	expectQueryString(t, ctx, "ello World!")
 	expectCaretPos(t, ctx, 0)
@@ -102,25 +107,25 @@ func TestDoDeleteForwardWord(t *testing.T) {
 
 	ctx.SetQuery([]rune("Hello, World!"))
 	ctx.SetCaretPos(5)
-	doDeleteForwardWord(input, termbox.Event{})
+	doDeleteForwardWord(input, Event{})
 
 	expectQueryString(t, ctx, "Hello World!")
 	expectCaretPos(t, ctx, 5)
 
 	ctx.SetCaretPos(ctx.QueryLen())
-	doDeleteForwardWord(input, termbox.Event{})
+	doDeleteForwardWord(input, Event{})
 
 	expectQueryString(t, ctx, "Hello World!")
 	expectCaretPos(t, ctx, ctx.QueryLen())
 
 	ctx.SetCaretPos(0)
-	doDeleteForwardWord(input, termbox.Event{})
+	doDeleteForwardWord(input, Event{})
 
 	expectQueryString(t, ctx, " World!")
 	expectCaretPos(t, ctx, 0)
 
 	ctx.SetCaretPos(1)
-	doDeleteForwardWord(input, termbox.Event{})
+	doDeleteForwardWord(input, Event{})
 
 	expectQueryString(t, ctx, " ")
 }
@@ -131,19 +136,19 @@ func TestDoDeleteBackwardChar(t *testing.T) {
 
 	ctx.SetQuery([]rune("Hello, World!"))
 	ctx.SetCaretPos(5)
-	doDeleteBackwardChar(input, termbox.Event{})
+	doDeleteBackwardChar(input, Event{})
 
 	expectQueryString(t, ctx, "Hell, World!")
 	expectCaretPos(t, ctx, 4)
 
 	ctx.SetCaretPos(ctx.QueryLen())
-	doDeleteBackwardChar(input, termbox.Event{})
+	doDeleteBackwardChar(input, Event{})
 
 	expectQueryString(t, ctx, "Hell, World")
 	expectCaretPos(t, ctx, ctx.QueryLen())
 
 	ctx.SetCaretPos(0)
-	doDeleteBackwardChar(input, termbox.Event{})
+	doDeleteBackwardChar(input, Event{})
 
 	expectQueryString(t, ctx, "Hell, World")
 	expectCaretPos(t, ctx, 0)
@@ -156,14 +161,14 @@ func TestDoDeleteBackwardWord(t *testing.T) {
 	// In case of an overflow (bug)
 	ctx.SetQuery([]rune("foo"))
 	ctx.SetCaretPos(5)
-	doDeleteBackwardWord(input, termbox.Event{})
+	doDeleteBackwardWord(input, Event{})
 
 	// https://github.com/peco/peco/pull/184#issuecomment-54026739
 
 	// Case 1. " foo<caret>" -> " "
 	ctx.SetQuery([]rune(" foo"))
 	ctx.SetCaretPos(4)
-	doDeleteBackwardWord(input, termbox.Event{})
+	doDeleteBackwardWord(input, Event{})
 
 	expectQueryString(t, ctx, " ")
 	expectCaretPos(t, ctx, 1)
@@ -171,7 +176,7 @@ func TestDoDeleteBackwardWord(t *testing.T) {
 	// Case 2. "foo bar<caret>" -> "foo "
 	ctx.SetQuery([]rune("foo bar"))
 	ctx.SetCaretPos(7)
-	doDeleteBackwardWord(input, termbox.Event{})
+	doDeleteBackwardWord(input, Event{})
 
 	expectQueryString(t, ctx, "foo ")
 	expectCaretPos(t, ctx, 4)
@@ -190,9 +195,9 @@ func writeQueryToPrompt(t *testing.T, message string) {
 		}
 
 		if r == ' ' {
-			screen.SendEvent(termbox.Event{Key: termbox.KeySpace})
+			screen.SendEvent(Event{Key: KeySpace})
 		} else {
-			screen.SendEvent(termbox.Event{Ch: r})
+			screen.SendEvent(Event{Ch: r})
 		}
 		str = str[size:]
 	}
@@ -203,7 +208,7 @@ func TestDoAcceptChar(t *testing.T) {
 	defer guard()
 
 	ctx := newCtx(nil, 25)
-	defer ctx.Stop()
+	defer stopLoops(ctx)
 	ctx.startInput()
 
 	message := "Hello, World!"
@@ -230,7 +235,7 @@ func TestRotateFilter(t *testing.T) {
 	defer guard()
 
 	ctx := newCtx(nil, 25)
-	defer ctx.Stop()
+	defer stopLoops(ctx)
 
 	size := ctx.filters.Size()
 	if size < 2 {
@@ -243,7 +248,7 @@ func TestRotateFilter(t *testing.T) {
 	first := ctx.Filter()
 	prev = first
 	for i := 0; i < size; i++ {
-		screen.SendEvent(termbox.Event{Key: termbox.KeyCtrlR})
+		screen.SendEvent(Event{Key: KeyCtrlR})
 
 		time.Sleep(500 * time.Millisecond)
 		f := ctx.Filter()
@@ -265,21 +270,1281 @@ func TestBeginningOfLineAndEndOfLine(t *testing.T) {
 	defer guard()
 
 	ctx := newCtx(nil, 25)
-	defer ctx.Stop()
+	defer stopLoops(ctx)
 
 	ctx.startInput()
 
 	message := "Hello, World!"
 	writeQueryToPrompt(t, message)
-	screen.SendEvent(termbox.Event{Key: termbox.KeyCtrlA})
+	screen.SendEvent(Event{Key: KeyCtrlA})
 	if cp := ctx.CaretPos(); cp != 0 {
 		t.Errorf("Expected caret position to be 0, got %d", cp)
 	}
 
-	screen.SendEvent(termbox.Event{Key: termbox.KeyCtrlE})
+	screen.SendEvent(Event{Key: KeyCtrlE})
 	time.Sleep(time.Second)
 	if cp := ctx.CaretPos(); cp != len(message) {
 		t.Errorf("Expected caret position to be %d, got %d", len(message), cp)
 	}
 
 }
+
+func TestForceExecQuery(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	ctx.config.QueryExecutionDelay = 5000
+
+	ctx.SetQuery([]rune("Hello"))
+	ctx.ExecQuery()
+	ctx.ForceExecQuery()
+	select {
+	case q := <-ctx.QueryCh():
+		if qs := q.DataString(); qs != "Hello" {
+			t.Errorf("Expected query to be 'Hello', got '%s'", qs)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected query to be sent right away")
+	}
+
+	execQueryLock.Lock()
+	defer execQueryLock.Unlock()
+	if execQueryTimer != nil {
+		t.Errorf("Expected pending query to be discarded")
+	}
+}
+
+type printQueryOption struct {
+	issue212DummyConfig
+}
+
+func (o printQueryOption) PrintQueryOnNoMatch() bool { return true }
+
+func TestDoFinishWithNoMatches(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	ctx.AddRawLine(NewRawLine("Alice", false))
+	ctx.SetQuery([]rune("Bob"))
+	// Nothing matched "Bob"
+	ctx.activeLineBuffer = NewRawLineBuffer()
+	input := ctx.NewInput()
+
+	doFinish(input, Event{Key: KeyEnter})
+	if ctx.ResultCh() != nil {
+		t.Errorf("Expected accept to be a no op when nothing matched")
+	}
+	select {
+	case <-ctx.LoopCh():
+		t.Errorf("Expected peco to keep running when nothing matched")
+	default:
+	}
+
+	ctx = newCtx(printQueryOption{}, 25)
+	ctx.AddRawLine(NewRawLine("Alice", false))
+	ctx.SetQuery([]rune("Bob"))
+	ctx.activeLineBuffer = NewRawLineBuffer()
+	input = ctx.NewInput()
+
+	doFinish(input, Event{Key: KeyEnter})
+	ch := ctx.ResultCh()
+	if ch == nil {
+		t.Fatalf("Expected the query to be emitted")
+	}
+	lines := []string{}
+	for l := range ch {
+		lines = append(lines, l.Output())
+	}
+	if len(lines) != 1 || lines[0] != "Bob" {
+		t.Errorf("Expected the query 'Bob' to be emitted, got %#v", lines)
+	}
+}
+
+func TestConfirmAccept(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	ctx.config.ConfirmAccept = true
+	ctx.AddRawLine(NewRawLine("Alice", false))
+	ctx.AddRawLine(NewRawLine("Bob", false))
+	input := ctx.NewInput()
+
+	doFinish(input, Event{Key: KeyEnter})
+	if input.pendingAccept == nil {
+		t.Fatalf("Expected accept to wait for confirmation")
+	}
+	if ctx.ResultCh() != nil {
+		t.Errorf("Expected nothing to be accepted before confirmation")
+	}
+
+	input.handleKeyEvent(Event{Ch: 'n'})
+	if input.pendingAccept != nil || ctx.ResultCh() != nil {
+		t.Errorf("Expected accept to be canceled")
+	}
+	if ctx.SelectionLen() != 0 {
+		t.Errorf("Expected selection to be restored after cancel, got %d lines", ctx.SelectionLen())
+	}
+
+	doFinish(input, Event{Key: KeyEnter})
+	input.handleKeyEvent(Event{Ch: 'y'})
+	ch := ctx.ResultCh()
+	if ch == nil {
+		t.Fatalf("Expected accept to be confirmed")
+	}
+	for l := range ch {
+		if l.Output() != "Alice" {
+			t.Errorf("Expected 'Alice' to be accepted, got '%s'", l.Output())
+		}
+	}
+}
+
+func TestAcceptCursorOnly(t *testing.T) {
+	newInput := func() (*Ctx, *Input) {
+		ctx := newCtx(nil, 25)
+		ctx.config.AcceptCursorOnly = true
+		for _, l := range []string{"Alice", "Bob", "Charlie"} {
+			ctx.AddRawLine(NewRawLine(l, false))
+		}
+		ctx.SelectionAdd(0)
+		ctx.SelectionAdd(2)
+		ctx.currentLine = 1
+		return ctx, ctx.NewInput()
+	}
+	accepted := func(ctx *Ctx) string {
+		ch := ctx.ResultCh()
+		if ch == nil {
+			return "(none)"
+		}
+		lines := []string{}
+		for l := range ch {
+			lines = append(lines, l.Output())
+		}
+		return strings.Join(lines, ",")
+	}
+
+	// The selection is ignored, and the prompt says so
+	ctx, input := newInput()
+	prompt := UserPrompt{Ctx: ctx}
+	if !strings.HasPrefix(prompt.resultCount(), "[cursor only]") {
+		t.Errorf("Expected the selection to be indicated as ignored, got '%s'", prompt.resultCount())
+	}
+	doFinish(input, Event{Key: KeyEnter})
+	if s := accepted(ctx); s != "Bob" {
+		t.Errorf("Expected 'Bob' alone to be accepted, got '%s'", s)
+	}
+
+	// Unless it is accepted explicitly
+	ctx, input = newInput()
+	doFinishWithSelection(input, Event{})
+	if s := accepted(ctx); s != "Alice,Charlie" {
+		t.Errorf("Expected 'Alice,Charlie' to be accepted, got '%s'", s)
+	}
+
+	// The confirmation is about the line under the cursor
+	ctx, input = newInput()
+	ctx.config.ConfirmAccept = true
+	doFinish(input, Event{Key: KeyEnter})
+	select {
+	case r := <-ctx.StatusMsgCh():
+		if msg := r.DataInterface().(StatusMsgRequest).message; msg != "Accept 'Bob'? (y/n)" {
+			t.Errorf("Expected to be asked to accept 'Bob', got '%s'", msg)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected to be asked for confirmation")
+	}
+	input.handleKeyEvent(Event{Ch: 'y'})
+	if s := accepted(ctx); s != "Bob" {
+		t.Errorf("Expected 'Bob' alone to be accepted, got '%s'", s)
+	}
+
+	// Without a selection, there's nothing to point out
+	ctx, _ = newInput()
+	ctx.SelectionClear()
+	if s := (UserPrompt{Ctx: ctx}).resultCount(); strings.HasPrefix(s, "[cursor only]") {
+		t.Errorf("Expected nothing to be indicated without a selection, got '%s'", s)
+	}
+}
+
+func TestIncrementAndDecrementNumber(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	input := ctx.NewInput()
+
+	ctx.SetQuery([]rune("page 9 of 10"))
+	ctx.SetCaretPos(0)
+	doIncrementNumber(input, Event{})
+	expectQueryString(t, ctx, "page 10 of 10")
+	expectCaretPos(t, ctx, 6)
+
+	// Caret is on the last digit, so this modifies the same number
+	doDecrementNumber(input, Event{})
+	doDecrementNumber(input, Event{})
+	expectQueryString(t, ctx, "page 8 of 10")
+	expectCaretPos(t, ctx, 5)
+
+	ctx.SetCaretPos(ctx.QueryLen())
+	doIncrementNumber(input, Event{})
+	expectQueryString(t, ctx, "page 8 of 11")
+
+	ctx.SetQuery([]rune("x-1"))
+	ctx.SetCaretPos(0)
+	doIncrementNumber(input, Event{})
+	doIncrementNumber(input, Event{})
+	expectQueryString(t, ctx, "x1")
+
+	ctx.SetQuery([]rune("no numbers"))
+	ctx.SetCaretPos(0)
+	doIncrementNumber(input, Event{})
+	expectQueryString(t, ctx, "no numbers")
+	expectCaretPos(t, ctx, 0)
+}
+
+func TestToggleRegexp(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	input := ctx.NewInput()
+
+	ctx.SetCurrentFilterByName(SmartCaseMatch)
+	ctx.SetQuery([]rune("foo.*bar"))
+
+	doToggleRegexp(input, Event{})
+	if f := ctx.Filter().String(); f != RegexpMatch {
+		t.Errorf("Expected filter to be Regexp, got %s", f)
+	}
+	expectQueryString(t, ctx, "foo.*bar")
+
+	doToggleRegexp(input, Event{})
+	if f := ctx.Filter().String(); f != SmartCaseMatch {
+		t.Errorf("Expected filter to be back to SmartCase, got %s", f)
+	}
+	expectQueryString(t, ctx, "foo.*bar")
+
+	// Starting with Regexp, we fall back to IgnoreCase
+	ctx = newCtx(nil, 25)
+	input = ctx.NewInput()
+	ctx.SetCurrentFilterByName(RegexpMatch)
+	doToggleRegexp(input, Event{})
+	if f := ctx.Filter().String(); f != IgnoreCaseMatch {
+		t.Errorf("Expected filter to be IgnoreCase, got %s", f)
+	}
+}
+
+func TestSaveBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "saved")
+
+	ctx := newCtx(nil, 25)
+	for _, l := range []string{"Alice", "Bob", "Charlie"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	input := ctx.NewInput()
+
+	// Every key typed in the prompt updates the status bar, so keep
+	// draining status messages while typing
+	msgs := make(chan string, 1024)
+	go func() {
+		for r := range ctx.StatusMsgCh() {
+			msgs <- r.DataInterface().(StatusMsgRequest).message
+		}
+	}()
+
+	// waitStatus skips status messages until one starting with
+	// `prefix` arrives
+	waitStatus := func(prefix string) {
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case m := <-msgs:
+				if strings.HasPrefix(m, prefix) {
+					return
+				}
+			case <-timeout:
+				t.Errorf("Expected status message '%s...'", prefix)
+				return
+			}
+		}
+	}
+	save := func(name string) {
+		doSaveRawBuffer(input, Event{})
+		for _, r := range name {
+			input.handleKeyEvent(Event{Ch: r})
+		}
+		input.handleKeyEvent(Event{Key: KeyEnter})
+	}
+	expectFile := func(expected string) {
+		buf, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Errorf("Failed to read %s: %s", out, err)
+		} else if string(buf) != expected {
+			t.Errorf("Expected %q, got %q", expected, buf)
+		}
+	}
+
+	save(out)
+	waitStatus("Saved 3 lines")
+	expectFile("Alice\nBob\nCharlie\n")
+
+	// Keys are not dispatched to actions after the prompt is done
+	if input.pendingPrompt != nil {
+		t.Errorf("Expected prompt to be done")
+	}
+
+	ioutil.WriteFile(out, []byte("precious\n"), 0644)
+	save(out)
+	waitStatus("'" + out + "' exists")
+	expectFile("precious\n")
+
+	save(out + "!")
+	waitStatus("Saved 3 lines")
+	expectFile("Alice\nBob\nCharlie\n")
+
+	doSaveBuffer(input, Event{})
+	input.handleKeyEvent(Event{Ch: 'x'})
+	input.handleKeyEvent(Event{Key: KeyEsc})
+	if input.pendingPrompt != nil {
+		t.Errorf("Expected prompt to be canceled")
+	}
+	waitStatus("Canceled")
+}
+
+func TestSelectionHintMode(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	for _, l := range []string{"Alice", "Bob", "Charlie"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	ctx.currentPage.perPage = 10
+	input := ctx.NewInput()
+
+	// Alt + label toggles the selection
+	doSelectionHintMode(input, Event{})
+	input.handleKeyEvent(Event{Ch: 'd', Mod: ModAlt})
+	if ctx.hintMode {
+		t.Errorf("Expected hint mode to end after a key")
+	}
+	if ctx.SelectionLen() != 1 || ctx.currentLine != 2 {
+		t.Errorf("Expected 'Charlie' to be selected, got %d lines (current line %d)", ctx.SelectionLen(), ctx.currentLine)
+	}
+	ctx.SelectionClear()
+
+	// Keys that are not labels of a line cancel the mode
+	doSelectionHintMode(input, Event{})
+	input.handleKeyEvent(Event{Ch: 'f'})
+	if ctx.hintMode || ctx.ResultCh() != nil {
+		t.Errorf("Expected hint mode to be canceled")
+	}
+
+	doSelectionHintMode(input, Event{})
+	input.handleKeyEvent(Event{Ch: 's'})
+	if ctx.ResultCh() == nil {
+		t.Fatalf("Expected a line to be accepted")
+	}
+	for l := range ctx.ResultCh() {
+		if l.DisplayString() != "Bob" {
+			t.Errorf("Expected 'Bob' to be accepted, got '%s'", l.DisplayString())
+		}
+	}
+}
+
+func TestActionMenu(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands in this test need a POSIX shell")
+	}
+
+	dir, err := ioutil.TempDir("", "peco-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	// The commands get the terminal, and the screen is given up and
+	// taken over again around them
+	oldTerminal := menuTerminal
+	defer func() { menuTerminal = oldTerminal }()
+	menuTerminal = func() (*os.File, *os.File, error) {
+		f, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+		return f, f, err
+	}
+	i, guard := setDummyScreen()
+	defer guard()
+	screen = suspendingScreen{screen.(dummyScreen)}
+
+	ctx := newCtx(nil, 25)
+	ctx.config.HintAlphabet = "as"
+	ctx.config.ActionMenu = []ActionMenuItem{
+		{Name: "Fail", Command: "echo oops >&2; exit 1"},
+		{Name: "Save", Command: "printf '%s\\n' $LINES > " + out},
+		{Name: "Unreachable", Command: "true"},
+	}
+	for _, l := range []string{"Alice", "Bob's", "Charlie Brown"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	input := ctx.NewInput()
+
+	msgs := make(chan string, 1024)
+	go func() {
+		for r := range ctx.StatusMsgCh() {
+			msgs <- r.DataInterface().(StatusMsgRequest).message
+		}
+	}()
+	waitStatus := func(prefix string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case m := <-msgs:
+				if strings.HasPrefix(m, prefix) {
+					return
+				}
+			case <-timeout:
+				t.Errorf("Expected status message '%s...'", prefix)
+				return
+			}
+		}
+	}
+
+	doActionMenu(input, Event{})
+	waitStatus("[a] Fail  [s] Save  (1 more without a key, see HintAlphabet)")
+	input.handleKeyEvent(Event{Ch: 'a'})
+	waitStatus("error: oops")
+	i.m.Lock()
+	suspended, resumed := len(i.events["Suspend"]), len(i.events["Resume"])
+	i.m.Unlock()
+	if suspended != 1 || resumed != 1 {
+		t.Errorf("Expected the screen to be suspended and resumed once, got %d and %d", suspended, resumed)
+	}
+
+	ctx.SelectionAdd(1)
+	ctx.SelectionAdd(2)
+	doActionMenu(input, Event{})
+	input.handleKeyEvent(Event{Ch: 's'})
+	waitStatus("Ran 'Save'")
+	buf, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %s", out, err)
+	}
+	if string(buf) != "Bob's\nCharlie Brown\n" {
+		t.Errorf("Expected the selected lines, got %q", buf)
+	}
+
+	// Any other key closes the menu without dispatching the key
+	doActionMenu(input, Event{})
+	input.handleKeyEvent(Event{Ch: 'x'})
+	waitStatus("Canceled")
+	if input.actionMenu || ctx.QueryLen() != 0 {
+		t.Errorf("Expected the menu to be closed, and the query to be left alone")
+	}
+
+	if s := expandMenuCommand("cmd $LINES -- $LINE $QUERY", []string{"a", "b c"}, "a", "q"); s != "cmd 'a' 'b c' -- 'a' 'q'" {
+		t.Errorf("Unexpected command %q", s)
+	}
+}
+
+// suspendingScreen is a screen that can be suspended (see suspender)
+type suspendingScreen struct {
+	dummyScreen
+}
+
+func (s suspendingScreen) Suspend() {
+	s.record("Suspend", interceptorArgs{})
+}
+
+func (s suspendingScreen) Resume() error {
+	s.record("Resume", interceptorArgs{})
+	return nil
+}
+
+func TestClearQuery(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	ctx.config.QueryExecutionDelay = 50
+	for _, l := range []string{"Alice", "Bob", "Charlie"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	input := ctx.NewInput()
+
+	ctx.SetQuery([]rune("Bob"))
+	ctx.SetCaretPos(1)
+	ctx.currentCol = 10
+	if !ctx.ExecQuery() {
+		t.Fatalf("Expected the query to be scheduled")
+	}
+	doClearQuery(input, Event{})
+
+	if ctx.QueryLen() != 0 || ctx.CaretPos() != 0 || ctx.currentCol != 0 {
+		t.Errorf("Expected query, caret and column to be reset, got %q, %d, %d", ctx.QueryString(), ctx.CaretPos(), ctx.currentCol)
+	}
+	if n := ctx.GetCurrentLineBuffer().Size(); n != 3 {
+		t.Errorf("Expected all 3 lines to be shown, got %d", n)
+	}
+
+	// The query that was waiting for QueryExecutionDelay never fires
+	select {
+	case q := <-ctx.QueryCh():
+		t.Errorf("Expected the pending query to be discarded, got '%s'", q.DataString())
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	// Later queries still go through
+	ctx.SetQuery([]rune("Alice"))
+	ctx.ExecQuery()
+	select {
+	case q := <-ctx.QueryCh():
+		if q.DataString() != "Alice" {
+			t.Errorf("Expected 'Alice', got '%s'", q.DataString())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the query to be executed")
+	}
+}
+
+func TestMoveLine(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	for _, l := range []string{"Alice", "Bob", "Charlie", "Dave"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	input := ctx.NewInput()
+
+	order := func(b LineBuffer) string {
+		names := []string{}
+		for _, l := range b.Snapshot() {
+			names = append(names, l.DisplayString())
+		}
+		return strings.Join(names, ",")
+	}
+
+	ctx.currentLine = 1
+	ctx.SelectionAdd(1) // Bob
+	doMoveLineDown(input, Event{})
+	if s := order(ctx.GetCurrentLineBuffer()); s != "Alice,Charlie,Bob,Dave" {
+		t.Errorf("Expected Bob to move down, got %s", s)
+	}
+	if ctx.currentLine != 2 {
+		t.Errorf("Expected the cursor to follow the line, got %d", ctx.currentLine)
+	}
+	if !ctx.SelectionContains(2) || ctx.SelectionContains(1) {
+		t.Errorf("Expected the selection to follow the line")
+	}
+
+	// Nothing happens at the edges
+	ctx.currentLine = 0
+	doMoveLineUp(input, Event{})
+	if s := order(ctx.GetCurrentLineBuffer()); s != "Alice,Charlie,Bob,Dave" || ctx.currentLine != 0 {
+		t.Errorf("Expected nothing to move, got %s (cursor %d)", s, ctx.currentLine)
+	}
+
+	// Moving lines in a filtered buffer only swaps the two lines,
+	// the lines in between stay where they are
+	active := NewRawLineBuffer()
+	for _, i := range []int{0, 3} { // Alice, Dave
+		l, _ := ctx.rawLineBuffer.LineAt(i)
+		active.Append(NewMatchedLine(l, nil))
+	}
+	ctx.activeLineBuffer = active
+	ctx.currentLine = 1
+	doMoveLineUp(input, Event{})
+	if s := order(ctx.GetCurrentLineBuffer()); s != "Dave,Alice" {
+		t.Errorf("Expected Dave to move up, got %s", s)
+	}
+	ctx.activeLineBuffer = nil
+	if s := order(ctx.GetCurrentLineBuffer()); s != "Dave,Charlie,Bob,Alice" {
+		t.Errorf("Expected the new order to be kept, got %s", s)
+	}
+	if s := order(ctx.rawLineBuffer); s != "Alice,Bob,Charlie,Dave" {
+		t.Errorf("Expected the raw buffer to be left alone, got %s", s)
+	}
+
+	// In the bottom-up layout, up is towards the end of the buffer
+	ctx.layoutType = LayoutTypeBottomUp
+	ctx.currentLine = 1
+	doMoveLineUp(input, Event{})
+	if s := order(ctx.GetCurrentLineBuffer()); s != "Dave,Bob,Charlie,Alice" || ctx.currentLine != 2 {
+		t.Errorf("Expected Charlie to move up the screen, got %s (cursor %d)", s, ctx.currentLine)
+	}
+
+	// The selected lines are output in the new order
+	ctx.SelectionAdd(0) // Dave
+	ctx.SelectionAdd(3) // Alice
+	ctx.SelectionAdd(2) // Charlie
+	finish(input)
+	got := []string{}
+	for l := range ctx.ResultCh() {
+		got = append(got, l.Output())
+	}
+	if s := strings.Join(got, ","); s != "Dave,Bob,Charlie,Alice" {
+		t.Errorf("Expected the output to follow the new order, got %s", s)
+	}
+}
+
+func TestShowSelectedOnly(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	for _, l := range []string{"Alice", "Bob", "Charlie", "Dave"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	input := ctx.NewInput()
+
+	runQuery := func() {
+		select {
+		case q := <-ctx.QueryCh():
+			ctx.NewFilter().Work(make(chan struct{}), q)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the query to be executed")
+		}
+	}
+
+	doShowSelectedOnly(input, Event{})
+	if ctx.selectedOnly != nil {
+		t.Errorf("Expected nothing to happen when nothing is selected")
+	}
+
+	ctx.SelectionAdd(1)
+	ctx.SelectionAdd(2)
+	doShowSelectedOnly(input, Event{})
+	if !waitForLines(t, ctx, "Bob,Charlie") {
+		t.Errorf("Expected the selected lines to be shown")
+	}
+
+	// The query only matches against the selected lines
+	ctx.SetQuery([]rune("a"))
+	ctx.ForceExecQuery()
+	runQuery()
+	if !waitForLines(t, ctx, "Charlie") {
+		t.Errorf("Expected the query to narrow down the selected lines")
+	}
+
+	doShowSelectedOnly(input, Event{})
+	runQuery()
+	if !waitForLines(t, ctx, "Alice,Charlie,Dave") {
+		t.Errorf("Expected the query to match against all of the lines again")
+	}
+}
+
+func TestScopeQuery(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	for _, l := range []string{"ERROR disk full", "INFO disk ok", "ERROR timeout", "WARN timeout"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	input := ctx.NewInput()
+
+	// Runs the query, and waits for it to complete
+	runQuery := func(query string) {
+		ctx.SetQuery([]rune(query))
+		ctx.ForceExecQuery()
+		select {
+		case q := <-ctx.QueryCh():
+			ctx.NewFilter().Work(make(chan struct{}), q)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the query to be executed")
+		}
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if q, _ := ctx.progress.Result(); q == query {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Expected query '%s' to complete", query)
+	}
+
+	doSetScopeQuery(input, Event{})
+	if ctx.scope != nil {
+		t.Errorf("Expected no scope without a query")
+	}
+
+	runQuery("ERROR")
+	ctx.SetQuery([]rune("disk"))
+	doSetScopeQuery(input, Event{})
+	if ctx.scope != nil {
+		t.Errorf("Expected no scope while the results are those of another query")
+	}
+
+	ctx.SetQuery([]rune("ERROR"))
+	doSetScopeQuery(input, Event{})
+	if ctx.ScopeQuery() != "ERROR" || ctx.QueryLen() != 0 {
+		t.Errorf("Expected scope 'ERROR' and an empty query, got '%s' and '%s'", ctx.ScopeQuery(), ctx.QueryString())
+	}
+	if !waitForLines(t, ctx, "ERROR disk full,ERROR timeout") {
+		t.Errorf("Expected the lines of the scope to be shown")
+	}
+
+	// The query refines the scope
+	runQuery("timeout")
+	if !waitForLines(t, ctx, "ERROR timeout") {
+		t.Errorf("Expected the query to be matched within the scope")
+	}
+	ctx.ClearQuery()
+	if !waitForLines(t, ctx, "ERROR disk full,ERROR timeout") {
+		t.Errorf("Expected an empty query to show the lines of the scope")
+	}
+
+	// Scopes can be narrowed down further
+	runQuery("disk")
+	doSetScopeQuery(input, Event{})
+	if ctx.ScopeQuery() != "ERROR > disk" || !waitForLines(t, ctx, "ERROR disk full") {
+		t.Errorf("Expected scope 'ERROR > disk', got '%s'", ctx.ScopeQuery())
+	}
+
+	ctx.SetQuery([]rune("o"))
+	doClearScopeQuery(input, Event{})
+	select {
+	case q := <-ctx.QueryCh():
+		ctx.NewFilter().Work(make(chan struct{}), q)
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the query to be executed")
+	}
+	if ctx.scope != nil || !waitForLines(t, ctx, "ERROR disk full,INFO disk ok,ERROR timeout,WARN timeout") {
+		t.Errorf("Expected the query to be matched against all of the lines again")
+	}
+}
+
+func TestFilterBufferThrough(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands in this test need a POSIX shell")
+	}
+
+	ctx := newCtx(nil, 25)
+	for _, l := range []string{"b", "a", "b", "c"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	shown := func() string {
+		names := []string{}
+		for _, l := range ctx.GetCurrentLineBuffer().Snapshot() {
+			names = append(names, l.DisplayString())
+		}
+		return strings.Join(names, ",")
+	}
+
+	if err := ctx.FilterBufferThrough("echo oops >&2; exit 1"); err == nil || err.Error() != "error: oops" {
+		t.Errorf("Expected the error of the command, got %v", err)
+	}
+	if ctx.scope != nil {
+		t.Errorf("Expected the lines to be left alone when the command fails")
+	}
+
+	ctx.SelectionAdd(1)
+	ctx.SetQuery([]rune("b"))
+	if err := ctx.FilterBufferThrough("sort -u"); err != nil {
+		t.Fatalf("Failed to run the command: %s", err)
+	}
+	if got := shown(); got != "a,b,c" {
+		t.Errorf("Expected the output of the command to be shown, got '%s'", got)
+	}
+	if ctx.SelectionLen() != 0 || ctx.QueryLen() != 0 {
+		t.Errorf("Expected the selection and the query to be cleared")
+	}
+	if ctx.ScopeQuery() != "| sort -u" {
+		t.Errorf("Expected scope '| sort -u', got '%s'", ctx.ScopeQuery())
+	}
+
+	// Commands can be chained
+	if err := ctx.FilterBufferThrough("tail -n 1"); err != nil {
+		t.Fatalf("Failed to run the command: %s", err)
+	}
+	if got := shown(); got != "c" || ctx.ScopeQuery() != "| sort -u | tail -n 1" {
+		t.Errorf("Expected 'c' with scope '| sort -u | tail -n 1', got '%s' with scope '%s'", got, ctx.ScopeQuery())
+	}
+
+	ctx.ClearScopeQuery()
+	if got := shown(); got != "b,a,b,c" {
+		t.Errorf("Expected all of the lines to be shown again, got '%s'", got)
+	}
+
+	// The output is read like the input
+	ctx.trim = true
+	ctx.selectMarker = "* "
+	if err := ctx.FilterBufferThrough(`printf '* x  \n y\n'`); err != nil {
+		t.Fatalf("Failed to run the command: %s", err)
+	}
+	if got := shown(); got != "x,y" || ctx.SelectionLen() != 1 {
+		t.Errorf("Expected 'x,y' with x selected, got '%s' with %d lines selected", got, ctx.SelectionLen())
+	}
+}
+
+func TestDoFilterBufferThrough(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands in this test need a POSIX shell")
+	}
+
+	ctx := newCtx(nil, 25)
+	for _, l := range []string{"b", "a"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	ctx.config.FilterBufferCommand = "sort"
+	input := ctx.NewInput()
+
+	doFilterBufferThrough(input, Event{})
+	if ctx.scope != nil {
+		t.Errorf("Expected the output to be applied by the input loop")
+	}
+
+	// Only one command runs at a time
+	doFilterBufferThrough(input, Event{})
+
+	select {
+	case f := <-input.callbackCh:
+		f()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the command to finish")
+	}
+	if ctx.scope == nil || ctx.scope.Size() != 2 {
+		t.Fatalf("Expected the output of the command to be shown")
+	}
+	if l, _ := ctx.scope.LineAt(0); l.DisplayString() != "a" {
+		t.Errorf("Expected the lines to be sorted, got '%s' first", l.DisplayString())
+	}
+
+	select {
+	case <-input.callbackCh:
+		t.Errorf("Expected the command to be run once")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if input.filtering {
+		t.Errorf("Expected the command to be done")
+	}
+}
+
+func TestToggleSelectionAndSelectNext(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+	screen = dummyScreen{i, 80, 5 + reservedLines(), make(chan Event, 256)}
+
+	for _, layout := range []string{LayoutTypeTopDown, LayoutTypeBottomUp} {
+		ctx := newCtx(CLIOptions{OptLayout: layout}, 25)
+		ctx.config.CycleCursor = true
+		for n := 0; n < 12; n++ {
+			ctx.AddRawLine(NewRawLine(fmt.Sprintf("line %d", n), false))
+		}
+		input := ctx.NewInput()
+		v := ctx.NewView()
+		v.layout.DrawScreen()
+
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case r := <-ctx.PagingCh():
+					v.movePage(r.DataInterface().(PagingRequest))
+					r.Done()
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		expect := func(line int, selected ...int) {
+			if ctx.currentLine != line {
+				t.Errorf("%s: expected the cursor on line %d, got %d", layout, line, ctx.currentLine)
+			}
+			if ctx.SelectionLen() != len(selected) {
+				t.Errorf("%s: expected %d lines to be selected, got %d", layout, len(selected), ctx.SelectionLen())
+			}
+			for _, n := range selected {
+				if l, _ := ctx.GetCurrentLineBuffer().LineAt(n); !ctx.SelectionHas(l) {
+					t.Errorf("%s: expected line %d to be selected", layout, n)
+				}
+			}
+		}
+
+		// Across the end of the first page
+		ctx.currentLine = 3
+		for n := 0; n < 4; n++ {
+			doToggleSelectionAndSelectNext(input, Event{})
+		}
+		expect(7, 3, 4, 5, 6)
+		if ctx.currentPage.page != 2 {
+			t.Errorf("%s: expected page 2, got %d", layout, ctx.currentPage.page)
+		}
+
+		doToggleSelectionAndSelectPrevious(input, Event{})
+		doToggleSelectionAndSelectPrevious(input, Event{})
+		expect(5, 3, 4, 5, 7)
+
+		// The cursor doesn't cycle at either end
+		ctx.SelectionClear()
+		ctx.currentLine = 11
+		doToggleSelectionAndSelectNext(input, Event{})
+		expect(11, 11)
+		ctx.currentLine = 0
+		doToggleSelectionAndSelectPrevious(input, Event{})
+		expect(0, 0, 11)
+
+		close(done)
+	}
+
+	var tab string
+	for _, b := range newCtx(nil, 25).NewKeymap().Bindings() {
+		if b.Keys == "Tab" {
+			tab = b.Action
+		}
+	}
+	if tab != "peco.ToggleSelectionAndSelectNext" {
+		t.Errorf("Expected Tab to be bound to peco.ToggleSelectionAndSelectNext, got '%s'", tab)
+	}
+}
+
+func TestTransposeChars(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	input := ctx.NewInput()
+
+	tests := []struct {
+		query    string
+		pos      int
+		expected string
+		caret    int
+	}{
+		{"abcd", 2, "acbd", 3},
+		{"abcd", 0, "bacd", 2}, // at the start, the first two
+		{"abcd", 4, "abdc", 4}, // at the end, the last two
+		{"ab", 1, "ba", 2},
+		{"a", 1, "a", 1},
+		{"", 0, "", 0},
+	}
+	for _, test := range tests {
+		ctx.SetQuery([]rune(test.query))
+		ctx.SetCaretPos(test.pos)
+		doTransposeChars(input, Event{})
+		if q := ctx.QueryString(); q != test.expected || ctx.CaretPos() != test.caret {
+			t.Errorf("Expected %q at %d to become %q at %d, got %q at %d",
+				test.query, test.pos, test.expected, test.caret, q, ctx.CaretPos())
+		}
+	}
+}
+
+func TestLineToQuery(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	for _, l := range []string{"Alice", "Bob"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	input := ctx.NewInput()
+
+	ctx.SetQuery([]rune("foo"))
+	ctx.currentLine = 1
+	doSetLineAsQuery(input, Event{})
+	if q := ctx.QueryString(); q != "Bob" || ctx.CaretPos() != 3 {
+		t.Errorf("Expected query to be 'Bob' with caret at 3, got '%s' (%d)", q, ctx.CaretPos())
+	}
+
+	ctx.currentLine = 0
+	doAppendLineToQuery(input, Event{})
+	if q := ctx.QueryString(); q != "Bob Alice" || ctx.CaretPos() != 9 {
+		t.Errorf("Expected query to be 'Bob Alice' with caret at 9, got '%s' (%d)", q, ctx.CaretPos())
+	}
+
+	ctx.SetQuery([]rune{})
+	doAppendLineToQuery(input, Event{})
+	if q := ctx.QueryString(); q != "Alice" {
+		t.Errorf("Expected query to be 'Alice', got '%s'", q)
+	}
+}
+
+func TestAcceleration(t *testing.T) {
+	_, guard := setDummyScreen()
+	defer guard()
+
+	ctx := newCtx(nil, 25)
+	defer stopLoops(ctx)
+	for n := 0; n < 500; n++ {
+		ctx.AddRawLine(NewRawLine(fmt.Sprintf("line %d", n), false))
+	}
+	ctx.AddWaitGroup(1)
+	go ctx.NewView().Loop()
+	input := ctx.NewInput()
+
+	// Waits for the paging requests to be processed
+	press := func(ev Event) {
+		ctx.Batch(func() { input.handleKeyEvent(ev) })
+	}
+	expectLine := func(expected int) {
+		if ctx.currentLine != expected {
+			t.Errorf("Expected the cursor to be on line %d, got %d", expected, ctx.currentLine)
+		}
+	}
+
+	ctx.config.Acceleration = AccelerationConfig{Enabled: true, Interval: 1000, Repeats: 2, MaxStep: 4}
+	for n := 0; n < 6; n++ {
+		press(Event{Key: KeyCtrlN})
+	}
+	expectLine(1 + 1 + 2 + 2 + 4 + 4)
+
+	// Another key starts over
+	press(Event{Key: KeyCtrlP})
+	expectLine(13)
+	press(Event{Key: KeyCtrlN})
+	expectLine(14)
+
+	press(Event{Key: KeyCtrlN})
+	press(Event{Key: KeyCtrlN})
+	expectLine(17)
+
+	// So does a pause
+	input.accel.last = time.Now().Add(-2 * time.Second)
+	press(Event{Key: KeyCtrlN})
+	expectLine(18)
+
+	// Disabled, the cursor moves a line at a time
+	ctx.config.Acceleration.Enabled = false
+	for n := 0; n < 20; n++ {
+		press(Event{Key: KeyCtrlN})
+	}
+	expectLine(38)
+
+	// As it does without a maximum step
+	ctx.config.Acceleration = AccelerationConfig{Enabled: true, Interval: 1000, Repeats: 2}
+	for n := 0; n < 6; n++ {
+		press(Event{Key: KeyCtrlN})
+	}
+	expectLine(44)
+
+	// Editing the query is never accelerated
+	for n := 0; n < 6; n++ {
+		input.handleKeyEvent(Event{Ch: 'a'})
+	}
+	expectQueryString(t, ctx, "aaaaaa")
+}
+
+func TestSaveAndRestoreQuery(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	defer ctx.Stop()
+	ctx.AddRawLine(NewRawLine("foo", false))
+	input := ctx.NewInput()
+	prompt := UserPrompt{Ctx: ctx}
+
+	ctx.SetQuery([]rune("foo"))
+	doSaveQuery(input, Event{})
+	if !strings.HasPrefix(prompt.resultCount(), "[saved]") {
+		t.Errorf("Expected the saved query to be indicated, got '%s'", prompt.resultCount())
+	}
+
+	// Editing the query doesn't change the saved one
+	ctx.SetQuery([]rune("fo"))
+	ctx.AppendQuery('x')
+	ctx.SetCaretPos(1)
+	doRestoreQuery(input, Event{})
+	expectQueryString(t, ctx, "foo")
+	expectCaretPos(t, ctx, 3)
+
+	ctx.SetQuery([]rune("bar"))
+	doRestoreQuery(input, Event{})
+	doRestoreQuery(input, Event{})
+	expectQueryString(t, ctx, "foo")
+	expectCaretPos(t, ctx, 3)
+
+	ctx.SetQuery([]rune("bar"))
+	doSwapQuery(input, Event{})
+	expectQueryString(t, ctx, "foo")
+	if sq := string(ctx.SavedQuery()); sq != "bar" {
+		t.Errorf("Expected 'bar' to be saved, got '%s'", sq)
+	}
+
+	// An empty saved query shows all of the lines again
+	ctx.SetQuery([]rune{})
+	doSaveQuery(input, Event{})
+	if strings.HasPrefix(prompt.resultCount(), "[saved]") {
+		t.Errorf("Expected no saved query to be indicated, got '%s'", prompt.resultCount())
+	}
+	ctx.SetQuery([]rune("foo"))
+	ctx.SetActiveLineBuffer(NewRawLineBuffer())
+	doRestoreQuery(input, Event{})
+	expectQueryString(t, ctx, "")
+	expectCaretPos(t, ctx, 0)
+	if ctx.GetCurrentLineBuffer() != ctx.rawLineBuffer {
+		t.Errorf("Expected all of the lines to be shown")
+	}
+}
+
+func TestDoubleEscapeToExit(t *testing.T) {
+	newInput := func() (*Ctx, *Input) {
+		ctx := newCtx(nil, 25)
+		ctx.config.DoubleEscapeToExit = true
+		ctx.AddRawLine(NewRawLine("foo", false))
+		return ctx, ctx.NewInput()
+	}
+	exited := func(ctx *Ctx) bool {
+		select {
+		case <-ctx.LoopCh():
+			return true
+		default:
+			return false
+		}
+	}
+
+	ctx, input := newInput()
+	ctx.SetQuery([]rune("foo"))
+	input.handleKeyEvent(Event{Key: KeyEsc})
+	expectQueryString(t, ctx, "")
+	if exited(ctx) {
+		t.Fatalf("Expected the first Esc not to exit")
+	}
+	input.handleKeyEvent(Event{Key: KeyEsc})
+	if !exited(ctx) || ctx.Error() != ErrUserCanceled {
+		t.Errorf("Expected the second Esc to exit")
+	}
+
+	// Another key in between starts over
+	ctx, input = newInput()
+	input.handleKeyEvent(Event{Key: KeyEsc})
+	input.handleKeyEvent(Event{Key: KeyCtrlN})
+	input.handleKeyEvent(Event{Key: KeyEsc})
+	if exited(ctx) {
+		t.Errorf("Expected Esc not to exit after another key")
+	}
+	ctx.Stop()
+
+	// So does a pause
+	ctx, input = newInput()
+	input.handleKeyEvent(Event{Key: KeyEsc})
+	input.escAt = time.Now().Add(-2 * doubleEscapeInterval)
+	input.handleKeyEvent(Event{Key: KeyEsc})
+	if exited(ctx) {
+		t.Errorf("Expected Esc not to exit after a pause")
+	}
+	ctx.Stop()
+
+	// Esc pressed twice faster than Alt is detected
+	ctx, input = newInput()
+	input.handleInputEvent(Event{Type: EventKey, Key: KeyEsc})
+	input.handleInputEvent(Event{Type: EventKey, Key: KeyEsc})
+	if !exited(ctx) {
+		t.Errorf("Expected a quick double Esc to exit")
+	}
+
+	// Other keys still exit right away
+	ctx, input = newInput()
+	input.handleKeyEvent(Event{Key: KeyCtrlC})
+	if !exited(ctx) {
+		t.Errorf("Expected C-c to exit")
+	}
+}
+
+func TestToggleNullSep(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	for _, l := range []string{"Alice\x00alice@example.com", "Bob\x00bob@example.com"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	input := ctx.NewInput()
+	first, _ := ctx.rawLineBuffer.LineAt(0)
+	ctx.config.StickySelection = true // kept while the query is run
+	ctx.SelectionAdd(0)
+
+	// Display strings, output of the selection, and the query result
+	expect := func(enabled bool, display, output, matched string) {
+		if ctx.nullSepOn() != enabled {
+			t.Errorf("Expected the null separator to be enabled: %t", enabled)
+		}
+		l, _ := ctx.rawLineBuffer.LineAt(0)
+		if l.ID() != first.ID() || l.DisplayString() != display {
+			t.Errorf("Expected line %d to be displayed as %q, got line %d displayed as %q", first.ID(), display, l.ID(), l.DisplayString())
+		}
+		selected := ctx.selection.GroupedLines()
+		if len(selected) != 1 || selected[0].Output() != output {
+			t.Errorf("Expected the selected line to print %q, got %v", output, selected)
+		}
+
+		select {
+		case q := <-ctx.QueryCh():
+			ctx.NewFilter().Work(make(chan struct{}), q)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the query to be executed again")
+		}
+		if !waitForLines(t, ctx, matched) {
+			t.Errorf("Expected the query to match %q", matched)
+		}
+	}
+
+	ctx.SetQuery([]rune("Bob"))
+	doToggleNullSep(input, Event{})
+	expect(true, "Alice", "alice@example.com", "Bob")
+
+	doToggleNullSep(input, Event{})
+	expect(false, "Alice�alice@example.com", "Alice\x00alice@example.com", "Bob�bob@example.com")
+}
+
+func TestToggleAnchored(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	defer ctx.Stop()
+	input := ctx.NewInput()
+	prompt := UserPrompt{Ctx: ctx}
+
+	// Only the Regexp filter is anchored
+	doToggleAnchored(input, Event{})
+	if ctx.IsAnchored() || strings.HasPrefix(prompt.resultCount(), "[anchored]") {
+		t.Errorf("Expected the %s filter not to be anchored", ctx.Filter())
+	}
+	if err := ctx.SetCurrentFilterByName(RegexpMatch); err != nil {
+		t.Fatalf("Failed to set filter: %s", err)
+	}
+	if !ctx.IsAnchored() || !strings.HasPrefix(prompt.resultCount(), "[anchored]") {
+		t.Errorf("Expected the anchored mode to be indicated, got '%s'", prompt.resultCount())
+	}
+
+	// Each of the terms has to match the whole line
+	rf := NewRegexpFilter()
+	rf.SetAnchored(true)
+	rf.SetQuery("foo.* .*bar")
+	for v, matched := range map[string]bool{
+		"foobar":       true,
+		"foo and bar":  true,
+		"a foobar":     false,
+		"foobar baz":   false,
+		"FOO AND BAR":  false,
+		"foo and bar.": false,
+	} {
+		l, err := rf.filter(NewRawLine(v, false))
+		switch {
+		case matched && err != nil:
+			t.Errorf("Expected '%s' to match: %s", v, err)
+		case !matched && err != ErrFilterDidNotMatch:
+			t.Errorf("Expected '%s' not to match", v)
+		case matched && !reflect.DeepEqual(l.Indices(), [][]int{{0, len(v)}}):
+			t.Errorf("Expected all of '%s' to be highlighted, got %v", v, l.Indices())
+		}
+	}
+
+	doToggleAnchored(input, Event{})
+	if ctx.IsAnchored() || strings.HasPrefix(prompt.resultCount(), "[anchored]") {
+		t.Errorf("Expected the anchored mode to be turned off")
+	}
+}
+
+func TestCompleteQuery(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	defer ctx.Stop()
+	input := ctx.NewInput()
+
+	// The lines that the query matched
+	show := func(lines ...string) {
+		b := NewRawLineBuffer()
+		for _, l := range lines {
+			b.Append(NewRawLine(l, false))
+		}
+		ctx.SetActiveLineBuffer(b)
+	}
+
+	ctx.SetQuery([]rune("hand"))
+	show("src/handler.go", "src/handler_test.go")
+	doCompleteQuery(input, Event{})
+	expectQueryString(t, ctx, "src/handler")
+	expectCaretPos(t, ctx, 11)
+	select {
+	case q := <-ctx.QueryCh():
+		if q.DataString() != "src/handler" {
+			t.Errorf("Expected the completed query to be executed, got '%s'", q.DataString())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the completed query to be executed")
+	}
+
+	// Nothing longer than the query in common, it is left alone
+	for _, lines := range [][]string{
+		{"src/handler.go", "lib/handler.go"},
+		{"handler.go", "hand.go"},
+		{},
+	} {
+		ctx.SetQuery([]rune("hand"))
+		show(lines...)
+		doCompleteQuery(input, Event{})
+		expectQueryString(t, ctx, "hand")
+		select {
+		case r := <-ctx.StatusMsgCh():
+			if msg := r.DataInterface().(StatusMsgRequest).message; msg != "No completion" {
+				t.Errorf("Expected no completion to be reported, got '%s'", msg)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected no completion to be reported for %v", lines)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package peco
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// columnGap is the number of spaces that separate aligned columns
+const columnGap = 2
+
+// ColumnAligner pads the columns of tabular lines to the width of the
+// widest cell in each column, so that the columns line up (--align).
+// It only changes how lines are displayed: queries are matched
+// against, and lines are output with, the original text
+type ColumnAligner struct {
+	mutex      sync.Locker // protects widths and generation
+	delimiter  *regexp.Regexp
+	widths     []int // width of the widest cell, per column
+	generation int   // incremented whenever widths change
+}
+
+// NewColumnAligner creates a ColumnAligner that splits lines into
+// columns with the given delimiter
+func NewColumnAligner(delimiter *regexp.Regexp) *ColumnAligner {
+	return &ColumnAligner{
+		mutex:     newMutex(),
+		delimiter: delimiter,
+	}
+}
+
+// Add takes the width of the columns of `s` into account. The last
+// column is never padded, so its width is ignored
+func (ca *ColumnAligner) Add(s string) {
+	cells := ca.delimiter.Split(s, -1)
+
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	changed := false
+	for i, cell := range cells[:len(cells)-1] {
+		w := runewidth.StringWidth(cell)
+		if i >= len(ca.widths) {
+			ca.widths = append(ca.widths, w)
+			changed = true
+		} else if w > ca.widths[i] {
+			ca.widths[i] = w
+			changed = true
+		}
+	}
+	if changed {
+		ca.generation++
+	}
+}
+
+// Reset forgets the widths of all of the columns
+func (ca *ColumnAligner) Reset() {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	ca.widths = nil
+	ca.generation++
+}
+
+// Generation returns a number that changes whenever the width of
+// the columns changes, which means that lines must be redrawn
+func (ca *ColumnAligner) Generation() int {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	return ca.generation
+}
+
+// Align returns `s` with its delimiters replaced by the padding that
+// lines up its columns, along with `matches` (byte offsets into `s`)
+// translated into offsets into the returned string
+func (ca *ColumnAligner) Align(s string, matches [][]int) (string, [][]int) {
+	locs := ca.delimiter.FindAllStringIndex(s, -1)
+	if len(locs) == 0 {
+		return s, matches
+	}
+
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	// pos[i] is the offset of s[i] in the result. The delimiters
+	// map to the end of the cell before them
+	pos := make([]int, len(s)+1)
+	buf := make([]byte, 0, len(s)+len(locs)*columnGap)
+	start := 0
+	for col, loc := range locs {
+		for i := start; i < loc[0]; i++ {
+			pos[i] = len(buf) + i - start
+		}
+		cell := s[start:loc[0]]
+		buf = append(buf, cell...)
+		for i := loc[0]; i < loc[1]; i++ {
+			pos[i] = len(buf)
+		}
+
+		pad := columnGap
+		if col < len(ca.widths) {
+			if w := ca.widths[col] - runewidth.StringWidth(cell); w > 0 {
+				pad += w
+			}
+		}
+		buf = append(buf, strings.Repeat(" ", pad)...)
+		start = loc[1]
+	}
+	for i := start; i <= len(s); i++ {
+		pos[i] = len(buf) + i - start
+	}
+	buf = append(buf, s[start:]...)
+
+	if matches == nil {
+		return string(buf), nil
+	}
+	aligned := make([][]int, len(matches))
+	for i, m := range matches {
+		aligned[i] = []int{pos[m[0]], pos[m[1]]}
+	}
+	return string(buf), aligned
+}
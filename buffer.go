@@ -3,12 +3,33 @@ package peco
 import (
 	"errors"
 	"runtime"
+	"sort"
+	"sync"
 )
 
 // ErrBufferOutOfRange is returned when the index within the buffer that
 // was queried was out of the containing buffer's range
 var ErrBufferOutOfRange = errors.New("error: Specified index is out of range")
 
+// ErrBufferFull is returned when a line could not be added to the
+// buffer, because the buffer is full and its BufferPolicy is to keep
+// the first lines that were read
+var ErrBufferFull = errors.New("error: Buffer is full")
+
+// These are the policies that control which lines are kept when
+// the number of lines exceed the capacity of a RawLineBuffer
+const (
+	// BufferPolicyHead keeps the first N lines
+	BufferPolicyHead = "head"
+	// BufferPolicyTail keeps the last N lines
+	BufferPolicyTail = "tail"
+)
+
+// IsValidBufferPolicy checks if a string is a supported buffer policy
+func IsValidBufferPolicy(v string) bool {
+	return v == BufferPolicyHead || v == BufferPolicyTail
+}
+
 type Pipeliner interface {
 	Pipeline() (chan struct{}, chan Line)
 }
@@ -71,6 +92,12 @@ type LineBuffer interface {
 	LineAt(int) (Line, error)
 	Size() int
 
+	// Snapshot returns the lines in this buffer at the time of the
+	// call. The returned slice is never modified by the buffer, so
+	// it can be walked without further locking, even if the buffer
+	// changes in the mean time
+	Snapshot() []Line
+
 	// Register registers another LineBuffer that is dependent on
 	// this buffer.
 	Register(LineBuffer)
@@ -115,33 +142,42 @@ func (buffers dependentBuffers) InvalidateUpTo(i int) {
 type RawLineBuffer struct {
 	simplePipeline
 	buffers  dependentBuffers
+	mutex    sync.Locker // protects lines, window, and total
 	lines    []Line
-	capacity int // max number of lines. 0 means unlimited
+	window   []Line // lines, plus lines that fell off (BufferPolicyTail)
+	total    int    // number of lines ever appended
+	capacity int    // max number of lines. 0 means unlimited
+	policy   string // BufferPolicyHead or BufferPolicyTail
 	onEnd    func()
 }
 
 func NewRawLineBuffer() *RawLineBuffer {
 	return &RawLineBuffer{
 		simplePipeline: simplePipeline{},
+		mutex:          newMutex(),
 		lines:          []Line{},
 		capacity:       0,
+		policy:         BufferPolicyTail,
 	}
 }
 
 func (rlb *RawLineBuffer) Replay() error {
-	rlb.outputCh = make(chan Line)
+	// The channels are captured here, as the buffer may be replayed
+	// again before this goroutine is done
+	outputCh, cancelCh := make(chan Line), rlb.cancelCh
+	rlb.outputCh = outputCh
 	go func() {
 		replayed := 0
 		trace("RawLineBuffer.Replay (goroutine): START")
 		defer func() { trace("RawLineBuffer.Replay (goroutine): END (Replayed %d lines)", replayed) }()
 
 		defer func() { recover() }() // It's okay if we fail to replay
-		defer close(rlb.outputCh)
-		for _, l := range rlb.lines {
+		defer close(outputCh)
+		for _, l := range rlb.Snapshot() {
 			select {
-			case rlb.outputCh <- l:
+			case outputCh <- l:
 				replayed++
-			case <-rlb.cancelCh:
+			case <-cancelCh:
 				return
 			}
 		}
@@ -159,13 +195,40 @@ func (rlb *RawLineBuffer) Accept(p Pipeliner) {
 
 func (rlb *RawLineBuffer) Append(l Line) (Line, error) {
 	trace("RawLineBuffer.Append: %s", l.DisplayString())
-	if rlb.capacity > 0 && len(rlb.lines) > rlb.capacity {
-		diff := len(rlb.lines) - rlb.capacity
 
-		// Golang's version of array realloc
-		rlb.lines = rlb.lines[diff:rlb.capacity:rlb.capacity]
-	} else {
+	// Existing elements in rlb.lines are never modified in place,
+	// we only ever swap the slice. This is what allows Snapshot()
+	// to hand out rlb.lines without copying
+	rlb.mutex.Lock()
+	defer rlb.mutex.Unlock()
+
+	rlb.total++
+	switch {
+	case rlb.capacity <= 0:
 		rlb.lines = append(rlb.lines, l)
+	case rlb.policy == BufferPolicyHead:
+		if len(rlb.lines) >= rlb.capacity {
+			return nil, ErrBufferFull
+		}
+		rlb.lines = append(rlb.lines, l)
+	default:
+		// We keep appending to window, and only show the last
+		// `capacity` lines from it. Once window grows to twice the
+		// capacity, the lines we show are copied over to a fresh
+		// window. This way we only copy once every `capacity` lines,
+		// and we never overwrite lines that a snapshot may refer to
+		if len(rlb.window) >= 2*rlb.capacity {
+			window := make([]Line, rlb.capacity, 2*rlb.capacity)
+			copy(window, rlb.window[len(rlb.window)-rlb.capacity:])
+			rlb.window = window
+		}
+		rlb.window = append(rlb.window, l)
+
+		start := len(rlb.window) - rlb.capacity
+		if start < 0 {
+			start = 0
+		}
+		rlb.lines = rlb.window[start:]
 	}
 
 	return l, nil
@@ -180,16 +243,64 @@ func (rlb *RawLineBuffer) Unregister(lb LineBuffer) {
 }
 
 // LineAt returns the line at index `i`
-func (rlb RawLineBuffer) LineAt(i int) (Line, error) {
-	if i < 0 || len(rlb.lines) <= i {
+func (rlb *RawLineBuffer) LineAt(i int) (Line, error) {
+	lines := rlb.Snapshot()
+	if i < 0 || len(lines) <= i {
 		return nil, ErrBufferOutOfRange
 	}
-	return rlb.lines[i], nil
+	return lines[i], nil
 }
 
 // Size returns the number of lines in the buffer
-func (rlb RawLineBuffer) Size() int {
-	return len(rlb.lines)
+func (rlb *RawLineBuffer) Size() int {
+	return len(rlb.Snapshot())
+}
+
+// Snapshot returns the lines in the buffer
+func (rlb *RawLineBuffer) Snapshot() []Line {
+	rlb.mutex.Lock()
+	defer rlb.mutex.Unlock()
+
+	// Cap the capacity, so that appending to the result doesn't
+	// clobber what we append to rlb.lines later
+	return rlb.lines[:len(rlb.lines):len(rlb.lines)]
+}
+
+// Reset discards all of the lines in the buffer
+func (rlb *RawLineBuffer) Reset() {
+	rlb.mutex.Lock()
+	defer rlb.mutex.Unlock()
+
+	rlb.lines = []Line{}
+	rlb.window = nil
+	rlb.total = 0
+}
+
+// Map replaces each of the lines in the buffer with what `f` returns
+// for it. Like Append, it replaces rlb.lines with a new slice instead
+// of modifying it, so snapshots taken earlier are left alone
+func (rlb *RawLineBuffer) Map(f func(Line) Line) {
+	rlb.mutex.Lock()
+	defer rlb.mutex.Unlock()
+
+	lines := make([]Line, len(rlb.lines))
+	for i, l := range rlb.lines {
+		lines[i] = f(l)
+	}
+	rlb.lines = lines
+	if rlb.window != nil {
+		rlb.window = lines
+	}
+}
+
+// IndexOf returns the index of the line whose ID is `id`, or -1
+func (rlb *RawLineBuffer) IndexOf(id uint64) int {
+	for i, l := range rlb.Snapshot() {
+		if l.ID() == id {
+			return i
+		}
+	}
+	return -1
 }
 
 func (rlb *RawLineBuffer) SetCapacity(capacity int) {
@@ -199,7 +310,32 @@ func (rlb *RawLineBuffer) SetCapacity(capacity int) {
 	rlb.capacity = capacity
 }
 
-func (rlb RawLineBuffer) InvalidateUpTo(_ int) {
+// SetPolicy sets which lines are kept when the buffer is full.
+// Unknown policies are ignored
+func (rlb *RawLineBuffer) SetPolicy(policy string) {
+	if !IsValidBufferPolicy(policy) {
+		return
+	}
+	rlb.policy = policy
+}
+
+// IsTruncated returns true if some of the lines appended to this
+// buffer were discarded because the buffer was full
+func (rlb *RawLineBuffer) IsTruncated() bool {
+	rlb.mutex.Lock()
+	defer rlb.mutex.Unlock()
+	return rlb.total > len(rlb.lines)
+}
+
+// Total returns the number of lines ever appended to this buffer,
+// including those that were discarded
+func (rlb *RawLineBuffer) Total() int {
+	rlb.mutex.Lock()
+	defer rlb.mutex.Unlock()
+	return rlb.total
+}
+
+func (rlb *RawLineBuffer) InvalidateUpTo(_ int) {
 	// no op
 }
 
@@ -278,6 +414,19 @@ func (flb FilteredLineBuffer) Size() int {
 	return len(flb.selection)
 }
 
+// Snapshot returns the lines in this buffer, as a new slice
+func (flb FilteredLineBuffer) Snapshot() []Line {
+	src := flb.src.Snapshot()
+	lines := make([]Line, 0, len(flb.selection))
+	for _, i := range flb.selection {
+		if i < 0 || i >= len(src) {
+			continue
+		}
+		lines = append(lines, src[i])
+	}
+	return lines
+}
+
 func (flb *FilteredLineBuffer) SelectSourceLineAt(i int) {
 	flb.selection = append(flb.selection, i)
 }
@@ -289,3 +438,239 @@ func (flb *FilteredLineBuffer) Register(lb LineBuffer) {
 func (flb *FilteredLineBuffer) Unregister(lb LineBuffer) {
 	flb.buffers.Unregister(lb)
 }
+
+// UniqueLineBuffer holds the lines of another buffer, except for the
+// lines whose output is the same as that of the line right before
+// them (like uniq(1)). It is a snapshot: lines added to the source
+// buffer afterwards are not reflected
+type UniqueLineBuffer struct {
+	simplePipeline
+	buffers dependentBuffers
+	lines   []Line
+}
+
+// NewUniqueLineBuffer creates a UniqueLineBuffer from the lines that
+// are in `src` at the moment
+func NewUniqueLineBuffer(src LineBuffer) *UniqueLineBuffer {
+	return (&UniqueLineBuffer{}).extend(src.Snapshot(), nil)
+}
+
+// extend returns a new UniqueLineBuffer that holds the lines of this
+// one, followed by `lines`. `prev` is the line of the source buffer
+// right before `lines`, if any. The lines of this buffer are shared
+// rather than copied, and it stays the same
+func (ulb *UniqueLineBuffer) extend(lines []Line, prev Line) *UniqueLineBuffer {
+	nlb := &UniqueLineBuffer{lines: ulb.lines[:len(ulb.lines):len(ulb.lines)]}
+	for _, l := range lines {
+		if prev == nil || prev.Output() != l.Output() {
+			nlb.lines = append(nlb.lines, l)
+		}
+		prev = l
+	}
+	return nlb
+}
+
+// LineAt returns the line at index `i`
+func (ulb UniqueLineBuffer) LineAt(i int) (Line, error) {
+	if i < 0 || i >= len(ulb.lines) {
+		return nil, ErrBufferOutOfRange
+	}
+	return ulb.lines[i], nil
+}
+
+// Size returns the number of lines in the buffer
+func (ulb UniqueLineBuffer) Size() int {
+	return len(ulb.lines)
+}
+
+// Snapshot returns the lines in this buffer. The buffer never
+// changes, so the lines are returned as they are
+func (ulb UniqueLineBuffer) Snapshot() []Line {
+	return ulb.lines
+}
+
+func (ulb *UniqueLineBuffer) Register(lb LineBuffer) {
+	ulb.buffers.Register(lb)
+}
+
+func (ulb *UniqueLineBuffer) Unregister(lb LineBuffer) {
+	ulb.buffers.Unregister(lb)
+}
+
+// InvalidateUpTo is a noop, as UniqueLineBuffer is a snapshot
+func (ulb UniqueLineBuffer) InvalidateUpTo(_ int) {
+}
+
+// uniqueView keeps the UniqueLineBuffer for the current buffer, so
+// that it is only rebuilt when the current buffer changes
+type uniqueView struct {
+	mutex sync.Locker
+	src   LineBuffer
+	size  int
+	last  Line
+	buf   *UniqueLineBuffer
+}
+
+func newUniqueView() *uniqueView {
+	return &uniqueView{mutex: newMutex()}
+}
+
+// Get returns the UniqueLineBuffer for `src`. If lines were only
+// appended to `src` since the last call, as they are while the input
+// is read or the query is run, only those lines are looked at
+func (u *uniqueView) Get(src LineBuffer) LineBuffer {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	size := src.Size()
+	last, _ := src.LineAt(size - 1)
+	if u.buf != nil && u.src == src && u.size == size && u.last == last {
+		return u.buf
+	}
+
+	// Unless lines were only appended, the buffer is built again
+	var prev Line
+	base, from := &UniqueLineBuffer{}, 0
+	if l, _ := src.LineAt(u.size - 1); u.buf != nil && u.src == src && u.size < size && l != nil && l == u.last {
+		base, from, prev = u.buf, u.size, u.last
+	}
+
+	added := make([]Line, 0, size-from)
+	for i := from; i < size; i++ {
+		l, err := src.LineAt(i)
+		if err != nil {
+			break
+		}
+		added = append(added, l)
+	}
+	u.buf = base.extend(added, prev)
+	u.src, u.size, u.last = src, size, last
+	return u.buf
+}
+
+// lineOrder keeps the order that the lines were put in with
+// peco.MoveLineUp and peco.MoveLineDown. The lines are left where they
+// are in their buffers: instead, each line has a position, which is
+// its ID unless it was moved. IDs grow in the order that the lines are
+// read, so the lines that were never moved keep that order
+type lineOrder struct {
+	mutex sync.Locker
+	pos   map[uint64]uint64 // the position of the lines that were moved, by ID
+	gen   int               // incremented whenever lines are moved
+}
+
+func newLineOrder() *lineOrder {
+	return &lineOrder{mutex: newMutex(), pos: map[uint64]uint64{}}
+}
+
+// Position returns the position of `l`
+func (o *lineOrder) Position(l Line) uint64 {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.position(l.ID())
+}
+
+func (o *lineOrder) position(id uint64) uint64 {
+	if p, ok := o.pos[id]; ok {
+		return p
+	}
+	return id
+}
+
+// Swap swaps the positions of `a` and `b`
+func (o *lineOrder) Swap(a, b Line) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	pa, pb := o.position(a.ID()), o.position(b.ID())
+	o.pos[a.ID()], o.pos[b.ID()] = pb, pa
+	o.gen++
+}
+
+// Reset puts all of the lines back in the order they were read
+func (o *lineOrder) Reset() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.pos = map[uint64]uint64{}
+	o.gen++
+}
+
+// Generation returns a number that changes whenever lines are moved
+func (o *lineOrder) Generation() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.gen
+}
+
+// IsModified returns true if any line is not at its original position
+func (o *lineOrder) IsModified() bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return len(o.pos) > 0
+}
+
+// Sorted returns `lines` sorted by their position. `lines` itself is
+// left alone, as it is usually a snapshot of a buffer
+func (o *lineOrder) Sorted(lines []Line) []Line {
+	if !o.IsModified() {
+		return lines
+	}
+
+	sorted := append([]Line(nil), lines...)
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	sort.Stable(byPosition{sorted, o})
+	return sorted
+}
+
+// byPosition sorts lines by their position in a lineOrder. The
+// lineOrder must be locked while sorting
+type byPosition struct {
+	lines []Line
+	order *lineOrder
+}
+
+func (p byPosition) Len() int      { return len(p.lines) }
+func (p byPosition) Swap(i, j int) { p.lines[i], p.lines[j] = p.lines[j], p.lines[i] }
+func (p byPosition) Less(i, j int) bool {
+	return p.order.position(p.lines[i].ID()) < p.order.position(p.lines[j].ID())
+}
+
+// orderedView keeps the current buffer sorted by lineOrder, so that
+// it is only sorted again when the current buffer or the order changes
+type orderedView struct {
+	mutex sync.Locker
+	src   LineBuffer
+	size  int
+	last  Line
+	gen   int
+	buf   *RawLineBuffer
+}
+
+func newOrderedView() *orderedView {
+	return &orderedView{mutex: newMutex()}
+}
+
+// Get returns the lines of `src` sorted by `order`. If no line was
+// moved, `src` itself is returned
+func (v *orderedView) Get(src LineBuffer, order *lineOrder) LineBuffer {
+	if !order.IsModified() {
+		return src
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	size := src.Size()
+	last, _ := src.LineAt(size - 1)
+	gen := order.Generation()
+	if v.buf == nil || v.src != src || v.size != size || v.last != last || v.gen != gen {
+		v.src, v.size, v.last, v.gen = src, size, last, gen
+		v.buf = NewRawLineBuffer()
+		for _, l := range order.Sorted(src.Snapshot()) {
+			v.buf.Append(l)
+		}
+	}
+	return v.buf
+}
@@ -1,6 +1,9 @@
 package peco
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestBuffer(t *testing.T) {
 	rawbuf := NewRawLineBuffer()
@@ -109,3 +112,169 @@ func TestBufferPaging(t *testing.T) {
 		}
 	}
 }
+
+func TestBufferSnapshot(t *testing.T) {
+	rawbuf := NewRawLineBuffer()
+	for _, l := range []string{"Alice", "Bob", "Charlie"} {
+		rawbuf.AppendLine(NewRawLine(l, false))
+	}
+
+	snapshot := rawbuf.Snapshot()
+	rawbuf.AppendLine(NewRawLine("David", false))
+	if len(snapshot) != 3 {
+		t.Errorf("Expected snapshot to keep 3 lines, got %d", len(snapshot))
+	}
+
+	// Appending to the snapshot must not affect the buffer
+	snapshot = append(snapshot, NewRawLine("Eve", false))
+	if l, _ := rawbuf.LineAt(3); l.DisplayString() != "David" {
+		t.Errorf("Expected line 3 to be 'David', got '%s'", l.DisplayString())
+	}
+
+	pc := PageCrop{perPage: 2, currentPage: 2}
+	paged := pc.Crop(rawbuf).Snapshot()
+	if len(paged) != 2 {
+		t.Fatalf("Expected 2 lines in page, got %d", len(paged))
+	}
+	for i, v := range []string{"Charlie", "David"} {
+		if paged[i].DisplayString() != v {
+			t.Errorf("Expected line %d to be '%s', got '%s'", i, v, paged[i].DisplayString())
+		}
+	}
+}
+
+func TestBufferPolicy(t *testing.T) {
+	names := []string{"Alice", "Bob", "Charlie", "David", "Eve", "Frank", "Grace"}
+
+	rawbuf := NewRawLineBuffer()
+	rawbuf.SetCapacity(3)
+	rawbuf.SetPolicy(BufferPolicyHead)
+	for i, v := range names {
+		_, err := rawbuf.AppendLine(NewRawLine(v, false))
+		if i < 3 && err != nil {
+			t.Errorf("Expected line %d to be appended, got %s", i, err)
+		} else if i >= 3 && err != ErrBufferFull {
+			t.Errorf("Expected line %d to be rejected, got %v", i, err)
+		}
+	}
+	checkLines(t, rawbuf, names[:3])
+
+	rawbuf = NewRawLineBuffer()
+	rawbuf.SetCapacity(3)
+	var snapshots [][]Line
+	for _, v := range names {
+		rawbuf.AppendLine(NewRawLine(v, false))
+		snapshots = append(snapshots, rawbuf.Snapshot())
+	}
+	checkLines(t, rawbuf, names[4:])
+
+	// Lines that fell off the buffer must not affect older snapshots
+	for i, snapshot := range snapshots {
+		start := i + 1 - 3
+		if start < 0 {
+			start = 0
+		}
+		for j, l := range snapshot {
+			if l.DisplayString() != names[start+j] {
+				t.Errorf("Expected line %d of snapshot %d to be '%s', got '%s'", j, i, names[start+j], l.DisplayString())
+			}
+		}
+	}
+
+	if !rawbuf.IsTruncated() {
+		t.Errorf("Expected buffer to be truncated")
+	}
+	if rawbuf.Total() != len(names) {
+		t.Errorf("Expected %d lines in total, got %d", len(names), rawbuf.Total())
+	}
+}
+
+func TestApproximateCount(t *testing.T) {
+	expected := map[int]string{
+		999:     "999",
+		1000:    "1k",
+		130001:  "130k+",
+		2500000: "2M+",
+	}
+	for n, v := range expected {
+		if s := approximateCount(n); s != v {
+			t.Errorf("Expected %d to be formatted as '%s', got '%s'", n, v, s)
+		}
+	}
+}
+
+func checkLines(t *testing.T, lb LineBuffer, expected []string) {
+	lines := lb.Snapshot()
+	if len(lines) != len(expected) {
+		t.Errorf("Expected %d lines, got %d", len(expected), len(lines))
+		return
+	}
+	for i, v := range expected {
+		if lines[i].DisplayString() != v {
+			t.Errorf("Expected line %d to be '%s', got '%s'", i, v, lines[i].DisplayString())
+		}
+	}
+}
+
+func BenchmarkSelectAll(b *testing.B) {
+	ctx := NewCtx(nil)
+	for i := 0; i < 1000000; i++ {
+		ctx.AddRawLine(NewRawLine("Hello, World!", false))
+	}
+	input := ctx.NewInput()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx.SelectionClear()
+		doSelectAll(input, Event{})
+	}
+}
+
+func TestUniqueLineBuffer(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	for _, v := range []string{"a", "a", "b", "a", "c\x00x", "d\x00x", "e"} {
+		ctx.AddRawLine(NewRawLine(v, true))
+	}
+
+	// Only consecutive duplicates are hidden, based on the output
+	ctx.currentLine = 5 // "d", which has the same output as "c"
+	ctx.ToggleHideDuplicates()
+	expected := []string{"a", "b", "a", "c", "e"}
+	lines := ctx.GetCurrentLineBuffer().Snapshot()
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %d", len(expected), len(lines))
+	}
+	for i, l := range lines {
+		if l.DisplayString() != expected[i] {
+			t.Errorf("Expected line %d to be '%s', got '%s'", i, expected[i], l.DisplayString())
+		}
+	}
+	if ctx.currentLine != 3 {
+		t.Errorf("Expected cursor to move to the line that hides 'd', got %d", ctx.currentLine)
+	}
+
+	// Lines that are added are picked up, without changing the buffer
+	// that was returned before
+	before := ctx.GetCurrentLineBuffer()
+	ctx.AddRawLine(NewRawLine("e", true))
+	ctx.AddRawLine(NewRawLine("f", true))
+	after := ctx.GetCurrentLineBuffer()
+	if n := after.Size(); n != 6 {
+		t.Errorf("Expected 6 lines after adding lines, got %d", n)
+	}
+	if n := before.Size(); n != 5 {
+		t.Errorf("Expected the previous buffer to keep 5 lines, got %d", n)
+	}
+	if !reflect.DeepEqual(after.Snapshot(), NewUniqueLineBuffer(ctx.rawLineBuffer).Snapshot()) {
+		t.Errorf("Expected the lines added to be the same as if the buffer was built again")
+	}
+
+	ctx.currentLine = 4
+	ctx.ToggleHideDuplicates()
+	if n := ctx.GetCurrentLineBuffer().Size(); n != 9 {
+		t.Errorf("Expected all 9 lines to be shown again, got %d", n)
+	}
+	if ctx.currentLine != 6 {
+		t.Errorf("Expected cursor to stay on the first 'e', got %d", ctx.currentLine)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 /* This script exists because godep deprecated -copy=false, and I really
@@ -24,6 +26,7 @@ var deps = map[string]string{
 	"github.com/mattn/go-runewidth": "58a0da4ed7b321c9b5dfeffb7e03ee188fae1c60",
 	"github.com/nsf/termbox-go":     "10f14d7408b64a659b7c694a771f5006952d336c",
 	"github.com/google/btree":       "0c05920fc3d98100a5e3f7fd339865a6e2aaa671",
+	"golang.org/x/text":             "f21a4dfb5e38f5895301dc265a8def02365cc3d0",
 }
 
 func init() {
@@ -89,10 +92,29 @@ func setupDeps() {
 }
 
 func buildBinaries() {
+	wd := "/work/src/github.com/peco/peco"
+
+	// The commit and the date are printed by peco --version. The
+	// commit is left as "unknown" outside of a git checkout
+	commit := "unknown"
+	cmd := exec.Command("git", "rev-parse", "--short", "HEAD")
+	cmd.Dir = wd
+	if out, err := cmd.Output(); err == nil {
+		commit = strings.TrimSpace(string(out))
+	} else {
+		log.Printf("failed to find the git commit: %s", err)
+	}
+	ldflags := fmt.Sprintf(
+		"-X github.com/peco/peco.commit=%s -X github.com/peco/peco.buildDate=%s",
+		commit,
+		time.Now().UTC().Format("2006-01-02"),
+	)
+
 	goxcArgs := []string{
 		"-tasks", "xc archive",
 		"-bc", "linux windows darwin",
-		"-wd", "/work/src/github.com/peco/peco",
+		"-wd", wd,
+		"-build-ldflags", ldflags,
 		"-d", os.Args[2],
 		"-resources-include", "README*,Changes",
 		"-main-dirs-exclude", "_demos,examples,build",
@@ -117,5 +139,9 @@ func run(name string, args ...string) error {
 }
 
 func repoURL(spec string) string {
+	// The golang.org/x packages are hosted elsewhere
+	if strings.HasPrefix(spec, "golang.org/x/") {
+		return "https://go.googlesource.com/" + strings.TrimPrefix(spec, "golang.org/x/")
+	}
 	return "https://" + spec + ".git"
 }
@@ -2,26 +2,73 @@ package peco
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"reflect"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/jessevdk/go-flags"
-	"github.com/nsf/termbox-go"
 )
 
+// rcfileWarningDelay is how long the warning about a malformed
+// config file is shown
+const rcfileWarningDelay = 5 * time.Second
+
 type CLIOptions struct {
 	OptHelp           bool   `short:"h" long:"help" description:"show this help message and exit"`
 	OptTTY            string `long:"tty" description:"path to the TTY (usually, the value of $TTY)"`
 	OptQuery          string `long:"query" description:"initial value for query"`
+	OptQueryFile      string `long:"query-file" description:"read the initial value for query from the first line of the given file"`
+	OptSaveQueryFile  string `long:"save-query-file" description:"write the query to the given file on exit"`
 	OptRcfile         string `long:"rcfile" description:"path to the settings file"`
+	OptIgnoreRcErrors bool   `long:"ignore-rcfile-errors" description:"use the default settings if the settings file is malformed"`
 	OptVersion        bool   `long:"version" description:"print the version and exit"`
 	OptBufferSize     int    `long:"buffer-size" short:"b" description:"number of lines to keep in search buffer"`
+	OptBufferPolicy   string `long:"buffer-policy" description:"lines to keep when the buffer is full: 'tail' (default) or 'head'" default:"tail"`
 	OptEnableNullSep  bool   `long:"null" description:"expect NUL (\\0) as separator for target/output"`
+	OptOutputAll      bool   `long:"output-all-fields" description:"with --null, also print the fields after the output, separated by NUL"`
 	OptInitialIndex   int    `long:"initial-index" description:"position of the initial index of the selection (0 base)"`
 	OptInitialMatcher string `long:"initial-matcher" description:"specify the default matcher (deprecated)"`
 	OptInitialFilter  string `long:"initial-filter" description:"specify the default filter"`
 	OptPrompt         string `long:"prompt" description:"specify the prompt string"`
-	OptLayout         string `long:"layout" description:"layout to be used 'top-down' (default) or 'bottom-up'" default:"top-down"`
+	OptMinHeight      int    `long:"min-height" description:"minimum number of lines in the list, peco exits if the terminal is smaller (default: 1)"`
+	OptLayout         string `long:"layout" description:"layout to be used 'top-down' (default), 'bottom-up', 'centered', or 'top-down-prompt-bottom'" default:"top-down"`
+	OptDebugLog       string `long:"debug-log" description:"write trace logs to the given file (also via $PECO_DEBUG_LOG)"`
+	OptPrintKeymap    bool   `long:"print-keymap" description:"print the effective key bindings and exit"`
+	OptDumpConfig     bool   `long:"dump-config" description:"print the effective configuration as JSON and exit"`
+	OptPrintQuery     bool   `long:"print-query-on-no-match" description:"print the query if no lines match when accepting"`
+	OptPrintSource    bool   `long:"print-source" description:"prefix each line with the name of the file it was read from"`
+	OptOutputFile     string `long:"output-file" description:"write the selected lines to the given file instead of stdout"`
+	OptOutputFd       int    `long:"output-fd" description:"write the selected lines to the given file descriptor instead of stdout" default:"-1"`
+	OptEncoding       string `long:"encoding" description:"encoding of the input and output, e.g. 'SHIFT_JIS' (default: UTF-8)"`
+	OptStartupTimeout int    `long:"startup-timeout" description:"seconds to wait for the first line of input (default: 0, wait forever)"`
+	OptAllowEmpty     bool   `long:"allow-empty" description:"start even if no input was received (see --startup-timeout)"`
+	OptExitOnEmpty    bool   `long:"exit-on-empty" description:"exit right away if the input is empty"`
+	OptEmptyExitCode  int    `long:"empty-exit-code" description:"exit status used by --exit-on-empty (default: 1)" default:"1"`
+	OptUnique         bool   `long:"unique" description:"drop lines whose output was already read"`
+	OptUniqueOutput   bool   `long:"unique-output" description:"print each of the selected lines only once, even if several have the same output"`
+	OptTrim           bool   `long:"trim" description:"remove leading and trailing whitespace from the lines read"`
+	OptTrimDisplay    bool   `long:"trim-display" description:"remove leading and trailing whitespace from the lines displayed, but print them as read"`
+	OptMaxSelect      int    `long:"max-select" description:"maximum number of lines that can be selected (default: 0, no limit)"`
+	OptSelectMarker   string `long:"select-marker" description:"select the lines that start with the given string, and remove it"`
+	OptPrintMarker    bool   `long:"print-with-marker" description:"print all of the lines, with the selected ones prefixed by --select-marker"`
+	OptSelectionOrder string `long:"selection-order" description:"order of the selected lines in the output: 'buffer' (default) or 'pick'" default:"buffer"`
+	OptCursorOnly     bool   `long:"select-cursor-only" description:"accept the line under the cursor only, even if other lines are selected"`
+	OptSource         string `long:"source" description:"run the given command via the shell, and read its output"`
+	OptTee            string `long:"tee" description:"write the input to the given file as it is read"`
+	OptProfile        bool   `long:"profile" description:"print statistics about the filtering to stderr on exit"`
+	OptDelimiter      string `long:"delimiter" description:"regexp that separates the fields of a line (default: whitespace)"`
+	OptDisplayFields  string `long:"display-fields" description:"comma separated list of fields to display and match, e.g. '1,2,5'"`
+	OptOutputField    int    `long:"output-field" description:"field to print when a line is accepted"`
+	OptAlign          bool   `long:"align" description:"line up the columns of the lines, split by --delimiter (default: tab)"`
+	OptFormat         string `long:"format" description:"text/template used to display the lines, e.g. '{{index .Fields 1}} ({{index .Fields 0}})'"`
+	OptCycle          bool   `long:"cycle" description:"move the cursor from the last line to the first, and back (the default, unless CycleCursor is false)"`
+	OptMaxLineLength  int    `long:"max-line-length" description:"cut the lines read down to the given number of bytes, which are all that is displayed and printed"`
+	OptFullOutput     bool   `long:"full-output" description:"with --max-line-length, keep the lines in their entirety to print them"`
 }
 
 func showHelp() {
@@ -29,7 +76,7 @@ func showHelp() {
 	// because I wanted to tweak the format just a bit... but
 	// there wasn't an easy way to do so
 	os.Stderr.WriteString(`
-Usage: peco [options] [FILE]
+Usage: peco [options] [FILE...]
 
 Options:
 `)
@@ -54,11 +101,79 @@ Options:
 	}
 }
 
+// printVersion prints the version of peco and how it was built, as
+// well as the settings file that is read, if any (--version)
+func printVersion(w io.Writer, v VersionInfo, rcfile string) error {
+	if rcfile == "" {
+		rcfile = "none"
+	}
+	_, err := fmt.Fprintf(w, "version:    %s\ncommit:     %s\nbuild date: %s\ngo version: %s\nplatform:   %s\nrcfile:     %s\n",
+		v.Version, v.Commit, v.BuildDate, v.GoVersion, v.Platform, rcfile)
+	return err
+}
+
+// printResults prints the lines from `ch` to `w`, one per line. If
+// `unique` is true, lines whose output was already printed are skipped.
+// If `allFields` is true, the extra fields of the lines are printed
+// after their output, separated by NUL. Returns the first error
+// writing to `w`, after which nothing more is written
+func printResults(w io.Writer, ch <-chan Line, unique, allFields bool) error {
+	seen := map[string]struct{}{}
+	for match := range ch {
+		line := match.Output()
+		if allFields {
+			for _, f := range match.ExtraFields() {
+				line += "\000" + f
+			}
+		}
+		if unique {
+			if _, ok := seen[line]; ok {
+				continue
+			}
+			seen[line] = struct{}{}
+		}
+		if len(line) == 0 || line[len(line)-1] != '\n' {
+			line = line + "\n"
+		}
+		if _, err := fmt.Fprint(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printWithMarker prints all of `lines` to `w` as they were read, one
+// per line, with `marker` in front of those that were selected (the
+// lines from `ch`). The output can be read back with --select-marker.
+// Returns the first error writing to `w`
+func printWithMarker(w io.Writer, lines []Line, ch <-chan Line, marker string) error {
+	selected := map[uint64]bool{}
+	for l := range ch {
+		selected[l.ID()] = true
+	}
+
+	for _, l := range lines {
+		line := l.Buffer()
+		if selected[l.ID()] {
+			line = marker + line
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // BufferSize returns the specified buffer size. Fulfills CtxOptions
 func (o CLIOptions) BufferSize() int {
 	return o.OptBufferSize
 }
 
+// BufferPolicy returns the specified buffer policy. Fulfills CtxOptions
+func (o CLIOptions) BufferPolicy() string {
+	return o.OptBufferPolicy
+}
+
 // EnableNullSep returns true if --null was specified. Fulfills CtxOptions
 func (o CLIOptions) EnableNullSep() bool {
 	return o.OptEnableNullSep
@@ -72,6 +187,147 @@ func (o CLIOptions) LayoutType() string {
 	return o.OptLayout
 }
 
+// PrintQueryOnNoMatch returns true if --print-query-on-no-match was
+// specified. Fulfills CtxOptions
+func (o CLIOptions) PrintQueryOnNoMatch() bool {
+	return o.OptPrintQuery
+}
+
+// Unique returns true if --unique was specified. Fulfills CtxOptions
+func (o CLIOptions) Unique() bool {
+	return o.OptUnique
+}
+
+// Trim returns true if --trim was specified. Fulfills CtxOptions
+func (o CLIOptions) Trim() bool {
+	return o.OptTrim
+}
+
+// TrimDisplay returns true if --trim-display was specified. Fulfills
+// CtxOptions
+func (o CLIOptions) TrimDisplay() bool {
+	return o.OptTrimDisplay
+}
+
+// MaxSelect returns the value of --max-select. Fulfills CtxOptions
+func (o CLIOptions) MaxSelect() int {
+	return o.OptMaxSelect
+}
+
+// SelectMarker returns the value of --select-marker. Fulfills
+// CtxOptions
+func (o CLIOptions) SelectMarker() string {
+	return o.OptSelectMarker
+}
+
+// SelectionOrder returns the value of --selection-order. Fulfills
+// CtxOptions
+func (o CLIOptions) SelectionOrder() string {
+	return o.OptSelectionOrder
+}
+
+// FieldSpec returns how lines are split into fields, as specified by
+// --delimiter, --display-fields and --output-field. Fulfills CtxOptions
+func (o CLIOptions) FieldSpec() *FieldSpec {
+	fs, _ := NewFieldSpec(o.OptDelimiter, o.OptDisplayFields, o.OptOutputField)
+	return fs
+}
+
+// openOutput opens where the selected lines are written to: the file
+// `name`, which is created or truncated, the file descriptor `fd`, or
+// stdout if neither is given (i.e. `name` is empty and `fd` is negative)
+func openOutput(name string, fd int) (io.WriteCloser, error) {
+	switch {
+	case name != "":
+		f, err := os.Create(name)
+		if err != nil {
+			return nil, fmt.Errorf("error: cannot write to output file: %s", err)
+		}
+		return f, nil
+	case fd >= 0:
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+		if f == nil {
+			return nil, fmt.Errorf("error: invalid output file descriptor: %d", fd)
+		}
+		if _, err := f.Stat(); err != nil {
+			return nil, fmt.Errorf("error: invalid output file descriptor: %s", err)
+		}
+		return f, nil
+	}
+
+	// Rather than letting the user select lines that can't be printed.
+	// A pipe whose reader exited can't be told apart as cheaply, and
+	// is reported once printing fails (see ErrOutputClosed)
+	if _, err := os.Stdout.Stat(); err != nil {
+		return nil, ErrOutputClosed
+	}
+	return nopWriteCloser{os.Stdout}, nil
+}
+
+// ExitCoder is implemented by the errors returned from CLI.Run that
+// call for a specific exit status
+type ExitCoder interface {
+	ExitCode() int
+}
+
+// emptyInputError is returned when the input is empty, and peco was
+// told to exit in that case. Its value is the exit status
+type emptyInputError int
+
+func (e emptyInputError) Error() string {
+	return "no input lines were read"
+}
+
+// ExitCode returns the exit status. Fulfills ExitCoder
+func (e emptyInputError) ExitCode() int {
+	return int(e)
+}
+
+// ErrOutputClosed is returned when the selected lines could not be
+// printed, because the output was closed (e.g. the command reading
+// from the pipe exited). Its exit status is the one of a process
+// killed by SIGPIPE
+var ErrOutputClosed error = outputClosedError{}
+
+type outputClosedError struct{}
+
+func (outputClosedError) Error() string {
+	return "output pipe closed"
+}
+
+// ExitCode returns the exit status. Fulfills ExitCoder
+func (outputClosedError) ExitCode() int {
+	return 128 + 13
+}
+
+// readQueryFile returns the first line of the given file, with
+// surrounding whitespace removed. A file that doesn't exist yet (see
+// --save-query-file) is read as an empty query
+func readQueryFile(name string) (string, error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("error: failed to read query file: %s", err)
+	}
+
+	s := string(buf)
+	if i := strings.IndexByte(s, '\n'); i > -1 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s), nil
+}
+
+// saveQueryFile writes the query to the given file, so that it can
+// be read back with readQueryFile
+func saveQueryFile(name, query string) error {
+	if err := ioutil.WriteFile(name, []byte(query+"\n"), 0644); err != nil {
+		return fmt.Errorf("error: failed to save query: %s", err)
+	}
+	return nil
+}
+
 type CLI struct {
 }
 
@@ -90,10 +346,75 @@ func (cli *CLI) parseOptions() (*CLIOptions, []string, error) {
 		}
 	}
 
+	if opts.OptSelectionOrder != "" {
+		if !IsValidSelectionOrder(opts.OptSelectionOrder) {
+			return nil, nil, fmt.Errorf("unknown selection order: '%s'\n", opts.OptSelectionOrder)
+		}
+	}
+
+	if opts.OptBufferPolicy != "" {
+		if !IsValidBufferPolicy(opts.OptBufferPolicy) {
+			return nil, nil, fmt.Errorf("unknown buffer policy: '%s'\n", opts.OptBufferPolicy)
+		}
+	}
+
+	if opts.OptQuery != "" && opts.OptQueryFile != "" {
+		return nil, nil, fmt.Errorf("--query and --query-file cannot be used together\n")
+	}
+
+	if opts.OptOutputFile != "" && opts.OptOutputFd >= 0 {
+		return nil, nil, fmt.Errorf("--output-file and --output-fd cannot be used together\n")
+	}
+
+	if opts.OptOutputAll && !opts.OptEnableNullSep {
+		return nil, nil, fmt.Errorf("--output-all-fields requires --null\n")
+	}
+
+	if opts.OptAllowEmpty && opts.OptExitOnEmpty {
+		return nil, nil, fmt.Errorf("--allow-empty and --exit-on-empty cannot be used together\n")
+	}
+
+	if opts.OptPrintMarker && opts.OptSelectMarker == "" {
+		return nil, nil, fmt.Errorf("--print-with-marker requires --select-marker\n")
+	}
+
+	if opts.OptMaxSelect < 0 {
+		return nil, nil, fmt.Errorf("invalid maximum number of selected lines: %d\n", opts.OptMaxSelect)
+	}
+
+	if opts.OptMinHeight < 0 {
+		return nil, nil, fmt.Errorf("invalid minimum height: %d\n", opts.OptMinHeight)
+	}
+
+	if opts.OptMaxLineLength < 0 {
+		return nil, nil, fmt.Errorf("invalid maximum line length: %d\n", opts.OptMaxLineLength)
+	}
+
+	if opts.OptStartupTimeout < 0 {
+		return nil, nil, fmt.Errorf("invalid startup timeout: %d\n", opts.OptStartupTimeout)
+	}
+
+	if err := CheckEncoding(opts.OptEncoding); err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := NewFieldSpec(opts.OptDelimiter, opts.OptDisplayFields, opts.OptOutputField); err != nil {
+		return nil, nil, err
+	}
+
+	if opts.OptFormat != "" {
+		if opts.OptAlign {
+			return nil, nil, fmt.Errorf("--format and --align cannot be used together\n")
+		}
+		if _, err := NewLineFormatter(opts.OptFormat, nil); err != nil {
+			return nil, nil, fmt.Errorf("invalid format: %s\n", err)
+		}
+	}
+
 	return opts, args, nil
 }
 
-func (cli *CLI) Run() error {
+func (cli *CLI) Run() (err error) {
 	opts, args, err := cli.parseOptions()
 	if err != nil {
 		return err
@@ -105,25 +426,46 @@ func (cli *CLI) Run() error {
 	}
 
 	if opts.OptVersion {
-		fmt.Fprintf(os.Stderr, "peco: %s\n", version)
-		return nil
+		rcfile := opts.OptRcfile
+		if rcfile == "" {
+			rcfile, _ = LocateRcfile()
+		}
+		return printVersion(os.Stdout, Version(), rcfile)
 	}
 
-	var in *os.File
+	if opts.OptDebugLog == "" {
+		opts.OptDebugLog = os.Getenv("PECO_DEBUG_LOG")
+	}
+	if opts.OptDebugLog != "" {
+		if err := EnableDebugLog(opts.OptDebugLog); err != nil {
+			return err
+		}
+		defer DisableDebugLog()
+	}
 
-	// receive in from either a file or Stdin
-	switch {
-	case len(args) > 0:
-		in, err = os.Open(args[0])
-		if err != nil {
+	if opts.OptQueryFile != "" {
+		if opts.OptQuery, err = readQueryFile(opts.OptQueryFile); err != nil {
 			return err
 		}
-	case !IsTty(os.Stdin.Fd()):
-		in = os.Stdin
-	default:
-		return fmt.Errorf("error: You must supply something to work with via filename or stdin")
 	}
 
+	// The output is opened upfront, so that errors are reported
+	// before the UI starts. A file is left empty if nothing is
+	// selected
+	output, err := openOutput(opts.OptOutputFile, opts.OptOutputFd)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	// Writing to a closed pipe fails with EPIPE, instead of killing
+	// peco before it can tell why
+	if len(brokenPipeSignals) > 0 {
+		signal.Notify(make(chan os.Signal, 1), brokenPipeSignals...)
+	}
+
+	// The lines are printed once the terminal is restored, so is the
+	// error if they can't be
 	ctx := NewCtx(opts)
 	defer func() {
 		ch := ctx.ResultCh()
@@ -131,29 +473,54 @@ func (cli *CLI) Run() error {
 			return
 		}
 
-		for match := range ch {
-			line := match.Output()
-			if line[len(line)-1] != '\n' {
-				line = line + "\n"
-			}
-			fmt.Fprint(os.Stdout, line)
+		out, werr := NewEncodingWriter(output, opts.OptEncoding)
+		if werr != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", werr)
+			return
+		}
+
+		if opts.OptPrintMarker {
+			werr = printWithMarker(out, ctx.lineOrder.Sorted(ctx.rawLineBuffer.Snapshot()), ch, opts.OptSelectMarker)
+		} else {
+			werr = printResults(out, ch, opts.OptUniqueOutput, opts.OptOutputAll)
+		}
+		if cerr := out.Close(); werr == nil {
+			werr = cerr
+		}
+
+		switch {
+		case werr == nil:
+		case isBrokenPipe(werr):
+			err = ErrOutputClosed
+		case err == nil:
+			err = werr
+		default:
+			fmt.Fprintf(os.Stderr, "%s\n", werr)
 		}
 	}()
 
+	// Errors in a config file that was located implicitly are not
+	// fatal, as peco may be in the middle of a pipeline
+	ignoreRcErrors := opts.OptIgnoreRcErrors
 	if opts.OptRcfile == "" {
 		file, err := LocateRcfile()
 		if err == nil {
 			opts.OptRcfile = file
+			ignoreRcErrors = true
 		}
 	}
 
 	// Default matcher is IgnoreCase
 	ctx.SetCurrentFilterByName(IgnoreCaseMatch)
 
+	var rcErr error
 	if opts.OptRcfile != "" {
-		err = ctx.ReadConfig(opts.OptRcfile)
-		if err != nil {
-			return err
+		if rcErr = ctx.ReadConfig(opts.OptRcfile); rcErr != nil {
+			if !ignoreRcErrors {
+				return rcErr
+			}
+			// Reported once the terminal has been restored
+			defer fmt.Fprintf(os.Stderr, "peco: ignored settings from %s: %s\n", opts.OptRcfile, rcErr)
 		}
 	}
 
@@ -161,6 +528,41 @@ func (cli *CLI) Run() error {
 		ctx.SetPrompt(opts.OptPrompt)
 	}
 
+	if opts.OptCycle {
+		ctx.config.CycleCursor = true
+	}
+
+	if opts.OptCursorOnly {
+		ctx.config.AcceptCursorOnly = true
+	}
+
+	if opts.OptMaxLineLength > 0 {
+		ctx.config.MaxLineLength = opts.OptMaxLineLength
+	}
+
+	if opts.OptFullOutput {
+		ctx.config.FullOutput = true
+	}
+
+	if opts.OptAlign {
+		delimiter := opts.OptDelimiter
+		if delimiter == "" {
+			delimiter = "\t"
+		}
+		// The delimiter was validated along with the other options
+		ctx.SetColumnAligner(NewColumnAligner(regexp.MustCompile(delimiter)))
+	}
+
+	if opts.OptFormat != "" {
+		var delimiter *regexp.Regexp
+		if opts.OptDelimiter != "" {
+			delimiter = regexp.MustCompile(opts.OptDelimiter)
+		}
+		// The template was validated along with the other options
+		lf, _ := NewLineFormatter(opts.OptFormat, delimiter)
+		ctx.SetLineFormatter(lf)
+	}
+
 	initialFilter := ""
 	if len(opts.OptInitialFilter) <= 0 && len(opts.OptInitialMatcher) > 0 {
 		initialFilter = opts.OptInitialMatcher
@@ -173,14 +575,100 @@ func (cli *CLI) Run() error {
 		}
 	}
 
+	if opts.OptPrintKeymap {
+		ctx.NewKeymap().WriteBindings(os.Stdout)
+		return nil
+	}
+
+	if opts.OptDumpConfig {
+		return ctx.WriteConfig(os.Stdout)
+	}
+
+	var in io.ReadCloser
+
+	// receive in from either files or Stdin
+	switch {
+	case opts.OptSource != "":
+		if len(args) > 0 {
+			return fmt.Errorf("error: --source cannot be used along with files")
+		}
+		// The command is run again by peco.ReloadSource
+		ctx.SetSource(func() (io.ReadCloser, error) {
+			in, err := OpenCommand(opts.OptSource)
+			if err != nil {
+				return nil, err
+			}
+			return NewDecodingReader(in, opts.OptEncoding)
+		})
+		in, err = OpenCommand(opts.OptSource)
+		if err != nil {
+			return err
+		}
+	case len(args) > 0:
+		// Files can be read again by peco.ReloadSource
+		ctx.SetSource(func() (io.ReadCloser, error) {
+			in, err := OpenInputFiles(args, opts.OptPrintSource)
+			if err != nil {
+				return nil, err
+			}
+			return NewDecodingReader(in, opts.OptEncoding)
+		})
+		in, err = OpenInputFiles(args, opts.OptPrintSource)
+		if err != nil {
+			return err
+		}
+	case !IsTty(os.Stdin.Fd()):
+		in = os.Stdin
+	default:
+		return fmt.Errorf("error: You must supply something to work with via filename or stdin")
+	}
+
+	// The input is saved as it was read, before it is decoded. Once
+	// the session ends, the file is closed even if the input is not
+	if opts.OptTee != "" {
+		f, err := os.Create(opts.OptTee)
+		if err != nil {
+			return fmt.Errorf("error: cannot write to tee file: %s", err)
+		}
+		defer f.Close()
+		in = newTeeReader(in, f, func(err error) {
+			// Not to block reading until the status bar is drawn
+			go ctx.SendStatusMsgAndClear(fmt.Sprintf("Cannot write to %s: %s", opts.OptTee, err), 3*time.Second)
+		})
+	}
+
+	in, err = NewDecodingReader(in, opts.OptEncoding)
+	if err != nil {
+		return err
+	}
+
 	// Try waiting for something available in the source stream
-	// before doing any terminal initialization (also done by termbox)
+	// before doing any terminal initialization (also done by screen.Init)
 	reader := ctx.NewBufferReader(in)
+	if opts.OptAllowEmpty {
+		// Keep going even if nothing is read, so that the UI is
+		// still there for lines that are read later (or never)
+		reader.onEOF = func() {}
+	}
 	ctx.AddWaitGroup(1)
 	go reader.Loop()
 
-	// This channel blocks until we receive something from `in`
-	<-reader.InputReadyCh()
+	// This blocks until we receive something from `in`
+	if !reader.WaitInputReady(time.Duration(opts.OptStartupTimeout)*time.Second) && !opts.OptAllowEmpty {
+		reader.Cancel()
+		return fmt.Errorf("error: no input received within %d seconds", opts.OptStartupTimeout)
+	}
+
+	// Scripts may rather not show an empty list when there was
+	// nothing to choose from
+	if (opts.OptExitOnEmpty || ctx.config.ExitOnEmpty) && !opts.OptAllowEmpty && ctx.GetRawLineBufferSize() == 0 {
+		return emptyInputError(opts.OptEmptyExitCode)
+	}
+
+	// Printed once the terminal is restored
+	if opts.OptProfile {
+		defer ctx.stats.Print(os.Stderr)
+	}
 
 	err = TtyReady()
 	if err != nil {
@@ -188,15 +676,21 @@ func (cli *CLI) Run() error {
 	}
 	defer TtyTerm()
 
-	err = termbox.Init()
+	err = screen.Init()
 	if err != nil {
 		return err
 	}
-	defer termbox.Close()
+	defer screen.Close()
+
+	if err := CheckScreenHeight(opts.OptMinHeight); err != nil {
+		return err
+	}
 
-	// Windows handle Esc/Alt self
+	// Windows handle Esc/Alt self. Esc pressed twice still arrives as
+	// two Esc events, which Input tells apart from Alt+Esc when
+	// DoubleEscapeToExit is set
 	if isWindows {
-		termbox.SetInputMode(termbox.InputEsc | termbox.InputAlt)
+		screen.SetInputMode(InputEsc | InputAlt)
 	}
 
 	ctx.startInput()
@@ -216,6 +710,10 @@ func (cli *CLI) Run() error {
 		go looper.Loop()
 	}
 
+	if rcErr != nil {
+		ctx.SendStatusMsgAndClear("Malformed settings file was ignored (details are shown on exit)", rcfileWarningDelay)
+	}
+
 	if len(opts.OptQuery) > 0 {
 		ctx.SetQuery([]rune(opts.OptQuery))
 		ctx.ExecQuery()
@@ -225,5 +723,11 @@ func (cli *CLI) Run() error {
 
 	ctx.WaitDone()
 
+	if opts.OptSaveQueryFile != "" {
+		if err := saveQueryFile(opts.OptSaveQueryFile, ctx.QueryString()); err != nil {
+			return err
+		}
+	}
+
 	return ctx.Error()
 }
@@ -0,0 +1,105 @@
+package peco
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// errNoClipboardCommand is returned when none of the known clipboard
+// commands are available on this system
+var errNoClipboardCommand = errors.New("error: No clipboard command available")
+
+// clipboardTTY is where the OSC 52 escape sequence is written to
+// when there are no clipboard commands available
+var clipboardTTY = "/dev/tty"
+
+// clipboardCommands returns the candidate commands that can be used
+// to copy text into the system clipboard, in order of preference
+func clipboardCommands() [][]string {
+	switch runtime.GOOS {
+	case "darwin":
+		return [][]string{{"pbcopy"}}
+	case "windows":
+		return [][]string{{"clip"}}
+	}
+
+	cmds := [][]string{
+		{"xclip", "-selection", "clipboard"},
+		{"xsel", "--clipboard", "--input"},
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		cmds = append([][]string{{"wl-copy"}}, cmds...)
+	}
+	return cmds
+}
+
+// findClipboardCommand returns the first command from
+// clipboardCommands() that is available in $PATH
+func findClipboardCommand() ([]string, error) {
+	for _, cmd := range clipboardCommands() {
+		if _, err := exec.LookPath(cmd[0]); err == nil {
+			return cmd, nil
+		}
+	}
+	return nil, errNoClipboardCommand
+}
+
+// CopyToClipboard puts `text` on the system clipboard. If `cmdline`
+// is empty, a suitable command is searched for. If there are none,
+// the text is sent to the terminal using the OSC 52 escape sequence,
+// which many terminal emulators support even over SSH
+func CopyToClipboard(cmdline []string, text string) error {
+	if len(cmdline) == 0 {
+		cmd, err := findClipboardCommand()
+		if err != nil {
+			return copyViaOSC52(text)
+		}
+		cmdline = cmd
+	}
+
+	// The errors are written to a file rather than to a pipe: xclip
+	// and wl-copy stay in the background to serve the clipboard, with
+	// their stdout and stderr still open, so waiting for a pipe to be
+	// closed would block until the clipboard is taken over
+	stderr, err := ioutil.TempFile("", "peco-clipboard-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+
+	trace("CopyToClipboard: using %v", cmdline)
+	cmd := exec.Command(cmdline[0], cmdline[1:]...)
+	cmd.Stdin = bytes.NewBufferString(text)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if out, _ := ioutil.ReadFile(stderr.Name()); len(bytes.TrimSpace(out)) > 0 {
+			return fmt.Errorf("error: %s failed: %s", cmdline[0], bytes.TrimSpace(out))
+		}
+		return fmt.Errorf("error: %s failed: %s", cmdline[0], err)
+	}
+	return nil
+}
+
+func copyViaOSC52(text string) error {
+	tty, err := os.OpenFile(clipboardTTY, os.O_WRONLY, 0)
+	if err != nil {
+		return errNoClipboardCommand
+	}
+	defer tty.Close()
+
+	_, err = tty.WriteString(osc52Sequence(text))
+	return err
+}
+
+// osc52Sequence creates the escape sequence that asks the terminal
+// to put `text` on the clipboard
+func osc52Sequence(text string) string {
+	return "\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte(text)) + "\a"
+}
@@ -0,0 +1,96 @@
+package peco
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOSC52Sequence(t *testing.T) {
+	if s := osc52Sequence("Hello"); s != "\x1b]52;c;SGVsbG8=\a" {
+		t.Errorf("Unexpected OSC 52 sequence: %q", s)
+	}
+}
+
+func TestCopySelection(t *testing.T) {
+	if isWindows {
+		t.Skip("test uses sh")
+	}
+
+	dir, err := ioutil.TempDir("", "peco-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "clipboard")
+
+	ctx := newCtx(nil, 25)
+	ctx.config.ClipboardCommand = []string{"sh", "-c", "cat > " + out}
+	for _, l := range []string{"Alice", "Bob", "Charlie"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	input := ctx.NewInput()
+
+	expectClipboard := func(expected, msg string) {
+		buf, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Errorf("Failed to read clipboard: %s", err)
+		} else if string(buf) != expected {
+			t.Errorf("Expected clipboard to be %q, got %q", expected, buf)
+		}
+
+		select {
+		case r := <-ctx.StatusMsgCh():
+			if m := r.DataInterface().(StatusMsgRequest).message; m != msg {
+				t.Errorf("Expected status message '%s', got '%s'", msg, m)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected status message '%s'", msg)
+		}
+	}
+
+	// Nothing selected: copies the current line
+	doCopySelection(input, Event{})
+	expectClipboard("Alice", "Copied 1 line")
+
+	ctx.SelectionAdd(0)
+	ctx.SelectionAdd(2)
+	doCopySelection(input, Event{})
+	expectClipboard("Alice\nCharlie", "Copied 2 lines")
+
+	ctx.config.ClipboardCommand = []string{"false"}
+	doCopyLine(input, Event{})
+	select {
+	case <-ctx.StatusMsgCh():
+	case <-time.After(time.Second):
+		t.Errorf("Expected failure to be reported in the status bar")
+	}
+}
+
+func TestCopyToClipboardDaemon(t *testing.T) {
+	if isWindows {
+		t.Skip("test uses sh")
+	}
+
+	// Like xclip, the command leaves a process in the background that
+	// keeps its stdout and stderr open
+	done := make(chan error, 1)
+	go func() {
+		done <- CopyToClipboard([]string{"sh", "-c", "cat > /dev/null; sleep 5 &"}, "Alice")
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Failed to copy: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected CopyToClipboard not to wait for the background process")
+	}
+
+	err := CopyToClipboard([]string{"sh", "-c", "echo oops >&2; exit 1"}, "Alice")
+	if err == nil || err.Error() != "error: sh failed: oops" {
+		t.Errorf("Expected the error of the command, got %v", err)
+	}
+}
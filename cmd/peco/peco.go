@@ -28,6 +28,9 @@ func _main() int {
 		if err != peco.ErrUserCanceled {
 			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 		}
+		if ec, ok := err.(peco.ExitCoder); ok {
+			return ec.ExitCode()
+		}
 		return 1
 	}
 	return 0
@@ -0,0 +1,207 @@
+package peco
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// openInputFile opens the file `name`. If it is compressed with gzip
+// or zstd (as told by its extension or its first few bytes), the
+// returned reader yields the decompressed contents.
+//
+// Go doesn't come with a zstd decoder, so zstd compressed files are
+// piped through the zstd command, which must be in $PATH.
+//
+// The first block of the file is decompressed before returning, so
+// that corrupt archives are reported before the UI starts
+func openInputFile(name string) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkInputFile(f, name); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	rdr := bufio.NewReader(f)
+	magic, _ := rdr.Peek(len(zstdMagic))
+
+	var closer func() error
+	switch ext := filepath.Ext(name); {
+	case ext == ".gz" || bytes.HasPrefix(magic, gzipMagic):
+		rdr, closer, err = newGzipReader(rdr)
+	case ext == ".zst" || bytes.HasPrefix(magic, zstdMagic):
+		rdr, closer, err = newZstdReader(rdr)
+	default:
+		// Peek() already consumed the beginning of the file
+		return &readCloser{rdr, f.Close}, nil
+	}
+
+	if err == nil {
+		if _, err = rdr.Peek(1); err == io.EOF {
+			// An empty archive is fine
+			err = nil
+		}
+	}
+	if err != nil {
+		if closer != nil {
+			closer()
+		}
+		f.Close()
+		return nil, fmt.Errorf("error: failed to decompress %s: %s", name, err)
+	}
+
+	return &readCloser{rdr, func() error {
+		closer()
+		return f.Close()
+	}}, nil
+}
+
+// checkInputFile returns an error if `f` can't be read lines from:
+// if it is a directory, or a terminal (which peco needs for itself).
+// Other files, including devices and named pipes, are read as usual
+func checkInputFile(f *os.File, name string) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	switch mode := fi.Mode(); {
+	case mode.IsDir():
+		return fmt.Errorf("error: %s is a directory", name)
+	case mode&os.ModeCharDevice != 0 && IsTty(f.Fd()):
+		return fmt.Errorf("error: %s is a terminal", name)
+	}
+	return nil
+}
+
+// readCloser combines a Reader with the function that
+// releases the resources associated with it
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
+func newGzipReader(src io.Reader) (*bufio.Reader, func() error, error) {
+	gz, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bufio.NewReader(gz), gz.Close, nil
+}
+
+func newZstdReader(src io.Reader) (*bufio.Reader, func() error, error) {
+	return newCommandReader(src, "zstd", "-d", "-c", "-q")
+}
+
+// newCommandReader pipes `src` through the given command, and returns
+// a reader for the output of the command, along with the function
+// that stops the command
+func newCommandReader(src io.Reader, name string, args ...string) (*bufio.Reader, func() error, error) {
+	c := &cmdOutput{
+		cmd:    exec.Command(name, args...),
+		stderr: newTailBuffer(stderrLimit),
+		once:   &sync.Once{},
+	}
+	c.cmd.Stdin = src
+	c.cmd.Stderr = c.stderr
+
+	out, err := c.cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := c.cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	c.Reader = out
+
+	return bufio.NewReader(c), func() error {
+		out.Close()
+		c.cmd.Process.Kill()
+		return c.wait()
+	}, nil
+}
+
+// cmdOutput reads the output of a command. Once the output is
+// exhausted, it reports the error from the command, if any
+type cmdOutput struct {
+	io.Reader
+	cmd     *exec.Cmd
+	stderr  *tailBuffer
+	once    *sync.Once
+	waitErr error
+}
+
+func (c *cmdOutput) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+
+	if err := c.wait(); err != nil {
+		return n, err
+	}
+	return n, io.EOF
+}
+
+func (c *cmdOutput) wait() error {
+	c.once.Do(func() {
+		if err := c.cmd.Wait(); err != nil {
+			if msg := bytes.TrimSpace(c.stderr.Bytes()); len(msg) > 0 {
+				err = fmt.Errorf("%s", msg)
+			}
+			c.waitErr = err
+		}
+	})
+	return c.waitErr
+}
+
+// stderrLimit is how much of what a command writes to stderr is kept
+// to report its errors. The end is what's kept, as that is usually
+// where the error is
+const stderrLimit = 4096
+
+// tailBuffer keeps the last bytes written to it, up to a limit, so
+// that a command that writes a lot to stderr doesn't use up memory
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) > t.max {
+		p = p[len(p)-t.max:]
+	}
+	if over := len(t.buf) + len(p) - t.max; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	t.buf = append(t.buf, p...)
+	return n, nil
+}
+
+// Bytes returns what was kept of what was written
+func (t *tailBuffer) Bytes() []byte {
+	return t.buf
+}
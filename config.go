@@ -3,17 +3,54 @@ package peco
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 
-	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/keyseq"
 )
 
 // DefaultCustomFilterBufferThreshold is the default value
 // for BufferThreshold setting on CustomFilters. 
 const DefaultCustomFilterBufferThreshold = 100
 
+// DefaultCustomFilterMaxBatchBytes is the default value for the
+// MaxBatchBytes setting on CustomFilters
+const DefaultCustomFilterMaxBatchBytes = 1 << 20
+
+// DefaultCustomFilterFlushInterval is the default value for the
+// FlushInterval setting on CustomFilters, in milliseconds
+const DefaultCustomFilterFlushInterval = 50
+
+// DefaultHintAlphabet is the default value for HintAlphabet
+const DefaultHintAlphabet = "asdfghjklqwertyuiopzxcvbnm"
+
+// DefaultOrSeparator is the default value for OrSeparator
+const DefaultOrSeparator = "|"
+
+// DefaultResultCountFormat is the default value for ResultCountFormat.
+// $FILTER, $MATCHED, $TOTAL, $PAGE, $MAX_PAGE and $LATENCY are replaced
+// with the name of the current filter, the number of lines that matched,
+// the number of lines read, the current page, the number of pages, and
+// how long the last query took
+const DefaultResultCountFormat = "$FILTER [$MATCHED ($PAGE/$MAX_PAGE)]"
+
+// DefaultFilteringIndicatorDelay is the default value for
+// FilteringIndicatorDelay
+const DefaultFilteringIndicatorDelay = 200
+
+// DefaultFrameInterval is the default value for FrameInterval,
+// which is about 30 frames per second
+const DefaultFrameInterval = 33
+
+// Default values for AccelerationConfig
+const (
+	DefaultAccelerationInterval = 100
+	DefaultAccelerationRepeats  = 10
+	DefaultAccelerationMaxStep  = 8
+)
+
 var homedirFunc = homedir
 
 // Config holds all the data that can be configured in the
@@ -32,8 +69,254 @@ type Config struct {
 	Layout          string            `json:"Layout"`
 	CustomMatcher   map[string][]string
 	CustomFilter    map[string]CustomFilterConfig
+	// Filters lists the filters that are available, in the order
+	// that peco.RotateFilter goes through them. Both the built-in
+	// filters and the ones from CustomFilter may be listed. If empty,
+	// all of them are available
+	Filters         []string
 	StickySelection bool
 	QueryExecutionDelay int
+
+	// IgnoreInterrupt tells peco not to exit upon receiving SIGINT
+	IgnoreInterrupt bool
+
+	// DoubleEscapeToExit makes Esc clear the query, and exit only if
+	// it is pressed again right away. Other keys bound to peco.Cancel
+	// still exit right away
+	DoubleEscapeToExit bool
+
+	// ConfirmAccept makes peco ask for confirmation before
+	// emitting the selected lines
+	ConfirmAccept bool
+
+	// ResultCountFormat is the format used to display the number of
+	// results next to the prompt. See DefaultResultCountFormat
+	ResultCountFormat string
+
+	// ClipboardCommand is the command (and its arguments) that
+	// receives the text to be copied by peco.CopyLine and
+	// peco.CopySelection via stdin. If empty, peco looks for
+	// pbcopy, clip, wl-copy, xclip, or xsel
+	ClipboardCommand []string
+
+	// ShowScrollbar controls when a scrollbar is displayed along
+	// the right edge of the list. See ScrollbarMode
+	ShowScrollbar ScrollbarMode
+
+	// MaxLineLength is the maximum number of bytes kept from each
+	// line of the input. The rest of longer lines is thrown away (but
+	// never in the middle of a character), and how many lines were
+	// cut short is shown in the status bar. 0 means unlimited
+	MaxLineLength int
+
+	// FullOutput keeps the lines longer than MaxLineLength in their
+	// entirety to be output, and only the string that is displayed and
+	// matched against the query is cut short
+	FullOutput bool
+
+	// KeepCarriageReturn stops peco from stripping the CR from
+	// lines terminated by CRLF
+	KeepCarriageReturn bool
+
+	// ShowLineNumbers displays the number of each line (that is,
+	// its position in the input) in front of it. This can be
+	// toggled with peco.ToggleLineNumbers
+	ShowLineNumbers bool
+
+	// ShowLoadingIndicator displays an animated indicator along
+	// with the number of lines read so far in the status bar, until
+	// all of the input has been read
+	ShowLoadingIndicator bool
+
+	// HintAlphabet is the list of keys used to label the lines in
+	// the page by peco.SelectionHintMode, and the entries of the
+	// action menu (see ActionMenu), in order
+	HintAlphabet string
+
+	// OrSeparator separates the alternatives within a term of the
+	// query in the IgnoreCase, CaseSensitive and SmartCase filters.
+	// A line matches the term if it contains any of them. An empty
+	// string disables this
+	OrSeparator string
+
+	// ActionMenu lists the entries of the menu that is opened by
+	// peco.ActionMenu, in order
+	ActionMenu []ActionMenuItem
+
+	// ExitOnEmpty makes peco exit right away, without taking over
+	// the terminal, if the input turns out to be empty
+	ExitOnEmpty bool
+
+	// EmptyQueryShowsAll tells whether all of the lines are shown
+	// while the query is empty. If false, no lines are shown until
+	// something is typed
+	EmptyQueryShowsAll bool
+
+	// FilteringIndicatorDelay is the number of milliseconds a query
+	// may take before an indicator is shown in the status bar until
+	// it completes. A negative value disables the indicator
+	FilteringIndicatorDelay int
+
+	// SelectionGroups are the styles of the lines selected in the
+	// groups after the first one, whose style is Style.SavedSelection
+	// (see peco.CycleSelectionGroup)
+	SelectionGroups []Style
+
+	// CycleCursor makes the cursor wrap around to the first line when
+	// it moves down from the last one, and the other way around.
+	// Otherwise it stops there
+	CycleCursor bool
+
+	// Acceleration makes the cursor move faster while the key of
+	// peco.SelectUp, peco.SelectDown, or one of the scroll actions
+	// is held down
+	Acceleration AccelerationConfig
+
+	// PollResize makes peco check the size of the terminal every
+	// resizePollInterval, and redraw the screen if it changed. This
+	// is done anyway until the terminal reports being resized, as
+	// some never do
+	PollResize bool
+
+	// ScrollOff is the number of lines that are kept visible above
+	// and below the cursor. If it is 0, the list is scrolled a page
+	// at a time, once the cursor leaves the page
+	ScrollOff int
+
+	// FillBackground extends the background of lines that are styled
+	// differently from the rest (e.g. the selected line) to the right
+	// edge of the screen. Otherwise only their text is styled
+	FillBackground bool
+
+	// RegexpFallbackLiteral makes the Regexp filter match the query
+	// literally while it is not a valid regular expression (e.g. an
+	// unclosed parenthesis while it is being typed), instead of
+	// matching nothing
+	RegexpFallbackLiteral bool
+
+	// FrameInterval is the number of milliseconds between the redraws
+	// of the screen while lines are being matched. However fast they
+	// come in, the screen is redrawn at most once per interval, so that
+	// keys are still handled promptly. A larger value (e.g. 100, for 10
+	// frames per second) helps over slow connections
+	FrameInterval int
+
+	// AcceptCursorOnly makes peco.Finish accept the line under the
+	// cursor alone, even if other lines are selected. The selected
+	// lines are accepted by peco.FinishWithSelection instead
+	AcceptCursorOnly bool
+
+	// ExtendedSearchSyntax makes the IgnoreCase, CaseSensitive,
+	// SmartCase and Exclude filters interpret a leading ^ in a term as
+	// the start of the line, a trailing $ as its end, and a leading '
+	// as "match the rest of the term exactly as typed"
+	ExtendedSearchSyntax bool
+
+	// Profiles are sets of settings that are picked by naming one of
+	// them in the PECO_PROFILE environment variable. They take
+	// precedence over the settings above, but not over the command
+	// line options
+	Profiles map[string]ProfileConfig
+
+	// FilterBufferCommand is the command that peco.FilterBufferThrough
+	// runs via the shell. The lines shown are written to its standard
+	// input, and the lines it outputs are shown in their place
+	FilterBufferCommand string
+
+	// MinQueryLength is the number of characters the query must have
+	// before it is run. Shorter queries leave the lines unfiltered, as
+	// if the query was empty. 0 runs every query
+	MinQueryLength int
+}
+
+// ProfileEnv is the environment variable that names the profile
+// to use (see Config.Profiles)
+const ProfileEnv = "PECO_PROFILE"
+
+// ProfileConfig holds the settings of a profile. Empty settings are
+// left as they are set in the rest of the configuration
+type ProfileConfig struct {
+	// InitialFilter is the name of the filter to start with
+	InitialFilter string
+}
+
+// Profile returns the profile named by the PECO_PROFILE environment
+// variable, and false if the variable isn't set or there is no such
+// profile
+func (c *Config) Profile() (ProfileConfig, bool) {
+	name := os.Getenv(ProfileEnv)
+	if name == "" {
+		return ProfileConfig{}, false
+	}
+	p, ok := c.Profiles[name]
+	return p, ok
+}
+
+// AccelerationConfig controls how the cursor speeds up as the key of a
+// movement action is held down. The action moves the cursor twice as
+// far every Repeats times it is repeated, up to MaxStep lines (or
+// pages). This starts over once another key is pressed, or the key is
+// released for more than Interval milliseconds
+type AccelerationConfig struct {
+	Enabled  bool
+	Interval int
+	Repeats  int
+	MaxStep  int
+}
+
+// ActionMenuItem is an entry of the menu opened by peco.ActionMenu
+type ActionMenuItem struct {
+	// Name is what is displayed in the menu
+	Name string
+
+	// Command is run via the shell when the entry is picked. $LINES
+	// is replaced with the selected lines (or the line under the
+	// cursor, if nothing is selected), $LINE with the line under the
+	// cursor, and $QUERY with the query. Each line is quoted
+	Command string
+
+	// Exit makes peco exit (without printing anything) once the
+	// command has succeeded
+	Exit bool
+}
+
+// ScrollbarMode controls when the scrollbar is displayed. In the
+// config file it may be specified as true, false, or "auto"
+type ScrollbarMode string
+
+const (
+	// ScrollbarNever hides the scrollbar. This is the default
+	ScrollbarNever ScrollbarMode = "false"
+	// ScrollbarAlways always shows the scrollbar
+	ScrollbarAlways ScrollbarMode = "true"
+	// ScrollbarAuto shows the scrollbar only when there is more
+	// than one page of lines
+	ScrollbarAuto ScrollbarMode = "auto"
+)
+
+// UnmarshalJSON satisfies json.Unmarshaler
+func (m *ScrollbarMode) UnmarshalJSON(buf []byte) error {
+	var b bool
+	if err := json.Unmarshal(buf, &b); err == nil {
+		if b {
+			*m = ScrollbarAlways
+		} else {
+			*m = ScrollbarNever
+		}
+		return nil
+	}
+
+	var v string
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return err
+	}
+
+	switch mode := ScrollbarMode(v); mode {
+	case ScrollbarNever, ScrollbarAlways, ScrollbarAuto:
+		*m = mode
+		return nil
+	}
+	return fmt.Errorf("invalid value for ShowScrollbar: %s", v)
 }
 
 // CustomFilterConfig is used to specify configuration parameters
@@ -53,6 +336,18 @@ type CustomFilterConfig struct {
 	// more often, but you pay the penalty of invoking that command
 	// more times.
 	BufferThreshold int
+
+	// MaxBatchBytes is the maximum size of the lines passed to a
+	// single run of the command. The command is run early once the
+	// lines buffered reach that size, so that a huge input is never
+	// held in memory at once
+	MaxBatchBytes int
+
+	// FlushInterval is the number of milliseconds after which the
+	// lines buffered are passed to the command, even if there are
+	// fewer than BufferThreshold of them, so that results show up
+	// while the input is being read slowly
+	FlushInterval int
 }
 
 // NewConfig creates a new Config
@@ -63,27 +358,54 @@ func NewConfig() *Config {
 		Style:          NewStyleSet(),
 		Prompt:         "QUERY>",
 		Layout:         "top-down",
+		ShowScrollbar:  ScrollbarNever,
+		HintAlphabet:   DefaultHintAlphabet,
+		OrSeparator:    DefaultOrSeparator,
+
+		ResultCountFormat:       DefaultResultCountFormat,
+		FilteringIndicatorDelay: DefaultFilteringIndicatorDelay,
+		FrameInterval:           DefaultFrameInterval,
+		EmptyQueryShowsAll:      true,
+		CycleCursor:             true,
+		Acceleration: AccelerationConfig{
+			Interval: DefaultAccelerationInterval,
+			Repeats:  DefaultAccelerationRepeats,
+			MaxStep:  DefaultAccelerationMaxStep,
+		},
+		SelectionGroups: []Style{
+			{fg: ColorBlack | AttrBold, bg: ColorYellow},
+			{fg: ColorBlack | AttrBold, bg: ColorGreen},
+		},
 	}
 }
 
 // ReadFilename reads the config from the given file, and
 // does the appropriate processing, if any
 func (c *Config) ReadFilename(filename string) error {
-	f, err := os.Open(filename)
+	buf, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	err = json.NewDecoder(f).Decode(c)
-	if err != nil {
-		return err
+	if err := json.Unmarshal(buf, c); err != nil {
+		if serr, ok := err.(*json.SyntaxError); ok {
+			// Offset is just past the offending character
+			line, col := textPosition(buf, serr.Offset-1)
+			return fmt.Errorf("error: failed to parse %s at line %d, column %d: %s", filename, line, col, err)
+		}
+		return fmt.Errorf("error: failed to parse %s: %s", filename, err)
 	}
 
 	if !IsValidLayoutType(LayoutType(c.Layout)) {
 		return fmt.Errorf("invalid layout type: %s", c.Layout)
 	}
 
+	for k := range c.Keymap {
+		if _, err := keyseq.ToKeyList(k); err != nil {
+			return fmt.Errorf("invalid key '%s' in Keymap: %s", k, err)
+		}
+	}
+
 	if len(c.CustomMatcher) > 0 {
 		fmt.Fprintf(os.Stderr, "'CustomMatcher' is deprecated. Use CustomFilter instead\n")
 
@@ -104,35 +426,35 @@ func (c *Config) ReadFilename(filename string) error {
 }
 
 var (
-	stringToFg = map[string]termbox.Attribute{
-		"default": termbox.ColorDefault,
-		"black":   termbox.ColorBlack,
-		"red":     termbox.ColorRed,
-		"green":   termbox.ColorGreen,
-		"yellow":  termbox.ColorYellow,
-		"blue":    termbox.ColorBlue,
-		"magenta": termbox.ColorMagenta,
-		"cyan":    termbox.ColorCyan,
-		"white":   termbox.ColorWhite,
+	stringToFg = map[string]Attribute{
+		"default": ColorDefault,
+		"black":   ColorBlack,
+		"red":     ColorRed,
+		"green":   ColorGreen,
+		"yellow":  ColorYellow,
+		"blue":    ColorBlue,
+		"magenta": ColorMagenta,
+		"cyan":    ColorCyan,
+		"white":   ColorWhite,
 	}
-	stringToBg = map[string]termbox.Attribute{
-		"on_default": termbox.ColorDefault,
-		"on_black":   termbox.ColorBlack,
-		"on_red":     termbox.ColorRed,
-		"on_green":   termbox.ColorGreen,
-		"on_yellow":  termbox.ColorYellow,
-		"on_blue":    termbox.ColorBlue,
-		"on_magenta": termbox.ColorMagenta,
-		"on_cyan":    termbox.ColorCyan,
-		"on_white":   termbox.ColorWhite,
+	stringToBg = map[string]Attribute{
+		"on_default": ColorDefault,
+		"on_black":   ColorBlack,
+		"on_red":     ColorRed,
+		"on_green":   ColorGreen,
+		"on_yellow":  ColorYellow,
+		"on_blue":    ColorBlue,
+		"on_magenta": ColorMagenta,
+		"on_cyan":    ColorCyan,
+		"on_white":   ColorWhite,
 	}
-	stringToFgAttr = map[string]termbox.Attribute{
-		"bold":      termbox.AttrBold,
-		"underline": termbox.AttrUnderline,
-		"reverse":   termbox.AttrReverse,
+	stringToFgAttr = map[string]Attribute{
+		"bold":      AttrBold,
+		"underline": AttrUnderline,
+		"reverse":   AttrReverse,
 	}
-	stringToBgAttr = map[string]termbox.Attribute{
-		"on_bold": termbox.AttrBold,
+	stringToBgAttr = map[string]Attribute{
+		"on_bold": AttrBold,
 	}
 )
 
@@ -143,23 +465,25 @@ type StyleSet struct {
 	Selected       Style `json:"Selected"`
 	Query          Style `json:"Query"`
 	Matched        Style `json:"Matched"`
+	Scrollbar      Style `json:"Scrollbar"`
 }
 
 // NewStyleSet creates a new StyleSet struct
 func NewStyleSet() *StyleSet {
 	return &StyleSet{
-		Basic:          Style{fg: termbox.ColorDefault, bg: termbox.ColorDefault},
-		Query:          Style{fg: termbox.ColorDefault, bg: termbox.ColorDefault},
-		Matched:        Style{fg: termbox.ColorCyan, bg: termbox.ColorDefault},
-		SavedSelection: Style{fg: termbox.ColorBlack | termbox.AttrBold, bg: termbox.ColorCyan},
-		Selected:       Style{fg: termbox.ColorDefault | termbox.AttrUnderline, bg: termbox.ColorMagenta},
+		Basic:          Style{fg: ColorDefault, bg: ColorDefault},
+		Query:          Style{fg: ColorDefault, bg: ColorDefault},
+		Matched:        Style{fg: ColorCyan, bg: ColorDefault},
+		SavedSelection: Style{fg: ColorBlack | AttrBold, bg: ColorCyan},
+		Selected:       Style{fg: ColorDefault | AttrUnderline, bg: ColorMagenta},
+		Scrollbar:      Style{fg: ColorDefault | AttrReverse, bg: ColorDefault},
 	}
 }
 
-// Style describes termbox styles
+// Style describes the colors and attributes of a cell
 type Style struct {
-	fg termbox.Attribute
-	bg termbox.Attribute
+	fg Attribute
+	bg Attribute
 }
 
 // UnmarshalJSON satisfies json.RawMessage.
@@ -172,10 +496,47 @@ func (s *Style) UnmarshalJSON(buf []byte) error {
 	return nil
 }
 
+// MarshalJSON satisfies json.Marshaler. The style is written in the
+// same format that is accepted by UnmarshalJSON
+func (s Style) MarshalJSON() ([]byte, error) {
+	return json.Marshal(styleToStrings(s))
+}
+
+// colorMask separates the color from the attributes in a
+// Attribute. Attributes start from the 9th bit
+const colorMask = Attribute(1<<9 - 1)
+
+func styleToStrings(s Style) []string {
+	raw := []string{}
+
+	for name, fg := range stringToFg {
+		if fg == s.fg&colorMask && fg != ColorDefault {
+			raw = append(raw, name)
+		}
+	}
+	for name, bg := range stringToBg {
+		if bg == s.bg&colorMask && bg != ColorDefault {
+			raw = append(raw, name)
+		}
+	}
+
+	// Iterate in a fixed order, so that the output is stable
+	for _, name := range []string{"bold", "underline", "reverse"} {
+		if s.fg&stringToFgAttr[name] != 0 {
+			raw = append(raw, name)
+		}
+	}
+	if s.bg&stringToBgAttr["on_bold"] != 0 {
+		raw = append(raw, "on_bold")
+	}
+
+	return raw
+}
+
 func stringsToStyle(raw []string) *Style {
 	style := &Style{
-		fg: termbox.ColorDefault,
-		bg: termbox.ColorDefault,
+		fg: ColorDefault,
+		bg: ColorDefault,
 	}
 
 	for _, s := range raw {
@@ -216,6 +577,26 @@ func locateRcfileIn(dir string) (string, error) {
 	return file, nil
 }
 
+// textPosition returns the line and the column (both starting at 1)
+// of the byte at `offset` in `buf`
+func textPosition(buf []byte, offset int64) (int, int) {
+	if offset < 0 {
+		offset = 0
+	} else if offset > int64(len(buf)) {
+		offset = int64(len(buf))
+	}
+	line, col := 1, 1
+	for _, b := range buf[:offset] {
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
+
 // LocateRcfile attempts to find the config file in various locations
 func LocateRcfile() (string, error) {
 	// http://standards.freedesktop.org/basedir-spec/basedir-spec-latest.html
@@ -8,8 +8,6 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
-
-	"github.com/nsf/termbox-go"
 )
 
 func TestReadRC(t *testing.T) {
@@ -44,23 +42,23 @@ func TestStringsToStyle(t *testing.T) {
 	tests := []stringsToStyleTest{
 		stringsToStyleTest{
 			strings: []string{"on_default", "default"},
-			style:   &Style{fg: termbox.ColorDefault, bg: termbox.ColorDefault},
+			style:   &Style{fg: ColorDefault, bg: ColorDefault},
 		},
 		stringsToStyleTest{
 			strings: []string{"bold", "on_blue", "yellow"},
-			style:   &Style{fg: termbox.ColorYellow | termbox.AttrBold, bg: termbox.ColorBlue},
+			style:   &Style{fg: ColorYellow | AttrBold, bg: ColorBlue},
 		},
 		stringsToStyleTest{
 			strings: []string{"underline", "on_cyan", "black"},
-			style:   &Style{fg: termbox.ColorBlack | termbox.AttrUnderline, bg: termbox.ColorCyan},
+			style:   &Style{fg: ColorBlack | AttrUnderline, bg: ColorCyan},
 		},
 		stringsToStyleTest{
 			strings: []string{"reverse", "on_red", "white"},
-			style:   &Style{fg: termbox.ColorWhite | termbox.AttrReverse, bg: termbox.ColorRed},
+			style:   &Style{fg: ColorWhite | AttrReverse, bg: ColorRed},
 		},
 		stringsToStyleTest{
 			strings: []string{"on_bold", "on_magenta", "green"},
-			style:   &Style{fg: termbox.ColorGreen, bg: termbox.ColorMagenta | termbox.AttrBold},
+			style:   &Style{fg: ColorGreen, bg: ColorMagenta | AttrBold},
 		},
 	}
 
@@ -71,6 +69,23 @@ func TestStringsToStyle(t *testing.T) {
 			t.Errorf("Expected '%s' to be '%#v', but got '%#v'", test.strings, test.style, a)
 		}
 	}
+
+	t.Logf("Checking color -> strings -> color round trip...")
+	for _, test := range tests {
+		buf, err := json.Marshal(test.style)
+		if err != nil {
+			t.Errorf("Failed to marshal %#v: %s", test.style, err)
+			continue
+		}
+		var s Style
+		if err := json.Unmarshal(buf, &s); err != nil {
+			t.Errorf("Failed to unmarshal %s: %s", buf, err)
+			continue
+		}
+		if s != *test.style {
+			t.Errorf("Expected %s to be '%#v', but got '%#v'", buf, test.style, s)
+		}
+	}
 }
 
 func TestLocateRcfile(t *testing.T) {
@@ -122,3 +137,115 @@ func TestLocateRcfile(t *testing.T) {
 	LocateRcfile()
 
 }
+
+func TestScrollbarMode(t *testing.T) {
+	expected := map[string]ScrollbarMode{
+		`true`:    ScrollbarAlways,
+		`false`:   ScrollbarNever,
+		`"auto"`:  ScrollbarAuto,
+		`"true"`:  ScrollbarAlways,
+		`"false"`: ScrollbarNever,
+	}
+	for v, mode := range expected {
+		cfg := NewConfig()
+		if err := json.Unmarshal([]byte(`{"ShowScrollbar": `+v+`}`), cfg); err != nil {
+			t.Errorf("Error unmarshaling %s: %s", v, err)
+			continue
+		}
+		if cfg.ShowScrollbar != mode {
+			t.Errorf("Expected %s to be parsed as %s, got %s", v, mode, cfg.ShowScrollbar)
+		}
+	}
+
+	cfg := NewConfig()
+	if err := json.Unmarshal([]byte(`{"ShowScrollbar": "sometimes"}`), cfg); err == nil {
+		t.Errorf("Expected error for invalid ShowScrollbar value")
+	}
+}
+
+func TestMalformedConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.json")
+	txt := "{\n\t\"Prompt\": \"[peco]\",\n\t\"Filters\": [ \"Regexp\" ],\n}\n"
+	if err := ioutil.WriteFile(file, []byte(txt), 0644); err != nil {
+		t.Fatalf("Failed to write config: %s", err)
+	}
+
+	err = NewConfig().ReadFilename(file)
+	if err == nil || !strings.Contains(err.Error(), "line 4, column 1") {
+		t.Errorf("Expected error to point at line 4, column 1, got %v", err)
+	}
+
+	// Nothing is applied from a malformed config
+	ctx := newCtx(nil, 25)
+	if err := ctx.ReadConfig(file); err == nil {
+		t.Errorf("Expected malformed config to be rejected")
+	}
+	if ctx.config.Prompt != NewConfig().Prompt {
+		t.Errorf("Expected default prompt, got '%s'", ctx.config.Prompt)
+	}
+
+	// Neither is anything from a config that can't be applied
+	txt = `{ "Prompt": "[peco]", "Filters": [ "Regexp", "NoSuchFilter" ] }`
+	if err := ioutil.WriteFile(file, []byte(txt), 0644); err != nil {
+		t.Fatalf("Failed to write config: %s", err)
+	}
+	if err := ctx.ReadConfig(file); err == nil {
+		t.Errorf("Expected config with an unknown filter to be rejected")
+	}
+	if ctx.config.Prompt != NewConfig().Prompt {
+		t.Errorf("Expected default prompt, got '%s'", ctx.config.Prompt)
+	}
+	if n := ctx.filters.Size(); n != 6 {
+		t.Errorf("Expected the 6 built-in filters to be left, got %d", n)
+	}
+
+	if line, col := textPosition([]byte("ab\ncd"), 4); line != 2 || col != 2 {
+		t.Errorf("Expected line 2, column 2, got line %d, column %d", line, col)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.json")
+	txt := `{
+	"InitialFilter": "SmartCase",
+	"Profiles": {
+		"files": { "InitialFilter": "Glob" },
+		"logs": { "InitialFilter": "Regexp" },
+		"default": {}
+	}
+}`
+	if err := ioutil.WriteFile(file, []byte(txt), 0644); err != nil {
+		t.Fatalf("Failed to write config: %s", err)
+	}
+
+	defer os.Setenv(ProfileEnv, os.Getenv(ProfileEnv))
+	tests := map[string]string{
+		"":        SmartCaseMatch,
+		"files":   GlobMatch,
+		"logs":    RegexpMatch,
+		"default": SmartCaseMatch,
+		"unknown": SmartCaseMatch,
+	}
+	for profile, expected := range tests {
+		os.Setenv(ProfileEnv, profile)
+		ctx := newCtx(nil, 25)
+		if err := ctx.ReadConfig(file); err != nil {
+			t.Fatalf("Failed to read config: %s", err)
+		}
+		if f := ctx.Filter().String(); f != expected {
+			t.Errorf("Expected filter '%s' with profile '%s', got '%s'", expected, profile, f)
+		}
+	}
+}
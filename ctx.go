@@ -1,16 +1,26 @@
 package peco
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
+
+	"github.com/google/btree"
 )
 
-var screen = Screen(Termbox{})
+var screen = Screen(NewDiffScreen(Termbox{}))
 
 // CtxOptions is the interface that defines that options can be
 // passed in from the command line
@@ -24,12 +34,53 @@ type CtxOptions interface {
 	// (--buffer-size)
 	BufferSize() int
 
+	// BufferPolicy should return which lines are kept when the
+	// buffer is full: BufferPolicyHead or BufferPolicyTail
+	// (--buffer-policy)
+	BufferPolicy() string
+
 	// InitialIndex is the line number to put the cursor on
 	// when peco starts
 	InitialIndex() int
 
 	// LayoutType returns the name of the layout to use
 	LayoutType() string
+
+	// PrintQueryOnNoMatch should return true if the query should be
+	// emitted when the user accepts while no lines match the query
+	// (--print-query-on-no-match)
+	PrintQueryOnNoMatch() bool
+
+	// FieldSpec should return how lines are split into fields to
+	// display and to output, or nil to use the whole line
+	// (--delimiter, --display-fields, --output-field)
+	FieldSpec() *FieldSpec
+
+	// Unique should return true if lines whose output is the same as
+	// that of a line that was already read should be dropped (--unique)
+	Unique() bool
+
+	// Trim should return true if leading and trailing whitespace is
+	// removed from the lines read, for matching and output (--trim)
+	Trim() bool
+
+	// TrimDisplay should return true if leading and trailing
+	// whitespace is removed from the lines as they are displayed and
+	// matched against, but not from the output (--trim-display)
+	TrimDisplay() bool
+
+	// MaxSelect should return the maximum number of lines that can be
+	// selected, or 0 for no limit (--max-select)
+	MaxSelect() int
+
+	// SelectMarker should return the prefix that marks the lines read
+	// as selected, or an empty string (--select-marker)
+	SelectMarker() string
+
+	// SelectionOrder should return the order in which the selected
+	// lines are output: SelectionOrderBuffer or SelectionOrderPick
+	// (--selection-order)
+	SelectionOrder() string
 }
 
 type PageInfo struct {
@@ -105,14 +156,29 @@ func (q *FilterQuery) InsertQueryAt(ch rune, where int) {
 	q.query = buf
 }
 
+// ReplaceQueryAt replaces the runes in query[start:end] with `r`
+func (q *FilterQuery) ReplaceQueryAt(start, end int, r []rune) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	sq := q.query
+	buf := make([]rune, 0, len(sq)-(end-start)+len(r))
+	buf = append(buf, sq[:start]...)
+	buf = append(buf, r...)
+	buf = append(buf, sq[end:]...)
+	q.query = buf
+}
+
 // Ctx contains all the important data. while you can easily access
 // data in this struct from anywhere, only do so via channels
 type Ctx struct {
 	*Hub
 	*FilterQuery
 	filters             FilterSet
+	previousFilter      string // filter to go back to in ToggleRegexp
+	anchored            int32  // 1 if the Regexp filter matches whole lines (peco.ToggleAnchored). Use atomic operations
 	caretPosition       int
-	enableSep           bool
+	enableSep           int32 // 1 if the lines are split at the null separator (--null). Use atomic operations
 	resultCh            chan Line
 	mutex               sync.Locker
 	currentLine         int
@@ -120,6 +186,7 @@ type Ctx struct {
 	currentPage         *PageInfo
 	selection           *Selection
 	activeLineBuffer    LineBuffer
+	activeMutex         sync.Locker
 	rawLineBuffer       *RawLineBuffer
 	lines               []Line
 	linesMutex          sync.Locker
@@ -129,6 +196,37 @@ type Ctx struct {
 	config              *Config
 	selectionRangeStart int
 	layoutType          string
+	printQueryOnNoMatch bool
+	fieldSpec           *FieldSpec
+	unique              bool         // true if duplicate lines are dropped as they are read (--unique)
+	trim                bool         // true if whitespace is trimmed from the lines read (--trim)
+	trimDisplay         bool         // true if whitespace is trimmed from the lines displayed (--trim-display)
+	selectMarker        string       // prefix of the lines that are selected as they are read (--select-marker)
+	selectionOrder      string       // order of the selected lines in the output (--selection-order)
+	hideDuplicates      bool         // true if consecutive duplicate lines are hidden
+	uniqueView          *uniqueView  // the current buffer, without consecutive duplicates
+	lineOrder           *lineOrder   // the order of the lines moved with peco.MoveLineUp/Down
+	orderedView         *orderedView // the current buffer, sorted by lineOrder
+	hintMode            bool         // true while quick select hints are displayed
+	wrapCurrent         bool         // true if the current line is wrapped over several rows (peco.ToggleWrap)
+	helpLines           []string     // the key bindings displayed by peco.ShowHelp, nil when hidden
+	helpOffset          int          // the first of helpLines that is displayed
+	loading             int32        // 1 while the input is being read. Use atomic operations
+	resized             int32        // 1 once the terminal reported being resized. Use atomic operations
+	invalidQuery        int32        // 1 while the error of a query that is not valid is shown. Use atomic operations
+	shortQuery          int32        // 1 while the hint for a query shorter than MinQueryLength is shown. Use atomic operations
+	reader              *BufferReader
+	source              func() (io.ReadCloser, error)
+	aligner             *ColumnAligner // lines up the columns of the lines when displayed (--align)
+	formatter           *LineFormatter // renders the lines when displayed (--format)
+	selectedOnly        *RawLineBuffer // the lines that were selected, while only they are shown
+	scope               *RawLineBuffer // the lines matched by the scope query, nil if there is none (see SetScopeQuery)
+	scopeQuery          string         // the scope query, as displayed
+	progress            *filterProgress
+	stats               *filterStats
+	transformLine       func(string) string // applied to the lines read, see SetLineTransformer
+
+	drawRequestCh chan struct{} // holds a draw requested by RequestDraw until the view does it
 
 	wait *sync.WaitGroup
 	err  error
@@ -150,6 +248,7 @@ func newCtx(o CtxOptions, hubBufferSize int) *Ctx {
 		currentPage:         &PageInfo{},
 		selection:           NewSelection(),
 		activeLineBuffer:    nil,
+		activeMutex:         newMutex(),
 		rawLineBuffer:       NewRawLineBuffer(),
 		lines:               []Line{},
 		linesMutex:          newMutex(),
@@ -159,40 +258,89 @@ func newCtx(o CtxOptions, hubBufferSize int) *Ctx {
 		selectionRangeStart: invalidSelectionRange,
 		wait:                &sync.WaitGroup{},
 		layoutType:          "top-down",
+		uniqueView:          newUniqueView(),
+		lineOrder:           newLineOrder(),
+		orderedView:         newOrderedView(),
+		progress:            newFilterProgress(),
+		stats:               newFilterStats(),
+		drawRequestCh:       make(chan struct{}, 1),
 	}
 
 	if o != nil {
 		// XXX Pray this is really nil :)
-		c.enableSep = o.EnableNullSep()
+		c.setNullSep(o.EnableNullSep())
 		c.currentLine = o.InitialIndex()
 
 		c.rawLineBuffer.SetCapacity(o.BufferSize())
+		c.rawLineBuffer.SetPolicy(o.BufferPolicy())
 
 		if v := o.LayoutType(); v != "" {
 			c.layoutType = v
 		}
+
+		c.printQueryOnNoMatch = o.PrintQueryOnNoMatch()
+		c.fieldSpec = o.FieldSpec()
+		c.unique = o.Unique()
+		c.trim = o.Trim()
+		c.trimDisplay = o.TrimDisplay()
+		c.selection = NewLimitedSelection(o.MaxSelect())
+		c.selectMarker = o.SelectMarker()
+		c.selectionOrder = o.SelectionOrder()
 	}
 
 	c.filters.Add(NewIgnoreCaseFilter())
 	c.filters.Add(NewCaseSensitiveFilter())
 	c.filters.Add(NewSmartCaseFilter())
 	c.filters.Add(NewRegexpFilter())
+	c.filters.Add(NewExcludeFilter())
+	c.filters.Add(NewGlobFilter())
 
 	return c
 }
 
 const invalidSelectionRange = -1
 
+// ReadConfig reads the config file, and applies it. If the config
+// cannot be read or applied, an error is returned and nothing is
+// changed, so that peco can still go on with the defaults
 func (c *Ctx) ReadConfig(file string) error {
-	if err := c.config.ReadFilename(file); err != nil {
+	config := NewConfig()
+	if err := config.ReadFilename(file); err != nil {
 		return err
 	}
 
+	prevConfig, prevFilters := c.config, c.filters
+	c.config = config
+	c.filters = FilterSet{append([]QueryFilterer{}, prevFilters.filters...), prevFilters.current}
+	rollback := func() {
+		c.config, c.filters = prevConfig, prevFilters
+	}
+
 	if err := c.LoadCustomFilter(); err != nil {
+		rollback()
 		return err
 	}
 
-	c.SetCurrentFilterByName(c.config.InitialFilter)
+	if len(c.config.Filters) > 0 {
+		if err := c.filters.SetOrder(c.config.Filters); err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	for _, f := range c.filters.filters {
+		if rf, ok := f.(*RegexpFilter); ok {
+			rf.SetOrSeparator(c.config.OrSeparator)
+			rf.SetFallbackLiteral(c.config.RegexpFallbackLiteral)
+			rf.SetExtendedSyntax(c.config.ExtendedSearchSyntax)
+		}
+	}
+
+	initialFilter := c.config.InitialFilter
+	if p, ok := c.config.Profile(); ok && p.InitialFilter != "" {
+		initialFilter = p.InitialFilter
+	}
+	c.SetCurrentFilterByName(initialFilter)
 
 	if c.layoutType == "" { // Not set yet
 		if c.config.Layout != "" {
@@ -203,19 +351,71 @@ func (c *Ctx) ReadConfig(file string) error {
 	return nil
 }
 
+// IsLoading returns true while BufferReader is reading the input
+func (c *Ctx) IsLoading() bool {
+	return atomic.LoadInt32(&c.loading) == 1
+}
+
+// markResized records that the terminal reported that it was resized,
+// so its size doesn't need to be polled (see PollResize)
+func (c *Ctx) markResized() {
+	atomic.StoreInt32(&c.resized, 1)
+}
+
+// resizeReported returns true if the terminal ever reported that it
+// was resized
+func (c *Ctx) resizeReported() bool {
+	return atomic.LoadInt32(&c.resized) == 1
+}
+
+// RequestDraw asks the view to redraw the screen on its next frame
+// (see FrameInterval). Unlike SendDraw it never blocks, and any number
+// of requests made before then result in a single draw, so it can be
+// called for every line that is matched
+func (c *Ctx) RequestDraw() {
+	select {
+	case c.drawRequestCh <- struct{}{}:
+	default:
+		// A draw is already pending
+	}
+}
+
+func (c *Ctx) setLoading(loading bool) {
+	if loading {
+		atomic.StoreInt32(&c.loading, 1)
+	} else {
+		atomic.StoreInt32(&c.loading, 0)
+	}
+}
+
 func (c *Ctx) IsRangeMode() bool {
 	return c.selectionRangeStart != invalidSelectionRange
 }
 
 func (c *Ctx) SelectionLen() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.selection.Len()
 }
 
-func (c *Ctx) SelectionAdd(x int) {
+// SelectionMax returns the maximum number of lines that can be
+// selected (--max-select), or 0 if there is no limit
+func (c *Ctx) SelectionMax() int {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	return c.selection.Max()
+}
+
+func (c *Ctx) SelectionAdd(x int) {
+	c.mutex.Lock()
+	full := false
 	if l, err := c.GetCurrentLineBuffer().LineAt(x); err == nil {
-		c.selection.Add(l)
+		full = !c.selection.Add(l)
+	}
+	c.mutex.Unlock()
+
+	if full {
+		c.warnSelectionFull()
 	}
 }
 
@@ -223,14 +423,150 @@ func (c *Ctx) SelectionRemove(x int) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	if l, err := c.GetCurrentLineBuffer().LineAt(x); err == nil {
-		c.selection.Delete(l)
+		c.selection.Remove(l)
+	}
+}
+
+// SelectionToggle selects the line at index `x` in the current line
+// buffer, or deselects it if it is already selected
+func (c *Ctx) SelectionToggle(x int) {
+	c.mutex.Lock()
+	full := false
+	if l, err := c.GetCurrentLineBuffer().LineAt(x); err == nil {
+		if c.selection.Has(l) {
+			c.selection.Remove(l)
+		} else {
+			full = !c.selection.Add(l)
+		}
+	}
+	c.mutex.Unlock()
+
+	if full {
+		c.warnSelectionFull()
+	}
+}
+
+// SelectionAddLines adds `lines` to the selection, for as long as
+// it isn't full
+func (c *Ctx) SelectionAddLines(lines []Line) {
+	c.mutex.Lock()
+	full := false
+	for _, l := range lines {
+		if !c.selection.Add(l) {
+			full = true
+			break
+		}
+	}
+	c.mutex.Unlock()
+
+	if full {
+		c.warnSelectionFull()
+	}
+}
+
+// SelectionInvert selects those of `lines` that are not selected,
+// and deselects everything else
+func (c *Ctx) SelectionInvert(lines []Line) {
+	c.mutex.Lock()
+	old := c.selection
+	c.selection = NewLimitedSelection(old.Max())
+	c.selection.SetGroup(old.CurrentGroup())
+	full := false
+	for _, l := range lines {
+		if old.Has(l) {
+			continue
+		}
+		if !c.selection.Add(l) {
+			full = true
+			break
+		}
+	}
+	c.mutex.Unlock()
+
+	if full {
+		c.warnSelectionFull()
+	}
+}
+
+// SelectionLines returns the selected lines, sorted by ID
+func (c *Ctx) SelectionLines() []Line {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	lines := make([]Line, 0, c.selection.Len())
+	c.selection.Ascend(func(it btree.Item) bool {
+		lines = append(lines, it.(Line))
+		return true
+	})
+	return lines
+}
+
+// selectionOutput returns the selected lines in the order they are
+// output: one group after the other (see CycleSelectionGroup), in
+// the order they are displayed, or in the order they were selected
+// with --selection-order=pick
+func (c *Ctx) selectionOutput() []Line {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.selectionOrder == SelectionOrderPick {
+		return c.selection.PickedLines()
+	}
+	return c.selection.OrderedLines(c.lineOrder.Position)
+}
+
+// SelectionAddRange adds lines from `start` to `end` (inclusive)
+// in the current line buffer to the selection
+func (c *Ctx) SelectionAddRange(start, end int) {
+	c.mutex.Lock()
+	full := false
+	for _, l := range lineRange(c.GetCurrentLineBuffer().Snapshot(), start, end) {
+		if !c.selection.Add(l) {
+			full = true
+			break
+		}
+	}
+	c.mutex.Unlock()
+
+	if full {
+		c.warnSelectionFull()
+	}
+}
+
+// warnSelectionFull tells the user that a line could not be selected
+// because the selection is full (--max-select)
+func (c *Ctx) warnSelectionFull() {
+	c.SendStatusMsgAndClear(fmt.Sprintf("Cannot select more than %d lines", c.SelectionMax()), time.Second)
+}
+
+// SelectionRemoveRange removes lines from `start` to `end` (inclusive)
+// in the current line buffer from the selection
+func (c *Ctx) SelectionRemoveRange(start, end int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, l := range lineRange(c.GetCurrentLineBuffer().Snapshot(), start, end) {
+		c.selection.Remove(l)
+	}
+}
+
+// lineRange returns lines[start:end+1], clipped to the bounds of lines
+func lineRange(lines []Line, start, end int) []Line {
+	if start < 0 {
+		start = 0
+	}
+	if end >= len(lines) {
+		end = len(lines) - 1
+	}
+	if start > end {
+		return nil
 	}
+	return lines[start : end+1]
 }
 
 func (c *Ctx) SelectionClear() {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	c.selection = NewSelection()
+	old := c.selection
+	c.selection = NewLimitedSelection(old.Max())
+	c.selection.SetGroup(old.CurrentGroup())
 }
 
 func (c *Ctx) SelectionContains(n int) bool {
@@ -242,6 +578,33 @@ func (c *Ctx) SelectionContains(n int) bool {
 	return false
 }
 
+// SelectionHas returns true if the given line is selected
+func (c *Ctx) SelectionHas(l Line) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.selection.Has(l)
+}
+
+// SelectionGroup returns the group of a selected line (see
+// CycleSelectionGroup)
+func (c *Ctx) SelectionGroup(l Line) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.selection.Group(l)
+}
+
+// CycleSelectionGroup makes the lines that are selected from now on
+// part of the next group, and returns it. There is one group for the
+// Style.SavedSelection style, and one for each of the SelectionGroups styles
+func (c *Ctx) CycleSelectionGroup() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	group := (c.selection.CurrentGroup() + 1) % (len(c.config.SelectionGroups) + 1)
+	c.selection.SetGroup(group)
+	return group
+}
+
 func (c *Ctx) ResultCh() <-chan Line {
 	return c.resultCh
 }
@@ -261,42 +624,120 @@ func (c *Ctx) WaitDone() {
 var execQueryLock = newMutex()
 var execQueryTimer *time.Timer
 
+// execQueryGen is incremented whenever a query that is waiting for
+// QueryExecutionDelay to pass is discarded, so that a timer that is
+// already about to fire can tell that it has been discarded
+var execQueryGen uint64
+
+// discardPendingQuery discards the query that is waiting for
+// QueryExecutionDelay to pass, if any
+func discardPendingQuery() {
+	execQueryLock.Lock()
+	defer execQueryLock.Unlock()
+
+	if execQueryTimer != nil {
+		execQueryTimer.Stop()
+		execQueryTimer = nil
+	}
+	execQueryGen++
+}
+
+// ExecQuery sends the current query to be processed by the filter.
+// If QueryExecutionDelay is set, queries issued within that delay
+// are batched up, and only the last one is executed
 func (c *Ctx) ExecQuery() bool {
 	trace("Ctx.ExecQuery: START")
 	defer trace("Ctx.ExecQuery: END")
 
-	if c.QueryLen() <= 0 {
-		if c.activeLineBuffer != nil {
+	return c.execQuery(c.config.QueryExecutionDelay)
+}
+
+// ForceExecQuery sends the current query to be processed by the
+// filter right away, discarding any query that is waiting for
+// QueryExecutionDelay to pass
+func (c *Ctx) ForceExecQuery() bool {
+	trace("Ctx.ForceExecQuery: START")
+	defer trace("Ctx.ForceExecQuery: END")
+
+	discardPendingQuery()
+	return c.execQuery(0)
+}
+
+// ClearQuery empties the query, and shows all of the lines again
+// (unless EmptyQueryShowsAll is false).
+// The query that is waiting for QueryExecutionDelay to pass, if any,
+// is discarded, so that it doesn't bring back the old results
+func (c *Ctx) ClearQuery() {
+	discardPendingQuery()
+
+	c.SetQuery([]rune{})
+	c.SetCaretPos(0)
+	c.currentCol = 0
+	c.ResetActiveLineBuffer()
+}
+
+// queryTooShort returns true if `query` has been typed, but is
+// shorter than MinQueryLength, and thus should not be run
+func (c *Ctx) queryTooShort(query string) bool {
+	n := utf8.RuneCountInString(query)
+	return n > 0 && n < c.config.MinQueryLength
+}
+
+// shortQueryMsg returns the status message shown while the query is
+// shorter than MinQueryLength
+func (c *Ctx) shortQueryMsg() string {
+	return fmt.Sprintf("Type %d+ characters to filter", c.config.MinQueryLength)
+}
+
+func (c *Ctx) execQuery(delay int) bool {
+	query := c.QueryString()
+	if c.queryTooShort(query) {
+		// Make sure that a query from before the query got too short
+		// doesn't fire afterwards
+		discardPendingQuery()
+		if atomic.CompareAndSwapInt32(&c.shortQuery, 0, 1) {
+			c.SendStatusMsg(c.shortQueryMsg())
+		}
+	} else if atomic.CompareAndSwapInt32(&c.shortQuery, 1, 0) {
+		c.ClearStatusMsg(c.shortQueryMsg())
+	}
+
+	if query == "" || c.queryTooShort(query) {
+		if c.activeBuffer() != nil {
 			c.ResetActiveLineBuffer()
 			return true
 		}
 		return false
 	}
 
-	delay := c.config.QueryExecutionDelay
-
 	if delay <= 0 {
-		c.SendQuery(c.QueryString())
+		c.SendQuery(query)
 		return true
 	}
 
-	go func() {
-		// Wait $delay millisecs before sending the query
-		// if a new input comes in, batch them up
+	// Wait $delay millisecs before sending the query
+	// if a new input comes in, batch them up. The timer is handed
+	// over under execQueryLock, so that a query that is discarded
+	// (see discardPendingQuery) in the meantime never fires
+	execQueryLock.Lock()
+	defer execQueryLock.Unlock()
+	if execQueryTimer != nil {
+		return true
+	}
+	gen := execQueryGen
+	execQueryTimer = time.AfterFunc(time.Duration(delay)*time.Millisecond, func() {
 		execQueryLock.Lock()
-		defer execQueryLock.Unlock()
-		if execQueryTimer != nil {
+		if gen != execQueryGen {
+			// Discarded while the timer was firing
+			execQueryLock.Unlock()
 			return
 		}
-		execQueryTimer = time.AfterFunc(time.Duration(delay)*time.Millisecond, func() {
-			trace("Ctx.ExecQuery: Sending Query!")
-			c.SendQuery(c.QueryString())
+		execQueryTimer = nil
+		execQueryLock.Unlock()
 
-			execQueryLock.Lock()
-			defer execQueryLock.Unlock()
-			execQueryTimer = nil
-		})
-	}()
+		trace("Ctx.ExecQuery: Sending Query!")
+		c.SendQuery(c.QueryString())
+	})
 	return true
 }
 
@@ -304,30 +745,151 @@ func (c *Ctx) DrawPrompt() {
 	c.SendDrawPrompt()
 }
 
+// NewBufferReader creates a BufferReader that reads lines from `r`.
+// It becomes the reader that ReloadSource replaces
 func (c *Ctx) NewBufferReader(r io.ReadCloser) *BufferReader {
-	return &BufferReader{c, r, make(chan struct{}, 1)}
+	b := &BufferReader{
+		Ctx:          c,
+		input:        r,
+		inputReadyCh: make(chan struct{}, 1),
+		cancelCh:     make(chan struct{}),
+		doneCh:       make(chan struct{}),
+	}
+	c.reader = b
+	return b
+}
+
+// SetSource sets the function that opens the input. This is what
+// allows ReloadSource to read the input again. Inputs that cannot
+// be read twice (i.e. stdin) have no source
+func (c *Ctx) SetSource(open func() (io.ReadCloser, error)) {
+	c.source = open
+}
+
+// ReloadSource discards all of the lines, and reads the input again.
+// The query is kept, and lines with the same contents as the lines
+// that were selected are selected again once the input has been read
+func (c *Ctx) ReloadSource() error {
+	if c.source == nil {
+		return errors.New("error: the input cannot be reloaded")
+	}
+
+	in, err := c.source()
+	if err != nil {
+		return err
+	}
+
+	if c.reader != nil {
+		c.reader.Cancel()
+	}
+
+	selected := map[string]bool{}
+	c.mutex.Lock()
+	c.selection.Ascend(func(it btree.Item) bool {
+		selected[it.(Line).Buffer()] = true
+		return true
+	})
+	c.mutex.Unlock()
+	c.SelectionClear()
+	c.mutex.Lock()
+	c.selectedOnly = nil
+	c.scope, c.scopeQuery = nil, ""
+	c.mutex.Unlock()
+	c.rawLineBuffer.Reset()
+	c.lineOrder.Reset()
+	if c.aligner != nil {
+		c.aligner.Reset()
+	}
+
+	// The lines that were selected are selected again as they are
+	// read. The input is shown as being loaded right away, rather than
+	// once the reader gets going
+	r := c.NewBufferReader(in)
+	r.reselect = selected
+	r.onEOF = func() {
+		if !c.ExecQuery() {
+			c.SendDraw()
+		}
+	}
+	c.setLoading(true)
+	c.AddWaitGroup(1)
+	go r.Loop()
+
+	if !c.ExecQuery() {
+		c.SendDraw()
+	}
+	return nil
 }
 
 func (c *Ctx) NewView() *View {
 	var layout Layout
 	switch c.layoutType {
-	case "bottom-up":
+	case LayoutTypeBottomUp:
 		layout = NewBottomUpLayout(c)
+	case LayoutTypeCentered:
+		layout = NewCenteredLayout(c)
+	case LayoutTypeTopDownPromptBottom:
+		layout = NewTopDownPromptBottomLayout(c)
 	default:
 		layout = NewDefaultLayout(c)
 	}
-	return &View{c, newMutex(), layout}
+	return &View{Ctx: c, mutex: newMutex(), layout: layout}
 }
 
 func (c *Ctx) NewFilter() *Filter {
 	return &Filter{c}
 }
 
-func (c *Ctx) NewInput() *Input {
-	// Create a new keymap object
+// NewKeymap creates the Keymap used by Input, with the user's
+// configuration applied on top of the default key bindings
+func (c *Ctx) NewKeymap() Keymap {
 	k := NewKeymap(c.config.Keymap, c.config.Action)
 	k.ApplyKeybinding()
-	return &Input{c, newMutex(), nil, k, []string{}}
+	return k
+}
+
+// resolvedConfig is the configuration in effect, after the config
+// file and the command line options have been applied
+type resolvedConfig struct {
+	Config
+	Keymap        map[string]string
+	Layout        string
+	InitialFilter string
+	Filters       []string
+}
+
+// WriteConfig writes the configuration in effect to `w` as JSON.
+// The Keymap contains the default key bindings as well as the ones
+// from the config file
+func (c *Ctx) WriteConfig(w io.Writer) error {
+	rc := resolvedConfig{
+		Config:        *c.config,
+		Keymap:        map[string]string{},
+		Layout:        c.layoutType,
+		InitialFilter: c.Filter().String(),
+		Filters:       c.filters.Names(),
+	}
+	for _, b := range c.NewKeymap().Bindings() {
+		rc.Keymap[b.Keys] = b.Action
+	}
+
+	buf, err := json.MarshalIndent(rc, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	_, err = w.Write(buf)
+	return err
+}
+
+func (c *Ctx) NewInput() *Input {
+	return &Input{
+		Ctx:           c,
+		mutex:         newMutex(),
+		keymap:        c.NewKeymap(),
+		currentKeySeq: []string{},
+		callbackCh:    make(chan func()),
+	}
 }
 
 func (c *Ctx) SetSavedQuery(q []rune) {
@@ -350,13 +912,28 @@ func (c *Ctx) Filter() QueryFilterer {
 	return c.filters.GetCurrent()
 }
 
+// AddFilter registers a filter under `name`, so that it can be used
+// like the built-in filters: with --initial-filter, peco.RotateFilter,
+// FilterOrder, and so on. See QueryFilterer for what the filter has
+// to do. Returns an error if there already is a filter of that name
+func (c *Ctx) AddFilter(name string, f QueryFilterer) error {
+	if f.String() != name {
+		f = namedFilter{f, name}
+	}
+	return c.filters.Add(f)
+}
+
 func (c *Ctx) LoadCustomFilter() error {
 	if len(c.config.CustomFilter) == 0 {
 		return nil
 	}
 
 	for name, cfg := range c.config.CustomFilter {
-		f := NewExternalCmdFilter(name, cfg.Cmd, cfg.Args, cfg.BufferThreshold, c.enableSep)
+		f := NewExternalCmdFilter(name, cfg.Cmd, cfg.Args, cfg.BufferThreshold, c.nullSepOn())
+		f.SetBatchLimits(cfg.MaxBatchBytes, time.Duration(cfg.FlushInterval)*time.Millisecond)
+		if err := f.Verify(); err != nil {
+			return err
+		}
 		if err := c.filters.Add(f); err != nil {
 			return err
 		}
@@ -371,25 +948,47 @@ type signalHandler struct {
 
 func (c *Ctx) NewSignalHandler() *signalHandler {
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signals := append([]os.Signal{syscall.SIGINT, syscall.SIGTERM}, resizeSignals...)
+	signal.Notify(sigCh, signals...)
 	return &signalHandler{c, sigCh}
 }
 
+func isResizeSignal(sig os.Signal) bool {
+	for _, s := range resizeSignals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *signalHandler) Loop() {
 	defer s.ReleaseWaitGroup()
+	defer signal.Stop(s.sigCh)
 
 	for {
 		select {
 		case <-s.LoopCh():
 			return
-		case <-s.sigCh:
+		case sig := <-s.sigCh:
+			switch {
+			case isResizeSignal(sig):
+				trace("signalHandler.Loop: terminal was resized")
+				s.markResized()
+				s.SendDraw()
+				continue
+			case sig == syscall.SIGINT && s.config.IgnoreInterrupt:
+				trace("signalHandler.Loop: ignoring SIGINT")
+				continue
+			}
+
 			// XXX For future reference: DO NOT, and I mean DO NOT call
-			// termbox.Close() here. Calling termbox.Close() twice in our
+			// screen.Close() here. Calling Close() twice in our
 			// context actually BLOCKS. Can you believe it? IT BLOCKS.
 			//
-			// So if we called termbox.Close() here, and then in main()
-			// defer termbox.Close() blocks. Not cool.
-			s.ExitWith(fmt.Errorf("received signal"))
+			// So if we called Close() here, and then in main()
+			// defer screen.Close() blocks. Not cool.
+			s.ExitWith(fmt.Errorf("received signal %s", sig))
 			return
 		}
 	}
@@ -409,38 +1008,481 @@ func (c *Ctx) SetPrompt(p string) {
 }
 
 func (c *Ctx) AddRawLine(l *RawLine) {
+	if c.aligner != nil {
+		c.aligner.Add(l.DisplayString())
+	}
 	c.rawLineBuffer.AppendLine(l)
 }
 
-func (c Ctx) GetRawLineBufferSize() int {
+// SetColumnAligner sets the ColumnAligner used to line up the columns
+// of the lines when they are displayed. nil disables alignment
+func (c *Ctx) SetColumnAligner(ca *ColumnAligner) {
+	c.aligner = ca
+}
+
+// SetLineFormatter sets the LineFormatter used to render the lines
+// when they are displayed. nil displays them as they are
+func (c *Ctx) SetLineFormatter(lf *LineFormatter) {
+	c.formatter = lf
+}
+
+// SetLineTransformer sets a function that every line read from the
+// input goes through before it is added to the buffer, after --trim
+// and --select-marker were applied. Lines that it turns into empty
+// strings are dropped. nil disables it.
+//
+// Lines added with AddRawLine are not transformed
+func (c *Ctx) SetLineTransformer(f func(raw string) string) {
+	c.transformLine = f
+}
+
+func (c *Ctx) GetRawLineBufferSize() int {
 	return c.rawLineBuffer.Size()
 }
 
+// ResetActiveLineBuffer shows the lines for an empty query: all of
+// them, or none at all if EmptyQueryShowsAll is false
 func (c *Ctx) ResetActiveLineBuffer() {
-	c.rawLineBuffer.Replay()
-	c.SetActiveLineBuffer(c.rawLineBuffer)
+	if !c.config.EmptyQueryShowsAll {
+		c.setActiveBuffer(NewRawLineBuffer())
+		c.SendDraw()
+		return
+	}
+
+	b := c.sourceLineBuffer()
+	b.Replay()
+	c.SetActiveLineBuffer(b)
+}
+
+// sourceLineBuffer returns the buffer that queries are matched
+// against: the selected lines while only they are shown (see
+// ToggleSelectedOnly), the lines matched by the scope query (see
+// SetScopeQuery), or else all of the lines
+func (c *Ctx) sourceLineBuffer() *RawLineBuffer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.selectedOnly != nil {
+		return c.selectedOnly
+	}
+	if c.scope != nil {
+		return c.scope
+	}
+	return c.rawLineBuffer
+}
+
+// lineNumber returns the number of `l`, counting from 1: its index
+// in the raw buffer, or in the buffer that queries are matched against
+// if it was not read from the input (see FilterBufferThrough). Returns
+// 0 if the line is in neither. Lines are appended to these buffers in
+// the order of their IDs, and stay where they are even when they are
+// moved (see lineOrder), so the index is found by a binary search
+func (c *Ctx) lineNumber(l Line) int {
+	id := l.ID()
+	for _, b := range []*RawLineBuffer{c.rawLineBuffer, c.sourceLineBuffer()} {
+		lines := b.Snapshot()
+		i := sort.Search(len(lines), func(i int) bool { return lines[i].ID() >= id })
+		if i < len(lines) && lines[i].ID() == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// IsSelectedOnly returns true while only the selected lines are shown
+// (see ToggleSelectedOnly)
+func (c *Ctx) IsSelectedOnly() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.selectedOnly != nil
+}
+
+// ScopeQuery returns the scope query, or an empty string if there
+// is none
+func (c *Ctx) ScopeQuery() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.scopeQuery
+}
+
+// SetScopeQuery pins the lines matched by the current query: the
+// query is cleared, and the queries that follow are matched against
+// those lines alone until ClearScopeQuery is called. Setting a scope
+// while there is one narrows it down further. Lines that are read
+// afterwards are not part of the scope
+func (c *Ctx) SetScopeQuery() error {
+	query := c.QueryString()
+	if query == "" {
+		return errors.New("the query is empty")
+	}
+
+	// The results shown must be complete, and those of this query
+	done, result := c.progress.Result()
+	if done != query || result == nil || c.activeBuffer() != result {
+		return errors.New("the query is still being run")
+	}
+
+	b := NewRawLineBuffer()
+	for _, l := range result.Snapshot() {
+		// Drop the matches of the scope query
+		for {
+			ml, ok := l.(*MatchedLine)
+			if !ok {
+				break
+			}
+			l = ml.Line
+		}
+		b.Append(l)
+	}
+
+	if scope := c.ScopeQuery(); scope != "" {
+		query = scope + " > " + query
+	}
+	c.setScope(b, query)
+	return nil
+}
+
+// setScope makes `b` the lines that queries are matched against,
+// described by `query`, and shows them
+func (c *Ctx) setScope(b *RawLineBuffer, query string) {
+	c.mutex.Lock()
+	c.scope, c.scopeQuery = b, query
+	c.mutex.Unlock()
+	c.currentLine = 0
+	c.ClearQuery()
+}
+
+// FilterBufferThrough runs `command` via the shell, with the lines
+// shown as its input, and shows the lines it outputs in their place.
+// Like with SetScopeQuery, the query is cleared, and the queries that
+// follow are matched against those lines until ClearScopeQuery is
+// called. The lines are new, so the selection is cleared as well.
+//
+// It waits for the command to finish. peco.FilterBufferThrough runs
+// the command in the background with pipeLinesThrough instead, and
+// then applies its output with setFilteredBuffer
+func (c *Ctx) FilterBufferThrough(command string) error {
+	b, marked, err := c.pipeLinesThrough(command, c.GetCurrentLineBuffer().Snapshot())
+	if err != nil {
+		return err
+	}
+	c.setFilteredBuffer(command, b, marked)
+	return nil
+}
+
+// pipeLinesThrough runs `command` via the shell with `lines` as its
+// input, and returns the lines it outputs, read like the lines of the
+// input (see newInputLine), along with the lines that were marked
+// with --select-marker. It only reads from the Ctx, so that it can be
+// run in the background
+func (c *Ctx) pipeLinesThrough(command string, lines []Line) (*RawLineBuffer, []Line, error) {
+	input := &bytes.Buffer{}
+	for _, l := range lines {
+		input.WriteString(l.Buffer())
+		input.WriteByte('\n')
+	}
+
+	out, err := pipeShellCommand(command, input.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b := NewRawLineBuffer()
+	var marked []Line
+	r := bufio.NewReader(bytes.NewReader(out))
+	for {
+		in, err := c.readInputLine(r)
+		if err != nil {
+			break
+		}
+		l, isMarked := c.newInputLine(in)
+		if l == nil {
+			continue
+		}
+		b.Append(l)
+		if isMarked {
+			marked = append(marked, l)
+		}
+	}
+	return b, marked, nil
+}
+
+// setFilteredBuffer shows the lines output by `command` (see
+// pipeLinesThrough) in place of the lines shown, and selects `marked`
+func (c *Ctx) setFilteredBuffer(command string, b *RawLineBuffer, marked []Line) {
+	c.SelectionClear()
+	c.mutex.Lock()
+	for _, l := range marked {
+		c.selection.Add(l)
+	}
+	c.mutex.Unlock()
+	c.setScope(b, strings.TrimSpace(c.ScopeQuery()+" | "+command))
+}
+
+// ClearScopeQuery drops the scope query, so that the query is
+// matched against all of the lines again
+func (c *Ctx) ClearScopeQuery() error {
+	c.mutex.Lock()
+	if c.scope == nil {
+		c.mutex.Unlock()
+		return errors.New("there is no scope query")
+	}
+	c.scope, c.scopeQuery = nil, ""
+	c.mutex.Unlock()
+
+	c.currentLine = 0
+	if c.QueryLen() == 0 {
+		c.ResetActiveLineBuffer()
+		return nil
+	}
+	c.ForceExecQuery()
+	return nil
+}
+
+// ToggleSelectedOnly switches between showing only the lines that
+// are currently selected, and showing all of the lines. While only
+// the selected lines are shown, the query is matched against them
+// alone, so that the selection can be narrowed down further
+func (c *Ctx) ToggleSelectedOnly() error {
+	if c.IsSelectedOnly() {
+		c.mutex.Lock()
+		c.selectedOnly = nil
+		c.mutex.Unlock()
+	} else {
+		if c.SelectionLen() == 0 {
+			return errors.New("no lines are selected")
+		}
+		b := NewRawLineBuffer()
+		c.mutex.Lock()
+		c.selection.Ascend(func(it btree.Item) bool {
+			// Drop the matches of the query the line was selected with
+			l := it.(Line)
+			for {
+				ml, ok := l.(*MatchedLine)
+				if !ok {
+					break
+				}
+				l = ml.Line
+			}
+			b.Append(l)
+			return true
+		})
+		c.selectedOnly = b
+		c.mutex.Unlock()
+	}
+
+	c.currentLine = 0
+	if c.QueryLen() == 0 {
+		c.ResetActiveLineBuffer()
+		return nil
+	}
+	c.ForceExecQuery()
+	return nil
 }
 
 func (c *Ctx) SetActiveLineBuffer(l *RawLineBuffer) {
-	c.activeLineBuffer = l
-
-	go func(l *RawLineBuffer) {
-		prev := time.Time{}
-		for _ = range l.OutputCh() {
-			if time.Since(prev) > time.Millisecond {
-				c.SendDraw()
-				prev = time.Now()
+	// The channel is taken here, as the buffer may be replayed again
+	// (which replaces the channel) before the goroutine starts
+	ch := l.OutputCh()
+	c.setActiveBuffer(l)
+
+	go func(ch chan Line) {
+		for _ = range ch {
+			c.RequestDraw()
+		}
+		c.RequestDraw()
+	}(ch)
+}
+
+// setActiveBuffer and activeBuffer guard activeLineBuffer, which
+// the filter replaces while the view and the input read it
+func (c *Ctx) setActiveBuffer(b LineBuffer) {
+	c.activeMutex.Lock()
+	defer c.activeMutex.Unlock()
+	c.activeLineBuffer = b
+}
+
+func (c *Ctx) activeBuffer() LineBuffer {
+	c.activeMutex.Lock()
+	defer c.activeMutex.Unlock()
+	return c.activeLineBuffer
+}
+
+// emptyLineBuffer is shown before the first query is run if
+// EmptyQueryShowsAll is false. Nothing is ever appended to it
+var emptyLineBuffer = NewRawLineBuffer()
+
+func (c *Ctx) GetCurrentLineBuffer() LineBuffer {
+	var b LineBuffer = c.rawLineBuffer
+	switch active := c.activeBuffer(); {
+	case active != nil:
+		b = active
+	case !c.config.EmptyQueryShowsAll:
+		b = emptyLineBuffer
+	}
+	b = c.orderedView.Get(b, c.lineOrder)
+	if c.hideDuplicates {
+		return c.uniqueView.Get(b)
+	}
+	return b
+}
+
+// ToggleHideDuplicates hides or shows the lines whose output is the
+// same as that of the line right before them. The cursor stays on
+// the same line, or on the line that hides it
+func (c *Ctx) ToggleHideDuplicates() {
+	current, err := c.GetCurrentLineBuffer().LineAt(c.currentLine)
+	c.hideDuplicates = !c.hideDuplicates
+	if err != nil {
+		return
+	}
+
+	c.currentLine = 0
+	pos := c.lineOrder.Position(current)
+	for i, l := range c.GetCurrentLineBuffer().Snapshot() {
+		if c.lineOrder.Position(l) > pos {
+			break
+		}
+		c.currentLine = i
+	}
+}
+
+// ToggleWrap turns the wrapping of the current line on or off (see
+// peco.ToggleWrap), and returns true if it is now on
+func (c *Ctx) ToggleWrap() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.wrapCurrent = !c.wrapCurrent
+	return c.wrapCurrent
+}
+
+// IsWrapped returns true if the current line is wrapped over several
+// rows
+func (c *Ctx) IsWrapped() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.wrapCurrent
+}
+
+// setHelp displays `lines` in place of the lines (see peco.ShowHelp),
+// starting from the first one. nil hides them
+func (c *Ctx) setHelp(lines []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.helpLines, c.helpOffset = lines, 0
+}
+
+// help returns the lines displayed by peco.ShowHelp, nil if they are
+// hidden, and the index of the first one displayed
+func (c *Ctx) help() ([]string, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.helpLines, c.helpOffset
+}
+
+// helpShown returns true while peco.ShowHelp displays the key bindings
+func (c *Ctx) helpShown() bool {
+	lines, _ := c.help()
+	return lines != nil
+}
+
+// setHelpOffset scrolls the lines displayed by peco.ShowHelp
+func (c *Ctx) setHelpOffset(offset int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.helpOffset = offset
+}
+
+// ToggleNullSep turns the null separator mode (--null) on or off.
+// The lines read so far, including the selected ones, are split
+// again, so that both the strings to display and the strings to
+// output follow the new mode. The query has to be run again to
+// display them
+func (c *Ctx) ToggleNullSep() {
+	enableSep := !c.nullSepOn()
+	c.setNullSep(enableSep)
+
+	resplit := func(l Line) Line {
+		for {
+			ml, ok := l.(*MatchedLine)
+			if !ok {
+				break
 			}
+			l = ml.Line
 		}
-		c.SendDraw()
-	}(l)
+		rl, ok := l.(*RawLine)
+		if !ok {
+			return l
+		}
+		nl := rl.resplit(enableSep, c.config.MaxLineLength)
+		if c.trimDisplay {
+			nl.trimDisplayString()
+		}
+		return nl
+	}
+
+	c.rawLineBuffer.Map(resplit)
+	c.mutex.Lock()
+	selectedOnly, scope := c.selectedOnly, c.scope
+	c.mutex.Unlock()
+	if selectedOnly != nil {
+		selectedOnly.Map(resplit)
+	}
+	if scope != nil {
+		scope.Map(resplit)
+	}
+
+	// Lines are replaced by the ones with the same ID
+	c.mutex.Lock()
+	var selected []Line
+	c.selection.Ascend(func(it btree.Item) bool {
+		selected = append(selected, resplit(it.(Line)))
+		return true
+	})
+	for _, l := range selected {
+		c.selection.ReplaceOrInsert(l)
+	}
+	c.mutex.Unlock()
 }
 
-func (c Ctx) GetCurrentLineBuffer() LineBuffer {
-	if b := c.activeLineBuffer; b != nil {
-		return b
+// setNullSep turns the null separator mode on or off, for the lines
+// read from then on
+func (c *Ctx) setNullSep(on bool) {
+	var v int32
+	if on {
+		v = 1
 	}
-	return c.rawLineBuffer
+	atomic.StoreInt32(&c.enableSep, v)
+}
+
+// nullSepOn returns true if the lines are split at the null separator
+func (c *Ctx) nullSepOn() bool {
+	return atomic.LoadInt32(&c.enableSep) == 1
+}
+
+// MoveCurrentLine swaps the line under the cursor with the line
+// `delta` lines away (-1 for the line before it, 1 for the line
+// after it), and moves the cursor along. Only the positions of the
+// two lines are swapped (see lineOrder), so the lines in between that
+// are not shown stay where they are, and the new order survives
+// changing the query. The selected lines are output in that order
+func (c *Ctx) MoveCurrentLine(delta int) error {
+	if c.hideDuplicates {
+		return errors.New("cannot move lines while duplicates are hidden")
+	}
+
+	b := c.GetCurrentLineBuffer()
+	x, err := b.LineAt(c.currentLine)
+	if err != nil {
+		return err
+	}
+	y, err := b.LineAt(c.currentLine + delta)
+	if err != nil {
+		return err
+	}
+
+	c.lineOrder.Swap(x, y)
+	c.currentLine += delta
+	return nil
 }
 
 func (c *Ctx) RotateFilter() {
@@ -451,6 +1493,46 @@ func (c *Ctx) SetCurrentFilterByName(name string) error {
 	return c.filters.SetCurrentByName(name)
 }
 
+// ToggleRegexp switches the current filter to the Regexp filter. If
+// the Regexp filter is already in effect, it switches back to the
+// filter that was in effect before (IgnoreCase, if there was none)
+func (c *Ctx) ToggleRegexp() error {
+	current := c.Filter().String()
+	if current != RegexpMatch {
+		if err := c.SetCurrentFilterByName(RegexpMatch); err != nil {
+			return err
+		}
+		c.previousFilter = current
+		return nil
+	}
+
+	prev := c.previousFilter
+	if prev == "" {
+		prev = IgnoreCaseMatch
+	}
+	return c.SetCurrentFilterByName(prev)
+}
+
+// ToggleAnchored switches the Regexp filter between matching the
+// terms of the query anywhere in the line, and matching the whole line
+// (as if each term was wrapped with ^ and $). Other filters are not
+// affected
+func (c *Ctx) ToggleAnchored() {
+	atomic.StoreInt32(&c.anchored, 1-atomic.LoadInt32(&c.anchored))
+}
+
+// anchoredOn returns true if ToggleAnchored was turned on, whether
+// or not the current filter can match whole lines
+func (c *Ctx) anchoredOn() bool {
+	return atomic.LoadInt32(&c.anchored) == 1
+}
+
+// IsAnchored returns true if the current filter matches whole lines
+// (see ToggleAnchored)
+func (c *Ctx) IsAnchored() bool {
+	return c.anchoredOn() && isAnchorable(c.Filter())
+}
+
 func (c *Ctx) startInput() {
 	c.AddWaitGroup(1)
 	go c.NewInput().Loop()
@@ -0,0 +1,313 @@
+package peco
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignalHandler(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	ctx.config.IgnoreInterrupt = true
+
+	sig := ctx.NewSignalHandler()
+	ctx.AddWaitGroup(1)
+	go sig.Loop()
+
+	for _, s := range resizeSignals {
+		sig.sigCh <- s
+		select {
+		case r := <-ctx.DrawCh():
+			if r.DataInterface() != nil {
+				t.Errorf("Expected a request to redraw the screen, got %#v", r.DataInterface())
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected %s to trigger a redraw", s)
+		}
+	}
+
+	sig.sigCh <- syscall.SIGINT
+	time.Sleep(100 * time.Millisecond)
+	if err := ctx.Error(); err != nil {
+		t.Errorf("Expected SIGINT to be ignored, got %s", err)
+	}
+
+	sig.sigCh <- syscall.SIGTERM
+	ctx.WaitDone()
+	if ctx.Error() == nil {
+		t.Errorf("Expected SIGTERM to stop peco")
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	ctx.config.Keymap["C-j"] = "peco.Finish"
+	ctx.config.Style.Query = Style{fg: ColorYellow | AttrBold, bg: ColorDefault}
+	ctx.SetCurrentFilterByName(RegexpMatch)
+
+	buf := &bytes.Buffer{}
+	if err := ctx.WriteConfig(buf); err != nil {
+		t.Fatalf("Failed to write config: %s", err)
+	}
+
+	var rc struct {
+		Keymap        map[string]string
+		Layout        string
+		InitialFilter string
+		Filters       []string
+		Style         map[string][]string
+	}
+	if err := json.Unmarshal(buf.Bytes(), &rc); err != nil {
+		t.Fatalf("Failed to parse %s: %s", buf, err)
+	}
+
+	if rc.Keymap["C-j"] != "peco.Finish" {
+		t.Errorf("Expected C-j to be bound to peco.Finish, got '%s'", rc.Keymap["C-j"])
+	}
+	if rc.Keymap["C-n"] != "peco.SelectDown" {
+		t.Errorf("Expected default binding C-n to be peco.SelectDown, got '%s'", rc.Keymap["C-n"])
+	}
+	if rc.Layout != "top-down" {
+		t.Errorf("Expected layout 'top-down', got '%s'", rc.Layout)
+	}
+	if rc.InitialFilter != RegexpMatch {
+		t.Errorf("Expected initial filter '%s', got '%s'", RegexpMatch, rc.InitialFilter)
+	}
+	if len(rc.Filters) != ctx.filters.Size() {
+		t.Errorf("Expected %d filters, got %v", ctx.filters.Size(), rc.Filters)
+	}
+	if q := strings.Join(rc.Style["Query"], ","); q != "yellow,bold" {
+		t.Errorf("Expected Query style to be 'yellow,bold', got '%s'", q)
+	}
+}
+
+func TestReloadSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "input")
+	ioutil.WriteFile(file, []byte("Alice\nBob\nCharlie\n"), 0644)
+
+	ctx := newCtx(nil, 25)
+	if err := ctx.ReloadSource(); err == nil {
+		t.Errorf("Expected input without a source to not be reloadable")
+	}
+
+	ctx.SetSource(func() (io.ReadCloser, error) {
+		return os.Open(file)
+	})
+	if err := ctx.ReloadSource(); err != nil {
+		t.Fatalf("Failed to load input: %s", err)
+	}
+	waitReader := func() {
+		select {
+		case <-ctx.reader.doneCh:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected reader to finish")
+		}
+	}
+	waitReader()
+	ctx.SelectionAdd(1)
+
+	ioutil.WriteFile(file, []byte("Bob\nDavid\n"), 0644)
+	if err := ctx.ReloadSource(); err != nil {
+		t.Fatalf("Failed to reload input: %s", err)
+	}
+	waitReader()
+
+	lines := []string{}
+	for _, l := range ctx.rawLineBuffer.Snapshot() {
+		lines = append(lines, l.DisplayString())
+	}
+	if s := strings.Join(lines, ","); s != "Bob,David" {
+		t.Errorf("Expected lines to be 'Bob,David', got '%s'", s)
+	}
+	if ctx.SelectionLen() != 1 || !ctx.SelectionContains(0) {
+		t.Errorf("Expected 'Bob' to still be selected")
+	}
+
+	// The input is shown as being loaded again, and the selection is
+	// restored as the lines come in, before the entire input is read
+	pr, pw := io.Pipe()
+	ctx.SetSource(func() (io.ReadCloser, error) {
+		return pr, nil
+	})
+	if err := ctx.ReloadSource(); err != nil {
+		t.Fatalf("Failed to reload input: %s", err)
+	}
+	if !ctx.IsLoading() {
+		t.Errorf("Expected the input to be loading again")
+	}
+	pw.Write([]byte("Alice\nBob\n"))
+	deadline := time.Now().Add(time.Second)
+	for !ctx.SelectionContains(1) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !ctx.SelectionContains(1) {
+		t.Errorf("Expected 'Bob' to be selected as soon as it is read")
+	}
+	pw.Close()
+	waitReader()
+	if ctx.IsLoading() {
+		t.Errorf("Expected the input to be loaded")
+	}
+	if ctx.SelectionLen() != 1 {
+		t.Errorf("Expected 'Bob' alone to be selected, got %d lines", ctx.SelectionLen())
+	}
+}
+
+func TestEmptyQueryShowsAll(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	ctx.config.EmptyQueryShowsAll = false
+	for _, l := range []string{"Alice", "Bob", "Charlie"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+
+	if !waitForLines(t, ctx, "") {
+		t.Errorf("Expected no lines to be shown before anything is typed")
+	}
+
+	ctx.SetQuery([]rune("li"))
+	ctx.ForceExecQuery()
+	select {
+	case q := <-ctx.QueryCh():
+		ctx.NewFilter().Work(make(chan struct{}), q)
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the query to be executed")
+	}
+	if !waitForLines(t, ctx, "Alice,Charlie") {
+		t.Errorf("Expected the matching lines to be shown")
+	}
+
+	ctx.ClearQuery()
+	if !waitForLines(t, ctx, "") {
+		t.Errorf("Expected no lines to be shown after the query is cleared")
+	}
+
+	ctx.config.EmptyQueryShowsAll = true
+	ctx.ClearQuery()
+	if !waitForLines(t, ctx, "Alice,Bob,Charlie") {
+		t.Errorf("Expected all of the lines to be shown after the query is cleared")
+	}
+}
+
+func TestQueryFollowsInput(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	defer ctx.Stop()
+	ctx.AddWaitGroup(1)
+	go ctx.NewFilter().Loop()
+	ctx.SetQuery([]rune("match"))
+
+	// As lines come in, the query is run again
+	pr, pw := io.Pipe()
+	rdr := ctx.NewBufferReader(pr)
+	rdr.onEOF = func() {}
+	ctx.AddWaitGroup(1)
+	go rdr.Loop()
+	io.WriteString(pw, "match 1\nother\n")
+	if !waitForLines(t, ctx, "match 1") {
+		t.Errorf("Expected the query to be run on the lines read")
+	}
+	io.WriteString(pw, "other\nmatch 2\n")
+	if !waitForLines(t, ctx, "match 1,match 2") {
+		t.Errorf("Expected the query to be run again on the lines read later")
+	}
+	pw.Close()
+
+	// Likewise once the input is reloaded, even if it is empty
+	for _, input := range []string{"other\nmatch 3\n", ""} {
+		input := input
+		ctx.SetSource(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(input)), nil
+		})
+		if err := ctx.ReloadSource(); err != nil {
+			t.Fatalf("Failed to reload the input: %s", err)
+		}
+		expected := strings.TrimPrefix(strings.TrimSpace(input), "other\n")
+		if !waitForLines(t, ctx, expected) {
+			t.Errorf("Expected the query to show '%s' once %q is reloaded", expected, input)
+		}
+	}
+}
+
+func TestMinQueryLength(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	ctx.config.MinQueryLength = 3
+	ctx.config.QueryExecutionDelay = 50
+	for _, l := range []string{"Alice", "Bob", "Charlie"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	ctx.activeLineBuffer = NewRawLineBuffer()
+
+	msgs := make(chan StatusMsgRequest, 16)
+	go func() {
+		for r := range ctx.StatusMsgCh() {
+			msgs <- r.DataInterface().(StatusMsgRequest)
+		}
+	}()
+	expectStatus := func(expected string, clear bool) {
+		select {
+		case m := <-msgs:
+			if m.message != expected || m.clear != clear {
+				t.Errorf("Expected status message '%s' (clear: %t), got '%s' (clear: %t)", expected, clear, m.message, m.clear)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected status message '%s'", expected)
+		}
+	}
+	expectNoQuery := func() {
+		select {
+		case q := <-ctx.QueryCh():
+			t.Errorf("Expected no query to be run, got '%s'", q.DataString())
+		case <-time.After(150 * time.Millisecond):
+		}
+	}
+
+	// Short queries aren't run, and all of the lines are shown
+	ctx.SetQuery([]rune("Al"))
+	ctx.ExecQuery()
+	expectStatus("Type 3+ characters to filter", false)
+	if n := ctx.GetCurrentLineBuffer().Size(); n != 3 {
+		t.Errorf("Expected all 3 lines to be shown, got %d", n)
+	}
+	expectNoQuery()
+
+	// Once the query is long enough, it is run and the hint goes away
+	// if it is still shown
+	ctx.SetQuery([]rune("Ali"))
+	ctx.ExecQuery()
+	expectStatus("Type 3+ characters to filter", true)
+
+	// The query waiting for QueryExecutionDelay is dropped if the
+	// query gets too short again in the meantime
+	ctx.SetQuery([]rune("A"))
+	ctx.ExecQuery()
+	expectStatus("Type 3+ characters to filter", false)
+	expectNoQuery()
+	if n := ctx.GetCurrentLineBuffer().Size(); n != 3 {
+		t.Errorf("Expected all 3 lines to be shown again, got %d", n)
+	}
+
+	// The filter checks the query it was sent, not the one typed since
+	ctx.AddWaitGroup(1)
+	go ctx.NewFilter().Loop()
+	defer ctx.Stop()
+	ctx.SetQuery([]rune("Alice"))
+	ctx.SendQuery("Alice")
+	if !waitForLines(t, ctx, "Alice") {
+		t.Fatalf("Expected the query to filter the lines")
+	}
+	ctx.SendQuery("Al")
+	if !waitForLines(t, ctx, "Alice,Bob,Charlie") {
+		t.Errorf("Expected a short query not to filter the lines")
+	}
+}
@@ -8,5 +8,3 @@ const debug = true
 func newMutex() sync.Locker {
 	return &sync.Mutex{}
 }
-
-func trace(f string, args ...interface{}) {}
\ No newline at end of file
@@ -12,13 +12,12 @@ import (
 
 const debug = true
 
-var tracer *log.Logger
 var mutexTracer *log.Logger
 
 func init() {
 	if v, err := strconv.ParseBool(os.Getenv("PECO_TRACE")); err == nil && v {
-		tracer = log.New(os.Stderr, "peco: ", log.LstdFlags)
-		tracer.Printf("==== INITIALIZED tracer ====")
+		setTraceOutput(os.Stderr, nil)
+		trace("==== INITIALIZED tracer ====")
 	}
 	if v, err := strconv.ParseBool(os.Getenv("PECO_LOCK_TRACE")); err == nil && v {
 		mutexTracer = log.New(os.Stderr, "mutex: ", log.LstdFlags)
@@ -26,13 +25,6 @@ func init() {
 	}
 }
 
-func trace(f string, args ...interface{}) {
-	if tracer == nil {
-		return
-	}
-	tracer.Printf(f, args...)
-}
-
 func mutexTrace(f string, args ...interface{}) {
 	if mutexTracer == nil {
 		return
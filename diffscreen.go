@@ -0,0 +1,171 @@
+package peco
+
+import (
+	"sync"
+)
+
+type cell struct {
+	ch rune
+	fg Attribute
+	bg Attribute
+}
+
+// invalidCell never matches anything that can be written to the
+// screen, and is used to force a row to be redrawn
+var invalidCell = cell{ch: -1}
+
+// DiffScreen wraps another Screen, and remembers what has been written
+// to it. SetCell() only records what the screen should look like, and
+// Flush() forwards the cells in the rows that actually changed since
+// the previous Flush()
+type DiffScreen struct {
+	Screen
+	mutex  sync.Locker
+	width  int
+	height int
+	front  [][]cell // what has been written to the underlying screen
+	back   [][]cell // what the screen should look like
+	dirty  []bool   // rows in back that differ from front
+}
+
+// NewDiffScreen creates a new DiffScreen that writes to `s`
+func NewDiffScreen(s Screen) *DiffScreen {
+	return &DiffScreen{
+		Screen: s,
+		mutex:  newMutex(),
+	}
+}
+
+// Size returns the dimensions of the underlying screen. If the
+// dimensions have changed since the last call, the entire screen
+// is redrawn upon the next Flush()
+func (d *DiffScreen) Size() (int, int) {
+	w, h := d.Screen.Size()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.resize(w, h)
+	return w, h
+}
+
+// TerminalSize asks the underlying screen for the current size of
+// the terminal (see Termbox.TerminalSize). Screens that can't tell
+// return their Size
+func (d *DiffScreen) TerminalSize() (int, int, error) {
+	if s, ok := d.Screen.(terminalSizer); ok {
+		return s.TerminalSize()
+	}
+	w, h := d.Screen.Size()
+	return w, h, nil
+}
+
+// Suspend gives the terminal up, if the underlying screen can do so
+// (see suspender)
+func (d *DiffScreen) Suspend() {
+	if s, ok := d.Screen.(suspender); ok {
+		s.Suspend()
+	}
+}
+
+// Resume takes the terminal over again. Whatever was on the screen is
+// gone, so the entire screen is redrawn upon the next Flush()
+func (d *DiffScreen) Resume() error {
+	s, ok := d.Screen.(suspender)
+	if !ok {
+		return nil
+	}
+	if err := s.Resume(); err != nil {
+		return err
+	}
+	d.Invalidate()
+	return nil
+}
+
+func (d *DiffScreen) resize(w, h int) {
+	if d.width == w && d.height == h && d.back != nil {
+		return
+	}
+
+	trace("DiffScreen.resize: %dx%d -> %dx%d", d.width, d.height, w, h)
+	d.width = w
+	d.height = h
+	d.front = make([][]cell, h)
+	d.back = make([][]cell, h)
+	d.dirty = make([]bool, h)
+	for y := 0; y < h; y++ {
+		d.front[y] = make([]cell, w)
+		d.back[y] = make([]cell, w)
+		for x := 0; x < w; x++ {
+			d.front[y][x] = invalidCell
+			d.back[y][x] = cell{' ', ColorDefault, ColorDefault}
+		}
+		d.dirty[y] = true
+	}
+}
+
+// SetCell records the contents of the cell at (x, y). Nothing is
+// written to the underlying screen until Flush() is called
+func (d *DiffScreen) SetCell(x, y int, ch rune, fg, bg Attribute) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.back == nil {
+		d.mutex.Unlock()
+		w, h := d.Screen.Size()
+		d.mutex.Lock()
+		d.resize(w, h)
+	}
+
+	if x < 0 || x >= d.width || y < 0 || y >= d.height {
+		return
+	}
+
+	c := cell{ch, fg, bg}
+	if d.back[y][x] == c {
+		return
+	}
+	d.back[y][x] = c
+	d.dirty[y] = true
+}
+
+// Flush writes the cells that changed since the last Flush() to the
+// underlying screen, and then flushes it
+func (d *DiffScreen) Flush() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	rows := 0
+	for y, dirty := range d.dirty {
+		if !dirty {
+			continue
+		}
+
+		rows++
+		front := d.front[y]
+		for x, c := range d.back[y] {
+			if front[x] == c {
+				continue
+			}
+			d.Screen.SetCell(x, y, c.ch, c.fg, c.bg)
+			front[x] = c
+		}
+		d.dirty[y] = false
+	}
+	trace("DiffScreen.Flush: redrew %d rows", rows)
+
+	return d.Screen.Flush()
+}
+
+// Invalidate forgets what has been written to the underlying screen,
+// so that the entire screen is redrawn upon the next Flush()
+func (d *DiffScreen) Invalidate() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for y, row := range d.front {
+		for x := range row {
+			row[x] = invalidCell
+		}
+		d.dirty[y] = true
+	}
+}
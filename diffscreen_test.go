@@ -0,0 +1,96 @@
+package peco
+
+import (
+	"fmt"
+	"testing"
+)
+
+func newDiffDummyScreen(width, height int) (*interceptor, *DiffScreen) {
+	i := newInterceptor()
+	return i, NewDiffScreen(dummyScreen{
+		i,
+		width,
+		height,
+		make(chan Event, 256),
+	})
+}
+
+func TestDiffScreen(t *testing.T) {
+	i, d := newDiffDummyScreen(10, 3)
+	old := screen
+	screen = d
+	defer func() { screen = old }()
+
+	draw := func(rows ...string) int {
+		i.reset()
+		for y, row := range rows {
+			printScreen(0, y, ColorDefault, ColorDefault, row, true)
+		}
+		d.Flush()
+		return len(i.events["SetCell"])
+	}
+
+	if n := draw("foo", "bar", "baz"); n != 30 {
+		t.Errorf("Expected the first draw to write all 30 cells, got %d", n)
+	}
+
+	if n := draw("foo", "bar", "baz"); n != 0 {
+		t.Errorf("Expected nothing to be written when nothing changed, got %d", n)
+	}
+
+	if n := draw("foo", "bat", "baz"); n != 1 {
+		t.Errorf("Expected only 1 cell to be written, got %d", n)
+	}
+
+	d.Invalidate()
+	if n := draw("foo", "bat", "baz"); n != 30 {
+		t.Errorf("Expected all 30 cells to be written after Invalidate, got %d", n)
+	}
+
+	// Resizing should also force a full redraw
+	d.Screen = dummyScreen{i, 20, 3, nil}
+	d.Size()
+	if n := draw("foo", "bat", "baz"); n != 60 {
+		t.Errorf("Expected all 60 cells to be written after resize, got %d", n)
+	}
+}
+
+func benchmarkDrawScreen(b *testing.B, useDiff bool) {
+	i := newInterceptor()
+	var s Screen = dummyScreen{i, 200, 50, make(chan Event, 256)}
+	if useDiff {
+		s = NewDiffScreen(s)
+	}
+	old := screen
+	screen = s
+	defer func() { screen = old }()
+
+	ctx := NewCtx(nil)
+	for n := 0; n < 1000; n++ {
+		ctx.AddRawLine(NewRawLine(fmt.Sprintf("%d: Hello, World!", n), false))
+	}
+	layout := NewDefaultLayout(ctx)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		// Simulate the user moving up and down
+		if n%2 == 0 {
+			ctx.currentLine = 0
+		} else {
+			ctx.currentLine = 1
+		}
+		layout.list.SetDirty(true)
+		layout.DrawScreen()
+	}
+	b.StopTimer()
+
+	b.Logf("%d SetCell calls for %d draws", len(i.events["SetCell"]), b.N)
+}
+
+func BenchmarkDrawScreen(b *testing.B) {
+	benchmarkDrawScreen(b, false)
+}
+
+func BenchmarkDrawScreenWithDiff(b *testing.B) {
+	benchmarkDrawScreen(b, true)
+}
@@ -0,0 +1,100 @@
+package peco
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// IsUTF8Encoding returns true if `name` refers to UTF-8, which is
+// what peco uses internally. An empty name means UTF-8 as well
+func IsUTF8Encoding(name string) bool {
+	switch strings.ToLower(name) {
+	case "", "utf-8", "utf8":
+		return true
+	}
+	return false
+}
+
+// lookupEncoding returns the encoding called `name`. Names are those
+// of the WHATWG Encoding Standard, e.g. "shift_jis", "euc-jp" or
+// "latin1", and are case insensitive
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("error: unknown encoding '%s'", name)
+	}
+	return enc, nil
+}
+
+// CheckEncoding returns an error if `name` is not an encoding that
+// can be converted to and from UTF-8
+func CheckEncoding(name string) error {
+	if IsUTF8Encoding(name) {
+		return nil
+	}
+
+	_, err := lookupEncoding(name)
+	return err
+}
+
+// NewDecodingReader returns a reader that converts the contents of
+// `src` from the encoding `name` to UTF-8
+func NewDecodingReader(src io.ReadCloser, name string) (io.ReadCloser, error) {
+	if IsUTF8Encoding(name) {
+		return src, nil
+	}
+
+	enc, err := lookupEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{transform.NewReader(src, enc.NewDecoder()), src.Close}, nil
+}
+
+// NewEncodingWriter returns a writer that converts what is written
+// to it from UTF-8 to the encoding `name`, and writes the result to
+// `dst`. The writer must be closed to flush the converted output.
+// Characters that the encoding cannot represent are an error
+func NewEncodingWriter(dst io.Writer, name string) (io.WriteCloser, error) {
+	if IsUTF8Encoding(name) {
+		return nopWriteCloser{dst}, nil
+	}
+
+	enc, err := lookupEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	return &encodingWriter{transform.NewWriter(dst, enc.NewEncoder())}, nil
+}
+
+type encodingWriter struct {
+	*transform.Writer
+}
+
+func (w *encodingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("error: failed to encode output: %s", err)
+	}
+	return n, nil
+}
+
+func (w *encodingWriter) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		return fmt.Errorf("error: failed to encode output: %s", err)
+	}
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,95 @@
+package peco
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FieldSpec tells how each line is split into fields, and which of
+// the fields are displayed (and matched against the query) and which
+// field is emitted when the line is accepted. Fields are numbered
+// from 1
+type FieldSpec struct {
+	// Delimiter separates the fields. If nil, fields are separated
+	// by runs of whitespace, and leading and trailing whitespace is
+	// ignored
+	Delimiter *regexp.Regexp
+
+	// Display lists the fields to display, in order. The fields are
+	// joined with a single space. If empty, the whole line is displayed
+	Display []int
+
+	// Output is the field to emit. If 0, the whole line is emitted
+	Output int
+}
+
+// NewFieldSpec creates a FieldSpec from the values given on the
+// command line: the delimiter regexp (empty for whitespace), the
+// comma separated list of fields to display (e.g. "1,2,5"), and the
+// field to output. Returns nil if no fields were requested
+func NewFieldSpec(delimiter, display string, output int) (*FieldSpec, error) {
+	var re *regexp.Regexp
+	if delimiter != "" {
+		var err error
+		if re, err = regexp.Compile(delimiter); err != nil {
+			return nil, fmt.Errorf("error: invalid delimiter '%s': %s", delimiter, err)
+		}
+	}
+
+	if output < 0 {
+		return nil, fmt.Errorf("error: invalid output field: %d", output)
+	}
+
+	if display == "" && output == 0 {
+		return nil, nil
+	}
+
+	fs := &FieldSpec{Delimiter: re, Output: output}
+	if display != "" {
+		for _, v := range strings.Split(display, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("error: invalid display field: '%s'", v)
+			}
+			fs.Display = append(fs.Display, n)
+		}
+	}
+
+	return fs, nil
+}
+
+// Split splits `s` into fields
+func (fs *FieldSpec) Split(s string) []string {
+	if fs.Delimiter == nil {
+		return strings.Fields(s)
+	}
+	return fs.Delimiter.Split(s, -1)
+}
+
+// display returns the string to display, given the fields of a line.
+// If any of the fields to display doesn't exist, `line` is returned
+func (fs *FieldSpec) display(line string, fields []string) string {
+	if len(fs.Display) == 0 {
+		return line
+	}
+
+	parts := make([]string, len(fs.Display))
+	for i, n := range fs.Display {
+		if n > len(fields) {
+			return line
+		}
+		parts[i] = fields[n-1]
+	}
+	return strings.Join(parts, " ")
+}
+
+// output returns the string to emit, given the fields of a line.
+// If the field to output doesn't exist, `line` is returned
+func (fs *FieldSpec) output(line string, fields []string) string {
+	if fs.Output == 0 || fs.Output > len(fields) {
+		return line
+	}
+	return fields[fs.Output-1]
+}
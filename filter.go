@@ -5,10 +5,15 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
 )
 
@@ -18,6 +23,8 @@ const (
 	CaseSensitiveMatch = "CaseSensitive"
 	SmartCaseMatch     = "SmartCase"
 	RegexpMatch        = "Regexp"
+	ExcludeMatch       = "Exclude"
+	GlobMatch          = "Glob"
 )
 
 var ignoreCaseFlags = []string{"i"}
@@ -64,12 +71,37 @@ func regexpFor(q string, flags []string, quotemeta bool) (*regexp.Regexp, error)
 	return re, nil
 }
 
-func queryToRegexps(flags regexpFlags, quotemeta bool, query string) ([]*regexp.Regexp, error) {
-	queries := strings.Split(strings.TrimSpace(query), " ")
+// queryToRegexps compiles each of the space separated terms in the
+// query. If orSeparator is not empty, the terms are split into OR
+// groups as well (see splitOrGroup). This only makes sense along with
+// quotemeta, because regular expressions have their own alternation.
+// If extended is true, the operators of the extended search syntax
+// are interpreted as well (see parseExtendedTerm)
+func queryToRegexps(flags regexpFlags, quotemeta bool, orSeparator string, extended bool, query string) ([]*regexp.Regexp, error) {
+	queries := strings.Fields(query)
 	regexps := make([]*regexp.Regexp, 0)
 
 	for _, q := range queries {
-		re, err := regexpFor(q, flags.flags(query), quotemeta)
+		exact := false
+		var start, end string
+		if extended {
+			q, exact, start, end = parseExtendedTerm(q)
+		}
+
+		var reTxt string
+		if alts := splitOrGroup(q, orSeparator); len(alts) > 1 && !exact {
+			reTxt = orGroupPattern(alts)
+		} else {
+			if len(alts) == 1 && !exact {
+				q = alts[0]
+			}
+			reTxt = q
+			if quotemeta {
+				reTxt = regexp.QuoteMeta(q)
+			}
+		}
+
+		re, err := regexpFor(start+reTxt+end, flags.flags(query), false)
 		if err != nil {
 			return nil, err
 		}
@@ -79,6 +111,93 @@ func queryToRegexps(flags regexpFlags, quotemeta bool, query string) ([]*regexp.
 	return regexps, nil
 }
 
+// parseExtendedTerm interprets the operators of the extended search
+// syntax in a term (see ExtendedSearchSyntax). A leading ' matches the
+// rest of the term exactly as typed, a leading ^ anchors the term to
+// the start of the line, and a trailing $ to its end. Returns the text
+// to match, whether it is exact, and the anchors to put around it. A
+// term that is nothing but operators is matched as is
+func parseExtendedTerm(term string) (text string, exact bool, start, end string) {
+	if len(term) > 1 && term[0] == '\'' {
+		return term[1:], true, "", ""
+	}
+
+	text = term
+	if strings.HasPrefix(text, "^") {
+		text, start = text[1:], "^"
+	}
+	if strings.HasSuffix(text, "$") {
+		text, end = text[:len(text)-1], "$"
+	}
+	if text == "" {
+		return term, false, "", ""
+	}
+	return text, false, start, end
+}
+
+// splitOrGroup splits a term at each occurrence of sep, which may be
+// escaped with a backslash to be matched literally. Empty alternatives
+// are dropped. If there is nothing left (i.e. the term only consists
+// of separators), nil is returned, and the term is used as is
+func splitOrGroup(q string, sep string) []string {
+	if sep == "" || !strings.Contains(q, sep) {
+		return nil
+	}
+
+	var alts []string
+	var buf bytes.Buffer
+	escapedSep := `\` + sep
+	for len(q) > 0 {
+		switch {
+		case strings.HasPrefix(q, escapedSep):
+			buf.WriteString(sep)
+			q = q[len(escapedSep):]
+		case strings.HasPrefix(q, sep):
+			if buf.Len() > 0 {
+				alts = append(alts, buf.String())
+				buf.Reset()
+			}
+			q = q[len(sep):]
+		default:
+			buf.WriteByte(q[0])
+			q = q[1:]
+		}
+	}
+	if buf.Len() > 0 {
+		alts = append(alts, buf.String())
+	}
+	return alts
+}
+
+// orGroupPattern returns a regular expression that matches any of
+// alts literally. Longer alternatives are tried first, so that the
+// longest one that matches is highlighted
+func orGroupPattern(alts []string) string {
+	sorted := make([]string, len(alts))
+	copy(sorted, alts)
+	sort.Stable(byLengthDesc(sorted))
+
+	quoted := make([]string, len(sorted))
+	for i, a := range sorted {
+		quoted[i] = regexp.QuoteMeta(a)
+	}
+	return "(?:" + strings.Join(quoted, "|") + ")"
+}
+
+type byLengthDesc []string
+
+func (s byLengthDesc) Len() int {
+	return len(s)
+}
+
+func (s byLengthDesc) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s byLengthDesc) Less(i, j int) bool {
+	return len(s[i]) > len(s[j])
+}
+
 // sort related stuff
 type byMatchStart [][]int
 
@@ -96,7 +215,7 @@ func (m byMatchStart) Less(i, j int) bool {
 	}
 
 	if m[i][0] == m[j][0] {
-		return m[i][1]-m[i][0] < m[i][1]-m[i][0]
+		return m[i][1]-m[i][0] < m[j][1]-m[j][0]
 	}
 
 	return false
@@ -135,6 +254,179 @@ type Filter struct {
 	*Ctx
 }
 
+// filterProgress keeps track of the query that is being run, so that
+// an indicator can be shown when it takes a while to complete (see
+// FilteringIndicatorDelay), and of how long the last query took
+type filterProgress struct {
+	mutex     sync.Locker // protects all of the fields
+	run       int         // incremented for every query
+	start     time.Time   // when the current run started
+	done      bool        // true once the current run has completed
+	filtering bool        // true while the indicator is shown
+	stale     bool        // true if a run was superseded while the indicator was shown
+	latency   time.Duration
+	query     string         // the last query that ran to completion
+	result    *RawLineBuffer // the lines that query matched
+}
+
+func newFilterProgress() *filterProgress {
+	return &filterProgress{mutex: newMutex(), done: true}
+}
+
+// Start records the start of a run, which supersedes the previous
+// one, and returns its number
+func (p *filterProgress) Start() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.run++
+	p.start = time.Now()
+	p.done = false
+	p.stale = p.stale || p.filtering
+	p.filtering = false
+	return p.run
+}
+
+// ShowIndicator turns the indicator on, unless `run` has completed
+// or was superseded. Returns true if the indicator was turned on
+func (p *filterProgress) ShowIndicator(run int) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if run != p.run || p.done {
+		return false
+	}
+	p.filtering = true
+	return true
+}
+
+// Finish records the completion of `run`, unless it was superseded.
+// Returns true if the indicator may still be displayed, and must be
+// cleared
+func (p *filterProgress) Finish(run int) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if run != p.run {
+		return false
+	}
+	p.done = true
+	p.latency = time.Since(p.start)
+	shown := p.filtering || p.stale
+	p.filtering = false
+	p.stale = false
+	return shown
+}
+
+// IsFiltering returns true while the indicator is to be shown
+func (p *filterProgress) IsFiltering() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.filtering
+}
+
+// SetResult records the lines that `query` matched, once all of
+// them are known
+func (p *filterProgress) SetResult(query string, result *RawLineBuffer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.query = query
+	p.result = result
+}
+
+// Result returns the last query that ran to completion, and the
+// lines that it matched
+func (p *filterProgress) Result() (string, *RawLineBuffer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.query, p.result
+}
+
+// Latency returns how long the last completed run took
+func (p *filterProgress) Latency() time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.latency
+}
+
+// filterStats accumulates how long the queries took, and how many
+// lines they went through, to be printed on exit (--profile)
+type filterStats struct {
+	mutex     sync.Locker // protects all of the fields
+	passes    int         // queries that were started
+	completed int         // queries that were not superseded before completing
+	total     time.Duration
+	max       time.Duration
+	scanned   int // lines matched against by the completed queries
+	matched   int // lines that the completed queries matched
+}
+
+func newFilterStats() *filterStats {
+	return &filterStats{mutex: newMutex()}
+}
+
+// Start records that a query is being run
+func (s *filterStats) Start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.passes++
+}
+
+// Finish records a query that ran to completion
+func (s *filterStats) Finish(latency time.Duration, scanned, matched int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.completed++
+	s.total += latency
+	if latency > s.max {
+		s.max = latency
+	}
+	s.scanned += scanned
+	s.matched += matched
+}
+
+// Print writes the statistics to `w`
+func (s *filterStats) Print(w io.Writer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var average time.Duration
+	if s.completed > 0 {
+		average = s.total / time.Duration(s.completed)
+	}
+	fmt.Fprintf(w, "filter passes:   %d (%d canceled)\n", s.passes, s.passes-s.completed)
+	fmt.Fprintf(w, "average latency: %s\n", average)
+	fmt.Fprintf(w, "max latency:     %s\n", s.max)
+	fmt.Fprintf(w, "lines scanned:   %d\n", s.scanned)
+	fmt.Fprintf(w, "lines matched:   %d\n", s.matched)
+}
+
+// startProgress records the start of a query. Once the query has
+// taken longer than FilteringIndicatorDelay, the indicator is shown
+// until the returned function is called upon completion
+func (f *Filter) startProgress() func() {
+	run := f.progress.Start()
+
+	var timer *time.Timer
+	if delay := f.config.FilteringIndicatorDelay; delay >= 0 {
+		timer = time.AfterFunc(time.Duration(delay)*time.Millisecond, func() {
+			if f.progress.ShowIndicator(run) {
+				f.SendStatusMsg("")
+			}
+		})
+	}
+
+	return func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		if f.progress.Finish(run) {
+			f.SendStatusMsg("")
+		}
+	}
+}
+
 // Work is the actual work horse that that does the matching
 // in a goroutine of its own. It wraps Matcher.Match().
 func (f *Filter) Work(cancel chan struct{}, q HubReq) {
@@ -143,23 +435,77 @@ func (f *Filter) Work(cancel chan struct{}, q HubReq) {
 	defer q.Done()
 
 	query := q.DataString()
-	if query == "" {
+	finish := f.startProgress()
+	// The query may have become shorter than MinQueryLength
+	// while this one was on its way
+	if query == "" || f.queryTooShort(query) {
 		trace("Filter.Work: Resetting activingLineBuffer")
 		f.ResetActiveLineBuffer()
+		finish()
 	} else {
-		f.rawLineBuffer.cancelCh = cancel
-		f.rawLineBuffer.Replay()
-
 		filter := f.Filter().Clone()
 		filter.SetQuery(query)
-		trace("Running %#v filter using query '%s'", filter, query)
+		if rf, ok := filter.(*RegexpFilter); ok {
+			rf.SetAnchored(f.anchoredOn())
+		}
+		// Custom filters split what they print as well
+		if ecf, ok := filter.(*ExternalCmdFilter); ok {
+			ecf.enableSep = f.nullSepOn()
+		}
 
-		filter.Accept(f.rawLineBuffer)
+		// The results of the previous query are kept while the
+		// patterns are not valid, e.g. while "[" isn't closed yet
+		if ef, ok := filter.(interface {
+			Err() error
+		}); ok && ef.Err() != nil {
+			trace("Filter.Work: %s", ef.Err())
+			finish()
+			atomic.StoreInt32(&f.invalidQuery, 1)
+			f.SendStatusMsg(ef.Err().Error())
+			return
+		}
+		if atomic.CompareAndSwapInt32(&f.invalidQuery, 1, 0) {
+			f.SendStatusMsg("")
+		}
+
+		src := f.sourceLineBuffer()
+		src.cancelCh = cancel
+		src.Replay()
+
+		// Queries that are superseded never reach onEnd, and are
+		// only counted as started
+		f.stats.Start()
+		start := time.Now()
+		scanned := src.Size()
+
+		trace("Filter.Work: running %s filter using query '%s'", filter, query)
+
+		filter.Accept(src)
 		buf := NewRawLineBuffer()
-		buf.onEnd = func() { f.SendStatusMsg("") }
+		// The fallback below has to replace buf, so it waits for
+		// buf to be made active first
+		active := make(chan struct{})
+		buf.onEnd = func() {
+			trace("Filter.Work: %s filter finished for query '%s' (%d lines)", filter, query, buf.Size())
+			finish()
+			f.stats.Finish(time.Since(start), scanned, buf.Size())
+			f.progress.SetResult(query, buf)
+
+			// Rather than leaving the list empty, show the lines
+			// unfiltered if a custom filter could not be run
+			if ecf, ok := filter.(*ExternalCmdFilter); ok && ecf.Err() != nil {
+				trace("Filter.Work: %s", ecf.Err())
+				f.SendStatusMsg(ecf.Err().Error())
+				src := f.sourceLineBuffer()
+				src.Replay()
+				<-active
+				f.SetActiveLineBuffer(src)
+			}
+		}
 		buf.Accept(filter)
 
 		f.SetActiveLineBuffer(buf)
+		close(active)
 	}
 
 	if ! f.config.StickySelection {
@@ -183,18 +529,43 @@ func (f *Filter) Loop() {
 		case <-f.LoopCh():
 			return
 		case q := <-f.QueryCh():
+			trace("Filter.Loop: received query request")
 			if previous != nil {
 				// Tell the previous query to stop
 				close(previous)
 			}
 			previous = make(chan struct{})
 
-			f.SendStatusMsg("Running query...")
 			go f.Work(previous, q)
 		}
 	}
 }
 
+// QueryFilterer is a filter, which matches the lines against the
+// query. Filters other than the built-in ones can be registered with
+// Ctx.AddFilter.
+//
+// For every query, the registered filter is cloned with Clone, the
+// query is given to the clone with SetQuery, and then the clone is
+// passed the lines with Accept. Accept returns right away, and the
+// matching happens in a goroutine of its own:
+//
+//   - The lines come from the channel returned by the Pipeline method
+//     of the Pipeliner given to Accept, which is closed once all of
+//     the lines were sent.
+//   - The lines that match are sent to the channel returned by the
+//     Pipeline method of the filter itself, in the order they came
+//     in. The lines can be wrapped with NewMatchedLine, in order to
+//     highlight the parts of the line that matched (byte offsets in
+//     DisplayString). The channel must be closed once done.
+//   - The cancel channel returned by the Pipeline method of the
+//     Pipeliner given to Accept, which is also returned by the
+//     Pipeline method of the filter, is closed when the query is
+//     superseded by another one. The filter must stop then, and not
+//     send anything more.
+//
+// Cancel stops the filter as well, and String returns its name, as
+// used by --initial-filter and FilterOrder.
 type QueryFilterer interface {
 	Pipeliner
 	Cancel()
@@ -204,6 +575,21 @@ type QueryFilterer interface {
 	String() string
 }
 
+// namedFilter is a filter that is registered under another name than
+// its own (see Ctx.AddFilter)
+type namedFilter struct {
+	QueryFilterer
+	name string
+}
+
+func (nf namedFilter) Clone() QueryFilterer {
+	return namedFilter{nf.QueryFilterer.Clone(), nf.name}
+}
+
+func (nf namedFilter) String() string {
+	return nf.name
+}
+
 type SelectionFilter struct {
 	sel *Selection
 }
@@ -217,9 +603,14 @@ type RegexpFilter struct {
 	compiledQuery []*regexp.Regexp
 	flags         regexpFlags
 	quotemeta     bool
+	orSeparator   string // separates OR groups within a term, if set
 	query         string
 	name          string
 	onEnd         func()
+	negate        bool // lines that match are removed, instead of kept
+	fallback      bool // an invalid query is matched literally (RegexpFallbackLiteral)
+	anchored      bool // the terms have to match whole lines (peco.ToggleAnchored)
+	extended      bool // the terms may contain operators (ExtendedSearchSyntax)
 }
 
 func NewRegexpFilter() *RegexpFilter {
@@ -235,9 +626,14 @@ func (rf RegexpFilter) Clone() QueryFilterer {
 		nil,
 		rf.flags,
 		rf.quotemeta,
+		rf.orSeparator,
 		rf.query,
 		rf.name,
 		nil,
+		rf.negate,
+		rf.fallback,
+		rf.anchored,
+		rf.extended,
 	}
 }
 
@@ -251,6 +647,11 @@ func (rf *RegexpFilter) Accept(p Pipeliner) {
 
 var ErrFilterDidNotMatch = errors.New("error: filter did not match against given line")
 
+// maxMatchIntervals is the maximum number of matches that are
+// highlighted in a line, per term and in total. This keeps queries
+// that match almost everywhere (e.g. "." in the Regexp filter) cheap
+const maxMatchIntervals = 64
+
 func (rf *RegexpFilter) filter(l Line) (Line, error) {
 	trace("RegexpFilter.filter: START")
 	defer trace("RegexpFilter.filter: END")
@@ -259,12 +660,23 @@ func (rf *RegexpFilter) filter(l Line) (Line, error) {
 		return nil, err
 	}
 	v := l.DisplayString()
+	if rf.negate {
+		// Any of the terms is enough to exclude a line. There's
+		// nothing to highlight in the lines that are left
+		for _, rx := range regexps {
+			if rx.MatchString(v) {
+				return nil, ErrFilterDidNotMatch
+			}
+		}
+		return l, nil
+	}
+
 	allMatched := true
 	matches := [][]int{}
 TryRegexps:
 	for _, rx := range regexps {
 		trace("RegexpFilter.filter: matching '%s' against '%s'", v, rx)
-		match := rx.FindAllStringSubmatchIndex(v, -1)
+		match := rx.FindAllStringSubmatchIndex(v, maxMatchIntervals)
 		if match == nil {
 			allMatched = false
 			break TryRegexps
@@ -284,9 +696,14 @@ TryRegexps:
 
 	deduped := make([][]int, 0, len(matches))
 
-	for i, m := range matches {
+	for _, m := range matches {
+		// Empty matches (e.g. "x*") have nothing to highlight
+		if m[0] == m[1] {
+			continue
+		}
+
 		// Always push the first one
-		if i == 0 {
+		if len(deduped) == 0 {
 			deduped = append(deduped, m)
 			continue
 		}
@@ -305,18 +722,57 @@ TryRegexps:
 			deduped = append(deduped, m)
 		}
 	}
-	return NewMatchedLine(l, deduped), nil
+	if len(deduped) > maxMatchIntervals {
+		deduped = deduped[:maxMatchIntervals]
+	}
+
+	// Unlike deduped, ml.match retains the capture groups. Prefer
+	// the first match that captured something
+	ml := NewMatchedLine(l, deduped)
+	for _, m := range matches {
+		if len(m) >= 4 && m[2] >= 0 {
+			ml.match = m
+			break
+		}
+	}
+	if ml.match == nil && len(matches) > 0 {
+		ml.match = matches[0]
+	}
+	return ml, nil
 }
 
 func (rf *RegexpFilter) getQueryAsRegexps() ([]*regexp.Regexp, error) {
 	if q := rf.compiledQuery; q != nil {
 		return q, nil
 	}
-	q, err := queryToRegexps(rf.flags, rf.quotemeta, rf.query)
+	q, err := queryToRegexps(rf.flags, rf.quotemeta, rf.orSeparator, rf.extended, rf.query)
+	if err != nil && rf.fallback {
+		// Only the terms that are not valid are matched literally
+		q, err = nil, nil
+		for _, term := range strings.Fields(rf.query) {
+			re, terr := queryToRegexps(rf.flags, rf.quotemeta, rf.orSeparator, false, term)
+			if terr != nil {
+				trace("RegexpFilter.getQueryAsRegexps: matching '%s' literally: %s", term, terr)
+				re, terr = queryToRegexps(rf.flags, true, "", false, term)
+			}
+			if terr != nil {
+				return nil, terr
+			}
+			q = append(q, re...)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	if rf.anchored {
+		for i, re := range q {
+			if q[i], err = regexp.Compile("^(?:" + re.String() + ")$"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	rf.compiledQuery = q
 	return q, nil
 }
@@ -326,6 +782,64 @@ func (rf *RegexpFilter) SetQuery(q string) {
 	rf.compiledQuery = nil
 }
 
+// Err returns the reason why the query is not valid, or nil if it is.
+// The query is compiled here, rather than once the lines come in
+func (rf *RegexpFilter) Err() error {
+	_, err := rf.getQueryAsRegexps()
+	return err
+}
+
+// SetOrSeparator changes the separator of OR groups within a term.
+// An empty separator disables OR groups. Filters that don't support
+// OR groups (Regexp and Exclude) ignore this
+func (rf *RegexpFilter) SetOrSeparator(sep string) {
+	if !rf.quotemeta || rf.negate {
+		return
+	}
+	rf.orSeparator = sep
+	rf.compiledQuery = nil
+}
+
+// SetFallbackLiteral makes the filter match queries that are not
+// valid regular expressions literally, instead of failing. Filters
+// that always match literally ignore this
+func (rf *RegexpFilter) SetFallbackLiteral(fallback bool) {
+	if rf.quotemeta {
+		return
+	}
+	rf.fallback = fallback
+	rf.compiledQuery = nil
+}
+
+// SetExtendedSyntax makes the filter interpret the operators of the
+// extended search syntax in the terms of the query (see
+// ExtendedSearchSyntax). The Regexp filter ignores this, as they are
+// part of regular expressions already
+func (rf *RegexpFilter) SetExtendedSyntax(extended bool) {
+	if !rf.quotemeta {
+		return
+	}
+	rf.extended = extended
+	rf.compiledQuery = nil
+}
+
+// SetAnchored makes the terms of the query match whole lines only.
+// Filters that match literally ignore this (see isAnchorable)
+func (rf *RegexpFilter) SetAnchored(anchored bool) {
+	if rf.quotemeta {
+		return
+	}
+	rf.anchored = anchored
+	rf.compiledQuery = nil
+}
+
+// isAnchorable returns true if the filter can be made to match whole
+// lines (see Ctx.ToggleAnchored)
+func isAnchorable(f QueryFilterer) bool {
+	rf, ok := f.(*RegexpFilter)
+	return ok && !rf.quotemeta
+}
+
 func (rf RegexpFilter) String() string {
 	return rf.name
 }
@@ -339,7 +853,14 @@ func (fs *FilterSet) Size() int {
 	return len(fs.filters)
 }
 
+// Add adds a filter. Returns an error if there already is a filter
+// of the same name
 func (fs *FilterSet) Add(qf QueryFilterer) error {
+	for _, f := range fs.filters {
+		if f.String() == qf.String() {
+			return fmt.Errorf("filter '%s' already exists", qf.String())
+		}
+	}
 	fs.filters = append(fs.filters, qf)
 	return nil
 }
@@ -364,23 +885,62 @@ func (fs *FilterSet) SetCurrentByName(name string) error {
 	return ErrFilterNotFound
 }
 
+// Names returns the names of the filters, in the order they are
+// rotated through
+func (fs *FilterSet) Names() []string {
+	names := make([]string, len(fs.filters))
+	for i, f := range fs.filters {
+		names[i] = f.String()
+	}
+	return names
+}
+
+// SetOrder keeps only the filters named in `names`, in that order.
+// The current filter stays the same if it is in `names`, otherwise
+// the first filter becomes current
+func (fs *FilterSet) SetOrder(names []string) error {
+	current := fs.filters[fs.current]
+	filters := make([]QueryFilterer, 0, len(names))
+	fs.current = 0
+
+OUTER:
+	for _, name := range names {
+		for _, f := range fs.filters {
+			if f.String() != name {
+				continue
+			}
+			if f == current {
+				fs.current = len(filters)
+			}
+			filters = append(filters, f)
+			continue OUTER
+		}
+		return fmt.Errorf("unknown filter: '%s'", name)
+	}
+
+	fs.filters = filters
+	return nil
+}
+
 func (fs *FilterSet) GetCurrent() QueryFilterer {
 	return fs.filters[fs.current]
 }
 
 func NewIgnoreCaseFilter() *RegexpFilter {
 	return &RegexpFilter{
-		flags:     regexpFlagList(ignoreCaseFlags),
-		quotemeta: true,
-		name:      "IgnoreCase",
+		flags:       regexpFlagList(ignoreCaseFlags),
+		quotemeta:   true,
+		orSeparator: DefaultOrSeparator,
+		name:        "IgnoreCase",
 	}
 }
 
 func NewCaseSensitiveFilter() *RegexpFilter {
 	return &RegexpFilter{
-		flags:     regexpFlagList(defaultFlags),
-		quotemeta: true,
-		name:      "CaseSensitive",
+		flags:       regexpFlagList(defaultFlags),
+		quotemeta:   true,
+		orSeparator: DefaultOrSeparator,
+		name:        "CaseSensitive",
 	}
 }
 
@@ -394,9 +954,184 @@ func NewSmartCaseFilter() *RegexpFilter {
 			}
 			return []string{"i"}
 		}),
+		quotemeta:   true,
+		orSeparator: DefaultOrSeparator,
+		name:        "SmartCase",
+	}
+}
+
+// NewExcludeFilter creates a filter that removes the lines that
+// contain any of the space separated terms in the query, ignoring
+// case. Everything else is kept
+func NewExcludeFilter() *RegexpFilter {
+	return &RegexpFilter{
+		flags:     regexpFlagList(ignoreCaseFlags),
 		quotemeta: true,
-		name:      "SmartCase",
+		name:      "Exclude",
+		negate:    true,
+	}
+}
+
+// GlobFilter matches the lines against the space separated glob
+// patterns in the query, all of which have to match. It is meant for
+// lists of paths: * and ? don't match /, but ** does. Like with the
+// other filters, a pattern may match any part of the line
+type GlobFilter struct {
+	simplePipeline
+	query    string
+	patterns []*regexp.Regexp
+	err      error // why the query is not valid, if it is not
+	onEnd    func()
+}
+
+func NewGlobFilter() *GlobFilter {
+	return &GlobFilter{}
+}
+
+func (gf GlobFilter) Clone() QueryFilterer {
+	return &GlobFilter{}
+}
+
+func (gf *GlobFilter) Accept(p Pipeliner) {
+	cancelCh, incomingCh := p.Pipeline()
+	gf.cancelCh = cancelCh
+	gf.outputCh = make(chan Line)
+	go acceptPipeline(cancelCh, incomingCh, gf.outputCh,
+		&pipelineCtx{gf.filter, gf.onEnd})
+}
+
+func (gf *GlobFilter) SetQuery(q string) {
+	gf.query = q
+	gf.patterns = nil
+	gf.err = nil
+	for _, term := range strings.Fields(q) {
+		re, err := globToRegexp(term)
+		if err != nil {
+			gf.patterns, gf.err = nil, err
+			return
+		}
+		gf.patterns = append(gf.patterns, re)
+	}
+}
+
+// Err returns the reason why the query is not valid, or nil if it is
+func (gf *GlobFilter) Err() error {
+	return gf.err
+}
+
+func (gf *GlobFilter) filter(l Line) (Line, error) {
+	if gf.err != nil {
+		return nil, gf.err
+	}
+
+	v := l.DisplayString()
+	matches := make([][]int, 0, len(gf.patterns))
+	for _, re := range gf.patterns {
+		m := re.FindStringIndex(v)
+		if m == nil {
+			return nil, ErrFilterDidNotMatch
+		}
+		// Empty matches (e.g. "**") have nothing to highlight
+		if m[0] != m[1] {
+			matches = append(matches, m)
+		}
+	}
+	sort.Sort(byMatchStart(matches))
+
+	deduped := make([][]int, 0, len(matches))
+	for _, m := range matches {
+		if len(deduped) == 0 {
+			deduped = append(deduped, m)
+			continue
+		}
+		prev := deduped[len(deduped)-1]
+		switch {
+		case matchContains(prev, m):
+		case matchOverlaps(prev, m):
+			deduped[len(deduped)-1] = mergeMatches(prev, m)
+		default:
+			deduped = append(deduped, m)
+		}
 	}
+	return NewMatchedLine(l, deduped), nil
+}
+
+func (gf GlobFilter) String() string {
+	return GlobMatch
+}
+
+// globToRegexp converts a glob pattern to a regular expression. *
+// matches any number of characters but /, ** matches any number of
+// characters including /, and **/ any number of directories (even
+// none). ? matches any single character but /, and [...] (or [!...])
+// any character (but /) in (or not in) the brackets. A backslash
+// makes the character that follows it match literally
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var buf bytes.Buffer
+	p := []rune(pattern)
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '*':
+			if i+1 < len(p) && p[i+1] == '*' {
+				for i+1 < len(p) && p[i+1] == '*' {
+					i++
+				}
+				if i+1 < len(p) && p[i+1] == '/' {
+					i++
+					buf.WriteString("(?:.*/)?")
+				} else {
+					buf.WriteString(".*")
+				}
+			} else {
+				buf.WriteString("[^/]*")
+			}
+		case '?':
+			buf.WriteString("[^/]")
+		case '[':
+			end := i + 1
+			if end < len(p) && (p[end] == '!' || p[end] == '^') {
+				end++
+			}
+			// A ] right after the [ is part of the class
+			if end < len(p) && p[end] == ']' {
+				end++
+			}
+			for end < len(p) && p[end] != ']' {
+				end++
+			}
+			if end >= len(p) {
+				return nil, fmt.Errorf("invalid pattern '%s': missing ']'", pattern)
+			}
+
+			class := p[i+1 : end]
+			buf.WriteByte('[')
+			if class[0] == '!' || class[0] == '^' {
+				buf.WriteString("^/")
+				class = class[1:]
+			}
+			for _, r := range class {
+				if r == '\\' || r == '[' || r == ']' || r == '^' {
+					buf.WriteByte('\\')
+				}
+				buf.WriteRune(r)
+			}
+			buf.WriteByte(']')
+			i = end
+		case '\\':
+			if i+1 < len(p) {
+				i++
+			}
+			buf.WriteString(regexp.QuoteMeta(string(p[i])))
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	re, err := regexp.Compile(buf.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s'", pattern)
+	}
+	return re, nil
 }
 
 type ExternalCmdFilter struct {
@@ -407,6 +1142,9 @@ type ExternalCmdFilter struct {
 	name            string
 	query           string
 	thresholdBufsiz int
+	maxBatchBytes   int           // the command is run once the lines buffered are that large
+	flushInterval   time.Duration // or once the first of them was buffered for that long
+	err             error         // why the command failed, if it did
 }
 
 func NewExternalCmdFilter(name, cmd string, args []string, threshold int, enableSep bool) *ExternalCmdFilter {
@@ -415,6 +1153,10 @@ func NewExternalCmdFilter(name, cmd string, args []string, threshold int, enable
 		args = []string{ "$QUERY" }
 	}
 
+	if threshold <= 0 {
+		threshold = DefaultCustomFilterBufferThreshold
+	}
+
 	return &ExternalCmdFilter{
 		simplePipeline:  simplePipeline{},
 		enableSep:       enableSep,
@@ -422,6 +1164,20 @@ func NewExternalCmdFilter(name, cmd string, args []string, threshold int, enable
 		args:            args,
 		name:            name,
 		thresholdBufsiz: threshold,
+		maxBatchBytes:   DefaultCustomFilterMaxBatchBytes,
+		flushInterval:   DefaultCustomFilterFlushInterval * time.Millisecond,
+	}
+}
+
+// SetBatchLimits sets how large the lines passed to a single run of
+// the command may get, and how long they may be buffered, before the
+// command is run. Zero values keep the defaults
+func (ecf *ExternalCmdFilter) SetBatchLimits(maxBytes int, flushInterval time.Duration) {
+	if maxBytes > 0 {
+		ecf.maxBatchBytes = maxBytes
+	}
+	if flushInterval > 0 {
+		ecf.flushInterval = flushInterval
 	}
 }
 
@@ -433,6 +1189,8 @@ func (ecf ExternalCmdFilter) Clone() QueryFilterer {
 		args:            ecf.args,
 		name:            ecf.name,
 		thresholdBufsiz: ecf.thresholdBufsiz,
+		maxBatchBytes:   ecf.maxBatchBytes,
+		flushInterval:   ecf.flushInterval,
 	}
 }
 
@@ -442,11 +1200,33 @@ func (ecf *ExternalCmdFilter) Verify() error {
 	}
 
 	if _, err := exec.LookPath(ecf.cmd); err != nil {
-		return err
+		return fmt.Errorf("cannot run command '%s' for custom filter '%s': %s", ecf.cmd, ecf.name, err)
 	}
 	return nil
 }
 
+// Err returns the reason why the command failed, or nil if it did
+// not. It is only meaningful once the output of the filter is closed
+func (ecf *ExternalCmdFilter) Err() error {
+	return ecf.err
+}
+
+// fail records why the command failed. Only the first failure is
+// kept, as the filter stops running the command after that
+func (ecf *ExternalCmdFilter) fail(err error, stderr *bytes.Buffer) {
+	if ecf.err != nil {
+		return
+	}
+
+	msg := err.Error()
+	if stderr != nil {
+		if line := strings.SplitN(strings.TrimSpace(stderr.String()), "\n", 2)[0]; line != "" {
+			msg = msg + ": " + line
+		}
+	}
+	ecf.err = fmt.Errorf("custom filter '%s' failed: %s", ecf.name, msg)
+}
+
 func (ecf *ExternalCmdFilter) Accept(p Pipeliner) {
 	cancelCh, incomingCh := p.Pipeline()
 	outputCh := make(chan Line)
@@ -458,20 +1238,48 @@ func (ecf *ExternalCmdFilter) Accept(p Pipeliner) {
 
 		defer trace("ExternalCmdFilter.Accept: DONE")
 
-		// for every N lines, execute the external command
-		buf := []Line{}
-		for l := range incomingCh {
-			buf = append(buf, l)
-			if len(buf) < ecf.thresholdBufsiz {
-				continue
+		// The external command is executed for every N lines, every
+		// maxBatchBytes, and whatever was buffered once flushInterval
+		// has passed or the input ends. Lines are not read while the
+		// command runs, so no more than a batch is held in memory
+		var buf []Line
+		var size int
+		var timer *time.Timer
+		var flushCh <-chan time.Time
+		flush := func() {
+			if timer != nil {
+				timer.Stop()
+				timer, flushCh = nil, nil
 			}
-
-			ecf.launchExternalCmd(buf, cancelCh, outputCh)
-			buf = []Line{} // drain
+			if len(buf) > 0 && ecf.err == nil {
+				ecf.launchExternalCmd(buf, cancelCh, outputCh)
+			}
+			buf, size = nil, 0
 		}
 
-		if len(buf) > 0 {
-			ecf.launchExternalCmd(buf, cancelCh, outputCh)
+		for {
+			select {
+			case l, ok := <-incomingCh:
+				if !ok {
+					flush()
+					return
+				}
+				if ecf.err != nil {
+					continue
+				}
+
+				buf = append(buf, l)
+				size += len(l.DisplayString()) + 1
+				if len(buf) >= ecf.thresholdBufsiz || size >= ecf.maxBatchBytes {
+					flush()
+				} else if timer == nil {
+					timer = time.NewTimer(ecf.flushInterval)
+					flushCh = timer.C
+				}
+			case <-flushCh:
+				timer, flushCh = nil, nil
+				flush()
+			}
 		}
 	}()
 }
@@ -505,19 +1313,34 @@ func (ecf *ExternalCmdFilter) launchExternalCmd(buf []Line, cancelCh chan struct
 		inbuf.WriteString(l.DisplayString() + "\n")
 	}
 
-	cmd.Stdin = inbuf
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		ecf.fail(err, nil)
+		return
+	}
 	r, err := cmd.StdoutPipe()
 	if err != nil {
+		ecf.fail(err, nil)
 		return
 	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
 
 	trace("cmd = %#v", cmd)
 	err = cmd.Start()
 	if err != nil {
+		ecf.fail(err, nil)
 		return
 	}
 
-	go cmd.Wait()
+	// The input is written separately, so that we can tell if the
+	// command exited without reading it
+	writeErrCh := make(chan error, 1)
+	go func() {
+		_, err := inbuf.WriteTo(stdin)
+		stdin.Close()
+		writeErrCh <- err
+	}()
 
 	cmdCh := make(chan Line)
 	go func(cmdCh chan Line, rdr *bufio.Reader) {
@@ -538,24 +1361,49 @@ func (ecf *ExternalCmdFilter) launchExternalCmd(buf []Line, cancelCh chan struct
 		}
 	}(cmdCh, bufio.NewReader(r))
 
-	defer func() {
-		if p := cmd.Process; p != nil {
-			p.Kill()
-		}
-	}()
-
 	defer trace("Done waiting for cancel or line")
 
+	n := 0
 	for {
 		select {
 		case <-cancelCh:
+			cmd.Process.Kill()
+			cmd.Wait()
 			return
 		case l, ok := <-cmdCh:
 			if l == nil || !ok {
+				// A command that printed nothing is considered to have
+				// failed if it exited with an error, or didn't read
+				// its input
+				err := cmd.Wait()
+				if werr := <-writeErrCh; err == nil && isBrokenPipe(werr) {
+					err = werr
+				}
+				if err != nil && n == 0 {
+					ecf.fail(err, stderr)
+				}
 				return
 			}
 			trace("Custom: l = %s", l.DisplayString())
+			n++
 			outputCh <- l
 		}
 	}
 }
+
+// isBrokenPipe returns true if `err` was returned when writing to a
+// pipe that was closed
+func isBrokenPipe(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	for _, e := range brokenPipeErrors {
+		if err == e {
+			return true
+		}
+	}
+	return false
+}
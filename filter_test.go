@@ -0,0 +1,801 @@
+package peco
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExcludeFilter(t *testing.T) {
+	f := NewExcludeFilter()
+	f.SetQuery("bob  DAVID")
+
+	expected := map[string]bool{
+		"Alice":   true,
+		"Bob":     false,
+		"Charlie": true,
+		"David":   false,
+		"Bobby":   false,
+	}
+	for v, kept := range expected {
+		l, err := f.filter(NewRawLine(v, false))
+		if kept && (err != nil || l == nil) {
+			t.Errorf("Expected '%s' to be kept", v)
+		} else if !kept && err != ErrFilterDidNotMatch {
+			t.Errorf("Expected '%s' to be excluded", v)
+		}
+	}
+
+	if c := f.Clone().(*RegexpFilter); !c.negate {
+		t.Errorf("Expected clone of an exclude filter to be an exclude filter")
+	}
+}
+
+func TestMatchedText(t *testing.T) {
+	f := NewRegexpFilter()
+	tests := map[string]string{
+		`[0-9a-f]{7}`:    "deadbee",
+		`t\s([0-9a-f]+)`: "deadbeef",
+		`error`:          "",
+	}
+	for query, expected := range tests {
+		f.SetQuery(query)
+		l, err := f.filter(NewRawLine("commit deadbeef (HEAD)", false))
+		if expected == "" {
+			if err == nil {
+				t.Errorf("Expected '%s' not to match", query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected '%s' to match: %s", query, err)
+			continue
+		}
+
+		if text, ok := matchedText(l); !ok || text != expected {
+			t.Errorf("Expected '%s' to yield '%s', got '%s'", query, expected, text)
+		}
+	}
+
+	if _, ok := matchedText(NewRawLine("commit deadbeef", false)); ok {
+		t.Errorf("Expected no matched text for a line that was not filtered")
+	}
+}
+
+func TestFilterOrder(t *testing.T) {
+	f, err := ioutil.TempFile("", "peco-config-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{
+	"CustomFilter": { "Cat": { "Cmd": "cat" } },
+	"Filters": [ "Cat", "Regexp" ]
+}`)
+	f.Close()
+
+	ctx := newCtx(nil, 25)
+	if err := ctx.ReadConfig(f.Name()); err != nil {
+		t.Fatalf("Failed to read config: %s", err)
+	}
+
+	for _, expected := range []string{"Cat", "Regexp", "Cat"} {
+		if name := ctx.Filter().String(); name != expected {
+			t.Errorf("Expected filter to be '%s', got '%s'", expected, name)
+		}
+		ctx.RotateFilter()
+	}
+
+	if err := ctx.SetCurrentFilterByName(IgnoreCaseMatch); err == nil {
+		t.Errorf("Expected filters that are not listed to be unavailable")
+	}
+
+	fs := FilterSet{}
+	fs.Add(NewIgnoreCaseFilter())
+	if err := fs.SetOrder([]string{"NoSuchFilter"}); err == nil {
+		t.Errorf("Expected unknown filter to be rejected")
+	}
+}
+
+func TestExternalCmdFilterErrors(t *testing.T) {
+	f, err := ioutil.TempFile("", "peco-config-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{ "CustomFilter": { "Missing": { "Cmd": "/nonexistent" } } }`)
+	f.Close()
+
+	ctx := newCtx(nil, 25)
+	if err := ctx.ReadConfig(f.Name()); err == nil || !strings.Contains(err.Error(), "/nonexistent") {
+		t.Errorf("Expected a custom filter with a missing command to be rejected, got %v", err)
+	}
+
+	// A command that exits with an error leaves the lines unfiltered
+	for _, l := range []string{"Alice", "Bob", "Charlie"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	ctx.filters.Add(NewExternalCmdFilter("False", "false", nil, DefaultCustomFilterBufferThreshold, false))
+	if err := ctx.SetCurrentFilterByName("False"); err != nil {
+		t.Fatalf("Failed to set filter: %s", err)
+	}
+
+	ctx.SetQuery([]rune("Bob"))
+	ctx.ForceExecQuery()
+	select {
+	case q := <-ctx.QueryCh():
+		ctx.NewFilter().Work(make(chan struct{}), q)
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the query to be executed")
+	}
+
+	select {
+	case r := <-ctx.StatusMsgCh():
+		if m := r.DataInterface().(StatusMsgRequest).message; !strings.Contains(m, "custom filter 'False' failed") {
+			t.Errorf("Expected the failure to be reported, got '%s'", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the failure to be reported in the status bar")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for ctx.GetCurrentLineBuffer().Size() != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := ctx.GetCurrentLineBuffer().Size(); n != 3 {
+		t.Errorf("Expected all 3 lines to be shown, got %d", n)
+	}
+
+	// A command that works is not reported
+	ecf := NewExternalCmdFilter("Cat", "cat", []string{"-"}, DefaultCustomFilterBufferThreshold, false)
+	src := ctx.rawLineBuffer
+	src.Replay()
+	ecf.Accept(src)
+	n := 0
+	for _ = range ecf.outputCh {
+		n++
+	}
+	if n != 3 || ecf.Err() != nil {
+		t.Errorf("Expected 3 lines and no error, got %d lines (%v)", n, ecf.Err())
+	}
+}
+
+func TestOrGroups(t *testing.T) {
+	f := NewIgnoreCaseFilter()
+
+	// Spaces bind looser than the separator: this is
+	// (error OR warn) AND fatal
+	f.SetQuery("error|warn fatal")
+	expected := map[string]bool{
+		"fatal error":      true,
+		"WARN: fatal":      true,
+		"fatal":            false,
+		"error":            false,
+		"warn error":       false,
+		"error|warn fatal": true,
+	}
+	for v, matched := range expected {
+		_, err := f.filter(NewRawLine(v, false))
+		if matched && err != nil {
+			t.Errorf("Expected '%s' to match: %s", v, err)
+		} else if !matched && err != ErrFilterDidNotMatch {
+			t.Errorf("Expected '%s' not to match", v)
+		}
+	}
+
+	// Highlights come from the alternative that matched, and the
+	// longest alternative wins
+	f.SetQuery("err|error|warn")
+	l, err := f.filter(NewRawLine("an error", false))
+	if err != nil {
+		t.Fatalf("Expected 'an error' to match: %s", err)
+	}
+	if indices := l.(*MatchedLine).Indices(); len(indices) != 1 || indices[0][0] != 3 || indices[0][1] != 8 {
+		t.Errorf("Expected 'error' to be highlighted, got %v", indices)
+	}
+
+	// Empty alternatives are dropped, separator-only terms and
+	// escaped separators are matched literally
+	queries := map[string]string{
+		"|foo||": "foo",
+		"bar|":   "bar",
+		"|":      "a | b",
+		"||":     "a || b",
+		`a\|b`:   "a|b",
+		`x|a\|b`: "a|b",
+		`\|`:     "a | b",
+	}
+	for q, v := range queries {
+		f.SetQuery(q)
+		if _, err := f.filter(NewRawLine(v, false)); err != nil {
+			t.Errorf("Expected '%s' to match '%s': %s", q, v, err)
+		}
+	}
+	f.SetQuery(`a\|b`)
+	if _, err := f.filter(NewRawLine("a", false)); err == nil {
+		t.Errorf("Expected an escaped separator not to start an OR group")
+	}
+
+	// The separator can be changed, or disabled
+	f.SetOrSeparator(",")
+	f.SetQuery("foo,bar")
+	if _, err := f.filter(NewRawLine("bar", false)); err != nil {
+		t.Errorf("Expected 'foo,bar' to match 'bar': %s", err)
+	}
+	f.SetOrSeparator("")
+	f.SetQuery("foo|bar")
+	if _, err := f.filter(NewRawLine("bar", false)); err == nil {
+		t.Errorf("Expected 'foo|bar' to be matched literally")
+	}
+
+	// The Regexp filter has its own alternation
+	rf := NewRegexpFilter()
+	rf.SetOrSeparator("|")
+	if rf.orSeparator != "" {
+		t.Errorf("Expected Regexp filter to ignore the OR separator")
+	}
+}
+
+func TestRegexpFallbackLiteral(t *testing.T) {
+	f := NewRegexpFilter()
+	f.SetQuery("foo(")
+	if _, err := f.filter(NewRawLine("call foo(1)", false)); err == nil || err == ErrFilterDidNotMatch {
+		t.Errorf("Expected an invalid regular expression to fail, got %v", err)
+	}
+	if f.Err() == nil {
+		t.Errorf("Expected an invalid regular expression to be reported")
+	}
+
+	// Clones follow the setting, and go back to regular expressions
+	// once the query is valid
+	f.SetFallbackLiteral(true)
+	rf := f.Clone().(*RegexpFilter)
+	for query, expected := range map[string]map[string][]int{
+		"foo(":   {"call foo(1)": {5, 9}, "call foo": nil},
+		"fo+ (1": {"call fooo(1)": {5, 11}, "call f(1": nil},
+		"fo+":    {"call fooo(1)": {5, 9}, "call f": nil},
+	} {
+		rf.SetQuery(query)
+		if err := rf.Err(); err != nil {
+			t.Errorf("Expected '%s' to be matched literally: %s", query, err)
+		}
+		for v, indices := range expected {
+			l, err := rf.filter(NewRawLine(v, false))
+			switch {
+			case indices == nil && err != ErrFilterDidNotMatch:
+				t.Errorf("Expected '%s' not to match '%s', got %v", v, query, err)
+			case indices != nil && err != nil:
+				t.Errorf("Expected '%s' to match '%s': %s", v, query, err)
+			case indices != nil && !reflect.DeepEqual(l.Indices()[0], indices):
+				t.Errorf("Expected %v of '%s' to match '%s', got %v", indices, v, query, l.Indices())
+			}
+		}
+	}
+
+	// Filters that match literally anyway are left alone
+	ef := NewExcludeFilter()
+	ef.SetFallbackLiteral(true)
+	if ef.fallback {
+		t.Errorf("Expected the Exclude filter to ignore RegexpFallbackLiteral")
+	}
+}
+
+func TestInvalidRegexp(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	for _, l := range []string{"foo(1)", "bar(2)"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	if err := ctx.SetCurrentFilterByName("Regexp"); err != nil {
+		t.Fatalf("Failed to set filter: %s", err)
+	}
+	run := func(query string) {
+		ctx.SetQuery([]rune(query))
+		ctx.ForceExecQuery()
+		select {
+		case q := <-ctx.QueryCh():
+			ctx.NewFilter().Work(make(chan struct{}), q)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the query to be executed")
+		}
+	}
+
+	// An invalid query keeps the previous results, and shows why
+	run("foo")
+	results := ctx.GetCurrentLineBuffer()
+	run("foo(")
+	if ctx.GetCurrentLineBuffer() != results {
+		t.Errorf("Expected the results to be kept while the query is not valid")
+	}
+	select {
+	case r := <-ctx.StatusMsgCh():
+		if m := r.DataInterface().(StatusMsgRequest).message; !strings.Contains(m, "missing closing )") {
+			t.Errorf("Expected the error to be shown, got '%s'", m)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the error to be shown in the status bar")
+	}
+}
+
+func TestGlobFilter(t *testing.T) {
+	f := NewGlobFilter()
+	for query, expected := range map[string]map[string][][]int{
+		"*.go": {
+			"main.go":          {{0, 7}},
+			"src/main.go":      {{4, 11}},
+			"src/main.go.orig": {{4, 11}},
+			"main.c":           nil,
+		},
+		"src/*.go": {
+			"src/main.go":         {{0, 11}},
+			"src/handler/main.go": nil,
+		},
+		"src/**/handler*.go": {
+			"src/handler.go":            {{0, 14}},
+			"./src/api/v1/handler_x.go": {{2, 25}},
+			"src/api/handler/main.go":   nil,
+		},
+		"?.c": {"src/a.c": {{4, 7}}, "a/.c": nil},
+		"[ab].c [!/]x": {
+			"b.cx": {{0, 4}},
+			"c.cx": nil,
+		},
+		"cmd main": {"cmd/peco/main.go": {{0, 3}, {9, 13}}, "main.go": nil},
+		`\*`:       {"a*b": {{1, 2}}, "ab": nil},
+	} {
+		f.SetQuery(query)
+		if err := f.Err(); err != nil {
+			t.Errorf("Expected '%s' to be valid: %s", query, err)
+			continue
+		}
+		for v, indices := range expected {
+			l, err := f.filter(NewRawLine(v, false))
+			switch {
+			case indices == nil && err != ErrFilterDidNotMatch:
+				t.Errorf("Expected '%s' not to match '%s', got %v", v, query, err)
+			case indices != nil && err != nil:
+				t.Errorf("Expected '%s' to match '%s': %s", v, query, err)
+			case indices != nil && !reflect.DeepEqual(l.Indices(), indices):
+				t.Errorf("Expected %v of '%s' to match '%s', got %v", indices, v, query, l.Indices())
+			}
+		}
+	}
+
+	for _, query := range []string{"foo [abc", "[z-a]"} {
+		f.SetQuery(query)
+		if f.Err() == nil {
+			t.Errorf("Expected '%s' not to be valid", query)
+		}
+	}
+
+	// An invalid query keeps the previous results, and shows why
+	ctx := newCtx(nil, 25)
+	for _, l := range []string{"main.go", "main.c", "lib.go"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	if err := ctx.SetCurrentFilterByName(GlobMatch); err != nil {
+		t.Fatalf("Failed to set filter: %s", err)
+	}
+	run := func(query string) {
+		ctx.SetQuery([]rune(query))
+		ctx.ForceExecQuery()
+		select {
+		case q := <-ctx.QueryCh():
+			ctx.NewFilter().Work(make(chan struct{}), q)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the query to be executed")
+		}
+	}
+	statusMsg := func() string {
+		select {
+		case r := <-ctx.StatusMsgCh():
+			return r.DataInterface().(StatusMsgRequest).message
+		case <-time.After(time.Second):
+			return "(none)"
+		}
+	}
+
+	run("*.go")
+	results := ctx.GetCurrentLineBuffer()
+	run("*.[ch")
+	if ctx.GetCurrentLineBuffer() != results {
+		t.Errorf("Expected the results to be kept while the query is not valid")
+	}
+	if msg := statusMsg(); !strings.Contains(msg, "*.[ch") {
+		t.Errorf("Expected the error to be shown, got '%s'", msg)
+	}
+	run("*.[ch]")
+	if ctx.GetCurrentLineBuffer() == results {
+		t.Errorf("Expected the query to be run once it is valid")
+	}
+	if msg := statusMsg(); msg != "" {
+		t.Errorf("Expected the error to be cleared, got '%s'", msg)
+	}
+}
+
+func TestExtendedSearchSyntax(t *testing.T) {
+	rf := NewIgnoreCaseFilter()
+	rf.SetExtendedSyntax(true)
+	f := rf.Clone().(*RegexpFilter)
+	for query, expected := range map[string]map[string][][]int{
+		"^foo":      {"Foo bar": {{0, 3}}, "bar foo": nil},
+		"bar$":      {"foo bar": {{4, 7}}, "bar foo": nil},
+		"^foo bar$": {"foo and bar": {{0, 3}, {8, 11}}, "foo bar baz": nil},
+		"^foo$":     {"foo": {{0, 3}}, "foo bar": nil},
+		"^err|warn": {"warning: x": {{0, 4}}, "no error": nil},
+		"'^foo$":    {"a ^foo$ b": {{2, 7}}, "foo": nil},
+		"'a|b":      {"a|b": {{0, 3}}, "a": nil},
+		"^ $ '":     {"^ $ '": {{0, 1}, {2, 3}, {4, 5}}, "foo": nil},
+	} {
+		f.SetQuery(query)
+		for v, indices := range expected {
+			l, err := f.filter(NewRawLine(v, false))
+			switch {
+			case indices == nil && err != ErrFilterDidNotMatch:
+				t.Errorf("Expected '%s' not to match '%s', got %v", v, query, err)
+			case indices != nil && err != nil:
+				t.Errorf("Expected '%s' to match '%s': %s", v, query, err)
+			case indices != nil && !reflect.DeepEqual(l.Indices(), indices):
+				t.Errorf("Expected %v of '%s' to match '%s', got %v", indices, v, query, l.Indices())
+			}
+		}
+	}
+
+	// Unless enabled, the operators are matched literally
+	f = NewIgnoreCaseFilter()
+	f.SetQuery("^foo")
+	if _, err := f.filter(NewRawLine("foo", false)); err != ErrFilterDidNotMatch {
+		t.Errorf("Expected '^foo' to be matched literally, got %v", err)
+	}
+
+	// The Regexp filter has operators of its own
+	f = NewRegexpFilter()
+	f.SetExtendedSyntax(true)
+	if f.extended {
+		t.Errorf("Expected the Regexp filter to ignore ExtendedSearchSyntax")
+	}
+
+	// Lines that start with a term are excluded
+	f = NewExcludeFilter()
+	f.SetExtendedSyntax(true)
+	f.SetQuery("^foo")
+	if _, err := f.filter(NewRawLine("bar foo", false)); err != nil {
+		t.Errorf("Expected 'bar foo' to be kept, got %v", err)
+	}
+	if _, err := f.filter(NewRawLine("foo bar", false)); err != ErrFilterDidNotMatch {
+		t.Errorf("Expected 'foo bar' to be excluded, got %v", err)
+	}
+}
+
+func TestHighlightAllMatches(t *testing.T) {
+	f := NewIgnoreCaseFilter()
+	f.SetQuery("foo ba")
+	l, err := f.filter(NewRawLine("foo bar foo baz foobar", false))
+	if err != nil {
+		t.Fatalf("Expected the line to match: %s", err)
+	}
+	expected := [][]int{{0, 3}, {4, 6}, {8, 11}, {12, 14}, {16, 21}}
+	if indices := l.(*MatchedLine).Indices(); !reflect.DeepEqual(indices, expected) {
+		t.Errorf("Expected every occurrence to be highlighted, got %v", indices)
+	}
+
+	// Queries that match everywhere are capped, and empty matches
+	// are not highlighted
+	f = NewRegexpFilter()
+	f.SetQuery(".")
+	l, err = f.filter(NewRawLine(strings.Repeat("x", 1000), false))
+	if err != nil {
+		t.Fatalf("Expected the line to match: %s", err)
+	}
+	if indices := l.(*MatchedLine).Indices(); len(indices) > maxMatchIntervals {
+		t.Errorf("Expected at most %d matches, got %d", maxMatchIntervals, len(indices))
+	}
+	f.SetQuery("y*")
+	l, err = f.filter(NewRawLine("xxx", false))
+	if err != nil {
+		t.Fatalf("Expected the line to match: %s", err)
+	}
+	if indices := l.(*MatchedLine).Indices(); len(indices) != 0 {
+		t.Errorf("Expected nothing to be highlighted, got %v", indices)
+	}
+}
+
+// BenchmarkFilterMultipleTerms matches a million lines, about half of
+// which match with several occurrences of each term
+func BenchmarkFilterMultipleTerms(b *testing.B) {
+	f := NewIgnoreCaseFilter()
+	f.SetQuery("error conn")
+	lines := make([]Line, 1000000)
+	for i := range lines {
+		if i%2 == 0 {
+			lines[i] = NewRawLine(fmt.Sprintf("2016-01-01 12:00:%02d [error] connection reset by peer; conn=%d error=ECONNRESET retrying connection in 5s", i%60, i), false)
+		} else {
+			lines[i] = NewRawLine(fmt.Sprintf("2016-01-01 12:00:%02d [info] request %d served in 12ms", i%60, i), false)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, l := range lines {
+			f.filter(l)
+		}
+	}
+}
+
+func TestFilterProgress(t *testing.T) {
+	p := newFilterProgress()
+
+	run := p.Start()
+	if p.IsFiltering() {
+		t.Errorf("Expected no indicator right after the query started")
+	}
+	if !p.ShowIndicator(run) || !p.IsFiltering() {
+		t.Errorf("Expected the indicator to be shown for a query that takes a while")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !p.Finish(run) || p.IsFiltering() {
+		t.Errorf("Expected the indicator to be cleared once the query completes")
+	}
+	if p.Latency() < 10*time.Millisecond {
+		t.Errorf("Expected the latency to be recorded, got %s", p.Latency())
+	}
+
+	// Completed queries don't bring the indicator back
+	if p.ShowIndicator(run) {
+		t.Errorf("Expected no indicator for a completed query")
+	}
+
+	// A superseded query neither shows nor clears the indicator,
+	// but the query that supersedes it clears what it left behind
+	old := p.Start()
+	p.ShowIndicator(old)
+	run = p.Start()
+	if p.IsFiltering() || p.ShowIndicator(old) {
+		t.Errorf("Expected the superseded query to lose its indicator")
+	}
+	if p.Finish(old) {
+		t.Errorf("Expected the superseded query not to be recorded")
+	}
+	if !p.Finish(run) {
+		t.Errorf("Expected the indicator of the superseded query to be cleared")
+	}
+}
+
+func TestFilterStats(t *testing.T) {
+	s := newFilterStats()
+
+	// Nothing has run yet
+	buf := &bytes.Buffer{}
+	s.Print(buf)
+	if !strings.Contains(buf.String(), "filter passes:   0 (0 canceled)") {
+		t.Errorf("Expected no passes, got %q", buf.String())
+	}
+
+	s.Start()
+	s.Finish(10*time.Millisecond, 100, 10)
+	s.Start() // superseded
+	s.Start()
+	s.Finish(30*time.Millisecond, 100, 5)
+
+	buf.Reset()
+	s.Print(buf)
+	expected := `filter passes:   3 (1 canceled)
+average latency: 20ms
+max latency:     30ms
+lines scanned:   200
+lines matched:   15
+`
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+// testPipeline is a Pipeliner whose lines are sent by the test
+type testPipeline struct {
+	cancelCh chan struct{}
+	ch       chan Line
+}
+
+func (p testPipeline) Pipeline() (chan struct{}, chan Line) {
+	return p.cancelCh, p.ch
+}
+
+func TestExternalCmdFilterBatches(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "peco-filter-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Records the number of lines of each batch, and prints them back
+	script := filepath.Join(dir, "record")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\nin=$(cat)\nprintf '%s\\n' \"$in\" | wc -l >> \"$1\"\nprintf '%s\\n' \"$in\"\n"), 0755)
+	record := filepath.Join(dir, "batches")
+	batches := func() []string {
+		buf, _ := ioutil.ReadFile(record)
+		os.Remove(record)
+		return strings.Fields(string(buf))
+	}
+
+	ecf := NewExternalCmdFilter("Record", script, []string{record}, 10000, false)
+	ecf.SetBatchLimits(200, 100*time.Millisecond)
+	p := testPipeline{make(chan struct{}), make(chan Line)}
+	ecf.Accept(p)
+
+	var output []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for l := range ecf.outputCh {
+			output = append(output, l.DisplayString())
+		}
+	}()
+	send := func(lines ...string) {
+		for _, l := range lines {
+			p.ch <- NewRawLine(l, false)
+		}
+	}
+
+	// Fewer lines than the threshold are passed to the command once
+	// they were buffered for the flush interval
+	send("a", "b", "c")
+	time.Sleep(20 * time.Millisecond)
+	if b := batches(); len(b) != 0 {
+		t.Errorf("Expected no batch before the flush interval, got %v", b)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if b := batches(); !reflect.DeepEqual(b, []string{"3"}) {
+		t.Errorf("Expected a batch of 3 lines after the flush interval, got %v", b)
+	}
+
+	// Large lines are passed on once they reach MaxBatchBytes, and the
+	// rest once the input ends
+	long := strings.Repeat("x", 99)
+	send(long, long, long, "d")
+	close(p.ch)
+	<-done
+	if b := batches(); !reflect.DeepEqual(b, []string{"2", "2"}) {
+		t.Errorf("Expected batches of 2 and 2 lines, got %v", b)
+	}
+	if expected := []string{"a", "b", "c", long, long, long, "d"}; !reflect.DeepEqual(output, expected) {
+		t.Errorf("Expected %v, got %v", expected, output)
+	}
+
+	// So are BufferThreshold lines
+	ecf = NewExternalCmdFilter("Record", script, []string{record}, 2, false)
+	p = testPipeline{make(chan struct{}), make(chan Line)}
+	ecf.Accept(p)
+	go func() {
+		for _ = range ecf.outputCh {
+		}
+	}()
+	send("a", "b", "c", "d", "e")
+	close(p.ch)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if buf, _ := ioutil.ReadFile(record); len(strings.Fields(string(buf))) == 3 {
+			break
+		}
+	}
+	if b := batches(); !reflect.DeepEqual(b, []string{"2", "2", "1"}) {
+		t.Errorf("Expected batches of 2, 2 and 1 lines, got %v", b)
+	}
+}
+
+// prefixFilter is an example of a filter that is not built in (see
+// QueryFilterer and Ctx.AddFilter). It matches the lines that start
+// with the query
+type prefixFilter struct {
+	query    string
+	cancelCh chan struct{}
+	outputCh chan Line
+}
+
+func (pf *prefixFilter) Pipeline() (chan struct{}, chan Line) {
+	return pf.cancelCh, pf.outputCh
+}
+
+func (pf *prefixFilter) Cancel() {
+	close(pf.cancelCh)
+}
+
+func (pf *prefixFilter) Clone() QueryFilterer {
+	return &prefixFilter{}
+}
+
+func (pf *prefixFilter) SetQuery(q string) {
+	pf.query = q
+}
+
+func (pf *prefixFilter) String() string {
+	return "Prefix"
+}
+
+func (pf *prefixFilter) Accept(p Pipeliner) {
+	cancelCh, incomingCh := p.Pipeline()
+	pf.cancelCh, pf.outputCh = cancelCh, make(chan Line)
+
+	go func(query string, out chan Line) {
+		defer close(out)
+		for {
+			select {
+			case <-cancelCh:
+				return
+			case l, ok := <-incomingCh:
+				if !ok {
+					return
+				}
+				if !strings.HasPrefix(l.DisplayString(), query) {
+					continue
+				}
+				select {
+				case out <- NewMatchedLine(l, [][]int{{0, len(query)}}):
+				case <-cancelCh:
+					return
+				}
+			}
+		}
+	}(pf.query, pf.outputCh)
+}
+
+func TestAddFilter(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	for _, l := range []string{"Alice", "Bob", "Alan", "Malice"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+
+	if err := ctx.AddFilter("Prefix", &prefixFilter{}); err != nil {
+		t.Fatalf("Failed to add filter: %s", err)
+	}
+	if err := ctx.AddFilter("StartsWith", &prefixFilter{}); err != nil {
+		t.Fatalf("Failed to add filter under another name: %s", err)
+	}
+	for _, name := range []string{"Prefix", "IgnoreCase"} {
+		if err := ctx.AddFilter(name, &prefixFilter{}); err == nil {
+			t.Errorf("Expected a second filter named %s to be rejected", name)
+		}
+	}
+	if names := strings.Join(ctx.filters.Names(), ","); !strings.HasSuffix(names, ",Prefix,StartsWith") {
+		t.Errorf("Expected the filters to be added after the built-in ones, got %s", names)
+	}
+
+	if err := ctx.SetCurrentFilterByName("StartsWith"); err != nil {
+		t.Fatalf("Failed to set filter: %s", err)
+	}
+	ctx.SetQuery([]rune("Al"))
+	ctx.ForceExecQuery()
+	select {
+	case q := <-ctx.QueryCh():
+		ctx.NewFilter().Work(make(chan struct{}), q)
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the query to be executed")
+	}
+
+	var matched []string
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		matched = matched[:0]
+		for _, l := range ctx.GetCurrentLineBuffer().Snapshot() {
+			if !reflect.DeepEqual(l.Indices(), [][]int{{0, 2}}) {
+				t.Errorf("Expected the prefix of %s to be highlighted, got %v", l.DisplayString(), l.Indices())
+			}
+			matched = append(matched, l.DisplayString())
+		}
+		if len(matched) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := strings.Join(matched, ","); s != "Alice,Alan" {
+		t.Errorf("Expected 'Alice,Alan' to match, got '%s'", s)
+	}
+}
@@ -0,0 +1,52 @@
+package peco
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// LineFormatter renders lines through a text/template when they are
+// displayed (--format). Like ColumnAligner, it only changes how lines
+// are displayed: queries are matched against, and lines are output
+// with, the original text
+type LineFormatter struct {
+	tmpl      *template.Template
+	delimiter *regexp.Regexp
+}
+
+// formatData is what the template is executed with
+type formatData struct {
+	Line   string   // the line, as it is displayed without --format
+	Fields []string // the fields of Line, counting from 0
+}
+
+// NewLineFormatter creates a LineFormatter from the text of a template.
+// Fields are split by `delimiter`, or by runs of whitespace if it is nil
+func NewLineFormatter(format string, delimiter *regexp.Regexp) (*LineFormatter, error) {
+	tmpl, err := template.New("format").Parse(format)
+	if err != nil {
+		return nil, err
+	}
+	return &LineFormatter{tmpl: tmpl, delimiter: delimiter}, nil
+}
+
+// Format returns the text to display for `s`. If the template fails
+// (e.g. it refers to a field that the line doesn't have), `s` is
+// returned as is
+func (lf *LineFormatter) Format(s string) string {
+	data := formatData{Line: s}
+	if lf.delimiter == nil {
+		data.Fields = strings.Fields(s)
+	} else {
+		data.Fields = lf.delimiter.Split(s, -1)
+	}
+
+	var buf bytes.Buffer
+	if err := lf.tmpl.Execute(&buf, data); err != nil {
+		trace("LineFormatter.Format: %s", err)
+		return s
+	}
+	return buf.String()
+}
@@ -84,13 +84,18 @@ func (h *Hub) Batch(f func()) {
 }
 
 // low-level utility
-func send(ch chan HubReq, r HubReq, needReply bool) {
+func send(name string, ch chan HubReq, r HubReq, needReply bool) {
+	trace("Hub.send: sending %s request (sync = %t, queued = %d)", name, needReply, len(ch))
 	if needReply {
 		r.replyCh = make(chan struct{})
-		defer func() { <-r.replyCh }()
+		defer func() {
+			<-r.replyCh
+			trace("Hub.send: %s request was processed", name)
+		}()
 	}
 
 	ch <- r
+	trace("Hub.send: %s request was received", name)
 }
 
 // QueryCh returns the underlying channel for queries
@@ -100,7 +105,7 @@ func (h *Hub) QueryCh() chan HubReq {
 
 // SendQuery sends the query string to be processed by the Filter
 func (h *Hub) SendQuery(q string) {
-	send(h.QueryCh(), HubReq{q, nil}, h.isSync)
+	send("query", h.QueryCh(), HubReq{q, nil}, h.isSync)
 }
 
 // LoopCh returns the channel to control the main execution loop.
@@ -119,7 +124,14 @@ func (h *Hub) DrawCh() chan HubReq {
 // SendDrawPrompt sends a request to redraw the prompt only
 func (h *Hub) SendDrawPrompt() {
 	req := HubReq{"prompt", nil}
-	send(h.DrawCh(), req, h.isSync)
+	send("draw prompt", h.DrawCh(), req, h.isSync)
+}
+
+// SendRefresh sends a request to discard what is known about the
+// current state of the terminal, and redraw the entire display
+func (h *Hub) SendRefresh() {
+	req := HubReq{"refresh", nil}
+	send("refresh", h.DrawCh(), req, h.isSync)
 }
 
 // SendDraw sends a request to redraw the terminal display
@@ -128,7 +140,7 @@ func (h *Hub) SendDraw() {
 	defer trace("Hub.SendDraw: END")
 	// to make sure interface is nil, I need to EXPLICITLY set nil
 	req := HubReq{nil, nil}
-	send(h.DrawCh(), req, h.isSync)
+	send("draw", h.DrawCh(), req, h.isSync)
 }
 
 // StatusMsgCh returns the channel to update the status message
@@ -144,7 +156,13 @@ func (h *Hub) SendStatusMsg(q string) {
 // SendStatusMsgAndClear sends a string to be displayed in the status message,
 // as well as a delay until the message should be cleared
 func (h *Hub) SendStatusMsgAndClear(q string, clearDelay time.Duration) {
-	send(h.StatusMsgCh(), HubReq{StatusMsgRequest{q, clearDelay}, nil}, h.isSync)
+	send("status", h.StatusMsgCh(), HubReq{StatusMsgRequest{message: q, clearDelay: clearDelay}, nil}, h.isSync)
+}
+
+// ClearStatusMsg clears the status message, but only if it is still
+// `q`. Messages that were sent since are left alone
+func (h *Hub) ClearStatusMsg(q string) {
+	send("status", h.StatusMsgCh(), HubReq{StatusMsgRequest{message: q, clear: true}, nil}, h.isSync)
 }
 
 // PagingCh returns the channel to page through the results
@@ -154,7 +172,7 @@ func (h *Hub) PagingCh() chan HubReq {
 
 // SendPaging sends a request to move the cursor around
 func (h *Hub) SendPaging(x PagingRequest) {
-	send(h.PagingCh(), HubReq{x, nil}, h.isSync)
+	send("paging", h.PagingCh(), HubReq{x, nil}, h.isSync)
 }
 
 // Stop closes the LoopCh so that peco shutdown
@@ -3,20 +3,40 @@ package peco
 import (
 	"sync"
 	"time"
-
-	"github.com/nsf/termbox-go"
 )
 
-// Input handles input events from termbox.
+// Input handles input events from the screen.
 type Input struct {
 	*Ctx
 	mutex         sync.Locker // Currently only used for protecting Alt/Esc workaround
 	mod           *time.Timer
 	keymap        Keymap
 	currentKeySeq []string
+	pendingAccept *pendingAccept // non-nil while waiting for ConfirmAccept
+	pendingPrompt *pendingPrompt // non-nil while the user types in the status bar
+	actionMenu    bool           // true while the action menu is displayed
+	keyCount      int            // number of key events handled so far
+	accel         accelerator
+	escKeyCount   int         // keyCount when Esc was last pressed (see DoubleEscapeToExit)
+	escAt         time.Time   // when Esc was last pressed
+	callbackCh    chan func() // functions to be called by Loop, see runInLoop
+	filtering     bool        // true while peco.FilterBufferThrough runs its command
 }
 
-// Loop watches for incoming events from termbox, and pass them
+// doubleEscapeInterval is how soon Esc must be pressed again to exit
+// with DoubleEscapeToExit
+const doubleEscapeInterval = time.Second
+
+// accelerator keeps track of a movement action being fired repeatedly,
+// as its key is held down (see AccelerationConfig)
+type accelerator struct {
+	paging   PagingRequest
+	keyCount int // Input.keyCount when it was last fired
+	last     time.Time
+	repeats  int
+}
+
+// Loop watches for incoming events from the screen, and pass them
 // to the appropriate handler when something arrives.
 func (i *Input) Loop() {
 	trace("Input.Loop: START")
@@ -31,19 +51,32 @@ func (i *Input) Loop() {
 			return
 		case ev := <-evCh:
 			i.handleInputEvent(ev)
+		case f := <-i.callbackCh:
+			f()
 		}
 	}
 }
 
-func (i *Input) handleInputEvent(ev termbox.Event) {
+// runInLoop has `f` called by Loop, between two input events. Actions
+// that do some work in the background use it to apply the result,
+// as the state that actions work on is only ever changed by Loop
+func (i *Input) runInLoop(f func()) {
+	select {
+	case i.callbackCh <- f:
+	case <-i.LoopCh():
+	}
+}
+
+func (i *Input) handleInputEvent(ev Event) {
 	switch ev.Type {
-	case termbox.EventError:
+	case EventError:
 		//update = false
-	case termbox.EventResize:
+	case EventResize:
+		i.markResized()
 		i.SendDraw()
-	case termbox.EventKey:
+	case EventKey:
 		// ModAlt is a sequence of letters with a leading \x1b (=Esc).
-		// It would be nice if termbox differentiated this for us, but
+		// It would be nice if the screen differentiated this for us, but
 		// we workaround it by waiting (juuuuse a few milliseconds) for
 		// extra key events. If no extra events arrive, it should be Esc
 
@@ -67,7 +100,15 @@ func (i *Input) handleInputEvent(ev termbox.Event) {
 			if i.mod != nil {
 				i.mod.Stop()
 				i.mod = nil
-				ev.Mod |= termbox.ModAlt
+				if ev.Ch == 0 && ev.Key == KeyEsc && i.config.DoubleEscapeToExit {
+					// Esc pressed twice in a row, rather than Alt+Esc
+					i.mutex.Unlock()
+					trace("Input.handleInputEvent: Firing double Esc")
+					i.handleKeyEvent(Event{Key: KeyEsc})
+					i.handleKeyEvent(ev)
+					return
+				}
+				ev.Mod |= ModAlt
 			}
 			i.mutex.Unlock()
 			trace("Input.handleInputEvent: Firing event")
@@ -76,12 +117,84 @@ func (i *Input) handleInputEvent(ev termbox.Event) {
 	}
 }
 
-func (i *Input) handleKeyEvent(ev termbox.Event) {
+func (i *Input) handleKeyEvent(ev Event) {
 	trace("Input.handleKeyEvent: START")
 	defer trace("Input.handleKeyEvent: END")
+
+	i.keyCount++
+
+	if i.pendingAccept != nil {
+		trace("Input.handleKeyEvent: resolving pending accept")
+		resolvePendingAccept(i, ev)
+		return
+	}
+
+	if i.hintMode {
+		trace("Input.handleKeyEvent: resolving quick select hint")
+		resolveHint(i, ev)
+		return
+	}
+
+	if i.pendingPrompt != nil {
+		trace("Input.handleKeyEvent: editing pending prompt")
+		resolvePendingPrompt(i, ev)
+		return
+	}
+
+	if i.actionMenu {
+		trace("Input.handleKeyEvent: picking from the action menu")
+		resolveActionMenu(i, ev)
+		return
+	}
+
+	if i.helpShown() {
+		trace("Input.handleKeyEvent: scrolling the help")
+		resolveHelp(i, ev)
+		return
+	}
+
 	if h := i.keymap.Handler(ev); h != nil {
 		trace("Input.handleKeyEvent: Event %#v maps to %s, firing action", ev, h)
 		h.Execute(i, ev)
 		return
 	}
 }
+
+// accelerationStep returns the number of times the paging request
+// should be sent. This grows while the movement action is fired by
+// consecutive key events in quick succession, i.e. while its key is
+// held down (see AccelerationConfig)
+func (i *Input) accelerationStep(p PagingRequest) int {
+	cfg := i.config.Acceleration
+	a := &i.accel
+	now := time.Now()
+	if a.paging == p && a.keyCount == i.keyCount-1 && now.Sub(a.last) <= time.Duration(cfg.Interval)*time.Millisecond {
+		a.repeats++
+	} else {
+		a.repeats = 0
+	}
+	a.paging, a.keyCount, a.last = p, i.keyCount, now
+
+	// The cursor always moves at least once
+	if !cfg.Enabled || cfg.Repeats <= 0 || cfg.MaxStep <= 1 {
+		return 1
+	}
+
+	step := 1
+	for n := a.repeats / cfg.Repeats; n > 0 && step < cfg.MaxStep; n-- {
+		step *= 2
+	}
+	if step > cfg.MaxStep {
+		step = cfg.MaxStep
+	}
+	return step
+}
+
+// secondEscape records that Esc was pressed, and returns true if it
+// was also the previous key, pressed less than doubleEscapeInterval ago
+func (i *Input) secondEscape() bool {
+	now := time.Now()
+	second := i.escKeyCount == i.keyCount-1 && now.Sub(i.escAt) < doubleEscapeInterval
+	i.escKeyCount, i.escAt = i.keyCount, now
+	return second
+}
@@ -63,9 +63,18 @@ type issue212DummyConfig struct {
 	layout string
 }
 func (i issue212DummyConfig) BufferSize() int { return 0 }
+func (i issue212DummyConfig) BufferPolicy() string { return "" }
 func (i issue212DummyConfig) InitialIndex() int { return 0 }
 func (i issue212DummyConfig) EnableNullSep() bool { return false }
 func (i issue212DummyConfig) LayoutType() string { return i.layout }
+func (i issue212DummyConfig) PrintQueryOnNoMatch() bool { return false }
+func (i issue212DummyConfig) FieldSpec() *FieldSpec { return nil }
+func (i issue212DummyConfig) Unique() bool { return false }
+func (i issue212DummyConfig) Trim() bool { return false }
+func (i issue212DummyConfig) TrimDisplay() bool { return false }
+func (i issue212DummyConfig) MaxSelect() int { return 0 }
+func (i issue212DummyConfig) SelectMarker() string { return "" }
+func (i issue212DummyConfig) SelectionOrder() string { return "" }
 func TestIssue212_ActualProblem(t *testing.T) {
 	ctx := NewCtx(issue212DummyConfig{ layout: "" })
 	if ctx.layoutType != "top-down" {
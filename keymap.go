@@ -2,36 +2,46 @@ package peco
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/nsf/termbox-go"
 	"github.com/peco/peco/keyseq"
 )
 
 // Keymap holds all the key sequence to action map
 type Keymap struct {
-	Config map[string]string
-	Action map[string][]string // custom actions
-	Keyseq *keyseq.Keyseq
+	Config   map[string]string
+	Action   map[string][]string // custom actions
+	Keyseq   *keyseq.Keyseq
+	bindings map[string]KeyBinding
+}
+
+// These describe where a KeyBinding came from
+const (
+	KeyBindingOriginDefault = "default"
+	KeyBindingOriginConfig  = "config"
+)
+
+// KeyBinding describes the action that a key sequence is mapped to,
+// and where that mapping was defined
+type KeyBinding struct {
+	Keys   string
+	Action string
+	Origin string
 }
 
 // NewKeymap creates a new Keymap struct
 func NewKeymap(config map[string]string, actions map[string][]string) Keymap {
-	return Keymap{config, actions, keyseq.New()}
+	return Keymap{config, actions, keyseq.New(), map[string]KeyBinding{}}
 
 }
 
-// Handler returns the appropriate action for the given termbox event
-func (km Keymap) Handler(ev termbox.Event) Action {
-	modifier := keyseq.ModNone
-	if (ev.Mod & termbox.ModAlt) != 0 {
-		modifier = keyseq.ModAlt
-	}
-
-	key := keyseq.Key{modifier, ev.Key, ev.Ch}
-	action, err := km.Keyseq.AcceptKey(key)
+// Handler returns the appropriate action for the given input event
+func (km Keymap) Handler(ev Event) Action {
+	action, err := km.Keyseq.AcceptKey(eventToKeyseqKey(ev))
 
 	switch err {
 	case nil:
@@ -48,8 +58,8 @@ func (km Keymap) Handler(ev termbox.Event) Action {
 }
 
 func wrapRememberSequence(a Action) Action {
-	return ActionFunc(func(i *Input, ev termbox.Event) {
-		s, err := keyseq.EventToString(ev)
+	return ActionFunc(func(i *Input, ev Event) {
+		s, err := eventToString(ev)
 		if err == nil {
 			i.currentKeySeq = append(i.currentKeySeq, s)
 			i.SendStatusMsg(strings.Join(i.currentKeySeq, " "))
@@ -59,8 +69,8 @@ func wrapRememberSequence(a Action) Action {
 }
 
 func wrapClearSequence(a Action) Action {
-	return ActionFunc(func(i *Input, ev termbox.Event) {
-		s, err := keyseq.EventToString(ev)
+	return ActionFunc(func(i *Input, ev Event) {
+		s, err := eventToString(ev)
 		if err == nil {
 			i.currentKeySeq = append(i.currentKeySeq, s)
 		}
@@ -112,16 +122,27 @@ func (km Keymap) ApplyKeybinding() {
 	k := km.Keyseq
 	k.Clear()
 
+	for s := range km.bindings {
+		delete(km.bindings, s)
+	}
+
 	// Copy the map
 	kb := map[string]Action{}
 	for s, a := range defaultKeyBinding {
 		kb[s] = a
+
+		name, ok := defaultKeyBindingNames[s]
+		if !ok {
+			name = "(unnamed)"
+		}
+		km.bindings[s] = KeyBinding{s, name, KeyBindingOriginDefault}
 	}
 
 	// munge the map using config
 	for s, as := range km.Config {
 		if as == "-" {
 			delete(kb, s)
+			delete(km.bindings, s)
 			continue
 		}
 
@@ -131,6 +152,7 @@ func (km Keymap) ApplyKeybinding() {
 			continue
 		}
 		kb[s] = v
+		km.bindings[s] = KeyBinding{s, as, KeyBindingOriginConfig}
 	}
 
 	// now compile using kb
@@ -138,6 +160,7 @@ func (km Keymap) ApplyKeybinding() {
 		list, err := keyseq.ToKeyList(s)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Unknown key %s: %s", s, err)
+			delete(km.bindings, s)
 			continue
 		}
 
@@ -147,6 +170,29 @@ func (km Keymap) ApplyKeybinding() {
 	k.Compile()
 }
 
+// Bindings returns the list of effective key bindings, sorted by
+// their key sequence. ApplyKeybinding must be called beforehand
+func (km Keymap) Bindings() []KeyBinding {
+	keys := make([]string, 0, len(km.bindings))
+	for s := range km.bindings {
+		keys = append(keys, s)
+	}
+	sort.Strings(keys)
+
+	list := make([]KeyBinding, len(keys))
+	for i, s := range keys {
+		list[i] = km.bindings[s]
+	}
+	return list
+}
+
+// WriteBindings writes a table of the effective key bindings to `w`
+func (km Keymap) WriteBindings(w io.Writer) {
+	for _, b := range km.Bindings() {
+		fmt.Fprintf(w, "%-20s %-40s %s\n", b.Keys, b.Action, b.Origin)
+	}
+}
+
 // TODO: this needs to be fixed.
 func (km Keymap) hasModifierMaps() bool {
 	return false
@@ -0,0 +1,71 @@
+package peco
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestKeymapBindings(t *testing.T) {
+	km := NewKeymap(
+		map[string]string{
+			"C-j":     "peco.Finish",
+			"C-x,C-c": "custom.Finish",
+			"C-n":     "-",
+			"C-q":     "peco.NoSuchAction",
+			"C-t":     "peco.Nop",
+		},
+		map[string][]string{
+			"custom.Finish": []string{"peco.SelectAll", "peco.Finish"},
+		},
+	)
+	km.ApplyKeybinding()
+
+	bindings := map[string]KeyBinding{}
+	for _, b := range km.Bindings() {
+		bindings[b.Keys] = b
+	}
+
+	expected := []KeyBinding{
+		{"C-a", "peco.BeginningOfLine", KeyBindingOriginDefault},
+		{"C-s", "peco.ForceExecQuery", KeyBindingOriginDefault},
+		{"C-j", "peco.Finish", KeyBindingOriginConfig},
+		{"C-x,C-c", "custom.Finish", KeyBindingOriginConfig},
+		{"C-t", "peco.Nop", KeyBindingOriginConfig},
+	}
+	for _, e := range expected {
+		b, ok := bindings[e.Keys]
+		if !ok {
+			t.Errorf("Expected binding for %s to exist", e.Keys)
+			continue
+		}
+		if b != e {
+			t.Errorf("Expected binding %#v, got %#v", e, b)
+		}
+	}
+
+	for _, k := range []string{"C-n", "C-q"} {
+		if _, ok := bindings[k]; ok {
+			t.Errorf("Expected binding for %s to not exist", k)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	km.WriteBindings(buf)
+	if !strings.Contains(buf.String(), "custom.Finish") {
+		t.Errorf("Expected output to contain custom.Finish, got '%s'", buf.String())
+	}
+}
+
+func TestNopBinding(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	ctx.config.Keymap["C-t"] = "peco.Nop"
+	ctx.SetQuery([]rune("foo"))
+	input := ctx.NewInput()
+
+	// Without the Nop binding, C-t would toggle the query
+	input.handleKeyEvent(Event{Key: KeyCtrlT})
+	if q := ctx.QueryString(); q != "foo" {
+		t.Errorf("Expected query to be 'foo', got '%s'", q)
+	}
+}
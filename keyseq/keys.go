@@ -105,11 +105,45 @@ func init() {
 	//	panic(fmt.Sprintf("%#q", stringToKey))
 }
 
+// termbox does not know about these keys, but terminals send them as
+// escape sequences, which termbox reports as Esc (which peco turns
+// into the Alt modifier) followed by the rest of the sequence. So we
+// can bind them as if they were key sequences. These are the sequences
+// sent by xterm and most of its descendants
+var keySequenceAliases = map[string]string{
+	"BackTab": "M-[,Z",
+	"S-Tab":   "M-[,Z",
+	"F13":     "M-[,1,;,2,P",
+	"F14":     "M-[,1,;,2,Q",
+	"F15":     "M-[,1,;,2,R",
+	"F16":     "M-[,1,;,2,S",
+	"F17":     "M-[,1,5,;,2,~",
+	"F18":     "M-[,1,7,;,2,~",
+	"F19":     "M-[,1,8,;,2,~",
+	"F20":     "M-[,1,9,;,2,~",
+	"F21":     "M-[,2,0,;,2,~",
+	"F22":     "M-[,2,1,;,2,~",
+	"F23":     "M-[,2,3,;,2,~",
+	"F24":     "M-[,2,4,;,2,~",
+	"KPEnter": "M-O,M",
+	"KPPlus":  "M-O,k",
+	"KPMinus": "M-O,m",
+}
+
 func ToKeyList(ksk string) (KeyList, error) {
 	list := KeyList{}
 	for _, term := range strings.Split(ksk, ",") {
 		term = strings.TrimSpace(term)
 
+		if alias, ok := keySequenceAliases[term]; ok {
+			seq, err := ToKeyList(alias)
+			if err != nil {
+				return list, fmt.Errorf("Failed to convert '%s': %s", term, err)
+			}
+			list = append(list, seq...)
+			continue
+		}
+
 		k, m, ch, err := ToKey(term)
 		if err != nil {
 			return list, fmt.Errorf("Failed to convert '%s': %s", term, err)
@@ -165,10 +199,13 @@ func ToKey(key string) (k termbox.Key, modifier ModifierKey, ch rune, err error)
 	var ok bool
 	k, ok = stringToKey[key]
 	if !ok {
-		// If this is a single rune, just allow it
-		ch, _ = utf8.DecodeRuneInString(key)
-		if ch != utf8.RuneError {
-			return
+		// If this is a single rune, just allow it. Anything longer
+		// is a key name that we don't know about
+		if utf8.RuneCountInString(key) == 1 {
+			ch, _ = utf8.DecodeRuneInString(key)
+			if ch != utf8.RuneError {
+				return
+			}
 		}
 
 		err = fmt.Errorf("No such key %s", key)
@@ -154,3 +154,62 @@ func TestKeymapStrToKeyValueCh(t *testing.T) {
 	}
 
 }
+
+func TestKeySequenceAliases(t *testing.T) {
+	alt := func(ch rune) Key { return Key{ModAlt, 0, ch} }
+	ch := func(ch rune) Key { return Key{ModNone, 0, ch} }
+
+	expected := map[string]KeyList{
+		"BackTab": {alt('['), ch('Z')},
+		"S-Tab":   {alt('['), ch('Z')},
+		"F13":     {alt('['), ch('1'), ch(';'), ch('2'), ch('P')},
+		"F14":     {alt('['), ch('1'), ch(';'), ch('2'), ch('Q')},
+		"F15":     {alt('['), ch('1'), ch(';'), ch('2'), ch('R')},
+		"F16":     {alt('['), ch('1'), ch(';'), ch('2'), ch('S')},
+		"F17":     {alt('['), ch('1'), ch('5'), ch(';'), ch('2'), ch('~')},
+		"F18":     {alt('['), ch('1'), ch('7'), ch(';'), ch('2'), ch('~')},
+		"F19":     {alt('['), ch('1'), ch('8'), ch(';'), ch('2'), ch('~')},
+		"F20":     {alt('['), ch('1'), ch('9'), ch(';'), ch('2'), ch('~')},
+		"F21":     {alt('['), ch('2'), ch('0'), ch(';'), ch('2'), ch('~')},
+		"F22":     {alt('['), ch('2'), ch('1'), ch(';'), ch('2'), ch('~')},
+		"F23":     {alt('['), ch('2'), ch('3'), ch(';'), ch('2'), ch('~')},
+		"F24":     {alt('['), ch('2'), ch('4'), ch(';'), ch('2'), ch('~')},
+		"KPEnter": {alt('O'), ch('M')},
+		"KPPlus":  {alt('O'), ch('k')},
+		"KPMinus": {alt('O'), ch('m')},
+		// Aliases can be part of a longer sequence
+		"C-x,BackTab": {Key{ModNone, termbox.KeyCtrlX, 0}, alt('['), ch('Z')},
+	}
+
+	for n, v := range expected {
+		list, err := ToKeyList(n)
+		if err != nil {
+			t.Errorf("Failed ToKeyList: Key name %s: %s", n, err)
+			continue
+		}
+		if !list.Equals(v) {
+			t.Errorf("Expected '%s' to be '%s', but got '%s'", n, v, list)
+		}
+	}
+}
+
+func TestUnknownKeyNames(t *testing.T) {
+	for _, n := range []string{"F25", "Foo", "C-Foo", "M-Bar", "C-x,Baz"} {
+		if list, err := ToKeyList(n); err == nil {
+			t.Errorf("Expected '%s' to be an unknown key, but got '%s'", n, list)
+		}
+	}
+}
+
+func TestKeyString(t *testing.T) {
+	for _, n := range []string{"C-Space", "a", "M-x", "C-x,C-c", "Enter"} {
+		list, err := ToKeyList(n)
+		if err != nil {
+			t.Errorf("Failed to parse '%s': %s", n, err)
+			continue
+		}
+		if s := list.String(); s != n {
+			t.Errorf("Expected '%s' to be printed as '%s', got %q", n, n, s)
+		}
+	}
+}
@@ -50,7 +50,8 @@ func (k Key) String() string {
 		s += m + "-"
 	}
 
-	if k.Key == 0 {
+	// C-Space is key 0 too, without a character
+	if k.Key == 0 && k.Ch != 0 {
 		s += string([]rune{k.Ch})
 	} else {
 		s += keyToString[k.Key]
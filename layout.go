@@ -2,12 +2,13 @@ package peco
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"unicode/utf8"
 
 	"github.com/mattn/go-runewidth"
-	"github.com/nsf/termbox-go"
 )
 
 // PageCrop filters out a new LineBuffer based on entries
@@ -48,11 +49,21 @@ const (
 	LayoutTypeTopDown = "top-down"
 	// LayoutTypeBottomUp changes the layout to read from bottom to up
 	LayoutTypeBottomUp = "bottom-up"
+	// LayoutTypeCentered is like top-down, but everything is placed
+	// in a box that is vertically centered on the screen
+	LayoutTypeCentered = "centered"
+	// LayoutTypeTopDownPromptBottom is like top-down, but the query
+	// prompt is at the bottom, above the status message line
+	LayoutTypeTopDownPromptBottom = "top-down-prompt-bottom"
 )
 
 // IsValidLayoutType checks if a string is a supported layout type
 func IsValidLayoutType(v LayoutType) bool {
-	return v == LayoutTypeTopDown || v == LayoutTypeBottomUp
+	switch v {
+	case LayoutTypeTopDown, LayoutTypeBottomUp, LayoutTypeCentered, LayoutTypeTopDownPromptBottom:
+		return true
+	}
+	return false
 }
 
 // VerticalAnchor describes the direction to which elements in the
@@ -74,25 +85,53 @@ func IsValidVerticalAnchor(anchor VerticalAnchor) bool {
 // Layout represents the component that controls where elements are placed on screen
 type Layout interface {
 	PrintStatus(string, time.Duration)
+	// ClearStatus clears the status message if it is the given one
+	ClearStatus(string)
 	DrawPrompt()
 	DrawScreen()
 	MovePage(PagingRequest) (moved bool)
+	// DrawIdleMessage redraws the status bar if no status
+	// message is being shown
+	DrawIdleMessage()
+	// StopClearTimer keeps the status message from being cleared
+	// later on, e.g. once the screen is no longer drawn
+	StopClearTimer()
 }
 
 // Utility function
-func mergeAttribute(a, b termbox.Attribute) termbox.Attribute {
+func mergeAttribute(a, b Attribute) Attribute {
 	if a&0x0F == 0 || b&0x0F == 0 {
 		return a | b
 	}
 	return ((a - 1) | (b - 1)) + 1
 }
 
+// overlayAttribute returns the foreground of text that has the style
+// `top`, drawn within text that has the foreground `base`. The color
+// of `top` is used unless it is the default color, and the text
+// attributes of both are combined. This allows styles such as Matched
+// to only make the text bold, for example
+func overlayAttribute(base, top Attribute) Attribute {
+	if top&colorMask == ColorDefault {
+		return base | top
+	}
+	return base&^colorMask | top
+}
+
 // Utility function
-func printScreen(x, y int, fg, bg termbox.Attribute, msg string, fill bool) int {
+func printScreen(x, y int, fg, bg Attribute, msg string, fill bool) int {
 	return printScreenWithOffset(x, y, 0, fg, bg, msg, fill)
 }
 
-func printScreenWithOffset(x, y, xOffset int, fg, bg termbox.Attribute, msg string, fill bool) int {
+func printScreenWithOffset(x, y, xOffset int, fg, bg Attribute, msg string, fill bool) int {
+	width, _ := screen.Size()
+	return printScreenClipped(x, y, xOffset, width, fg, bg, msg, fill)
+}
+
+// printScreenClipped works like printScreenWithOffset, but draws
+// nothing from column `limit` onwards. A wide character that doesn't
+// fit before `limit` is replaced by spaces, rather than cut in half
+func printScreenClipped(x, y, xOffset, limit int, fg, bg Attribute, msg string, fill bool) int {
 	var written int
 
 	for len(msg) > 0 {
@@ -105,14 +144,20 @@ func printScreenWithOffset(x, y, xOffset int, fg, bg termbox.Attribute, msg stri
 		if c == '\t' {
 			// In case we found a tab, we draw it as 4 spaces
 			n := 4 - (x+xOffset)%4
-			for i := 0; i <= n; i++ {
+			for i := 0; i <= n && x+i < limit; i++ {
 				screen.SetCell(x+i, y, ' ', fg, bg)
 			}
 			written += n
 			x += n
 		} else {
-			screen.SetCell(x, y, c, fg, bg)
 			n := runewidth.RuneWidth(c)
+			if x+n > limit {
+				for i := x; i < limit; i++ {
+					screen.SetCell(i, y, ' ', fg, bg)
+				}
+			} else {
+				screen.SetCell(x, y, c, fg, bg)
+			}
 			x += n
 			written += n
 		}
@@ -122,11 +167,10 @@ func printScreenWithOffset(x, y, xOffset int, fg, bg termbox.Attribute, msg stri
 		return written
 	}
 
-	width, _ := screen.Size()
-	for ; x < width; x++ {
+	for ; x < limit; x++ {
 		screen.SetCell(x, y, ' ', fg, bg)
 	}
-	written += width - x
+	written += limit - x
 	return written
 }
 
@@ -218,12 +262,12 @@ func (u UserPrompt) Draw() {
 	switch ql {
 	case 0:
 		printScreen(u.prefixLen, location, fg, bg, "", true)
-		printScreen(u.prefixLen+1, location, fg|termbox.AttrReverse, bg|termbox.AttrReverse, " ", false)
+		printScreen(u.prefixLen+1, location, fg|AttrReverse, bg|AttrReverse, " ", false)
 	case u.CaretPos():
 		// the entire string + the caret after the string
 		printScreen(u.prefixLen, location, fg, bg, "", true)
 		printScreen(u.prefixLen+1, location, fg, bg, qs, false)
-		printScreen(u.prefixLen+runewidth.StringWidth(qs)+1, location, fg|termbox.AttrReverse, bg|termbox.AttrReverse, " ", false)
+		printScreen(u.prefixLen+runewidth.StringWidth(qs)+1, location, fg|AttrReverse, bg|AttrReverse, " ", false)
 	default:
 		// the caret is in the middle of the string
 		prev := 0
@@ -231,8 +275,8 @@ func (u UserPrompt) Draw() {
 			fg := u.queryStyle.fg
 			bg := u.queryStyle.bg
 			if i == u.CaretPos() {
-				fg |= termbox.AttrReverse
-				bg |= termbox.AttrReverse
+				fg |= AttrReverse
+				bg |= AttrReverse
 			}
 			screen.SetCell(u.prefixLen+1+prev, location, r, fg, bg)
 			prev += runewidth.RuneWidth(r)
@@ -244,18 +288,68 @@ func (u UserPrompt) Draw() {
 
 	width, _ := screen.Size()
 
-	pmsg := fmt.Sprintf("%s [%d (%d/%d)]", u.Filter().String(), u.currentPage.total, u.currentPage.page, u.currentPage.maxPage)
+	pmsg := u.resultCount()
 	printScreen(width-runewidth.StringWidth(pmsg), location, u.basicStyle.fg, u.basicStyle.bg, pmsg, false)
 
 	screen.Flush()
 }
 
+// resultCount formats the number of results according to the
+// ResultCountFormat configuration
+func (u UserPrompt) resultCount() string {
+	format := u.config.ResultCountFormat
+	if format == "" {
+		format = DefaultResultCountFormat
+	}
+
+	// With --max-select, how close the selection is to the limit
+	// is always shown
+	var selected string
+	if max := u.SelectionMax(); max > 0 {
+		selected = fmt.Sprintf(" %d/%d selected", u.SelectionLen(), max)
+	}
+
+	// There is a query to go back to (see peco.RestoreQuery)
+	var saved string
+	if len(u.SavedQuery()) > 0 {
+		saved = "[saved] "
+	}
+
+	// Whole lines are matched (see peco.ToggleAnchored)
+	var anchored string
+	if u.IsAnchored() {
+		anchored = "[anchored] "
+	}
+
+	// The selected lines won't be accepted (see AcceptCursorOnly)
+	var cursorOnly string
+	if u.config.AcceptCursorOnly && u.SelectionLen() > 0 {
+		cursorOnly = "[cursor only] "
+	}
+
+	// Queries are matched within a scope (see peco.SetScopeQuery)
+	var scope string
+	if q := u.ScopeQuery(); q != "" {
+		scope = "[scope: " + q + "] "
+	}
+
+	return saved + anchored + cursorOnly + scope + strings.NewReplacer(
+		"$FILTER", u.Filter().String(),
+		"$MATCHED", strconv.Itoa(u.currentPage.total),
+		"$TOTAL", strconv.Itoa(u.GetRawLineBufferSize()),
+		"$PAGE", strconv.Itoa(u.currentPage.page),
+		"$MAX_PAGE", strconv.Itoa(u.currentPage.maxPage),
+		"$LATENCY", strconv.FormatInt(int64(u.progress.Latency()/time.Millisecond), 10)+"ms",
+	).Replace(format) + selected
+}
+
 // StatusBar draws the status message bar
 type StatusBar struct {
 	*Ctx
 	*AnchorSettings
 	clearTimer *time.Timer
-	timerMutex sync.Locker
+	timerMutex sync.Locker // protects clearTimer and message
+	message    string      // the status message currently shown, if any
 	basicStyle Style
 }
 
@@ -270,7 +364,7 @@ func NewStatusBar(ctx *Ctx, anchor VerticalAnchor, anchorOffset int) *StatusBar
 	}
 }
 
-func (s *StatusBar) stopTimer() {
+func (s *StatusBar) StopClearTimer() {
 	s.timerMutex.Lock()
 	defer s.timerMutex.Unlock()
 	if t := s.clearTimer; t != nil {
@@ -288,10 +382,99 @@ func (s *StatusBar) setClearTimer(t *time.Timer) {
 // PrintStatus prints a new status message. This also resets the
 // timer created by ClearStatus()
 func (s *StatusBar) PrintStatus(msg string, clearDelay time.Duration) {
-	s.stopTimer()
+	s.StopClearTimer()
 
 	s.timerMutex.Lock()
 
+	s.message = msg
+	if msg == "" {
+		msg = s.idleMessage()
+	}
+	s.draw(msg)
+
+	s.timerMutex.Unlock()
+
+	// if everything is successful AND the clearDelay timer is specified,
+	// then set a timer to clear the status
+	if clearDelay != 0 {
+		s.setClearTimer(time.AfterFunc(clearDelay, func() {
+			s.PrintStatus("", 0)
+		}))
+	}
+}
+
+// ClearStatus clears the status message if it is still `msg`, so
+// that the messages printed since are not lost
+func (s *StatusBar) ClearStatus(msg string) {
+	s.timerMutex.Lock()
+	shown := s.message == msg
+	s.timerMutex.Unlock()
+
+	if shown {
+		s.PrintStatus("", 0)
+	}
+}
+
+// DrawIdleMessage refreshes the message that is shown while there
+// are no status messages, such as the truncation indicator
+func (s *StatusBar) DrawIdleMessage() {
+	s.timerMutex.Lock()
+	defer s.timerMutex.Unlock()
+
+	if s.message != "" {
+		return
+	}
+
+	s.draw(s.idleMessage())
+}
+
+// spinnerFrames are the frames of the animation shown while the
+// input is being read (see ShowLoadingIndicator)
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+// idleMessage returns the message to be shown in place of an empty
+// status message. This tells the user that a query is taking a while,
+// that the input is still being read, or that some lines were
+// discarded because the buffer size was exceeded
+func (s *StatusBar) idleMessage() string {
+	if s.progress.IsFiltering() {
+		return "filtering…"
+	}
+
+	rlb := s.rawLineBuffer
+	if s.config.ShowLoadingIndicator && s.IsLoading() {
+		frame := spinnerFrames[int(time.Now().UnixNano()/int64(loadingIndicatorInterval))%len(spinnerFrames)]
+		return fmt.Sprintf("%s loading… %d lines", frame, rlb.Size())
+	}
+
+	if !rlb.IsTruncated() {
+		return ""
+	}
+	return fmt.Sprintf("truncated: showing %d of %s", rlb.Size(), approximateCount(rlb.Total()))
+}
+
+// approximateCount formats large numbers in a compact form such as
+// "130k+". The "+" denotes that the actual number was rounded down
+func approximateCount(n int) string {
+	var unit string
+	var div int
+	switch {
+	case n >= 1000000:
+		unit, div = "M", 1000000
+	case n >= 1000:
+		unit, div = "k", 1000
+	default:
+		return strconv.Itoa(n)
+	}
+
+	s := strconv.Itoa(n/div) + unit
+	if n%div != 0 {
+		s += "+"
+	}
+	return s
+}
+
+func (s *StatusBar) draw(msg string) {
 	location := s.AnchorPosition()
 
 	w, _ := screen.Size()
@@ -318,19 +501,9 @@ func (s *StatusBar) PrintStatus(msg string, clearDelay time.Duration) {
 	}
 
 	if width > 0 {
-		printScreen(w-width, location, fgAttr|termbox.AttrReverse|termbox.AttrBold, bgAttr|termbox.AttrReverse, msg, false)
+		printScreen(w-width, location, fgAttr|AttrReverse|AttrBold, bgAttr|AttrReverse, msg, false)
 	}
 	screen.Flush()
-
-	s.timerMutex.Unlock()
-
-	// if everything is successful AND the clearDelay timer is specified,
-	// then set a timer to clear the status
-	if clearDelay != 0 {
-		s.setClearTimer(time.AfterFunc(clearDelay, func() {
-			s.PrintStatus("", 0)
-		}))
-	}
 }
 
 // ListArea represents the area where the actual line buffer is
@@ -346,8 +519,38 @@ type ListArea struct {
 	matchedStyle        Style
 	selectedStyle       Style
 	savedSelectionStyle Style
+	groupStyles         []Style
+	scrollbarStyle      Style
+	scrollbarShown      bool
+	gutterWidth         int
+	alignGeneration     int       // ColumnAligner.Generation() when the lines were last drawn
+	wrapRows            int       // extra rows used by the current line when it is wrapped, set by the layout
+	wrapShown           wrapState // where the current line was wrapped when the lines were last drawn
+}
+
+// wrapState is where the current line is wrapped in the page (see
+// peco.ToggleWrap). The zero value means that no line is wrapped
+type wrapState struct {
+	cursor int // the index of the wrapped line in the page
+	rows   int // the number of extra rows it takes
+	shift  int // the number of lines before it that are not displayed to make room
+}
+
+// row returns the row, counted from the anchor, where the n-th line
+// of the page is drawn. Rows outside of the page are not displayed.
+// In bottom-up layouts the first row of the wrapped line is the one
+// farthest from the anchor
+func (w wrapState) row(n int, topDown bool) int {
+	if n > w.cursor || (n == w.cursor && !topDown) {
+		n += w.rows
+	}
+	return n - w.shift
 }
 
+// hintGutterWidth is the number of columns reserved for the quick
+// select labels (see peco.SelectionHintMode): the label, and a space
+const hintGutterWidth = 2
+
 // NewListArea creates a new ListArea struct
 func NewListArea(ctx *Ctx, anchor VerticalAnchor, anchorOffset int, sortTopDown bool) *ListArea {
 	return &ListArea{
@@ -361,6 +564,8 @@ func NewListArea(ctx *Ctx, anchor VerticalAnchor, anchorOffset int, sortTopDown
 		matchedStyle:        ctx.config.Style.Matched,
 		selectedStyle:       ctx.config.Style.Selected,
 		savedSelectionStyle: ctx.config.Style.SavedSelection,
+		groupStyles:         ctx.config.SelectionGroups,
+		scrollbarStyle:      ctx.config.Style.Scrollbar,
 	}
 }
 
@@ -376,11 +581,58 @@ func (l *ListArea) SetDirty(dirty bool) {
 func (l *ListArea) Draw(perPage int) {
 	trace("ListArea.Draw: START")
 	defer trace("ListArea.Draw: END")
+
+	if l.helpShown() {
+		l.drawHelp(perPage)
+		return
+	}
+
 	currentPage := l.currentPage
 
-	pf := PageCrop{perPage: currentPage.perPage, currentPage: currentPage.page}
-	buf := pf.Crop(l.GetCurrentLineBuffer())
-	bufsiz := buf.Size()
+	// Only the lines on the current page are read. They are read
+	// before anything is drawn, so that they don't change under our
+	// feet while we draw them
+	buf := l.GetCurrentLineBuffer()
+	visible := make([]Line, 0, currentPage.perPage)
+	for n := 0; n < currentPage.perPage; n++ {
+		target, err := buf.LineAt(currentPage.offset + n)
+		if err != nil {
+			break
+		}
+		visible = append(visible, target)
+	}
+	bufsiz := len(visible)
+
+	// If the scrollbar appeared or disappeared, the last column of
+	// every line needs to be redrawn
+	if shown := l.scrollbarVisible(); shown != l.scrollbarShown {
+		l.scrollbarShown = shown
+		l.SetDirty(true)
+	}
+
+	// Likewise, lines are shifted to make room for the quick
+	// select labels and the line numbers when they are displayed
+	gutter := 0
+	if l.hintMode {
+		gutter = hintGutterWidth
+	}
+	numberWidth := 0
+	if l.config.ShowLineNumbers {
+		numberWidth = l.lineNumberWidth()
+	}
+	if gutter+numberWidth != l.gutterWidth {
+		l.gutterWidth = gutter + numberWidth
+		l.SetDirty(true)
+	}
+
+	// Lines that were drawn before a wider cell was read are
+	// padded with the old widths
+	if l.aligner != nil {
+		if g := l.aligner.Generation(); g != l.alignGeneration {
+			l.alignGeneration = g
+			l.SetDirty(true)
+		}
+	}
 
 	// previously drawn lines are cached. first, truncate the cache
 	// to current size of the drawable area
@@ -394,6 +646,22 @@ func (l *ListArea) Draw(perPage int) {
 		}
 	}
 
+	// The current line takes wrapRows more rows when it is wrapped
+	// (see peco.ToggleWrap). They are taken from the page, so the
+	// lines that follow it are pushed out of the page, or those that
+	// precede it when it is too close to the end of the page
+	var wrap wrapState
+	if cursor := l.currentLine - currentPage.offset; cursor >= 0 && cursor < bufsiz && l.wrapRows > 0 {
+		wrap = wrapState{cursor: cursor, rows: l.wrapRows}
+		if over := cursor + l.wrapRows + 1 - perPage; over > 0 {
+			wrap.shift = over
+		}
+	}
+	if wrap != l.wrapShown {
+		l.wrapShown = wrap
+		l.SetDirty(true)
+	}
+
 	var y int
 	start := l.AnchorPosition()
 
@@ -402,6 +670,8 @@ func (l *ListArea) Draw(perPage int) {
 	trace("ListeArea.Draw: buffer size is %d, our view area is %d\n", bufsiz, perPage)
 	for n := bufsiz; n < perPage; n++ {
 		l.displayCache[n] = nil
+	}
+	for n := bufsiz + wrap.rows - wrap.shift; n < perPage; n++ {
 		if l.sortTopDown {
 			y = n + start
 		} else {
@@ -412,34 +682,47 @@ func (l *ListArea) Draw(perPage int) {
 		printScreen(0, y, l.basicStyle.fg, l.basicStyle.bg, "", true)
 	}
 
+	// The text stops before the scrollbar, so that wide characters
+	// are not cut in half by it
+	limit, _ := screen.Size()
+	if l.scrollbarShown {
+		limit--
+	}
+
 	var cached, written int
-	var fgAttr, bgAttr termbox.Attribute
+	var fgAttr, bgAttr Attribute
+	var numbered []numberedRow
 	for n := 0; n < perPage; n++ {
+		if n >= bufsiz {
+			break
+		}
+		target := visible[n]
+
 		switch {
 		case n+currentPage.offset == l.currentLine:
 			fgAttr = l.selectedStyle.fg
 			bgAttr = l.selectedStyle.bg
-		case l.SelectionContains(n + currentPage.offset):
-			fgAttr = l.savedSelectionStyle.fg
-			bgAttr = l.savedSelectionStyle.bg
+		case l.SelectionHas(target):
+			style := l.savedSelectionStyle
+			if g := l.SelectionGroup(target); g > 0 && g <= len(l.groupStyles) {
+				style = l.groupStyles[g-1]
+			}
+			fgAttr = style.fg
+			bgAttr = style.bg
 		default:
 			fgAttr = l.basicStyle.fg
 			bgAttr = l.basicStyle.bg
 		}
 
-		if n >= bufsiz {
-			break
+		row := wrap.row(n, l.sortTopDown)
+		if row < 0 || row >= perPage {
+			l.displayCache[n] = nil
+			continue
 		}
-
 		if l.sortTopDown {
-			y = n + start
+			y = row + start
 		} else {
-			y = start - n
-		}
-
-		target, err := buf.LineAt(n)
-		if err != nil {
-			break
+			y = start - row
 		}
 
 		if l.IsDirty() || target.IsDirty() {
@@ -451,45 +734,290 @@ func (l *ListArea) Draw(perPage int) {
 
 		written++
 		l.displayCache[n] = target
+		if numberWidth > 0 {
+			numbered = append(numbered, numberedRow{y, l.lineNumber(target), fgAttr, bgAttr})
+		}
 
-		x := -l.currentCol
-		xOffset := l.currentCol
+		x := l.gutterWidth - l.currentCol
+		xOffset := l.currentCol - l.gutterWidth
+
+		// Unless FillBackground is set, the style of the line only
+		// covers its text, and the rest of the row is left to the
+		// terminal's background
+		fill := l.config.FillBackground || (fgAttr == l.basicStyle.fg && bgAttr == l.basicStyle.bg)
+		if !fill {
+			printScreen(0, y, l.basicStyle.fg, l.basicStyle.bg, "", true)
+		}
 
-		line := target.DisplayString()
-		matches := target.Indices()
+		line, matches := l.displayText(target)
+		if n == wrap.cursor && wrap.rows > 0 {
+			l.drawWrapped(y, wrap.rows+1, fgAttr, bgAttr, line, matches, fill)
+			continue
+		}
 		if matches == nil {
-			printScreenWithOffset(x, y, xOffset, fgAttr, bgAttr, line, true)
+			printScreenClipped(x, y, xOffset, limit, fgAttr, bgAttr, line, fill)
 			continue
 		}
 
-		prev := -l.currentCol
+		prev := x
 		index := 0
 
 		for _, m := range matches {
 			if m[0] > index {
 				c := line[index:m[0]]
-				n := printScreenWithOffset(prev, y, xOffset, fgAttr, bgAttr, c, false)
+				n := printScreenClipped(prev, y, xOffset, limit, fgAttr, bgAttr, c, false)
 				prev += n
 				index += len(c)
 			}
 			c := line[m[0]:m[1]]
 
-			n := printScreenWithOffset(prev, y, xOffset, l.matchedStyle.fg, mergeAttribute(bgAttr, l.matchedStyle.bg), c, true)
+			n := printScreenClipped(prev, y, xOffset, limit, overlayAttribute(fgAttr, l.matchedStyle.fg), mergeAttribute(bgAttr, l.matchedStyle.bg), c, fill)
 			prev += n
 			index += len(c)
 		}
 
 		m := matches[len(matches)-1]
 		if m[0] > index {
-			printScreenWithOffset(prev, y, xOffset, l.queryStyle.fg, mergeAttribute(bgAttr, l.queryStyle.bg), line[m[0]:m[1]], true)
+			printScreenClipped(prev, y, xOffset, limit, l.queryStyle.fg, mergeAttribute(bgAttr, l.queryStyle.bg), line[m[0]:m[1]], fill)
 		} else if len(line) > m[1] {
-			printScreenWithOffset(prev, y, xOffset, fgAttr, bgAttr, line[m[1]:len(line)], true)
+			printScreenClipped(prev, y, xOffset, limit, fgAttr, bgAttr, line[m[1]:len(line)], fill)
 		}
 	}
+	l.drawScrollbar(perPage)
+
+	// Line numbers are drawn after the lines, because lines that are
+	// scrolled horizontally start to the left of the gutter
+	for _, r := range numbered {
+		printScreen(gutter, r.y, r.fg, r.bg, fmt.Sprintf("%*d ", numberWidth-1, r.number), false)
+	}
+	if l.hintMode {
+		l.drawHints(bufsiz, perPage, wrap)
+	}
 	l.SetDirty(false)
 	trace("ListArea.Draw: Written total of %d lines (%d cached)\n", written+cached, cached)
 }
 
+// displayText returns the text of `target` as it is displayed, and
+// the position of the matches in that text (nil if they are unknown)
+func (l *ListArea) displayText(target Line) (string, [][]int) {
+	line := target.DisplayString()
+	matches := target.Indices()
+	if l.formatter != nil {
+		// There is no telling where the matches end up
+		line, matches = l.formatter.Format(line), nil
+	}
+	if l.aligner != nil {
+		line, matches = l.aligner.Align(line, matches)
+	}
+	return line, matches
+}
+
+// wrapWidth returns the number of columns available to the text of
+// a wrapped line, between the gutter and the scrollbar
+func (l *ListArea) wrapWidth() int {
+	width, _ := screen.Size()
+	if l.hintMode {
+		width -= hintGutterWidth
+	}
+	if l.config.ShowLineNumbers {
+		width -= l.lineNumberWidth()
+	}
+	if l.scrollbarVisible() {
+		width--
+	}
+	return width
+}
+
+// wrappedRows returns the number of extra rows needed to display
+// all of `target` when it is wrapped, at most `limit`
+func (l *ListArea) wrappedRows(target Line, limit int) int {
+	line, _ := l.displayText(target)
+	rows := wrapLine(line, l.wrapWidth(), func(int, int, int, rune) {}) - 1
+	if rows > limit {
+		rows = limit
+	}
+	return rows
+}
+
+// drawWrapped draws `line` over `rows` rows starting at row `y`,
+// and going down the screen whatever the layout. The text starts
+// after the gutter, and isn't scrolled horizontally
+func (l *ListArea) drawWrapped(y, rows int, fg, bg Attribute, line string, matches [][]int, fill bool) {
+	for k := 0; k < rows; k++ {
+		if fill {
+			printScreen(0, y+k, fg, bg, "", true)
+		} else {
+			printScreen(0, y+k, l.basicStyle.fg, l.basicStyle.bg, "", true)
+		}
+	}
+
+	wrapLine(line, l.wrapWidth(), func(i, col, row int, c rune) {
+		if row >= rows {
+			return
+		}
+
+		cfg, cbg := fg, bg
+		for _, m := range matches {
+			if i >= m[0] && i < m[1] {
+				cfg, cbg = overlayAttribute(fg, l.matchedStyle.fg), mergeAttribute(bg, l.matchedStyle.bg)
+				break
+			}
+		}
+		screen.SetCell(l.gutterWidth+col, y+row, c, cfg, cbg)
+	})
+}
+
+// wrapLine splits `line` into rows of `width` columns, and calls fn
+// with the byte index, column and row of each character. Tabs are
+// expanded to spaces. It returns the number of rows
+func wrapLine(line string, width int, fn func(i, col, row int, c rune)) int {
+	if width < 1 {
+		width = 1
+	}
+
+	var col, row int
+	for i, c := range line {
+		n := runewidth.RuneWidth(c)
+		if c == '\t' {
+			n = 4 - col%4
+		}
+		if col > 0 && col+n > width {
+			col = 0
+			row++
+		}
+
+		if c == '\t' {
+			for k := 0; k < n; k++ {
+				fn(i, col+k, row, ' ')
+			}
+		} else {
+			fn(i, col, row, c)
+		}
+		col += n
+	}
+	return row + 1
+}
+
+// drawHelp displays the key bindings listed by peco.ShowHelp in place
+// of the lines, from top to bottom whatever the layout
+func (l *ListArea) drawHelp(perPage int) {
+	top := l.AnchorPosition()
+	if !l.sortTopDown {
+		top -= perPage - 1
+	}
+
+	lines, offset := l.help()
+	for n := 0; n < perPage; n++ {
+		text := ""
+		if x := offset + n; x < len(lines) {
+			text = lines[x]
+		}
+		printScreen(0, top+n, l.basicStyle.fg, l.basicStyle.bg, text, true)
+	}
+
+	// The lines need to be drawn again once the help is hidden
+	l.SetDirty(true)
+}
+
+// scrollbarVisible returns true if the scrollbar should be drawn
+func (l *ListArea) scrollbarVisible() bool {
+	switch l.config.ShowScrollbar {
+	case ScrollbarAlways:
+		return true
+	case ScrollbarAuto:
+		return l.currentPage.maxPage > 1
+	}
+	return false
+}
+
+// scrollbarThumb returns the first row and the number of rows
+// of the scrollbar thumb, which represents the lines currently
+// displayed relative to all of the lines
+func scrollbarThumb(offset, perPage, total int) (int, int) {
+	if total <= perPage || perPage <= 0 {
+		return 0, perPage
+	}
+
+	size := perPage * perPage / total
+	if size < 1 {
+		size = 1
+	}
+	// The last page (offset >= total-perPage) puts the thumb at the end
+	start := offset * (perPage - size) / (total - perPage)
+	if start+size > perPage {
+		start = perPage - size
+	}
+	return start, size
+}
+
+// drawScrollbar draws the scrollbar on the rightmost column of the
+// list area, where the lines stop while it is visible. Rows are
+// counted from the anchor, so in bottom-up layouts the thumb moves
+// upwards as you scroll
+func (l *ListArea) drawScrollbar(perPage int) {
+	if !l.scrollbarVisible() {
+		return
+	}
+
+	width, _ := screen.Size()
+	x := width - 1
+	start := l.AnchorPosition()
+	thumbStart, thumbSize := scrollbarThumb(l.currentPage.offset, perPage, l.currentPage.total)
+	for n := 0; n < perPage; n++ {
+		y := n + start
+		if !l.sortTopDown {
+			y = start - n
+		}
+
+		if n >= thumbStart && n < thumbStart+thumbSize {
+			screen.SetCell(x, y, ' ', l.scrollbarStyle.fg, l.scrollbarStyle.bg)
+		} else {
+			screen.SetCell(x, y, ' ', l.basicStyle.fg, l.basicStyle.bg)
+		}
+	}
+}
+
+// numberedRow is a row that needs a line number in its gutter
+type numberedRow struct {
+	y      int
+	number int
+	fg, bg Attribute
+}
+
+// lineNumberWidth returns the number of columns needed to display
+// the line numbers, which is enough to fit the number of the last
+// line read so far, plus a space
+func (l *ListArea) lineNumberWidth() int {
+	n := l.rawLineBuffer.Size()
+	if m := l.sourceLineBuffer().Size(); m > n {
+		n = m
+	}
+	return len(strconv.Itoa(n)) + 1
+}
+
+// drawHints draws the quick select labels over the gutter of the
+// first `n` lines of the page. Lines beyond the length of the
+// alphabet, or that are not displayed, are not labeled
+func (l *ListArea) drawHints(n, perPage int, wrap wrapState) {
+	start := l.AnchorPosition()
+	for i, r := range []rune(l.config.HintAlphabet) {
+		if i >= n {
+			break
+		}
+
+		row := wrap.row(i, l.sortTopDown)
+		if row < 0 || row >= perPage {
+			continue
+		}
+		y := row + start
+		if !l.sortTopDown {
+			y = start - row
+		}
+		screen.SetCell(0, y, r, l.matchedStyle.fg|AttrBold, l.basicStyle.bg)
+		screen.SetCell(1, y, ' ', l.basicStyle.fg, l.basicStyle.bg)
+	}
+}
+
 // BasicLayout is... the basic layout :) At this point this is the
 // only struct for layouts, which means that while the position
 // of components may be configurable, the actual types of components
@@ -497,8 +1025,9 @@ func (l *ListArea) Draw(perPage int) {
 type BasicLayout struct {
 	*Ctx
 	*StatusBar
-	prompt *UserPrompt
-	list   *ListArea
+	prompt  *UserPrompt
+	list    *ListArea
+	padding int // number of unused lines above and below the layout
 }
 
 // NewDefaultLayout creates a new Layout in the default format (top-down)
@@ -535,12 +1064,88 @@ func NewBottomUpLayout(ctx *Ctx) *BasicLayout {
 	}
 }
 
-// CalculatePage calculates which page we're displaying
+// NewTopDownPromptBottomLayout creates a new Layout in top-down format,
+// with the prompt at the bottom
+func NewTopDownPromptBottomLayout(ctx *Ctx) *BasicLayout {
+	extraOffset := 0
+	if isWindows {
+		extraOffset = 1
+	}
+	return &BasicLayout{
+		Ctx:       ctx,
+		StatusBar: NewStatusBar(ctx, AnchorBottom, 0+extraOffset),
+		// The prompt is at the bottom, above the status bar
+		prompt: NewUserPrompt(ctx, AnchorBottom, 1+extraOffset),
+		// The list area is at the top, and takes up the rest of the
+		// screen. It's displayed in top-to-bottom order
+		list: NewListArea(ctx, AnchorTop, 0, true),
+	}
+}
+
+// CenteredLayout is a top-down layout that is placed in a box
+// vertically centered on the screen, leaving a quarter of the screen
+// unused above and below it
+type CenteredLayout struct {
+	*BasicLayout
+}
+
+// NewCenteredLayout creates a new Layout in centered format
+func NewCenteredLayout(ctx *Ctx) *CenteredLayout {
+	return &CenteredLayout{NewDefaultLayout(ctx)}
+}
+
+// DrawScreen draws the entire screen
+func (l *CenteredLayout) DrawScreen() {
+	l.adjustPadding()
+	l.BasicLayout.DrawScreen()
+}
+
+// MovePage scrolls the screen
+func (l *CenteredLayout) MovePage(p PagingRequest) bool {
+	l.adjustPadding()
+	return l.BasicLayout.MovePage(p)
+}
+
+// adjustPadding moves the components of the layout according to the
+// current height of the screen. If they moved, the entire screen is
+// cleared so that nothing is left behind
+func (l *CenteredLayout) adjustPadding() {
+	_, height := screen.Size()
+
+	padding := height / 4
+	if height-2*padding < 3 {
+		// Not enough room. Use the entire screen
+		padding = 0
+	}
+	if padding == l.padding {
+		return
+	}
+
+	trace("CenteredLayout.adjustPadding: %d -> %d", l.padding, padding)
+	l.padding = padding
+	l.prompt.anchorOffset = padding
+	l.list.anchorOffset = padding + 1
+	l.StatusBar.anchorOffset = padding
+	if isWindows {
+		l.StatusBar.anchorOffset++
+	}
+
+	for y := 0; y < height; y++ {
+		printScreen(0, y, l.list.basicStyle.fg, l.list.basicStyle.bg, "", true)
+	}
+	l.list.SetDirty(true)
+}
+
+// CalculatePage calculates which page we're displaying: the one that
+// contains the current line. If the current line is past the end of
+// the buffer, the cursor is moved to the last line. While the input is
+// being read and no query is run, it is left where it is (e.g.
+// --initial-index points to a line that was not read yet), and the
+// last page is displayed in the meantime
 func (l *BasicLayout) CalculatePage(perPage int) error {
 	buf := l.GetCurrentLineBuffer()
 	currentPage := l.currentPage
-	currentPage.page = (l.currentLine / perPage) + 1
-	currentPage.offset = (currentPage.page - 1) * perPage
+	prevOffset := currentPage.offset
 	currentPage.perPage = perPage
 	currentPage.total = buf.Size()
 
@@ -551,17 +1156,54 @@ func (l *BasicLayout) CalculatePage(perPage int) error {
 		currentPage.maxPage = ((currentPage.total + perPage - 1) / perPage)
 	}
 
-	if currentPage.maxPage < currentPage.page {
-		if buf.Size() == 0 {
-			// wait for targets
-			return fmt.Errorf("no targets or query. nothing to do")
+	line := l.currentLine
+	if line >= currentPage.total {
+		line = currentPage.total - 1
+		if line < 0 {
+			line = 0
+		}
+		// Lines that no longer match are gone for good, even if
+		// more input comes in. The line under the cursor changed,
+		// and has to be highlighted
+		if (!l.IsLoading() || l.activeBuffer() != nil) && l.currentLine != line {
+			l.currentLine = line
+			l.list.SetDirty(true)
 		}
-		l.currentLine = currentPage.offset
+	}
+
+	currentPage.page = (line / perPage) + 1
+	currentPage.offset = (currentPage.page - 1) * perPage
+	if l.config.ScrollOff > 0 {
+		currentPage.offset = scrollOffset(prevOffset, line, perPage, currentPage.total, l.config.ScrollOff)
 	}
 
 	return nil
 }
 
+// scrollOffset returns the index of the first line to display, so
+// that `margin` lines stay visible above and below `line`. The list
+// is scrolled from `offset` only as far as needed to do so
+func scrollOffset(offset, line, perPage, total, margin int) int {
+	// The cursor can't have a full margin on both sides otherwise
+	if max := (perPage - 1) / 2; margin > max {
+		margin = max
+	}
+
+	if line-margin < offset {
+		offset = line - margin
+	}
+	if line+margin > offset+perPage-1 {
+		offset = line + margin - perPage + 1
+	}
+	if offset > total-perPage {
+		offset = total - perPage
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return offset
+}
+
 // DrawPrompt draws the prompt to the terminal
 func (l *BasicLayout) DrawPrompt() {
 	l.prompt.Draw()
@@ -572,30 +1214,65 @@ func (l *BasicLayout) DrawScreen() {
 	trace("DrawScreen: START")
 	defer trace("DrawScreen: END")
 
-	perPage := linesPerPage()
+	perPage := l.linesPerPage()
 
 	if err := l.CalculatePage(perPage); err != nil {
 		return
 	}
 
+	// The wrapped current line is drawn within the page, which keeps
+	// the same boundaries
+	l.list.wrapRows = 0
+	if l.IsWrapped() && !l.helpShown() {
+		if line, err := l.GetCurrentLineBuffer().LineAt(l.currentLine); err == nil {
+			l.list.wrapRows = l.list.wrappedRows(line, perPage-1)
+		}
+	}
+
 	l.DrawPrompt()
 	l.list.Draw(perPage)
+	l.DrawIdleMessage()
 
 	if err := screen.Flush(); err != nil {
 		return
 	}
 }
 
-func linesPerPage() int {
+// linesPerPage returns the number of lines in the list area. It is
+// never less than 1, even if the screen is too small to display
+// anything, so that paging still works
+func (l *BasicLayout) linesPerPage() int {
 	_, height := screen.Size()
 
+	if n := height - reservedLines() - 2*l.padding; n > 0 {
+		return n
+	}
+	return 1
+}
+
+// reservedLines returns the number of lines on the screen that are
+// not part of the list area
+func reservedLines() int {
 	// list area is always the display area - 2 lines for prompt and status
-	reservedLines := 2
 	if isWindows {
 		// Of course, *except* for windows... :)
-		reservedLines = 3
+		return 3
+	}
+	return 2
+}
+
+// CheckScreenHeight returns an error if the screen is too small to
+// display at least `lines` lines in the list area (see --min-height)
+func CheckScreenHeight(lines int) error {
+	if lines < 1 {
+		lines = 1
 	}
-	return height - reservedLines
+
+	_, height := screen.Size()
+	if need := lines + reservedLines(); height < need {
+		return fmt.Errorf("error: the terminal is too small (%d lines, at least %d are needed)", height, need)
+	}
+	return nil
 }
 
 // MovePage scrolls the screen
@@ -611,13 +1288,20 @@ func (l *BasicLayout) MovePage(p PagingRequest) (moved bool) {
 
 // verticalScroll moves the cursor position vertically
 func verticalScroll(l *BasicLayout, p PagingRequest) bool {
+	cp := l.currentPage
+	buf := l.GetCurrentLineBuffer()
+	lcur := buf.Size()
+
+	// The cursor may still be past the lines read so far, while the
+	// last page is displayed (see CalculatePage). Move from there
+	if lcur > 0 && l.currentLine >= lcur {
+		l.currentLine = lcur - 1
+	}
+
 	// Before we move, on which line were we located?
 	lineBefore := l.currentLine
 
 	defer func() { trace("currentLine changed from %d -> %d", lineBefore, l.currentLine) }()
-	cp := l.currentPage
-	buf := l.GetCurrentLineBuffer()
-	lcur := buf.Size()
 
 	defer func() {
 		for _, lno := range []int{lineBefore, l.currentLine} {
@@ -628,7 +1312,7 @@ func verticalScroll(l *BasicLayout, p PagingRequest) bool {
 		}
 	}()
 
-	lpp := linesPerPage()
+	lpp := l.linesPerPage()
 	if l.list.sortTopDown {
 		switch p {
 		case ToLineAbove:
@@ -656,6 +1340,14 @@ func verticalScroll(l *BasicLayout, p PagingRequest) bool {
 		}
 	}
 
+	switch {
+	case l.config.CycleCursor:
+	case l.currentLine < 0:
+		l.currentLine = 0
+	case lcur > 0 && l.currentLine >= lcur:
+		l.currentLine = lcur - 1
+	}
+
 	if l.currentLine < 0 {
 		if lcur > 0 {
 			// Go to last page, if possible
@@ -675,33 +1367,21 @@ func verticalScroll(l *BasicLayout, p PagingRequest) bool {
 
 	if l.list.sortTopDown {
 		if l.currentLine < l.selectionRangeStart {
-			for lineno := l.currentLine; lineno <= l.selectionRangeStart; lineno++ {
-				l.SelectionAdd(lineno)
-			}
+			l.SelectionAddRange(l.currentLine, l.selectionRangeStart)
 			switch {
 			case l.selectionRangeStart <= lineBefore:
-				for lineno := l.selectionRangeStart; lineno <= lcur && lineno < lineBefore; lineno++ {
-					l.SelectionRemove(lineno)
-				}
+				l.SelectionRemoveRange(l.selectionRangeStart, lineBefore-1)
 			case lineBefore < l.currentLine:
-				for lineno := lineBefore; lineno < l.currentLine; lineno++ {
-					l.SelectionRemove(lineno)
-				}
+				l.SelectionRemoveRange(lineBefore, l.currentLine-1)
 			}
 		} else {
-			for lineno := l.selectionRangeStart; lineno <= lcur && lineno <= l.currentLine; lineno++ {
-				l.SelectionAdd(lineno)
-			}
+			l.SelectionAddRange(l.selectionRangeStart, l.currentLine)
 
 			switch {
 			case lineBefore <= l.selectionRangeStart:
-				for lineno := lineBefore; lineno < l.selectionRangeStart; lineno++ {
-					l.SelectionRemove(lineno)
-				}
+				l.SelectionRemoveRange(lineBefore, l.selectionRangeStart-1)
 			case l.currentLine < lineBefore:
-				for lineno := l.currentLine; lineno <= lineBefore; lineno++ {
-					l.SelectionRemove(lineno)
-				}
+				l.SelectionRemoveRange(l.currentLine, lineBefore)
 			}
 		}
 	}
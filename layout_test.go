@@ -1,21 +1,24 @@
 package peco
 
 import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
 	"unicode/utf8"
 
 	"github.com/mattn/go-runewidth"
-	"github.com/nsf/termbox-go"
 )
 
 type dummyScreen struct {
 	*interceptor
 	width  int
 	height int
-	pollCh chan termbox.Event
+	pollCh chan Event
 }
 
-func (d dummyScreen) SendEvent(e termbox.Event) {
+func (d dummyScreen) SendEvent(e Event) {
 	d.pollCh <- e
 }
 
@@ -27,24 +30,74 @@ func setDummyScreen() (*interceptor, func()) {
 		i,
 		100,
 		100,
-		make(chan termbox.Event, 256), // chan has a biiiig buffer, so we avoid blocking
+		make(chan Event, 256), // chan has a biiiig buffer, so we avoid blocking
 	}
 	return i, guard
 }
 
-func (d dummyScreen) SetCell(x, y int, ch rune, fg, bg termbox.Attribute) {
+// stopLoops stops the loops of ctx, and waits for them to be done
+// with the screen before it is restored
+func stopLoops(ctx *Ctx) {
+	ctx.Stop()
+	ctx.WaitDone()
+}
+
+func (d dummyScreen) SetCell(x, y int, ch rune, fg, bg Attribute) {
 	d.record("SetCell", interceptorArgs{x, y, ch, fg, bg})
 }
+
+// rows returns the text of each row that was drawn since the
+// interceptor was last reset, without the leading and trailing spaces.
+// What is drawn off the screen is left out
+func (d dummyScreen) rows() map[int]string {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	cells := map[int][]rune{}
+	for _, args := range d.events["SetCell"] {
+		x, y := args[0].(int), args[1].(int)
+		if x < 0 || x >= d.width {
+			continue
+		}
+		row := cells[y]
+		for len(row) <= x {
+			row = append(row, ' ')
+		}
+		row[x] = args[2].(rune)
+		cells[y] = row
+	}
+	rows := map[int]string{}
+	for y, row := range cells {
+		rows[y] = strings.TrimSpace(string(row))
+	}
+	return rows
+}
 func (d dummyScreen) Flush() error {
 	d.record("Flush", interceptorArgs{})
 	return nil
 }
-func (d dummyScreen) PollEvent() chan termbox.Event {
+func (d dummyScreen) PollEvent() chan Event {
 	return d.pollCh
 }
 func (d dummyScreen) Size() (int, int) {
 	return d.width, d.height
 }
+func (d dummyScreen) Init() error {
+	d.record("Init", interceptorArgs{})
+	return nil
+}
+func (d dummyScreen) Close() {
+	d.record("Close", interceptorArgs{})
+}
+func (d dummyScreen) SetCursor(x, y int) {
+	d.record("SetCursor", interceptorArgs{x, y})
+}
+func (d dummyScreen) HideCursor() {
+	d.record("HideCursor", interceptorArgs{})
+}
+func (d dummyScreen) SetInputMode(mode InputMode) {
+	d.record("SetInputMode", interceptorArgs{mode})
+}
 
 func TestLayoutType(t *testing.T) {
 	layouts := []struct {
@@ -53,6 +106,8 @@ func TestLayoutType(t *testing.T) {
 	}{
 		{LayoutTypeTopDown, true},
 		{LayoutTypeBottomUp, true},
+		{LayoutTypeCentered, true},
+		{LayoutTypeTopDownPromptBottom, true},
 		{"foobar", false},
 	}
 	for _, l := range layouts {
@@ -76,7 +131,7 @@ func TestPrintScreen(t *testing.T) {
 			i.reset()
 			t.Logf("Checking printScreen(%d, %d, %s, %s)", initX, initY, msg, fill)
 			width := utf8.RuneCountInString(msg)
-			printScreen(initX, initY, termbox.ColorDefault, termbox.ColorDefault, msg, fill)
+			printScreen(initX, initY, ColorDefault, ColorDefault, msg, fill)
 			events := i.events["SetCell"]
 			if !fill {
 				if len(events) != width {
@@ -124,4 +179,895 @@ func TestStatusBar(t *testing.T) {
 		t.Errorf("Expected 1 Flush event, got %d", l)
 		return
 	}
+
+	// Only the given message is cleared
+	st.ClearStatus("Goodbye")
+	if st.message != "Hello, World!" {
+		t.Errorf("Expected another message to be left alone, got '%s'", st.message)
+	}
+	st.ClearStatus("Hello, World!")
+	if st.message != "" {
+		t.Errorf("Expected the message to be cleared, got '%s'", st.message)
+	}
+}
+
+func TestResultCountFormat(t *testing.T) {
+	ctx := NewCtx(nil)
+	for _, l := range []string{"Alice", "Bob", "Charlie"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	ctx.SetCurrentFilterByName(IgnoreCaseMatch)
+	ctx.currentPage = &PageInfo{page: 1, perPage: 10, total: 2, maxPage: 1}
+
+	u := NewUserPrompt(ctx, AnchorTop, 0)
+	if s := u.resultCount(); s != "IgnoreCase [2 (1/1)]" {
+		t.Errorf("Expected default format to produce 'IgnoreCase [2 (1/1)]', got '%s'", s)
+	}
+
+	ctx.config.ResultCountFormat = "$PAGE/$MAX_PAGE ($MATCHED/$TOTAL)"
+	if s := u.resultCount(); s != "1/1 (2/3)" {
+		t.Errorf("Expected '1/1 (2/3)', got '%s'", s)
+	}
+}
+
+func TestCenteredLayout(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+
+	ctx := NewCtx(nil)
+	for _, l := range []string{"Alice", "Bob", "Charlie"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	l := NewCenteredLayout(ctx)
+	l.DrawScreen()
+
+	// The screen is 100 lines high, so 25 lines are left unused
+	// above and below the layout
+	expected := 48
+	if isWindows {
+		expected--
+	}
+	if n := l.linesPerPage(); n != expected {
+		t.Errorf("Expected %d lines per page, got %d", expected, n)
+	}
+
+	rows := map[rune]int{}
+	for _, args := range i.events["SetCell"] {
+		if x := args[0].(int); x == 0 {
+			rows[args[2].(rune)] = args[1].(int)
+		}
+	}
+	if y := rows['Q']; y != 25 {
+		t.Errorf("Expected prompt to be drawn on row 25, got %d", y)
+	}
+	if y := rows['A']; y != 26 {
+		t.Errorf("Expected 'Alice' to be drawn on row 26, got %d", y)
+	}
+	if y := rows['C']; y != 28 {
+		t.Errorf("Expected 'Charlie' to be drawn on row 28, got %d", y)
+	}
+}
+
+func TestHintLabels(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+
+	ctx := NewCtx(nil)
+	ctx.hintMode = true
+	for _, l := range []string{"Alice", "Bob", "Charlie"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	l := NewDefaultLayout(ctx)
+	l.DrawScreen()
+
+	cells := map[[2]int]rune{}
+	for _, args := range i.events["SetCell"] {
+		cells[[2]int{args[0].(int), args[1].(int)}] = args[2].(rune)
+	}
+
+	for n, r := range "asd" {
+		if c := cells[[2]int{0, n + 1}]; c != r {
+			t.Errorf("Expected label '%c' on row %d, got '%c'", r, n+1, c)
+		}
+	}
+	if c := cells[[2]int{0, 4}]; c != ' ' {
+		t.Errorf("Expected no label past the last line, got '%c'", c)
+	}
+	if c := cells[[2]int{hintGutterWidth, 1}]; c != 'A' {
+		t.Errorf("Expected 'Alice' to be shifted by the gutter, got '%c'", c)
+	}
+}
+
+func TestLineNumbers(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+
+	ctx := NewCtx(nil)
+	ctx.config.ShowLineNumbers = true
+	for n := 0; n < 12; n++ {
+		ctx.AddRawLine(NewRawLine(fmt.Sprintf("line %d", n), false))
+	}
+
+	// Lines are numbered by their index, whatever their ID
+	l := NewDefaultLayout(ctx)
+	if w := l.list.lineNumberWidth(); w != 3 {
+		t.Errorf("Expected line numbers to take 3 columns, got %d", w)
+	}
+	l.DrawScreen()
+
+	cells := map[[2]int]rune{}
+	for _, args := range i.events["SetCell"] {
+		cells[[2]int{args[0].(int), args[1].(int)}] = args[2].(rune)
+	}
+	for y := 1; y <= 12; y++ {
+		if c := cells[[2]int{1, y}]; c != rune('0'+y%10) {
+			t.Errorf("Expected row %d to be numbered %d, got '%c'", y, y, c)
+		}
+		if c := cells[[2]int{3, y}]; c != 'l' {
+			t.Errorf("Expected line to start at column 3 of row %d, got '%c'", y, c)
+		}
+	}
+
+	// Moved lines keep their number
+	ctx.currentLine = 0
+	ctx.MoveCurrentLine(1)
+	if n := ctx.lineNumber(ctx.GetCurrentLineBuffer().Snapshot()[1]); n != 1 {
+		t.Errorf("Expected the moved line to keep number 1, got %d", n)
+	}
+}
+
+func TestScrollbarThumb(t *testing.T) {
+	tests := []struct {
+		offset, perPage, total int
+		start, size            int
+	}{
+		{0, 10, 5, 0, 10},
+		{0, 10, 100, 0, 1},
+		{10, 10, 40, 2, 2},
+		{30, 10, 40, 8, 2},
+		{990, 10, 1000, 9, 1},
+	}
+	for _, test := range tests {
+		start, size := scrollbarThumb(test.offset, test.perPage, test.total)
+		if start != test.start || size != test.size {
+			t.Errorf("scrollbarThumb(%d, %d, %d): expected (%d, %d), got (%d, %d)",
+				test.offset, test.perPage, test.total, test.start, test.size, start, size)
+		}
+	}
+}
+
+func TestScrollbarWideCharacters(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+	screen = dummyScreen{i, 10, 10, make(chan Event, 256)}
+
+	ctx := NewCtx(nil)
+	ctx.config.ShowScrollbar = ScrollbarAlways
+	ctx.AddRawLine(NewRawLine("abcdefgh日本", false))
+	l := NewDefaultLayout(ctx)
+	l.DrawScreen()
+
+	// The wide character at column 8 would be cut in half by the
+	// scrollbar on column 9, so it is left out
+	for _, args := range i.events["SetCell"] {
+		if args[2].(rune) == '日' || args[2].(rune) == '本' {
+			t.Errorf("Expected the wide characters not to be drawn, got '%c' at column %d", args[2].(rune), args[0].(int))
+		}
+	}
+	if row := screen.(dummyScreen).rows()[l.list.AnchorPosition()]; row != "abcdefgh" {
+		t.Errorf("Expected the line to stop before the scrollbar, got '%s'", row)
+	}
+}
+
+func TestMatchedStyle(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+
+	ctx := NewCtx(nil)
+	ctx.config.Style.Selected = Style{fg: ColorDefault | AttrUnderline, bg: ColorMagenta}
+	ctx.config.Style.Matched = Style{fg: ColorDefault | AttrBold, bg: ColorDefault}
+	for _, v := range []string{"foo bar", "bar foo"} {
+		ctx.rawLineBuffer.AppendLine(NewMatchedLine(NewRawLine(v, false), [][]int{{0, 3}}))
+	}
+	l := NewDefaultLayout(ctx)
+	l.DrawScreen()
+
+	fgs := map[[2]int]Attribute{}
+	for _, args := range i.events["SetCell"] {
+		fgs[[2]int{args[0].(int), args[1].(int)}] = args[3].(Attribute)
+	}
+
+	// Matched text keeps the style of the line, plus bold
+	expected := map[[2]int]Attribute{
+		{0, 1}: ColorDefault | AttrUnderline | AttrBold,
+		{4, 1}: ColorDefault | AttrUnderline,
+		{0, 2}: ColorDefault | AttrBold,
+		{4, 2}: ColorDefault,
+	}
+	for cell, fg := range expected {
+		if fgs[cell] != fg {
+			t.Errorf("Expected foreground %d at %v, got %d", fg, cell, fgs[cell])
+		}
+	}
+
+	if a := overlayAttribute(ColorGreen|AttrUnderline, ColorRed); a != ColorRed|AttrUnderline {
+		t.Errorf("Expected the color of the matched style to be used, got %d", a)
+	}
+}
+
+func TestScrollOff(t *testing.T) {
+	tests := []struct {
+		offset, line, perPage, total, margin int
+		expected                             int
+	}{
+		{0, 7, 10, 30, 2, 0},
+		{0, 8, 10, 30, 2, 1},   // scrolls a line at a time
+		{5, 6, 10, 30, 2, 4},   // and back up
+		{0, 29, 10, 30, 2, 20}, // not past the last line
+		{20, 0, 10, 30, 2, 0},  // nor before the first one
+		{0, 12, 10, 30, 9, 7},  // the margin is at most half a page
+		{0, 3, 10, 5, 2, 0},
+	}
+	for _, test := range tests {
+		if offset := scrollOffset(test.offset, test.line, test.perPage, test.total, test.margin); offset != test.expected {
+			t.Errorf("scrollOffset(%d, %d, %d, %d, %d): expected %d, got %d",
+				test.offset, test.line, test.perPage, test.total, test.margin, test.expected, offset)
+		}
+	}
+
+	i, guard := setDummyScreen()
+	defer guard()
+	screen = dummyScreen{i, 80, 10 + reservedLines(), make(chan Event, 256)}
+
+	ctx := NewCtx(nil)
+	ctx.config.ScrollOff = 2
+	for n := 0; n < 30; n++ {
+		ctx.AddRawLine(NewRawLine(fmt.Sprintf("line %d", n), false))
+	}
+
+	l := NewDefaultLayout(ctx)
+	for n := 0; n < 8; n++ {
+		l.MovePage(ToLineBelow)
+		l.DrawScreen()
+	}
+	if ctx.currentPage.offset != 1 {
+		t.Errorf("Expected the list to scroll by a line, got offset %d", ctx.currentPage.offset)
+	}
+
+	ctx.config.ScrollOff = 0
+	l.DrawScreen()
+	if ctx.currentPage.offset != 0 {
+		t.Errorf("Expected the list to go back to scrolling by pages, got offset %d", ctx.currentPage.offset)
+	}
+}
+
+func TestInitialIndexPage(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+	screen = dummyScreen{i, 80, 30 + reservedLines(), make(chan Event, 256)}
+
+	shows := func(text string) bool {
+		for _, row := range screen.(dummyScreen).rows() {
+			if row == text {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		index, offset int
+	}{
+		{0, 0},
+		{29, 0},
+		{30, 30},
+		{120, 120},
+		{199, 180},
+	}
+	for _, layout := range []string{LayoutTypeTopDown, LayoutTypeBottomUp} {
+		for _, test := range tests {
+			ctx := NewCtx(CLIOptions{OptInitialIndex: test.index, OptLayout: layout})
+			for n := 0; n < 200; n++ {
+				ctx.AddRawLine(NewRawLine(fmt.Sprintf("line %d", n), false))
+			}
+
+			i.reset()
+			ctx.NewView().layout.DrawScreen()
+			if ctx.currentPage.offset != test.offset {
+				t.Errorf("%s, --initial-index %d: expected page to start at line %d, got %d", layout, test.index, test.offset, ctx.currentPage.offset)
+			}
+			if text := fmt.Sprintf("line %d", test.index); !shows(text) {
+				t.Errorf("%s, --initial-index %d: expected '%s' to be displayed", layout, test.index, text)
+			}
+		}
+	}
+
+	// While the input is being read, the last page is displayed until
+	// the line is read. The cursor moves from the last line read
+	ctx := NewCtx(CLIOptions{OptInitialIndex: 120})
+	for n := 0; n < 50; n++ {
+		ctx.AddRawLine(NewRawLine(fmt.Sprintf("line %d", n), false))
+	}
+	ctx.setLoading(true)
+	l := NewDefaultLayout(ctx)
+	l.DrawScreen()
+	if ctx.currentLine != 120 || ctx.currentPage.offset != 30 {
+		t.Errorf("Expected cursor on line 120 and page to start at line 30, got %d and %d", ctx.currentLine, ctx.currentPage.offset)
+	}
+
+	ctx.setLoading(false)
+	l.DrawScreen()
+	if ctx.currentLine != 49 {
+		t.Errorf("Expected cursor to move to the last line once the input is read, got %d", ctx.currentLine)
+	}
+
+	ctx.currentLine = 120
+	l.MovePage(ToLineAbove)
+	if ctx.currentLine != 48 {
+		t.Errorf("Expected cursor to move up from the last line, got %d", ctx.currentLine)
+	}
+}
+
+func TestTinyScreen(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+	screen = dummyScreen{i, 80, 1, make(chan Event, 256)}
+
+	ctx := NewCtx(nil)
+	for _, l := range []string{"Alice", "Bob", "Charlie"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+
+	// The list area never gets less than a line, so that paging
+	// doesn't break
+	for _, l := range []Layout{NewDefaultLayout(ctx), NewBottomUpLayout(ctx), NewCenteredLayout(ctx)} {
+		l.DrawScreen()
+		if ctx.currentPage.perPage != 1 {
+			t.Errorf("Expected 1 line per page, got %d", ctx.currentPage.perPage)
+		}
+		l.MovePage(ToScrollPageDown)
+	}
+
+	if err := CheckScreenHeight(0); err == nil {
+		t.Errorf("Expected a screen of 1 line to be too small")
+	}
+
+	screen = dummyScreen{i, 80, 10, make(chan Event, 256)}
+	if err := CheckScreenHeight(10 - reservedLines()); err != nil {
+		t.Errorf("Expected a screen of 10 lines to be enough: %s", err)
+	}
+	if err := CheckScreenHeight(11 - reservedLines()); err == nil {
+		t.Errorf("Expected a screen of 10 lines to be too small")
+	}
+}
+
+func TestColumnAligner(t *testing.T) {
+	ca := NewColumnAligner(regexp.MustCompile("\t"))
+	for _, l := range []string{"a\tbb\tc", "aaaa\tb\tc", "x"} {
+		ca.Add(l)
+	}
+	g := ca.Generation()
+
+	s, matches := ca.Align("a\tbb\tc", [][]int{{0, 1}, {2, 4}, {5, 6}})
+	if s != "a     bb  c" {
+		t.Errorf("Expected the columns to be padded, got %q", s)
+	}
+	expected := [][]int{{0, 1}, {6, 8}, {10, 11}}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Errorf("Expected matches %v, got %v", expected, matches)
+	}
+
+	// Lines without a delimiter are left alone
+	if s, _ := ca.Align("x", nil); s != "x" {
+		t.Errorf("Expected 'x', got %q", s)
+	}
+
+	// Only wider cells change the widths
+	ca.Add("aa\tb")
+	if ca.Generation() != g {
+		t.Errorf("Expected the widths to stay the same")
+	}
+	ca.Add("aa\tbbbbb\tc")
+	if ca.Generation() == g {
+		t.Errorf("Expected the widths to change")
+	}
+	if s, _ := ca.Align("a\tbb\tc", nil); s != "a     bb     c" {
+		t.Errorf("Expected the columns to be padded to the new widths, got %q", s)
+	}
+}
+
+func TestLineFormatter(t *testing.T) {
+	lf, err := NewLineFormatter("{{index .Fields 1}} ({{index .Fields 0}})", nil)
+	if err != nil {
+		t.Fatalf("Failed to parse the template: %s", err)
+	}
+	tests := map[string]string{
+		"  1234  alice  ": "alice (1234)",
+		"5678 bob x":      "bob (5678)",
+		"nofields":        "nofields", // the template fails
+	}
+	for line, expected := range tests {
+		if s := lf.Format(line); s != expected {
+			t.Errorf("Expected %q to be displayed as %q, got %q", line, expected, s)
+		}
+	}
+
+	lf, _ = NewLineFormatter("{{.Line}}: {{len .Fields}}", regexp.MustCompile(","))
+	if s := lf.Format("a,b,c"); s != "a,b,c: 3" {
+		t.Errorf("Expected the fields to be split by the delimiter, got %q", s)
+	}
+
+	if _, err := NewLineFormatter("{{.Fields", nil); err == nil {
+		t.Errorf("Expected an invalid template to be rejected")
+	}
+
+	// Lines are matched against their original text
+	_, guard := setDummyScreen()
+	defer guard()
+	ctx := NewCtx(nil)
+	lf, _ = NewLineFormatter("{{index .Fields 1}} ({{index .Fields 0}})", nil)
+	ctx.SetLineFormatter(lf)
+	ctx.AddRawLine(NewRawLine("1234 alice", false))
+	b := NewRawLineBuffer()
+	b.Append(NewMatchedLine(NewRawLine("1234 alice", false), [][]int{{0, 2}}))
+	ctx.SetActiveLineBuffer(b)
+	NewDefaultLayout(ctx).DrawScreen()
+
+	if s := screen.(dummyScreen).rows()[1]; s != "alice (1234)" {
+		t.Errorf("Expected the line to be displayed as 'alice (1234)', got %q", s)
+	}
+}
+
+func TestFillBackground(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+
+	ctx := NewCtx(nil)
+	for _, v := range []string{"foo", "bar"} {
+		ctx.AddRawLine(NewRawLine(v, false))
+	}
+
+	// Returns the background of the cells of the selected line
+	// (row 1), past its text
+	drawAndGetBg := func() map[Attribute]bool {
+		i.reset()
+		NewDefaultLayout(ctx).DrawScreen()
+		bgs := map[Attribute]bool{}
+		for _, args := range i.events["SetCell"] {
+			if args[1].(int) == 1 && args[0].(int) >= 3 && args[0].(int) < 90 {
+				bgs[args[4].(Attribute)] = true
+			}
+		}
+		return bgs
+	}
+
+	// The default styles leave the background to the terminal
+	if s := NewStyleSet().Basic; s.fg != ColorDefault || s.bg != ColorDefault {
+		t.Errorf("Expected the basic style to use the default colors")
+	}
+	if s := stringsToStyle([]string{"default", "on_default"}); s.fg != ColorDefault || s.bg != ColorDefault {
+		t.Errorf("Expected 'default' and 'on_default' to be the default colors")
+	}
+
+	bgs := drawAndGetBg()
+	if len(bgs) != 1 || !bgs[ColorDefault] {
+		t.Errorf("Expected the rest of the selected line to be left alone, got %v", bgs)
+	}
+
+	ctx.config.FillBackground = true
+	bgs = drawAndGetBg()
+	if len(bgs) != 1 || !bgs[ctx.config.Style.Selected.bg] {
+		t.Errorf("Expected the rest of the selected line to be filled, got %v", bgs)
+	}
+}
+
+func TestFilteringIndicator(t *testing.T) {
+	_, guard := setDummyScreen()
+	defer guard()
+
+	ctx := NewCtx(nil)
+	ctx.config.ResultCountFormat = "$LATENCY"
+	st := NewStatusBar(ctx, AnchorBottom, 0)
+	prompt := NewUserPrompt(ctx, AnchorTop, 0)
+
+	run := ctx.progress.Start()
+	ctx.progress.ShowIndicator(run)
+	if msg := st.idleMessage(); msg != "filtering…" {
+		t.Errorf("Expected the filtering indicator, got %q", msg)
+	}
+
+	ctx.progress.Finish(run)
+	if msg := st.idleMessage(); msg != "" {
+		t.Errorf("Expected no indicator once the query completed, got %q", msg)
+	}
+	if s := prompt.resultCount(); s != "0ms" {
+		t.Errorf("Expected the latency of the last query, got %q", s)
+	}
+}
+
+func TestPollSize(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+
+	ctx := newCtx(nil, 25)
+	ctx.AddRawLine(NewRawLine("foo", false))
+	v := ctx.NewView()
+	v.drawScreen()
+
+	// Nothing changed, nothing is drawn
+	i.reset()
+	v.pollSize()
+	if n := len(i.events["Flush"]); n != 0 {
+		t.Errorf("expected no redraw while the size is unchanged, got %d flushes", n)
+	}
+
+	screen = dummyScreen{i, 50, 20, make(chan Event, 256)}
+	v.pollSize()
+	if n := len(i.events["Flush"]); n == 0 {
+		t.Errorf("expected the screen to be redrawn after being resized")
+	}
+
+	i.reset()
+	v.pollSize()
+	if n := len(i.events["Flush"]); n != 0 {
+		t.Errorf("expected no redraw after the resized screen was drawn, got %d flushes", n)
+	}
+
+	if ctx.resizeReported() {
+		t.Errorf("expected no resize to be reported yet")
+	}
+	ctx.markResized()
+	if !ctx.resizeReported() {
+		t.Errorf("expected a resize to be reported")
+	}
+
+	// Like termbox, the screen only knows of the new size once it is
+	// redrawn, so the terminal is asked for its size
+	tty := &staleScreen{dummyScreen{i, 50, 20, make(chan Event, 256)}, 50, 20}
+	screen = NewDiffScreen(tty)
+	v.drawScreen()
+	tty.ttyWidth = 60
+	i.reset()
+	v.pollSize()
+	if n := len(i.events["Flush"]); n == 0 {
+		t.Errorf("expected the screen to be redrawn once the terminal was resized")
+	}
+}
+
+// staleScreen is a screen whose Size is not updated when the terminal
+// is resized, but that can ask the terminal for its size
+type staleScreen struct {
+	dummyScreen
+	ttyWidth, ttyHeight int
+}
+
+func (s *staleScreen) TerminalSize() (int, int, error) {
+	return s.ttyWidth, s.ttyHeight, nil
+}
+
+func TestCycleCursor(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+	screen = dummyScreen{i, 80, 10 + reservedLines(), make(chan Event, 256)}
+
+	tests := []struct {
+		layout   string
+		cycle    bool
+		start    int
+		p        PagingRequest
+		expected int
+	}{
+		{LayoutTypeTopDown, true, 29, ToLineBelow, 0},
+		{LayoutTypeTopDown, true, 0, ToLineAbove, 29},
+		{LayoutTypeTopDown, false, 29, ToLineBelow, 29},
+		{LayoutTypeTopDown, false, 0, ToLineAbove, 0},
+		{LayoutTypeTopDown, false, 25, ToScrollPageDown, 29},
+		{LayoutTypeTopDown, false, 5, ToScrollPageUp, 0},
+		{LayoutTypeBottomUp, true, 29, ToLineAbove, 0},
+		{LayoutTypeBottomUp, false, 29, ToLineAbove, 29},
+		{LayoutTypeBottomUp, false, 0, ToLineBelow, 0},
+	}
+	for _, test := range tests {
+		ctx := NewCtx(CLIOptions{OptLayout: test.layout})
+		ctx.config.CycleCursor = test.cycle
+		for n := 0; n < 30; n++ {
+			ctx.AddRawLine(NewRawLine(fmt.Sprintf("line %d", n), false))
+		}
+		l := ctx.NewView().layout
+		ctx.currentLine = test.start
+		l.DrawScreen()
+		l.MovePage(test.p)
+		if ctx.currentLine != test.expected {
+			t.Errorf("%s, CycleCursor = %t: expected request %d to move the cursor from line %d to %d, got %d",
+				test.layout, test.cycle, test.p, test.start, test.expected, ctx.currentLine)
+		}
+	}
+}
+
+func TestTopDownPromptBottomLayout(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+	height := 10 + reservedLines()
+	screen = dummyScreen{i, 80, height, make(chan Event, 256)}
+
+	ctx := NewCtx(CLIOptions{OptLayout: LayoutTypeTopDownPromptBottom})
+	for n := 0; n < 30; n++ {
+		ctx.AddRawLine(NewRawLine(fmt.Sprintf("line %d", n), false))
+	}
+	ctx.currentLine = 12
+	ctx.NewView().layout.DrawScreen()
+
+	rows := screen.(dummyScreen).rows()
+	row := func(y int) string {
+		return rows[y]
+	}
+
+	// The second page, top-down, then the prompt and the status bar
+	for n := 0; n < 10; n++ {
+		if expected := fmt.Sprintf("line %d", n+10); row(n) != expected {
+			t.Errorf("Expected row %d to be '%s', got '%s'", n, expected, row(n))
+		}
+	}
+	if y := height - reservedLines(); !strings.HasPrefix(row(y), "QUERY>") {
+		t.Errorf("Expected the prompt on row %d, got '%s'", y, row(y))
+	}
+}
+
+func TestShowHelp(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+	height := 10 + reservedLines()
+	screen = dummyScreen{i, 80, height, make(chan Event, 256)}
+
+	for _, layout := range []string{LayoutTypeTopDown, LayoutTypeBottomUp} {
+		ctx := newCtx(CLIOptions{OptLayout: layout}, 25)
+		ctx.AddRawLine(NewRawLine("foo", false))
+		input := ctx.NewInput()
+		v := ctx.NewView()
+		v.layout.DrawScreen()
+
+		doShowHelp(input, Event{})
+		bindings := input.keymap.Bindings()
+		if len(ctx.helpLines) != len(bindings) {
+			t.Fatalf("%s: expected %d key bindings, got %d", layout, len(bindings), len(ctx.helpLines))
+		}
+
+		i.reset()
+		v.layout.DrawScreen()
+		shown := map[string]bool{}
+		for _, row := range screen.(dummyScreen).rows() {
+			shown[row] = true
+		}
+		for _, line := range ctx.helpLines[:10] {
+			if !shown[strings.TrimSpace(line)] {
+				t.Errorf("%s: expected '%s' to be displayed", layout, line)
+			}
+		}
+		if shown["foo"] {
+			t.Errorf("%s: expected the lines to be hidden", layout)
+		}
+
+		// Scrolling stops at the last page
+		input.handleKeyEvent(Event{Key: KeyCtrlN})
+		if ctx.helpOffset != 1 {
+			t.Errorf("%s: expected the help to scroll by a line, got offset %d", layout, ctx.helpOffset)
+		}
+		for n := 0; n < 10; n++ {
+			input.handleKeyEvent(Event{Key: KeyPgdn})
+		}
+		if max := len(ctx.helpLines) - 10; ctx.helpOffset != max {
+			t.Errorf("%s: expected the help to scroll up to offset %d, got %d", layout, max, ctx.helpOffset)
+		}
+
+		// Any other key hides it
+		input.handleKeyEvent(Event{Ch: 'x'})
+		if ctx.helpLines != nil {
+			t.Errorf("%s: expected the help to be hidden", layout)
+		}
+		expectQueryString(t, ctx, "")
+
+		i.reset()
+		v.layout.DrawScreen()
+		shown = map[string]bool{}
+		for _, row := range screen.(dummyScreen).rows() {
+			shown[row] = true
+		}
+		if !shown["foo"] {
+			t.Errorf("%s: expected the lines to be displayed again", layout)
+		}
+	}
+}
+
+func TestPageNavigation(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+	screen = dummyScreen{i, 80, 10 + reservedLines(), make(chan Event, 256)}
+
+	ctx := newCtx(nil, 25)
+	for n := 0; n < 95; n++ {
+		ctx.AddRawLine(NewRawLine(fmt.Sprintf("line %d", n), false))
+	}
+	input := ctx.NewInput()
+	v := ctx.NewView()
+	v.layout.DrawScreen()
+
+	expectPage := func(page, line int) {
+		v.layout.DrawScreen()
+		if ctx.currentPage.page != page || ctx.currentLine != line {
+			t.Errorf("Expected page %d and line %d, got page %d and line %d", page, line, ctx.currentPage.page, ctx.currentLine)
+		}
+	}
+	gotoPage := func(answer string) {
+		doGotoPage(input, Event{})
+		for _, r := range answer {
+			input.handleKeyEvent(Event{Ch: r})
+		}
+		input.handleKeyEvent(Event{Key: KeyEnter})
+	}
+
+	doLastPage(input, Event{})
+	expectPage(10, 90)
+	gotoPage("3")
+	expectPage(3, 20)
+	doFirstPage(input, Event{})
+	expectPage(1, 0)
+	gotoPage("42")
+	expectPage(10, 90)
+	gotoPage("x")
+	expectPage(10, 90)
+
+	// Fewer lines than the cursor's page, the cursor goes to the last one
+	b := NewRawLineBuffer()
+	for n := 0; n < 15; n++ {
+		b.Append(NewRawLine(fmt.Sprintf("match %d", n), false))
+	}
+	ctx.SetActiveLineBuffer(b)
+	expectPage(2, 14)
+
+	// None at all, an empty page is still drawn
+	ctx.currentLine = 50
+	ctx.SetActiveLineBuffer(NewRawLineBuffer())
+	i.reset()
+	expectPage(1, 0)
+	if len(i.events["Flush"]) == 0 {
+		t.Errorf("Expected the screen to be drawn")
+	}
+}
+
+func TestBottomUpCursorAfterShrink(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+	height := 10 + reservedLines()
+	screen = dummyScreen{i, 80, height, make(chan Event, 256)}
+
+	// The input may still be coming in when the query is typed
+	for _, loading := range []bool{false, true} {
+		ctx := newCtx(CLIOptions{OptLayout: LayoutTypeBottomUp}, 25)
+		for n := 0; n < 30; n++ {
+			ctx.AddRawLine(NewRawLine(fmt.Sprintf("line %d", n), false))
+		}
+		ctx.setLoading(loading)
+		input := ctx.NewInput()
+		v := ctx.NewView()
+
+		// On the third page, then the query leaves 3 lines
+		ctx.currentLine = 25
+		v.layout.DrawScreen()
+		b := NewRawLineBuffer()
+		for n := 0; n < 3; n++ {
+			b.Append(NewMatchedLine(NewRawLine(fmt.Sprintf("match %d", n), false), nil))
+		}
+		ctx.activeLineBuffer = b
+		i.reset()
+		v.layout.DrawScreen()
+
+		// The lines are at the bottom of the list, and the cursor is
+		// on the top one of them
+		highlighted := map[int]bool{}
+		for _, args := range i.events["SetCell"] {
+			if args[4].(Attribute) == ctx.config.Style.Selected.bg {
+				highlighted[args[1].(int)] = true
+			}
+		}
+		rows := screen.(dummyScreen).rows()
+		for n := 0; n < 3; n++ {
+			if expected, got := fmt.Sprintf("match %d", n), rows[9-n]; got != expected {
+				t.Errorf("Expected row %d to be '%s', got '%s' (loading = %t)", 9-n, expected, got, loading)
+			}
+		}
+		if len(highlighted) != 1 || !highlighted[7] {
+			t.Errorf("Expected row 7 to be highlighted, got %v (loading = %t)", highlighted, loading)
+		}
+
+		// Selection works on the highlighted line
+		doToggleSelection(input, Event{})
+		if l, _ := b.LineAt(2); ctx.SelectionLen() != 1 || !ctx.SelectionHas(l) {
+			t.Errorf("Expected '%s' to be selected (loading = %t)", l.DisplayString(), loading)
+		}
+	}
+}
+
+func TestToggleWrap(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+	screen = dummyScreen{i, 20, 10 + reservedLines(), make(chan Event, 256)}
+
+	ctx := newCtx(nil, 25)
+	long := "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMN"
+	for n := 0; n < 30; n++ {
+		if n == 1 || n == 9 {
+			ctx.AddRawLine(NewRawLine(long, false))
+			continue
+		}
+		ctx.AddRawLine(NewRawLine(fmt.Sprintf("line %d", n), false))
+	}
+	input := ctx.NewInput()
+	v := ctx.NewView()
+	ctx.currentLine = 1
+
+	drawRows := func() map[int]string {
+		i.reset()
+		v.layout.DrawScreen()
+		return screen.(dummyScreen).rows()
+	}
+	checkRows := func(rows map[int]string, start int, expected []string) {
+		for n, s := range expected {
+			if rows[start+n] != s {
+				t.Errorf("Expected row %d to be '%s', got '%s'", n, s, rows[start+n])
+			}
+		}
+	}
+
+	// The line is 50 characters long, which takes 3 rows of 20. The
+	// lines that follow it make room
+	doToggleWrap(input, Event{})
+	rows := drawRows()
+	start := v.layout.(*BasicLayout).list.AnchorPosition()
+	checkRows(rows, start, []string{"line 0", long[:20], long[20:40], long[40:], "line 2", "line 3", "line 4", "line 5", "line 6", "line 7"})
+	if ctx.currentPage.perPage != 10 || ctx.currentPage.offset != 0 {
+		t.Errorf("Expected the page to stay the same while wrapping, got %d lines from %d", ctx.currentPage.perPage, ctx.currentPage.offset)
+	}
+
+	// Nothing is drawn again until the wrap changes
+	rows = drawRows()
+	if s, ok := rows[start+2]; ok {
+		t.Errorf("Expected the wrapped line not to be drawn again, got '%s'", s)
+	}
+
+	// At the end of the page, the lines that precede it make room
+	ctx.currentLine = 9
+	rows = drawRows()
+	checkRows(rows, start, []string{"line 2", "line 3", "line 4", "line 5", "line 6", "line 7", "line 8", long[:20], long[20:40], long[40:]})
+	if ctx.currentPage.offset != 0 {
+		t.Errorf("Expected the page to start at line 0, got %d", ctx.currentPage.offset)
+	}
+
+	// Back to a single, truncated row
+	ctx.currentLine = 1
+	doToggleWrap(input, Event{})
+	rows = drawRows()
+	checkRows(rows, start, []string{"line 0", long[:20], "line 2"})
+	if ctx.currentPage.perPage != 10 {
+		t.Errorf("Expected 10 lines per page, got %d", ctx.currentPage.perPage)
+	}
+}
+
+func TestWrapLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		width int
+		rows  int
+	}{
+		{"", 10, 1},
+		{"0123456789", 10, 1},
+		{"0123456789a", 10, 2},
+		{"\tabcdefgh", 10, 2},
+		{"abcdefghi日本", 10, 2},
+		{"abc", 0, 3},
+	}
+	for _, test := range tests {
+		if rows := wrapLine(test.line, test.width, func(int, int, int, rune) {}); rows != test.rows {
+			t.Errorf("Expected '%s' to take %d rows of %d columns, got %d", test.line, test.rows, test.width, rows)
+		}
+	}
 }
@@ -3,6 +3,7 @@ package peco
 import (
 	"regexp"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/google/btree"
 )
@@ -56,14 +57,22 @@ type Line interface {
 
 	// Indices return the matched portion(s) of a string after filtering.
 	// Note that while Indices may return nil, that just means that there are
-	// no substrings to be highlighted. It doesn't mean there were no matches
+	// no substrings to be highlighted. It doesn't mean there were no matches.
+	// The built-in filters return every match of every term, sorted and
+	// with overlapping matches merged, up to maxMatchIntervals of them
 	Indices() [][]int
 
 	// Output returns the string to be display as peco finishes up doing its
 	// thing. This means if you have null separator, the contents before the
-	// separator are not included in this string
+	// separator are not included in this string. Neither are the extra
+	// fields (see ExtraFields)
 	Output() string
 
+	// ExtraFields returns the fields after the second one, if the line
+	// has more than two null separated fields. They are not displayed
+	// nor matched against, and are only output with --output-all-fields
+	ExtraFields() []string
+
 	// IsDirty returns true if this line should be forcefully redrawn
 	IsDirty() bool
 
@@ -75,8 +84,12 @@ type Line interface {
 type RawLine struct {
 	id            uint64
 	buf           string
-	sepLoc        int
+	sepLoc        int // location of the first null
+	extraLoc      int // location of the null before the extra fields
 	displayString string
+	fields        []string   // the fields of the line, if fieldSpec is set
+	fieldSpec     *FieldSpec // how the line is split into fields
+	truncated     bool       // true if the line was cut short as it was read (see markTruncated)
 	dirty         bool
 }
 
@@ -85,25 +98,173 @@ var idGenerator = newIDGen()
 // NewRawLine creates a new RawLine. The `enableSep` flag tells
 // it if we should search for a null character to split the
 // string to display and the string to emit upon selection of
-// of said line
+// of said line. Any fields after a second null character are
+// kept as extra fields. The string to display is not limited
 func NewRawLine(v string, enableSep bool) *RawLine {
+	return NewRawLineWithMaxLength(v, enableSep, 0)
+}
+
+// NewRawLineWithMaxLength creates a new RawLine, whose string to
+// display is limited to `max` bytes. If `max` is 0 or less, the
+// string to display is not limited
+func NewRawLineWithMaxLength(v string, enableSep bool, max int) *RawLine {
+	return NewRawLineWithFields(v, enableSep, max, nil)
+}
+
+// NewRawLineWithFields creates a new RawLine like
+// NewRawLineWithMaxLength. If `fs` is not nil, the line is split
+// into fields, and the fields given by `fs` are used as the string
+// to display and the string to emit (see FieldSpec)
+func NewRawLineWithFields(v string, enableSep bool, max int, fs *FieldSpec) *RawLine {
 	id := idGenerator.create()
 	rl := &RawLine{
 		id:            id,
 		buf:           v,
 		sepLoc:        -1,
+		extraLoc:      -1,
 		displayString: "",
 		dirty:         false,
 	}
+	rl.split(enableSep, max, fs)
+	return rl
+}
 
-	if !enableSep {
-		return rl
+// resplit returns a copy of the line, split again depending on
+// `enableSep` (see NewRawLine). The copy has the same ID, so that it
+// stands for the same line in the selection
+func (rl RawLine) resplit(enableSep bool, max int) *RawLine {
+	nl := &RawLine{
+		id:        rl.id,
+		buf:       rl.buf,
+		sepLoc:    -1,
+		extraLoc:  -1,
+		truncated: rl.truncated,
+		dirty:     true,
 	}
+	nl.split(enableSep, max, rl.fieldSpec)
+	return nl
+}
 
-	if i := strings.IndexByte(rl.buf, '\000'); i != -1 {
-		rl.sepLoc = i
+// split computes the string to display and where the string to
+// output is, for NewRawLineWithFields
+func (rl *RawLine) split(enableSep bool, max int, fs *FieldSpec) {
+	if enableSep {
+		if i := strings.IndexByte(rl.buf, '\000'); i != -1 {
+			rl.sepLoc = i
+			if j := strings.IndexByte(rl.buf[i+1:], '\000'); j != -1 {
+				rl.extraLoc = i + 1 + j
+			}
+		}
+	}
+
+	// The string to display is computed upfront, so that we don't
+	// have to do it over and over again while filtering
+	display := rl.buf
+	if i := rl.sepLoc; i > -1 {
+		display = rl.buf[:i]
+	}
+	if fs != nil {
+		// Split once here, so that the fields can be reused
+		rl.fieldSpec = fs
+		rl.fields = fs.Split(display)
+		display = fs.display(display, rl.fields)
+	}
+	if strings.IndexByte(display, '\x1b') > -1 {
+		display = stripANSISequence(display)
+	}
+	rl.displayString = sanitizeDisplayString(display, max)
+	if rl.truncated {
+		rl.markTruncated()
+	}
+}
+
+// markTruncated records that the line was cut short as it was read
+// (see MaxLineLength), which is shown with an ellipsis at the end of
+// the string to display, like for the lines whose string to display
+// alone is cut short with FullOutput
+func (rl *RawLine) markTruncated() {
+	rl.truncated = true
+	if !strings.HasSuffix(rl.displayString, "\u2026") {
+		rl.displayString += "\u2026"
 	}
-	return rl
+}
+
+// trimFields removes the leading and trailing whitespace from `s`.
+// If `enableSep` is true, it is removed from each of the null
+// separated fields instead, so that both the string to display and
+// the string to output are trimmed
+func trimFields(s string, enableSep bool) string {
+	if !enableSep || strings.IndexByte(s, '\000') == -1 {
+		return strings.TrimSpace(s)
+	}
+
+	fields := strings.Split(s, "\000")
+	for i, f := range fields {
+		fields[i] = strings.TrimSpace(f)
+	}
+	return strings.Join(fields, "\000")
+}
+
+// trimDisplayString removes the leading and trailing whitespace from
+// the string to display, leaving the output as it is
+func (rl *RawLine) trimDisplayString() {
+	rl.displayString = strings.TrimSpace(rl.displayString)
+}
+
+// sanitizeDisplayString makes `s` safe to be drawn on the terminal.
+// Invalid UTF-8 sequences and control characters (except for tabs)
+// are replaced with U+FFFD, as they would otherwise garble the
+// screen. If `s` is longer than `max` bytes, it is truncated and an
+// ellipsis is appended
+func sanitizeDisplayString(s string, max int) string {
+	truncated := max > 0 && len(s) > max
+	if !truncated && isPrintable(s) {
+		return s
+	}
+
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); {
+		r, w := utf8.DecodeRuneInString(s[i:])
+		if max > 0 && len(buf)+utf8.RuneLen(r) > max {
+			break
+		}
+		i += w
+
+		if (r == utf8.RuneError && w == 1) || isControl(r) {
+			r = utf8.RuneError
+		}
+		buf = append(buf, string(r)...)
+	}
+
+	if truncated {
+		buf = append(buf, "\u2026"...)
+	}
+	return string(buf)
+}
+
+// isPrintable returns true if `s` is valid UTF-8 and contains
+// no control characters other than tabs
+func isPrintable(s string) bool {
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if isControl(rune(c)) {
+				return false
+			}
+			i++
+			continue
+		}
+
+		r, w := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && w == 1 {
+			return false
+		}
+		i += w
+	}
+	return true
+}
+
+func isControl(r rune) bool {
+	return (r < 0x20 && r != '\t') || r == 0x7f
 }
 
 // Less implements the btree.Item interface
@@ -131,28 +292,41 @@ func (rl RawLine) Buffer() string {
 	return rl.buf
 }
 
-// DisplayString returns the string to be displayed
+// DisplayString returns the string to be displayed. This may differ
+// from the original line (see NewRawLineWithMaxLength)
 func (rl RawLine) DisplayString() string {
-	if rl.displayString != "" {
-		return rl.displayString
-	}
-
-	if i := rl.sepLoc; i > -1 {
-		rl.displayString = stripANSISequence(rl.buf[:i])
-	} else {
-		rl.displayString = stripANSISequence(rl.buf)
-	}
 	return rl.displayString
 }
 
 // Output returns the string to be displayed *after peco is done
 func (rl RawLine) Output() string {
+	if rl.fieldSpec != nil && rl.fieldSpec.Output > 0 {
+		return rl.fieldSpec.output(rl.Buffer(), rl.fields)
+	}
 	if i := rl.sepLoc; i > -1 {
+		if j := rl.extraLoc; j > -1 {
+			return rl.buf[i+1 : j]
+		}
 		return rl.buf[i+1:]
 	}
 	return rl.buf
 }
 
+// ExtraFields returns the null separated fields after the string to
+// output, or nil if there are none
+func (rl RawLine) ExtraFields() []string {
+	if rl.extraLoc < 0 {
+		return nil
+	}
+	return strings.Split(rl.buf[rl.extraLoc+1:], "\000")
+}
+
+// Fields returns the fields of the line, or nil if the line was not
+// split into fields (see NewRawLineWithFields)
+func (rl RawLine) Fields() []string {
+	return rl.fields
+}
+
 // Indices fulfills the Line interface, but for RawLine it always
 // returns nil
 func (rl RawLine) Indices() [][]int {
@@ -163,14 +337,22 @@ func (rl RawLine) Indices() [][]int {
 type MatchedLine struct {
 	Line
 	indices [][]int
+	match   []int
 }
 
 // NewMatchedLine creates a new MatchedLine
 func NewMatchedLine(rl Line, matches [][]int) *MatchedLine {
-	return &MatchedLine{rl, matches}
+	return &MatchedLine{rl, matches, nil}
 }
 
 // Indices returns the indices in the buffer that matched
 func (ml MatchedLine) Indices() [][]int {
 	return ml.indices
 }
+
+// Match returns the indices of the first match in the display string,
+// followed by the indices of its capture groups, if any (see
+// regexp.FindStringSubmatchIndex). Returns nil if unavailable
+func (ml MatchedLine) Match() []int {
+	return ml.match
+}
@@ -0,0 +1,147 @@
+package peco
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRawLineSanitize(t *testing.T) {
+	tests := []struct {
+		input   string
+		display string
+	}{
+		{"Hello, World!", "Hello, World!"},
+		{"tab\tseparated", "tab\tseparated"},
+		{"日本語", "日本語"},
+		{"invalid \xff\xfe bytes", "invalid �� bytes"},
+		{"truncated \xe6\x97", "truncated ��"},
+		{"\x00\x00\x00", "���"},
+		{"\x1b[31mred\x1b[0m", "red"},
+	}
+
+	for _, test := range tests {
+		l := NewRawLine(test.input, false)
+		if s := l.DisplayString(); s != test.display {
+			t.Errorf("Expected %q to be displayed as %q, got %q", test.input, test.display, s)
+		}
+		if s := l.Output(); s != test.input {
+			t.Errorf("Expected output to be %q, got %q", test.input, s)
+		}
+	}
+
+	// With --null, NUL is a separator, not something to display
+	l := NewRawLine("foo\x00bar", true)
+	if s := l.DisplayString(); s != "foo" {
+		t.Errorf("Expected 'foo', got %q", s)
+	}
+}
+
+func TestRawLineMaxLength(t *testing.T) {
+	huge := strings.Repeat("a", 10*1024*1024)
+	l := NewRawLineWithMaxLength(huge, false, 16*1024)
+	if s := l.DisplayString(); s != huge[:16*1024]+"…" {
+		t.Errorf("Expected display string to be truncated to %d bytes, got %d bytes", 16*1024, len(s))
+	}
+	if s := l.Output(); s != huge {
+		t.Errorf("Expected output to contain the entire line")
+	}
+
+	// Multibyte characters are never split
+	l = NewRawLineWithMaxLength("日本語", false, 4)
+	if s := l.DisplayString(); s != "日…" {
+		t.Errorf("Expected '日…', got %q", s)
+	}
+
+	l = NewRawLineWithMaxLength(huge, false, 0)
+	if s := l.DisplayString(); s != huge {
+		t.Errorf("Expected display string not to be truncated")
+	}
+}
+
+func TestRawLineFields(t *testing.T) {
+	fs, err := NewFieldSpec("", "1,2,5", 3)
+	if err != nil {
+		t.Fatalf("Failed to create FieldSpec: %s", err)
+	}
+
+	// Ragged rows: the lines that lack any of the fields are
+	// displayed/emitted as they are
+	tests := []struct {
+		input   string
+		display string
+		output  string
+		fields  int
+	}{
+		{"a b c d e f", "a b e", "c", 6},
+		{"  a   b\tc d e  ", "a b e", "c", 5},
+		{"a b c", "a b c", "c", 3},
+		{"a b", "a b", "a b", 2},
+		{"", "", "", 0},
+	}
+	for _, test := range tests {
+		l := NewRawLineWithFields(test.input, false, 0, fs)
+		if s := l.DisplayString(); s != test.display {
+			t.Errorf("Expected %q to be displayed as %q, got %q", test.input, test.display, s)
+		}
+		if s := l.Output(); s != test.output {
+			t.Errorf("Expected %q to output %q, got %q", test.input, test.output, s)
+		}
+		if n := len(l.Fields()); n != test.fields {
+			t.Errorf("Expected %q to have %d fields, got %d", test.input, test.fields, n)
+		}
+	}
+
+	// Queries are matched against the fields that are displayed
+	fs, err = NewFieldSpec(`\s*,\s*`, "2", 1)
+	if err != nil {
+		t.Fatalf("Failed to create FieldSpec: %s", err)
+	}
+	f := NewIgnoreCaseFilter()
+	f.SetQuery("bob")
+	for input, matched := range map[string]bool{"1, bob, x": true, "bob, alice": false} {
+		l := NewRawLineWithFields(input, false, 0, fs)
+		if _, err := f.filter(l); (err == nil) != matched {
+			t.Errorf("Expected '%s' matching %q to be %t", f.query, input, matched)
+		}
+	}
+	if s := NewRawLineWithFields("1, bob, x", false, 0, fs).Output(); s != "1" {
+		t.Errorf("Expected '1', got %q", s)
+	}
+
+	for _, args := range [][]string{{"(", ""}, {"", "0"}, {"", "1,x"}} {
+		if _, err := NewFieldSpec(args[0], args[1], 0); err == nil {
+			t.Errorf("Expected NewFieldSpec(%q, %q) to fail", args[0], args[1])
+		}
+	}
+	if fs, err := NewFieldSpec(",", "", 0); err != nil || fs != nil {
+		t.Errorf("Expected no FieldSpec when no fields are requested")
+	}
+}
+
+func TestRawLineExtraFields(t *testing.T) {
+	tests := []struct {
+		input   string
+		display string
+		output  string
+		extra   []string
+	}{
+		{"foo", "foo", "foo", nil},
+		{"foo\x00bar", "foo", "bar", nil},
+		{"foo\x00bar\x00baz\x00qux", "foo", "bar", []string{"baz", "qux"}},
+		{"foo\x00\x00\x00", "foo", "", []string{"", ""}},
+	}
+
+	for _, test := range tests {
+		l := NewRawLine(test.input, true)
+		if s := l.DisplayString(); s != test.display {
+			t.Errorf("Expected %q to be displayed as %q, got %q", test.input, test.display, s)
+		}
+		if s := l.Output(); s != test.output {
+			t.Errorf("Expected %q to output %q, got %q", test.input, test.output, s)
+		}
+		if extra := l.ExtraFields(); !reflect.DeepEqual(extra, test.extra) {
+			t.Errorf("Expected %q to have extra fields %q, got %q", test.input, test.extra, extra)
+		}
+	}
+}
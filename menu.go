@@ -0,0 +1,103 @@
+package peco
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// expandMenuCommand replaces the variables in the command of an
+// ActionMenu entry: $LINES with `lines`, $LINE with `line`, and
+// $QUERY with `query`. The values are quoted for the shell, so that
+// they are passed as a single argument each
+func expandMenuCommand(command string, lines []string, line, query string) string {
+	quoted := make([]string, len(lines))
+	for n, l := range lines {
+		quoted[n] = shellQuote(l)
+	}
+
+	// $LINES must come before $LINE, so that it takes precedence
+	return strings.NewReplacer(
+		"$LINES", strings.Join(quoted, " "),
+		"$LINE", shellQuote(line),
+		"$QUERY", shellQuote(query),
+	).Replace(command)
+}
+
+// suspender is implemented by the screens that can give the terminal
+// back for a while, so that another program can use it
+type suspender interface {
+	// Suspend restores the terminal. Nothing is drawn until Resume
+	Suspend()
+	// Resume takes the terminal over again. The entire screen has to
+	// be redrawn afterwards
+	Resume() error
+}
+
+// suspendScreen gives the terminal up, if the screen can do so (see
+// suspender), until the returned function is called
+func suspendScreen() (resume func() error) {
+	s, ok := screen.(suspender)
+	if !ok {
+		return func() error { return nil }
+	}
+	s.Suspend()
+	return s.Resume
+}
+
+// menuTerminal opens the terminal for the commands run by
+// runShellCommand. Tests replace it, as there may be no terminal
+var menuTerminal = openTerminal
+
+// runShellCommand runs `command` via the shell, and waits for it to
+// finish. The command is attached to the terminal, so that it can be
+// interactive (e.g. an editor), which means that the screen must be
+// suspended meanwhile (see suspendScreen). If the command fails, the
+// error contains the end of what it wrote to stderr
+func runShellCommand(command string) error {
+	in, out, err := menuTerminal()
+	if err != nil {
+		return fmt.Errorf("error: failed to open the terminal: %s", err)
+	}
+	defer in.Close()
+	if out != in {
+		defer out.Close()
+	}
+
+	args := shellCommand(command)
+	cmd := exec.Command(args[0], args[1:]...)
+	stderr := newTailBuffer(stderrLimit)
+	cmd.Stdin = in
+	cmd.Stdout = out
+	cmd.Stderr = io.MultiWriter(out, stderr)
+
+	if err := cmd.Run(); err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			return fmt.Errorf("error: %s", msg)
+		}
+		return fmt.Errorf("error: %s", err)
+	}
+	return nil
+}
+
+// pipeShellCommand runs `command` via the shell with `input` as its
+// standard input, waits for it to finish, and returns its output. If
+// the command fails, the error contains what it wrote to stderr
+func pipeShellCommand(command string, input []byte) ([]byte, error) {
+	args := shellCommand(command)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			return nil, fmt.Errorf("error: %s", msg)
+		}
+		return nil, fmt.Errorf("error: %s", err)
+	}
+	return out, nil
+}
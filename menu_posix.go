@@ -0,0 +1,25 @@
+// +build !windows
+
+package peco
+
+import (
+	"os"
+	"strings"
+)
+
+// shellQuote quotes `s` so that sh (see shellCommand) treats it as a
+// single word
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// openTerminal opens the terminal that peco runs in. Its standard
+// input and output may well be pipes, so the commands that need the
+// terminal are given this instead
+func openTerminal() (in, out *os.File, err error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tty, tty, nil
+}
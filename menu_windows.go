@@ -0,0 +1,28 @@
+package peco
+
+import (
+	"os"
+	"syscall"
+)
+
+// shellQuote quotes `s` so that it is passed to the command that cmd
+// (see shellCommand) runs as a single argument
+func shellQuote(s string) string {
+	return syscall.EscapeArg(s)
+}
+
+// openTerminal opens the console that peco runs in. Its standard
+// input and output may well be pipes, so the commands that need the
+// console are given this instead
+func openTerminal() (in, out *os.File, err error) {
+	in, err = os.Open("CONIN$")
+	if err != nil {
+		return nil, nil, err
+	}
+	out, err = os.OpenFile("CONOUT$", os.O_RDWR, 0)
+	if err != nil {
+		in.Close()
+		return nil, nil, err
+	}
+	return in, out, nil
+}
@@ -4,3 +4,32 @@ import "runtime"
 
 const version = "v0.3.2"
 const isWindows = (runtime.GOOS == "windows")
+
+// commit and buildDate are set when building a release, e.g.
+//
+//	go build -ldflags "-X github.com/peco/peco.commit=$(git rev-parse --short HEAD) -X github.com/peco/peco.buildDate=$(date -u +%Y-%m-%d)" ./cmd/peco
+var (
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// VersionInfo describes the build of peco (see Version)
+type VersionInfo struct {
+	Version   string // the version of peco, e.g. "v0.3.2"
+	Commit    string // the git commit it was built from, or "unknown"
+	BuildDate string // when it was built, or "unknown"
+	GoVersion string // the version of Go it was built with
+	Platform  string // the OS and architecture it was built for, e.g. "linux/amd64"
+}
+
+// Version returns the version of peco, and how it was built. This is
+// what --version prints
+func Version() VersionInfo {
+	return VersionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
@@ -1,11 +1,41 @@
 package peco
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
+// waitForLines waits for the current buffer of `ctx` to hold the lines
+// `expected`, which are the display strings of the lines joined by
+// commas. Returns false if they are not shown within a couple of
+// seconds, in which case the lines that are shown are logged
+func waitForLines(t *testing.T, ctx *Ctx, expected string) bool {
+	t.Helper()
+
+	var shown string
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		names := []string{}
+		for _, l := range ctx.GetCurrentLineBuffer().Snapshot() {
+			names = append(names, l.DisplayString())
+		}
+		if shown = strings.Join(names, ","); shown == expected {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Logf("Expected '%s' to be shown, got '%s'", expected, shown)
+	return false
+}
+
 type interceptorArgs []interface{}
 type interceptor struct {
 	m      sync.Locker
@@ -53,3 +83,204 @@ func TestIDGen(t *testing.T) {
 		sel.Add(l)
 	}
 }
+
+func TestOpenOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files are truncated, and left empty if nothing is written
+	name := filepath.Join(dir, "out")
+	if err := ioutil.WriteFile(name, []byte("stale"), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %s", name, err)
+	}
+	out, err := openOutput(name, -1)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %s", name, err)
+	}
+	out.Close()
+	if buf, _ := ioutil.ReadFile(name); len(buf) != 0 {
+		t.Errorf("Expected %s to be empty, got %q", name, buf)
+	}
+
+	if _, err := openOutput(filepath.Join(dir, "no", "such", "dir"), -1); err == nil {
+		t.Errorf("Expected an unwritable path to be rejected")
+	}
+	if _, err := openOutput("", 9999); err == nil {
+		t.Errorf("Expected a closed file descriptor to be rejected")
+	}
+}
+
+func TestPrintResults(t *testing.T) {
+	send := func(lines ...string) <-chan Line {
+		ch := make(chan Line, len(lines))
+		for _, l := range lines {
+			ch <- NewRawLine(l, false)
+		}
+		close(ch)
+		return ch
+	}
+
+	buf := &bytes.Buffer{}
+	printResults(buf, send("foo", "bar", "foo", "baz\n", "baz"), false, false)
+	if s := buf.String(); s != "foo\nbar\nfoo\nbaz\nbaz\n" {
+		t.Errorf("Expected all lines to be printed, got %q", s)
+	}
+
+	buf.Reset()
+	printResults(buf, send("foo", "bar", "foo", "baz", "baz"), true, false)
+	if s := buf.String(); s != "foo\nbar\nbaz\n" {
+		t.Errorf("Expected each line to be printed once, got %q", s)
+	}
+
+	// With --output-all-fields, the extra fields follow the output
+	ch := make(chan Line, 3)
+	for _, l := range []string{"a", "b\x00c", "d\x00e\x00f\x00g"} {
+		ch <- NewRawLine(l, true)
+	}
+	close(ch)
+	buf.Reset()
+	printResults(buf, ch, false, true)
+	if s := buf.String(); s != "a\nc\ne\x00f\x00g\n" {
+		t.Errorf("Expected the extra fields to be printed, got %q", s)
+	}
+}
+
+func TestPrintWithMarker(t *testing.T) {
+	var lines []Line
+	for _, l := range []string{"foo", "bar", "baz"} {
+		lines = append(lines, NewRawLine(l, false))
+	}
+	ch := make(chan Line, 2)
+	ch <- lines[0]
+	ch <- NewMatchedLine(lines[2], nil)
+	close(ch)
+
+	buf := &bytes.Buffer{}
+	printWithMarker(buf, lines, ch, "* ")
+	if s := buf.String(); s != "* foo\nbar\n* baz\n" {
+		t.Errorf("Expected the selected lines to be marked, got %q", s)
+	}
+}
+
+func TestOutputClosed(t *testing.T) {
+	// Nothing is selected when stdout is closed to begin with
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %s", err)
+	}
+	w.Close()
+	stdout := os.Stdout
+	os.Stdout = w
+	_, err = openOutput("", -1)
+	os.Stdout = stdout
+	if err != ErrOutputClosed {
+		t.Errorf("Expected stdout to be reported as closed, got %v", err)
+	}
+
+	// A pipe whose reader exited is noticed once printing fails
+	r, w, err = os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %s", err)
+	}
+	defer w.Close()
+	r.Close()
+
+	ch := make(chan Line, 1)
+	ch <- NewRawLine("foo", false)
+	close(ch)
+	if err := printResults(w, ch, false, false); !isBrokenPipe(err) {
+		t.Errorf("Expected a broken pipe error, got %v", err)
+	}
+	if ec, ok := ErrOutputClosed.(ExitCoder); !ok || ec.ExitCode() != 141 {
+		t.Errorf("Expected the exit status of SIGPIPE")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	v := Version()
+	if v.Version != version || v.Commit != "unknown" || v.BuildDate != "unknown" {
+		t.Errorf("Expected the version, and unknown build metadata, got %#v", v)
+	}
+	if v.GoVersion != runtime.Version() || v.Platform != runtime.GOOS+"/"+runtime.GOARCH {
+		t.Errorf("Expected the Go version and the platform, got %#v", v)
+	}
+
+	// As stamped by -ldflags
+	defer func(c, d string) { commit, buildDate = c, d }(commit, buildDate)
+	commit, buildDate = "abc1234", "2016-01-02"
+	v = Version()
+	v.GoVersion, v.Platform = "go1.5", "linux/amd64"
+
+	buf := &bytes.Buffer{}
+	if err := printVersion(buf, v, ""); err != nil {
+		t.Fatalf("Failed to print version: %s", err)
+	}
+	expected := "version:    " + version + `
+commit:     abc1234
+build date: 2016-01-02
+go version: go1.5
+platform:   linux/amd64
+rcfile:     none
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	buf.Reset()
+	printVersion(buf, v, "/home/peco/.config/peco/config.json")
+	if !strings.HasSuffix(buf.String(), "\nrcfile:     /home/peco/.config/peco/config.json\n") {
+		t.Errorf("Expected the rcfile to be printed, got:\n%s", buf.String())
+	}
+}
+
+func TestQueryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "query")
+	contents := map[string]string{
+		"":                  "",
+		"\n":                "",
+		"foo bar\n":         "foo bar",
+		"  'quoted' \"q\" ": "'quoted' \"q\"",
+		"first\nsecond\n":   "first",
+		"trailing\r\n":      "trailing",
+	}
+	for c, expected := range contents {
+		if err := ioutil.WriteFile(name, []byte(c), 0644); err != nil {
+			t.Fatalf("Failed to write query file: %s", err)
+		}
+		q, err := readQueryFile(name)
+		if err != nil {
+			t.Errorf("Failed to read %q: %s", c, err)
+			continue
+		}
+		if q != expected {
+			t.Errorf("Expected %q to be read as %q, got %q", c, expected, q)
+		}
+	}
+
+	// A file that doesn't exist yet is an empty query
+	if q, err := readQueryFile(filepath.Join(dir, "missing")); err != nil || q != "" {
+		t.Errorf("Expected a missing file to be an empty query, got %q (%v)", q, err)
+	}
+	if _, err := readQueryFile(dir); err == nil {
+		t.Errorf("Expected reading a directory to fail")
+	}
+
+	// Saved queries are read back as they were
+	for _, q := range []string{"", "foo bar", "it's"} {
+		if err := saveQueryFile(name, q); err != nil {
+			t.Fatalf("Failed to save query: %s", err)
+		}
+		if saved, _ := readQueryFile(name); saved != q {
+			t.Errorf("Expected %q to round trip, got %q", q, saved)
+		}
+	}
+}
@@ -3,9 +3,13 @@ package peco
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // BufferReader reads from either stdin or a file. In case of stdin,
@@ -14,6 +18,12 @@ type BufferReader struct {
 	*Ctx
 	input        io.ReadCloser
 	inputReadyCh chan struct{}
+	cancelCh     chan struct{}   // closed to stop reading
+	doneCh       chan struct{}   // closed once Loop is done
+	onEOF        func()          // called when the entire input has been read
+	reselect     map[string]bool // lines to select as they are read, by their contents
+	truncated    int32           // lines cut short by MaxLineLength. Use atomic operations
+	reported     int32           // the value of truncated that was last shown
 }
 
 // InputReadyCh returns a channel which, when the input starts coming
@@ -22,24 +32,63 @@ func (b *BufferReader) InputReadyCh() <-chan struct{} {
 	return b.inputReadyCh
 }
 
+// WaitInputReady waits until the input starts coming in (or turns
+// out to be empty), or until `timeout` passes. A timeout of 0 or less
+// waits forever. Returns false if the timeout passed
+func (b *BufferReader) WaitInputReady(timeout time.Duration) bool {
+	if timeout <= 0 {
+		<-b.inputReadyCh
+		return true
+	}
+
+	select {
+	case <-b.inputReadyCh:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Cancel stops reading the input, and waits for Loop to return
+func (b *BufferReader) Cancel() {
+	close(b.cancelCh)
+	<-b.doneCh
+}
+
 // Loop keeps reading from the input
 func (b *BufferReader) Loop() {
 	defer b.ReleaseWaitGroup()
+	defer close(b.doneCh)
 	defer func() { recover() }()             // ignore errors
 	defer func() { close(b.inputReadyCh) }() // Make sure to close notifier
 	defer b.input.Close()
 
-	ch := make(chan string, 10)
+	b.setLoading(true)
+	defer b.setLoading(false)
 
-	// scanner.Scan() blocks until the next read or error. But we want our
+	ch := make(chan inputLine, 10)
+
+	// readLine() blocks until the next read or error. But we want our
 	// main loop to be able to exit without blocking, so we move this out
 	// to its own goroutine
 	go func() {
 		defer func() { recover() }()
 		defer func() { close(ch) }()
-		scanner := bufio.NewScanner(b.input)
-		for scanner.Scan() {
-			ch <- scanner.Text()
+		r := bufio.NewReader(b.input)
+		for {
+			in, err := b.readInputLine(r)
+			if err != nil {
+				return
+			}
+			if in.truncated {
+				atomic.AddInt32(&b.truncated, 1)
+			}
+
+			select {
+			case ch <- in:
+			case <-b.cancelCh:
+				return
+			}
 		}
 	}()
 
@@ -58,43 +107,319 @@ func (b *BufferReader) Loop() {
 		}
 
 		refresh = time.AfterFunc(100*time.Millisecond, func() {
+			// The lines read from now on call for another refresh,
+			// even if they are read while the query is being run
+			// again. Otherwise the last lines read could be left out
+			// of the results
+			m.Lock()
+			refresh = nil
+			m.Unlock()
+
+			b.reportTruncated()
 			if !b.ExecQuery() {
 				b.SendDraw()
 			}
-			m.Lock()
-			defer m.Unlock()
-			refresh = nil
 		})
 	}
 
+	// With --unique, the output of every line read is remembered, so
+	// this grows with the number of distinct lines. Unless the output
+	// is a field (--output-field), the keys share their bytes with the
+	// lines themselves, which are kept anyway, so that each entry only
+	// costs the map's own overhead
+	var seen map[string]struct{}
+	if b.unique {
+		seen = make(map[string]struct{})
+	}
+
+	eof := false
 	for loop := true; loop; {
 		select {
 		case <-b.LoopCh():
 			loop = false
-		case line, ok := <-ch:
+		case <-b.cancelCh:
+			return
+		case in, ok := <-ch:
 			if !ok {
+				eof = true
 				loop = false
 				continue
 			}
 
-			if line != "" {
-				// Notify once that we have received something from the file/stdin
-				// This is the cue to start initializing the terminal
-				once.Do(func() { b.inputReadyCh <- struct{}{} })
+			if l, marked := b.newInputLine(in); l != nil {
+				if seen != nil {
+					if _, ok := seen[l.Output()]; ok {
+						continue
+					}
+					seen[l.Output()] = struct{}{}
+				}
+
+				// The line is read before it is added, as it may be
+				// changed (e.g. marked dirty) from then on
+				selected := marked || b.reselect[l.Buffer()]
 
 				// Make sure we lock access to b.lines
 				m.Lock()
-				b.AddRawLine(NewRawLine(line, b.enableSep))
+				b.AddRawLine(l)
 				m.Unlock()
+
+				if selected {
+					b.mutex.Lock()
+					b.selection.Add(l)
+					b.mutex.Unlock()
+				}
+
+				// Notify once that we have received something from the file/stdin
+				// This is the cue to start initializing the terminal. It's done
+				// after the line is added, so that an empty buffer once the input
+				// is ready means that the input was empty
+				once.Do(func() { b.inputReadyCh <- struct{}{} })
 			}
 
 			doDelayedDraw()
 		}
 	}
 
+	if eof {
+		b.reportTruncated()
+	}
+	if eof && b.onEOF != nil {
+		b.onEOF()
+		return
+	}
+
 	// Out of the reader loop. If at this point we have no buffer,
 	// that means we have no buffer, so we should quit.
 	if b.GetRawLineBufferSize() == 0 {
 		b.ExitWith(errors.New("no buffer to work with was available"))
 	}
 }
+
+// teeReader writes everything that is read from the input to a file
+// as is (--tee). If writing fails, the input is still read, and
+// onError is called once
+type teeReader struct {
+	io.ReadCloser
+	w       io.WriteCloser
+	onError func(error)
+	err     error
+}
+
+func newTeeReader(r io.ReadCloser, w io.WriteCloser, onError func(error)) *teeReader {
+	return &teeReader{ReadCloser: r, w: w, onError: onError}
+}
+
+func (t *teeReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 && t.err == nil {
+		if _, werr := t.w.Write(p[:n]); werr != nil {
+			t.err = werr
+			t.onError(werr)
+		}
+	}
+	return n, err
+}
+
+// Close closes both the input and the file
+func (t *teeReader) Close() error {
+	werr := t.w.Close()
+	if err := t.ReadCloser.Close(); err != nil {
+		return err
+	}
+	return werr
+}
+
+// inputLine is a line read by BufferReader, before it is processed
+type inputLine struct {
+	text      string
+	truncated bool // true if the line was longer than MaxLineLength
+}
+
+// readInputLine reads the next line from `r`, cut at MaxLineLength
+// unless FullOutput is set. Unless KeepCarriageReturn is set, the CR
+// that ends CRLF terminated lines is stripped, which is almost always
+// what we want. Returns io.EOF once there are no more lines
+func (c *Ctx) readInputLine(r *bufio.Reader) (inputLine, error) {
+	max := c.config.MaxLineLength
+	if c.config.FullOutput {
+		max = 0
+	}
+
+	line, truncated, err := readLine(r, max)
+	if err != nil {
+		return inputLine{}, err
+	}
+	if !truncated && !c.config.KeepCarriageReturn && len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return inputLine{string(line), truncated}, nil
+}
+
+// newInputLine turns a line read from the input into a RawLine: --trim
+// is applied, the --select-marker prefix is removed (in which case
+// `marked` is true), and then the line goes through the line
+// transformer. Returns nil if nothing is left of the line
+func (c *Ctx) newInputLine(in inputLine) (l *RawLine, marked bool) {
+	line := in.text
+	if c.trim {
+		line = trimFields(line, c.nullSepOn())
+	}
+
+	// With --select-marker, the marker is not part of the line
+	if c.selectMarker != "" && strings.HasPrefix(line, c.selectMarker) {
+		line = line[len(c.selectMarker):]
+		marked = true
+	}
+
+	if c.transformLine != nil {
+		line = c.transformLine(line)
+	}
+	if line == "" {
+		return nil, false
+	}
+
+	l = NewRawLineWithFields(line, c.nullSepOn(), c.config.MaxLineLength, c.fieldSpec)
+	if c.trimDisplay {
+		l.trimDisplayString()
+	}
+	if in.truncated {
+		l.markTruncated()
+	}
+	return l, marked
+}
+
+// readLine reads the next line from `r`, without the LF that ends it.
+// Lines of any length are read, but only the first `max` bytes are
+// kept (unless `max` is 0 or less), in which case `truncated` is true.
+// A multibyte character is never split: the line is cut before it.
+// Returns io.EOF once there are no more lines
+func readLine(r *bufio.Reader, max int) (line []byte, truncated bool, err error) {
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if err == nil {
+			chunk = chunk[:len(chunk)-1]
+		}
+		if !truncated && max > 0 && len(line)+len(chunk) > max {
+			n := max - len(line)
+			for n > 0 && !utf8.RuneStart(chunk[n]) {
+				n--
+			}
+			chunk = chunk[:n]
+			truncated = true
+		} else if truncated {
+			chunk = nil
+		}
+		line = append(line, chunk...)
+
+		switch {
+		case err == nil:
+			return line, truncated, nil
+		case err == bufio.ErrBufferFull:
+			// The line goes on
+		case len(line) > 0 || truncated:
+			// The last line is not terminated by LF
+			return line, truncated, nil
+		default:
+			return nil, false, err
+		}
+	}
+}
+
+// reportTruncated shows how many lines were cut short by
+// MaxLineLength so far, unless that was already shown
+func (b *BufferReader) reportTruncated() {
+	n := atomic.LoadInt32(&b.truncated)
+	if atomic.SwapInt32(&b.reported, n) == n {
+		return
+	}
+
+	if n == 1 {
+		b.SendStatusMsg("1 oversized line truncated")
+	} else {
+		b.SendStatusMsg(fmt.Sprintf("%d oversized lines truncated", n))
+	}
+}
+
+// OpenInputFiles opens the files specified in `names`, and returns a
+// reader that yields the lines of each file, one after another. If
+// `printSource` is true, each line is prefixed with the name of the
+// file that it came from, followed by a colon. Compressed files are
+// decompressed on the fly (see openInputFile)
+func OpenInputFiles(names []string, printSource bool) (io.ReadCloser, error) {
+	files := make([]io.ReadCloser, 0, len(names))
+	for _, name := range names {
+		f, err := openInputFile(name)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	if len(files) == 1 && !printSource {
+		return files[0], nil
+	}
+	return newConcatReader(files, names, printSource), nil
+}
+
+// concatReader concatenates the lines from multiple sources. Unlike
+// io.MultiReader, it makes sure that the last line of a source is
+// never joined with the first line of the next one
+type concatReader struct {
+	*io.PipeReader
+	sources []io.ReadCloser
+}
+
+func newConcatReader(sources []io.ReadCloser, names []string, printSource bool) *concatReader {
+	pr, pw := io.Pipe()
+	go func() {
+		var err error
+		defer func() { pw.CloseWithError(err) }()
+
+		for i, src := range sources {
+			var prefix string
+			if printSource {
+				prefix = names[i] + ":"
+			}
+			if err = copyLines(pw, src, prefix); err != nil {
+				return
+			}
+			src.Close()
+		}
+	}()
+	return &concatReader{pr, sources}
+}
+
+// Close closes the reader, as well as all of the sources
+func (r *concatReader) Close() error {
+	for _, src := range r.sources {
+		src.Close()
+	}
+	return r.PipeReader.Close()
+}
+
+// copyLines copies the lines from `src` to `dst`, prefixing each line
+// with `prefix` and terminating each line with a newline
+func copyLines(dst io.Writer, src io.Reader, prefix string) error {
+	rdr := bufio.NewReader(src)
+	for {
+		line, err := rdr.ReadString('\n')
+		if len(line) > 0 {
+			if line[len(line)-1] != '\n' {
+				line = line + "\n"
+			}
+			if _, werr := io.WriteString(dst, prefix+line); werr != nil {
+				return werr
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -1,11 +1,18 @@
 package peco
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -39,3 +46,689 @@ func TestReader(t *testing.T) {
 		t.Errorf("Expected 3 lines from input, only got %d", ctx.GetRawLineBufferSize())
 	}
 }
+
+func TestOpenInputFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Note that the first file does not end with a newline
+	foo := filepath.Join(dir, "foo")
+	bar := filepath.Join(dir, "bar")
+	ioutil.WriteFile(foo, []byte("1. Foo\n2. Foo"), 0644)
+	ioutil.WriteFile(bar, []byte("1. Bar\n"), 0644)
+
+	expected := map[bool]string{
+		false: "1. Foo\n2. Foo\n1. Bar\n",
+		true:  foo + ":1. Foo\n" + foo + ":2. Foo\n" + bar + ":1. Bar\n",
+	}
+	for printSource, v := range expected {
+		in, err := OpenInputFiles([]string{foo, bar}, printSource)
+		if err != nil {
+			t.Fatalf("Failed to open input files: %s", err)
+		}
+		buf, err := ioutil.ReadAll(in)
+		in.Close()
+		if err != nil {
+			t.Errorf("Failed to read input files: %s", err)
+		}
+		if string(buf) != v {
+			t.Errorf("Expected %q, got %q", v, buf)
+		}
+	}
+
+	if _, err := OpenInputFiles([]string{foo, filepath.Join(dir, "nonexistent")}, false); err == nil {
+		t.Errorf("Expected error when opening a file that does not exist")
+	}
+}
+
+func TestOpenCompressedFiles(t *testing.T) {
+	testOpenCompressedFile(t, "lines.gz", map[string][]byte{
+		"corrupt.gz": append([]byte{0x1f, 0x8b}, "not really gzip"...),
+		// No extension, but the magic bytes tell us it's gzip
+		"corrupt": append([]byte{0x1f, 0x8b}, "not really gzip"...),
+	}, gzip.ErrHeader.Error())
+}
+
+func TestOpenZstdFiles(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not available")
+	}
+
+	// The error is what zstd reports about its input, rather than its
+	// exit status
+	testOpenCompressedFile(t, "lines.zst", map[string][]byte{
+		"corrupt.zst": append([]byte{0x28, 0xb5, 0x2f, 0xfd}, "not really zstd"...),
+		// No extension, but the magic bytes tell us it's zstd
+		"corrupt": append([]byte{0x28, 0xb5, 0x2f, 0xfd}, "not really zstd"...),
+	}, "*stdin*")
+}
+
+// testOpenCompressedFile checks that the file `name` in testdata is
+// decompressed, and that each of the `corrupt` files fails to open
+// with an error that contains `reason`
+func testOpenCompressedFile(t *testing.T, name string, corrupt map[string][]byte, reason string) {
+	in, err := openInputFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("Failed to open %s: %s", name, err)
+	}
+	buf, err := ioutil.ReadAll(in)
+	in.Close()
+	if err != nil {
+		t.Errorf("Failed to read %s: %s", name, err)
+	}
+	if string(buf) != "1. Foo\n2. Bar\n3. Baz\n" {
+		t.Errorf("Unexpected contents in %s: %q", name, buf)
+	}
+
+	dir, err := ioutil.TempDir("", "peco-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range corrupt {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, content, 0644)
+		in, err := openInputFile(path)
+		if err == nil {
+			in.Close()
+			t.Errorf("Expected error when opening %s", name)
+			continue
+		}
+
+		prefix := "error: failed to decompress " + path + ": "
+		if msg := err.Error(); !strings.HasPrefix(msg, prefix) || !strings.Contains(msg, reason) {
+			t.Errorf("Expected '%s' to fail with '%s...%s', got '%s'", name, prefix, reason, msg)
+		}
+	}
+}
+
+func TestOpenSpecialFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if in, err := openInputFile(dir); err == nil || !strings.Contains(err.Error(), "is a directory") {
+		if in != nil {
+			in.Close()
+		}
+		t.Errorf("Expected a directory to be rejected, got %v", err)
+	}
+
+	// Reads the lines from `name` like peco does, and returns them
+	// once the input is ready (see --exit-0)
+	readLines := func(name string) []string {
+		in, err := openInputFile(name)
+		if err != nil {
+			t.Errorf("Failed to open %s: %s", name, err)
+			return nil
+		}
+		ctx := NewCtx(nil)
+		rdr := ctx.NewBufferReader(in)
+		ctx.AddWaitGroup(1)
+		rdr.Loop()
+		if !rdr.WaitInputReady(time.Second) {
+			t.Errorf("Expected %s to be ready", name)
+		}
+
+		var lines []string
+		for _, l := range ctx.rawLineBuffer.Snapshot() {
+			lines = append(lines, l.Buffer())
+		}
+		return lines
+	}
+
+	empty := filepath.Join(dir, "empty")
+	ioutil.WriteFile(empty, nil, 0644)
+	if lines := readLines(empty); len(lines) != 0 {
+		t.Errorf("Expected no lines from an empty file, got %q", lines)
+	}
+
+	// Devices other than terminals are read as usual
+	if fi, err := os.Stat(os.DevNull); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		if lines := readLines(os.DevNull); len(lines) != 0 {
+			t.Errorf("Expected no lines from %s, got %q", os.DevNull, lines)
+		}
+	}
+
+	if _, err := exec.LookPath("mkfifo"); err != nil {
+		t.Logf("mkfifo not available, skipping named pipes")
+		return
+	}
+	fifo := filepath.Join(dir, "fifo")
+	if err := exec.Command("mkfifo", fifo).Run(); err != nil {
+		t.Fatalf("Failed to create %s: %s", fifo, err)
+	}
+	go func() {
+		// Blocks until the pipe is opened for reading
+		if f, err := os.OpenFile(fifo, os.O_WRONLY, 0); err == nil {
+			io.WriteString(f, "foo\nbar\n")
+			f.Close()
+		}
+	}()
+	if lines := readLines(fifo); strings.Join(lines, ",") != "foo,bar" {
+		t.Errorf("Expected 'foo' and 'bar' from a named pipe, got %q", lines)
+	}
+}
+
+func TestReaderCarriageReturn(t *testing.T) {
+	input := "1. Foo\r\n2. Bar\n3. Baz\x00baz\r\n4. Qux\r"
+
+	expected := map[bool][]string{
+		false: {"1. Foo", "2. Bar", "baz", "4. Qux"},
+		true:  {"1. Foo\r", "2. Bar", "baz\r", "4. Qux\r"},
+	}
+	for keep, outputs := range expected {
+		ctx := NewCtx(nil)
+		ctx.setNullSep(true)
+		ctx.config.KeepCarriageReturn = keep
+		rdr := ctx.NewBufferReader(ioutil.NopCloser(strings.NewReader(input)))
+		ctx.AddWaitGroup(1)
+		rdr.Loop()
+
+		lines := ctx.rawLineBuffer.Snapshot()
+		if len(lines) != len(outputs) {
+			t.Errorf("Expected %d lines, got %d", len(outputs), len(lines))
+			continue
+		}
+		for i, l := range lines {
+			if l.Output() != outputs[i] {
+				t.Errorf("KeepCarriageReturn = %t: expected output %q, got %q", keep, outputs[i], l.Output())
+			}
+			if !keep && strings.ContainsRune(l.DisplayString(), '\r') {
+				t.Errorf("Expected CR not to be displayed, got %q", l.DisplayString())
+			}
+		}
+	}
+}
+
+// repeatReader yields the same byte forever
+type repeatReader byte
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestReaderLongLines(t *testing.T) {
+	read := func(ctx *Ctx, r io.Reader) []Line {
+		rdr := ctx.NewBufferReader(ioutil.NopCloser(r))
+		ctx.AddWaitGroup(1)
+		rdr.Loop()
+		return ctx.rawLineBuffer.Snapshot()
+	}
+
+	// Lines longer than bufio's buffer are read in one piece, without
+	// stopping there
+	ctx := NewCtx(nil)
+	huge := strings.Repeat("x", 1<<20)
+	lines := read(ctx, strings.NewReader("before\n"+huge+"\r\nafter"))
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %d", len(lines))
+	}
+	if lines[1].Output() != huge || lines[2].Output() != "after" {
+		t.Errorf("Expected the long line to be read as is")
+	}
+	select {
+	case r := <-ctx.StatusMsgCh():
+		t.Errorf("Expected no lines to be truncated, got '%s'", r.DataInterface().(StatusMsgRequest).message)
+	default:
+	}
+
+	// Longer than MaxLineLength, the rest of the line is thrown away,
+	// rather than held in memory
+	const max = 16 << 20
+	ctx = NewCtx(nil)
+	ctx.config.MaxLineLength = max
+	input := io.MultiReader(
+		io.LimitReader(repeatReader('y'), 100<<20),
+		strings.NewReader("\nshort\n"),
+		io.LimitReader(repeatReader('z'), max+1),
+	)
+	lines = read(ctx, input)
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %d", len(lines))
+	}
+	for i, expected := range []string{
+		strings.Repeat("y", max),
+		"short",
+		strings.Repeat("z", max),
+	} {
+		if l := lines[i].Output(); l != expected {
+			t.Errorf("Expected line %d to be %d bytes long, got %d bytes", i, len(expected), len(l))
+		}
+	}
+	// The lines truncated so far may be reported while reading
+	var msg string
+	for done := false; !done; {
+		select {
+		case r := <-ctx.StatusMsgCh():
+			msg = r.DataInterface().(StatusMsgRequest).message
+		case <-time.After(200 * time.Millisecond):
+			done = true
+		}
+	}
+	if msg != "2 oversized lines truncated" {
+		t.Errorf("Expected the truncated lines to be reported, got '%s'", msg)
+	}
+
+	// Multibyte characters are never split
+	ctx = NewCtx(nil)
+	ctx.config.MaxLineLength = 4
+	lines = read(ctx, strings.NewReader("日本語\nab日本語\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(lines))
+	}
+	for i, expected := range []string{"日", "ab"} {
+		if l := lines[i].Output(); l != expected {
+			t.Errorf("Expected line %d to be cut down to '%s', got '%s'", i, expected, l)
+		}
+	}
+}
+
+func TestReaderTruncationMarker(t *testing.T) {
+	tests := []struct {
+		fullOutput bool
+		display    string
+		output     string
+	}{
+		// --max-line-length 5
+		{false, "abcde\u2026", "abcde"},
+		// --max-line-length 5 --full-output
+		{true, "abcde\u2026", "abcdefgh"},
+	}
+	for _, test := range tests {
+		ctx := NewCtx(nil)
+		ctx.config.MaxLineLength = 5
+		ctx.config.FullOutput = test.fullOutput
+		rdr := ctx.NewBufferReader(ioutil.NopCloser(strings.NewReader("abcdefgh\nabc\n")))
+		ctx.AddWaitGroup(1)
+		rdr.Loop()
+
+		lines := ctx.rawLineBuffer.Snapshot()
+		if len(lines) != 2 {
+			t.Fatalf("Expected 2 lines, got %d", len(lines))
+		}
+		if d, o := lines[0].DisplayString(), lines[0].Output(); d != test.display || o != test.output {
+			t.Errorf("Expected '%s' to be displayed and '%s' output, got '%s' and '%s'", test.display, test.output, d, o)
+		}
+		if d := lines[1].DisplayString(); d != "abc" {
+			t.Errorf("Expected a short line to be displayed as is, got '%s'", d)
+		}
+
+		// The marker stays when the line is split again
+		if d := lines[0].(*RawLine).resplit(true, 5).DisplayString(); d != test.display {
+			t.Errorf("Expected '%s' to be displayed once split again, got '%s'", test.display, d)
+		}
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	if err := CheckEncoding("no-such-encoding"); err == nil {
+		t.Errorf("Expected unknown encoding to be rejected")
+	}
+	if err := CheckEncoding("LATIN1"); err != nil {
+		t.Errorf("Expected LATIN1 to be accepted: %s", err)
+	}
+
+	in, err := NewDecodingReader(ioutil.NopCloser(bytes.NewBufferString("caf\xe9\n")), "LATIN1")
+	if err != nil {
+		t.Fatalf("Failed to create decoding reader: %s", err)
+	}
+	buf, err := ioutil.ReadAll(in)
+	in.Close()
+	if err != nil {
+		t.Errorf("Failed to read: %s", err)
+	}
+	if string(buf) != "café\n" {
+		t.Errorf("Expected 'café', got %q", buf)
+	}
+
+	out := &bytes.Buffer{}
+	w, err := NewEncodingWriter(out, "LATIN1")
+	if err != nil {
+		t.Fatalf("Failed to create encoding writer: %s", err)
+	}
+	io.WriteString(w, "café\n")
+	if err := w.Close(); err != nil {
+		t.Errorf("Failed to encode: %s", err)
+	}
+	if out.String() != "caf\xe9\n" {
+		t.Errorf("Expected latin1 'café', got %q", out.Bytes())
+	}
+
+	in, err = NewDecodingReader(ioutil.NopCloser(bytes.NewBufferString("\x83\x79\x83\x52\n")), "Shift_JIS")
+	if err != nil {
+		t.Fatalf("Failed to create decoding reader: %s", err)
+	}
+	if buf, _ := ioutil.ReadAll(in); string(buf) != "ペコ\n" {
+		t.Errorf("Expected 'ペコ', got %q", buf)
+	}
+
+	// Characters that latin1 doesn't have can't be output
+	w, _ = NewEncodingWriter(&bytes.Buffer{}, "LATIN1")
+	_, err = io.WriteString(w, "ペコ\n")
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		t.Errorf("Expected an error for characters that can't be encoded")
+	}
+}
+
+func TestLoadingIndicator(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	ctx.config.ShowLoadingIndicator = true
+	st := NewStatusBar(ctx, AnchorBottom, 0)
+
+	r, w := io.Pipe()
+	rdr := ctx.NewBufferReader(r)
+	done := make(chan struct{})
+	ctx.AddWaitGroup(1)
+	go func() {
+		defer close(done)
+		rdr.Loop()
+	}()
+
+	io.WriteString(w, "1. Foo\n2. Bar\n")
+	<-rdr.InputReadyCh()
+	time.Sleep(50 * time.Millisecond)
+
+	if !ctx.IsLoading() {
+		t.Errorf("Expected input to be loading")
+	}
+	if msg := st.idleMessage(); !strings.HasSuffix(msg, " loading… 2 lines") {
+		t.Errorf("Expected loading indicator, got '%s'", msg)
+	}
+
+	w.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected reader to finish")
+	}
+
+	if ctx.IsLoading() {
+		t.Errorf("Expected input to be done loading")
+	}
+	if msg := st.idleMessage(); msg != "" {
+		t.Errorf("Expected no idle message, got '%s'", msg)
+	}
+}
+
+func TestOpenCommand(t *testing.T) {
+	if _, err := exec.LookPath(shellCommand("")[0]); err != nil {
+		t.Skip("shell not available")
+	}
+
+	in, err := OpenCommand("echo foo; echo bar")
+	if err != nil {
+		t.Fatalf("Failed to run command: %s", err)
+	}
+	buf, err := ioutil.ReadAll(in)
+	in.Close()
+	if err != nil {
+		t.Errorf("Failed to read: %s", err)
+	}
+	if string(buf) != "foo\nbar\n" {
+		t.Errorf("Expected 'foo\\nbar\\n', got %q", buf)
+	}
+
+	// No output is not an error by itself
+	in, err = OpenCommand("true")
+	if err != nil {
+		t.Fatalf("Expected a command with no output to succeed: %s", err)
+	}
+	in.Close()
+
+	// Failures are reported before anything is read
+	_, err = OpenCommand("echo oops >&2; exit 1")
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("Expected the error from the command, got %v", err)
+	}
+
+	// Only the end of what is written to stderr is kept
+	_, err = OpenCommand("i=0; while [ $i -lt 1000 ]; do echo 'lots of noise' >&2; i=$((i+1)); done; echo oops >&2; exit 1")
+	if err == nil || !strings.HasSuffix(err.Error(), "lots of noise\noops") || len(err.Error()) > 2*stderrLimit {
+		t.Errorf("Expected the end of the error from the command, got %d bytes", len(err.Error()))
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	b := newTailBuffer(5)
+	for _, s := range []string{"abc", "de", "fg", "hijklmn", "o"} {
+		if n, err := b.Write([]byte(s)); n != len(s) || err != nil {
+			t.Errorf("Expected %d bytes to be written, got %d (%v)", len(s), n, err)
+		}
+	}
+	if s := string(b.Bytes()); s != "klmno" {
+		t.Errorf("Expected 'klmno' to be kept, got '%s'", s)
+	}
+}
+
+func TestReaderUnique(t *testing.T) {
+	ctx := NewCtx(nil)
+	ctx.unique = true
+	rdr := ctx.NewBufferReader(ioutil.NopCloser(strings.NewReader("a\nb\na\nc\nb\n")))
+	ctx.AddWaitGroup(1)
+	rdr.Loop()
+
+	expected := []string{"a", "b", "c"}
+	lines := ctx.rawLineBuffer.Snapshot()
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %d", len(expected), len(lines))
+	}
+	for i, l := range lines {
+		if l.Output() != expected[i] {
+			t.Errorf("Expected line %d to be '%s', got '%s'", i, expected[i], l.Output())
+		}
+	}
+}
+
+func TestReaderTrim(t *testing.T) {
+	input := "  foo  \n   \n\tbar\x00 baz \n"
+	tests := []struct {
+		trim, trimDisplay, enableSep bool
+		display, output              []string
+	}{
+		{false, true, false, []string{"foo", "", "bar\ufffd baz"}, []string{"  foo  ", "   ", "\tbar\x00 baz "}},
+		{true, false, false, []string{"foo", "bar\ufffd baz"}, []string{"foo", "bar\x00 baz"}},
+		{true, false, true, []string{"foo", "bar"}, []string{"foo", "baz"}},
+		{false, true, true, []string{"foo", "", "bar"}, []string{"  foo  ", "   ", " baz "}},
+	}
+
+	for _, test := range tests {
+		ctx := NewCtx(nil)
+		ctx.trim = test.trim
+		ctx.trimDisplay = test.trimDisplay
+		ctx.setNullSep(test.enableSep)
+		rdr := ctx.NewBufferReader(ioutil.NopCloser(strings.NewReader(input)))
+		ctx.AddWaitGroup(1)
+		rdr.Loop()
+
+		lines := ctx.rawLineBuffer.Snapshot()
+		if len(lines) != len(test.output) {
+			t.Errorf("Expected %d lines, got %d (%#v)", len(test.output), len(lines), test)
+			continue
+		}
+		for i, l := range lines {
+			if l.DisplayString() != test.display[i] || l.Output() != test.output[i] {
+				t.Errorf("Expected line %d to be displayed as %q and output as %q, got %q and %q",
+					i, test.display[i], test.output[i], l.DisplayString(), l.Output())
+			}
+		}
+	}
+}
+
+func TestReaderSelectMarker(t *testing.T) {
+	ctx := NewCtx(CLIOptions{OptSelectMarker: "* "})
+	rdr := ctx.NewBufferReader(ioutil.NopCloser(strings.NewReader("* foo\nbar\n*baz\n* \n* qux\n")))
+	ctx.AddWaitGroup(1)
+	rdr.Loop()
+
+	expected := []string{"foo", "bar", "*baz", "qux"}
+	lines := ctx.rawLineBuffer.Snapshot()
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %d", len(expected), len(lines))
+	}
+	for i, l := range lines {
+		if l.DisplayString() != expected[i] || l.Output() != expected[i] {
+			t.Errorf("Expected line %d to be '%s', got '%s'", i, expected[i], l.Output())
+		}
+	}
+
+	if ctx.SelectionLen() != 2 || !ctx.SelectionContains(0) || !ctx.SelectionContains(3) {
+		t.Errorf("Expected 'foo' and 'qux' to be selected")
+	}
+}
+
+func TestStartupTimeout(t *testing.T) {
+	ctx := NewCtx(nil)
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	rdr := ctx.NewBufferReader(pr)
+	ctx.AddWaitGroup(1)
+	go rdr.Loop()
+
+	if rdr.WaitInputReady(50 * time.Millisecond) {
+		t.Errorf("Expected to time out while nothing is written")
+	}
+
+	// Cancel must not hang even though the input is still open
+	done := make(chan struct{})
+	go func() {
+		rdr.Cancel()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the reader to be canceled")
+	}
+
+	pr, pw = io.Pipe()
+	defer pw.Close()
+	rdr = ctx.NewBufferReader(pr)
+	ctx.AddWaitGroup(1)
+	go rdr.Loop()
+	go io.WriteString(pw, "foo\n")
+	if !rdr.WaitInputReady(time.Second) {
+		t.Errorf("Expected input to be ready")
+	}
+	rdr.Cancel()
+}
+
+func TestInputReadyWithEmptyInput(t *testing.T) {
+	// Once the input is ready, the buffer is empty only if the
+	// input was empty
+	for input, size := range map[string]int{"": 0, "\n\n": 0, "foo\n": 1} {
+		ctx := NewCtx(nil)
+		rdr := ctx.NewBufferReader(ioutil.NopCloser(strings.NewReader(input)))
+		rdr.onEOF = func() {}
+		ctx.AddWaitGroup(1)
+		go rdr.Loop()
+
+		if !rdr.WaitInputReady(time.Second) {
+			t.Fatalf("Expected input %q to be ready", input)
+		}
+		if n := ctx.GetRawLineBufferSize(); (n == 0) != (size == 0) {
+			t.Errorf("Expected %d lines once %q is ready, got %d", size, input, n)
+		}
+		rdr.Cancel()
+	}
+
+	var err error = emptyInputError(3)
+	if ec, ok := err.(ExitCoder); !ok || ec.ExitCode() != 3 {
+		t.Errorf("Expected the exit status to be 3")
+	}
+}
+
+func TestReaderLineTransformer(t *testing.T) {
+	ctx := NewCtx(CLIOptions{OptSelectMarker: "* "})
+	ctx.SetLineTransformer(func(raw string) string {
+		if raw == "drop" {
+			return ""
+		}
+		return strings.ToUpper(raw)
+	})
+	rdr := ctx.NewBufferReader(ioutil.NopCloser(strings.NewReader("foo\n* bar\ndrop\n")))
+	ctx.AddWaitGroup(1)
+	rdr.Loop()
+
+	lines := ctx.rawLineBuffer.Snapshot()
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(lines))
+	}
+	for i, expected := range []string{"FOO", "BAR"} {
+		if lines[i].Buffer() != expected {
+			t.Errorf("Expected line %d to be %q, got %q", i, expected, lines[i].Buffer())
+		}
+	}
+	if !ctx.SelectionHas(lines[1]) {
+		t.Errorf("Expected the marked line to be selected")
+	}
+}
+
+// failingWriter fails every write after the first `ok` bytes
+type failingWriter struct {
+	bytes.Buffer
+	ok     int
+	closed bool
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.Len()+len(p) > w.ok {
+		return 0, errors.New("disk full")
+	}
+	return w.Buffer.Write(p)
+}
+
+func (w *failingWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestTeeReader(t *testing.T) {
+	input := "foo\r\nbar\x00baz\n\nqux"
+
+	w := &failingWriter{ok: 1 << 20}
+	var errs []error
+	tee := newTeeReader(ioutil.NopCloser(strings.NewReader(input)), w, func(err error) { errs = append(errs, err) })
+	ctx := NewCtx(nil)
+	rdr := ctx.NewBufferReader(tee)
+	go func(ch <-chan struct{}) { <-ch }(rdr.InputReadyCh())
+	ctx.AddWaitGroup(1)
+	rdr.Loop()
+
+	if w.String() != input || !w.closed || len(errs) != 0 {
+		t.Errorf("Expected the input to be written as is and closed, got %q (closed = %t, errors = %v)", w.String(), w.closed, errs)
+	}
+	if n := ctx.GetRawLineBufferSize(); n != 3 {
+		t.Errorf("Expected 3 lines to be read, got %d", n)
+	}
+
+	// Errors are reported once, and the input is still read
+	w = &failingWriter{ok: 0}
+	errs = nil
+	tee = newTeeReader(ioutil.NopCloser(iotest.OneByteReader(strings.NewReader(input))), w, func(err error) { errs = append(errs, err) })
+	ctx = NewCtx(nil)
+	rdr = ctx.NewBufferReader(tee)
+	go func(ch <-chan struct{}) { <-ch }(rdr.InputReadyCh())
+	ctx.AddWaitGroup(1)
+	rdr.Loop()
+
+	if len(errs) != 1 {
+		t.Errorf("Expected the error to be reported once, got %v", errs)
+	}
+	if n := ctx.GetRawLineBufferSize(); n != 3 {
+		t.Errorf("Expected 3 lines to be read, got %d", n)
+	}
+}
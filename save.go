@@ -0,0 +1,43 @@
+package peco
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+// WriteLines writes the output of each line in `lines` to the file
+// `name`, one per line. Unless `overwrite` is true, it is an error
+// for the file to exist already
+func WriteLines(name string, lines []Line, overwrite bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+
+	f, err := os.OpenFile(name, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("error: failed to save lines: %s", err)
+	}
+
+	w := bufio.NewWriter(f)
+	for _, l := range lines {
+		line := l.Output()
+		if len(line) == 0 || line[len(line)-1] != '\n' {
+			line = line + "\n"
+		}
+		if _, err := w.WriteString(line); err != nil {
+			f.Close()
+			return fmt.Errorf("error: failed to save lines: %s", err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("error: failed to save lines: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error: failed to save lines: %s", err)
+	}
+	return nil
+}
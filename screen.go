@@ -1,73 +1,161 @@
 package peco
 
-import "github.com/nsf/termbox-go"
-
-// Screen hides termbox from the consuming code so that
-// it can be swapped out for testing
+// Screen hides the terminal library from the consuming code, so
+// that it can be swapped out for testing (or for another library).
+// Only the types defined in this file are passed through it
 type Screen interface {
+	Init() error
+	Close()
 	Flush() error
-	PollEvent() chan termbox.Event
-	SetCell(int, int, rune, termbox.Attribute, termbox.Attribute)
+	PollEvent() chan Event
+	SetCell(int, int, rune, Attribute, Attribute)
+	SetCursor(int, int)
+	HideCursor()
+	SetInputMode(InputMode)
 	Size() (int, int)
-	SendEvent(termbox.Event)
+	SendEvent(Event)
 }
 
-// Termbox just hands out the processing to the termbox library
-type Termbox struct{}
-
-// termbox always gives us some sort of warning when we run
-// go run -race cmd/peco/peco.go
-var termboxMutex = newMutex()
+type (
+	// Attribute is the color of a cell, optionally combined with
+	// text attributes using bitwise OR ('|')
+	Attribute uint16
+	// Key is a special key (such as Enter or C-a) that was pressed
+	Key uint16
+	// Modifier is a modifier key that was held down
+	Modifier uint8
+	// EventType tells what an Event is about
+	EventType uint8
+	// InputMode controls how Esc and Alt are reported
+	InputMode int
+)
 
-// SendEvent is used to allow programmers generate random
-// events, but it's only useful for testing purposes.
-// When interactiving with termbox-go, this method is a noop
-func (t Termbox) SendEvent(_ termbox.Event) {
-	// no op
+// Event is an input event. The Mod, Key and Ch fields are valid if
+// Type is EventKey. The Width and Height fields are valid if Type is
+// EventResize. The Err field is valid if Type is EventError.
+type Event struct {
+	Type   EventType
+	Mod    Modifier
+	Key    Key  // invalid if Ch is not 0
+	Ch     rune // the character that was typed
+	Width  int
+	Height int
+	Err    error
 }
 
-// Flush calls termbox.Flush
-func (t Termbox) Flush() error {
-	termboxMutex.Lock()
-	defer termboxMutex.Unlock()
-	return termbox.Flush()
-}
+// Colors. Only one color can be used at a time
+const (
+	ColorDefault Attribute = iota
+	ColorBlack
+	ColorRed
+	ColorGreen
+	ColorYellow
+	ColorBlue
+	ColorMagenta
+	ColorCyan
+	ColorWhite
+)
 
-// PollEvent returns a channel that you can listen to for
-// termbox's events. The actual polling is done in a 
-// separate gouroutine
-func (t Termbox) PollEvent() chan termbox.Event {
-	// XXX termbox.PollEvent() can get stuck on unexpected signal
-	// handling cases. We still would like to wait until the user
-	// (termbox) has some event for us to process, but we don't
-	// want to allow termbox to control/block our input loop.
-	//
-	// Solution: put termbox polling in a separate goroutine,
-	// and we just watch for a channel. The loop can now
-	// safely be implemented in terms of select {} which is
-	// safe from being stuck.
-	evCh := make(chan termbox.Event)
-	go func() {
-		defer func() { recover() }()
-		defer func() { close(evCh) }()
-		for {
-			evCh <- termbox.PollEvent()
-		}
-	}()
-	return evCh
+// Text attributes, which can be combined with each other and with
+// a color
+const (
+	AttrBold Attribute = 1 << (iota + 9)
+	AttrUnderline
+	AttrReverse
+)
 
-}
+// ModAlt is set in Event.Mod if the Alt key was held down
+const ModAlt Modifier = 1
 
-// SetCell writes to the terminal
-func (t Termbox) SetCell(x, y int, ch rune, fg, bg termbox.Attribute) {
-	termboxMutex.Lock()
-	defer termboxMutex.Unlock()
-	termbox.SetCell(x, y, ch, fg, bg)
-}
+// Event types
+const (
+	EventKey EventType = iota
+	EventResize
+	EventMouse
+	EventError
+	EventInterrupt
+	EventRaw
+	EventNone
+)
 
-// Size returns the dimensions of the current terminal
-func (t Termbox) Size() (int, int) {
-	termboxMutex.Lock()
-	defer termboxMutex.Unlock()
-	return termbox.Size()
-}
+// Input modes. See Screen.SetInputMode
+const (
+	InputEsc InputMode = 1 << iota
+	InputAlt
+)
+
+// Special keys. Control keys have the values of the corresponding
+// control characters, and the others count down from 0xFFFF
+const (
+	KeyF1 Key = 0xFFFF - iota
+	KeyF2
+	KeyF3
+	KeyF4
+	KeyF5
+	KeyF6
+	KeyF7
+	KeyF8
+	KeyF9
+	KeyF10
+	KeyF11
+	KeyF12
+	KeyInsert
+	KeyDelete
+	KeyHome
+	KeyEnd
+	KeyPgup
+	KeyPgdn
+	KeyArrowUp
+	KeyArrowDown
+	KeyArrowLeft
+	KeyArrowRight
+)
+
+const (
+	KeyCtrlTilde      Key = 0x00
+	KeyCtrl2          Key = 0x00
+	KeyCtrlSpace      Key = 0x00
+	KeyCtrlA          Key = 0x01
+	KeyCtrlB          Key = 0x02
+	KeyCtrlC          Key = 0x03
+	KeyCtrlD          Key = 0x04
+	KeyCtrlE          Key = 0x05
+	KeyCtrlF          Key = 0x06
+	KeyCtrlG          Key = 0x07
+	KeyBackspace      Key = 0x08
+	KeyCtrlH          Key = 0x08
+	KeyTab            Key = 0x09
+	KeyCtrlI          Key = 0x09
+	KeyCtrlJ          Key = 0x0A
+	KeyCtrlK          Key = 0x0B
+	KeyCtrlL          Key = 0x0C
+	KeyEnter          Key = 0x0D
+	KeyCtrlM          Key = 0x0D
+	KeyCtrlN          Key = 0x0E
+	KeyCtrlO          Key = 0x0F
+	KeyCtrlP          Key = 0x10
+	KeyCtrlQ          Key = 0x11
+	KeyCtrlR          Key = 0x12
+	KeyCtrlS          Key = 0x13
+	KeyCtrlT          Key = 0x14
+	KeyCtrlU          Key = 0x15
+	KeyCtrlV          Key = 0x16
+	KeyCtrlW          Key = 0x17
+	KeyCtrlX          Key = 0x18
+	KeyCtrlY          Key = 0x19
+	KeyCtrlZ          Key = 0x1A
+	KeyEsc            Key = 0x1B
+	KeyCtrlLsqBracket Key = 0x1B
+	KeyCtrl3          Key = 0x1B
+	KeyCtrl4          Key = 0x1C
+	KeyCtrlBackslash  Key = 0x1C
+	KeyCtrl5          Key = 0x1D
+	KeyCtrlRsqBracket Key = 0x1D
+	KeyCtrl6          Key = 0x1E
+	KeyCtrl7          Key = 0x1F
+	KeyCtrlSlash      Key = 0x1F
+	KeyCtrlUnderscore Key = 0x1F
+	KeySpace          Key = 0x20
+	KeyBackspace2     Key = 0x7F
+	KeyCtrl8          Key = 0x7F
+)
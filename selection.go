@@ -1,24 +1,181 @@
 package peco
 
-import "github.com/google/btree"
+import (
+	"sort"
+
+	"github.com/google/btree"
+)
+
+// These are the orders in which the selected lines can be output
+const (
+	// SelectionOrderBuffer outputs the lines in the order they were read
+	SelectionOrderBuffer = "buffer"
+	// SelectionOrderPick outputs the lines in the order they were selected
+	SelectionOrderPick = "pick"
+)
+
+// IsValidSelectionOrder checks if a string is a supported selection order
+func IsValidSelectionOrder(v string) bool {
+	return v == SelectionOrderBuffer || v == SelectionOrderPick
+}
 
 // Selection stores the line ids that were selected by the user.
 // The contents of the Selection is always sorted from smallest to
-// largest line ID
-type Selection struct{ *btree.BTree }
+// largest line ID.
+//
+// Lines are identified by their ID alone, which is assigned in the
+// order the lines were read, and never by their contents. Identical
+// lines in the input are therefore selected independently
+type Selection struct {
+	*btree.BTree
+	max    int            // the maximum number of lines, or 0 for no limit
+	group  int            // the group that lines are added to
+	groups map[uint64]int // the group of each line by ID, unless it is 0
+	picked map[uint64]int // when each line was selected, by ID
+	seq    int            // incremented for every line selected
+}
 
 // NewSelection creates a new empty Selection
 func NewSelection() *Selection {
-	return &Selection{btree.New(32)}
+	return NewLimitedSelection(0)
+}
+
+// NewLimitedSelection creates a new empty Selection that holds at
+// most `max` lines (--max-select). If `max` is 0 or less, there is
+// no limit
+func NewLimitedSelection(max int) *Selection {
+	return &Selection{btree.New(32), max, 0, map[uint64]int{}, map[uint64]int{}, 0}
 }
 
 // Add adds a new line to the selection. If the line already
-// exists in the selection, it is silently ignored
-func (s *Selection) Add(l Line) {
-	s.ReplaceOrInsert(l)
+// exists in the selection, it is silently ignored. Returns false
+// if the line could not be added because the selection is full.
+// New lines are added to the current group (see SetGroup)
+func (s *Selection) Add(l Line) bool {
+	if s.IsFull() && !s.Has(l) {
+		return false
+	}
+	if s.ReplaceOrInsert(l) != nil {
+		return true
+	}
+
+	s.seq++
+	s.picked[l.ID()] = s.seq
+
+	if s.group == 0 {
+		delete(s.groups, l.ID())
+	} else {
+		s.groups[l.ID()] = s.group
+	}
+	return true
+}
+
+// SetGroup sets the group that lines are added to from now on.
+// Groups let lines be selected in several batches, which are told
+// apart by their color, and output one after the other
+func (s *Selection) SetGroup(group int) {
+	s.group = group
+}
+
+// CurrentGroup returns the group that lines are added to
+func (s *Selection) CurrentGroup() int {
+	return s.group
+}
+
+// Group returns the group of a line in the selection
+func (s *Selection) Group(l Line) int {
+	return s.groups[l.ID()]
+}
+
+// GroupedLines returns the lines in the selection, group by group.
+// Within a group, lines are sorted by their ID
+func (s *Selection) GroupedLines() []Line {
+	var groups [][]Line
+	s.Ascend(func(it btree.Item) bool {
+		l := it.(Line)
+		g := s.Group(l)
+		for len(groups) <= g {
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], l)
+		return true
+	})
+
+	lines := make([]Line, 0, s.Len())
+	for _, g := range groups {
+		lines = append(lines, g...)
+	}
+	return lines
+}
+
+// OrderedLines returns the lines in the selection like GroupedLines,
+// except that within a group, lines are sorted by `position` (see
+// peco.MoveLineUp)
+func (s *Selection) OrderedLines(position func(Line) uint64) []Line {
+	lines := s.GroupedLines()
+	sort.Stable(positionOrder{lines, s, position})
+	return lines
+}
+
+// positionOrder sorts lines by group, then by position
+type positionOrder struct {
+	lines    []Line
+	sel      *Selection
+	position func(Line) uint64
+}
+
+func (p positionOrder) Len() int      { return len(p.lines) }
+func (p positionOrder) Swap(i, j int) { p.lines[i], p.lines[j] = p.lines[j], p.lines[i] }
+func (p positionOrder) Less(i, j int) bool {
+	a, b := p.lines[i], p.lines[j]
+	if ga, gb := p.sel.Group(a), p.sel.Group(b); ga != gb {
+		return ga < gb
+	}
+	return p.position(a) < p.position(b)
+}
+
+// PickedLines returns the lines in the selection like GroupedLines,
+// except that within a group, lines are sorted by when they were
+// selected (--selection-order pick)
+func (s *Selection) PickedLines() []Line {
+	lines := s.GroupedLines()
+	sort.Stable(pickOrder{lines, s})
+	return lines
+}
+
+// pickOrder sorts lines by group, then by when they were selected
+type pickOrder struct {
+	lines []Line
+	sel   *Selection
+}
+
+func (p pickOrder) Len() int      { return len(p.lines) }
+func (p pickOrder) Swap(i, j int) { p.lines[i], p.lines[j] = p.lines[j], p.lines[i] }
+func (p pickOrder) Less(i, j int) bool {
+	a, b := p.lines[i], p.lines[j]
+	if ga, gb := p.sel.Group(a), p.sel.Group(b); ga != gb {
+		return ga < gb
+	}
+	return p.sel.picked[a.ID()] < p.sel.picked[b.ID()]
+}
+
+// IsFull returns true if no more lines can be added
+func (s *Selection) IsFull() bool {
+	return s.max > 0 && s.Len() >= s.max
+}
+
+// Max returns the maximum number of lines, or 0 if there is no limit
+func (s *Selection) Max() int {
+	return s.max
 }
 
 // Remove removes the specified line from the selection
 func (s *Selection) Remove(l Line) {
 	s.Delete(l)
+	delete(s.picked, l.ID())
+}
+
+// Has returns true if the specified line is in the selection
+func (s *Selection) Has(l Line) bool {
+	return s.BTree.Has(l)
 }
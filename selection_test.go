@@ -1,6 +1,15 @@
 package peco
 
-import "testing"
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/btree"
+)
 
 func TestSelection(t *testing.T) {
 	s := NewSelection()
@@ -23,3 +32,273 @@ func TestSelection(t *testing.T) {
 		t.Errorf("expected Len = 1, got %d", s.Len())
 	}
 }
+
+func TestSelectionOfDuplicateLines(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+
+	ctx := newCtx(nil, 25)
+	ctx.config.Style.SavedSelection = Style{fg: ColorDefault, bg: ColorCyan}
+	for n := 0; n < 100; n++ {
+		ctx.AddRawLine(NewRawLine("same", false))
+	}
+	input := ctx.NewInput()
+
+	selected := map[int]bool{3: true, 50: true, 97: true}
+	for _, n := range []int{3, 50, 97, 60} {
+		input.currentLine = n
+		doToggleSelection(input, Event{})
+	}
+	// Toggling a line off leaves its duplicates alone
+	input.currentLine = 60
+	doToggleSelection(input, Event{})
+
+	if ctx.SelectionLen() != len(selected) {
+		t.Errorf("Expected %d lines to be selected, got %d", len(selected), ctx.SelectionLen())
+	}
+	for n := 0; n < 100; n++ {
+		if ctx.SelectionContains(n) != selected[n] {
+			t.Errorf("Expected line %d selected = %t", n, selected[n])
+		}
+	}
+
+	// Only the selected rows are drawn in the selection style. Row 0
+	// is the prompt, and the cursor is on line 0
+	ctx.currentLine = 0
+	NewDefaultLayout(ctx).DrawScreen()
+	bgs := map[int]Attribute{} // the last background drawn at the start of each row
+	for _, args := range i.events["SetCell"] {
+		if x, y := args[0].(int), args[1].(int); x == 0 && y >= 2 && y <= 98 {
+			bgs[y] = args[4].(Attribute)
+		}
+	}
+	if len(bgs) != 97 {
+		t.Errorf("Expected 97 rows to be drawn, got %d", len(bgs))
+	}
+	for y, bg := range bgs {
+		if isSelected := bg == ColorCyan; isSelected != selected[y-1] {
+			t.Errorf("Expected row for line %d drawn as selected = %t", y-1, selected[y-1])
+		}
+	}
+
+	var ids []uint64
+	ctx.selection.Ascend(func(it btree.Item) bool {
+		ids = append(ids, it.(Line).ID())
+		return true
+	})
+	finish(input)
+	count := 0
+	for _ = range ctx.ResultCh() {
+		count++
+	}
+	if count != len(selected) {
+		t.Errorf("Expected %d lines to be emitted, got %d", len(selected), count)
+	}
+	if len(ids) != 3 || ids[0] >= ids[1] || ids[1] >= ids[2] {
+		t.Errorf("Expected 3 distinct lines in input order, got %v", ids)
+	}
+}
+
+func TestMaxSelect(t *testing.T) {
+	ctx := NewCtx(CLIOptions{OptMaxSelect: 2})
+	for _, l := range []string{"Alice", "Bob", "Charlie", "Dave"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	input := ctx.NewInput()
+
+	warned := func() bool {
+		select {
+		case r := <-ctx.StatusMsgCh():
+			return r.DataInterface().(StatusMsgRequest).message == "Cannot select more than 2 lines"
+		default:
+			return false
+		}
+	}
+
+	for n := 0; n < 3; n++ {
+		ctx.currentLine = n
+		doToggleSelection(input, Event{})
+	}
+	if ctx.SelectionLen() != 2 || ctx.SelectionContains(2) || !warned() {
+		t.Errorf("Expected the third line to be refused with a warning")
+	}
+	if s := ctx.NewView().layout.(*BasicLayout).prompt.resultCount(); !strings.HasSuffix(s, " 2/2 selected") {
+		t.Errorf("Expected the result count to show '2/2 selected', got '%s'", s)
+	}
+
+	// Toggling a selected line off makes room again
+	ctx.currentLine = 0
+	doToggleSelection(input, Event{})
+	ctx.currentLine = 3
+	doToggleSelection(input, Event{})
+	if ctx.SelectionLen() != 2 || !ctx.SelectionContains(3) {
+		t.Errorf("Expected a line to be selectable once another one is unselected")
+	}
+
+	doSelectNone(input, Event{})
+	doSelectAll(input, Event{})
+	if ctx.SelectionLen() != 2 || !ctx.SelectionContains(0) || !ctx.SelectionContains(1) || !warned() {
+		t.Errorf("Expected SelectAll to select the first 2 lines")
+	}
+
+	// Bob, Charlie and Dave are not selected, but only 2 fit
+	ctx.SelectionClear()
+	ctx.SelectionAdd(0)
+	doInvertSelection(input, Event{})
+	if ctx.SelectionLen() != 2 || ctx.SelectionContains(0) || !ctx.SelectionContains(1) || !ctx.SelectionContains(2) {
+		t.Errorf("Expected InvertSelection to select Bob and Charlie")
+	}
+
+	ctx.SelectionClear()
+	ctx.SelectionAddRange(0, 3)
+	if ctx.SelectionLen() != 2 || !warned() {
+		t.Errorf("Expected a range to be cut short at 2 lines")
+	}
+
+	s := NewLimitedSelection(1)
+	alice, bob := NewRawLine("Alice", false), NewRawLine("Bob", false)
+	if !s.Add(alice) || !s.Add(alice) || s.Add(bob) {
+		t.Errorf("Expected a selection of 1 line to only hold Alice")
+	}
+}
+
+func TestSelectionWhileReading(t *testing.T) {
+	ctx := newCtx(nil, 25)
+	ctx.selectMarker = "* "
+	input := ctx.NewInput()
+	go func() {
+		for range ctx.DrawCh() {
+		}
+	}()
+
+	// Marked lines are selected by the reader while lines are
+	// selected and deselected from the input
+	buf := &bytes.Buffer{}
+	for n := 0; n < 500; n++ {
+		if n%2 == 0 {
+			buf.WriteString("* ")
+		}
+		fmt.Fprintf(buf, "line %d\n", n)
+	}
+	rdr := ctx.NewBufferReader(ioutil.NopCloser(buf))
+	go func(ch <-chan struct{}) { <-ch }(rdr.InputReadyCh())
+	ctx.AddWaitGroup(1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rdr.Loop()
+	}()
+
+	for n := 0; n < 100; n++ {
+		doToggleSelection(input, Event{})
+		doSelectAll(input, Event{})
+		doInvertSelection(input, Event{})
+	}
+	<-done
+
+	doSelectNone(input, Event{})
+	doSelectAll(input, Event{})
+	if n := ctx.SelectionLen(); n != 500 {
+		t.Errorf("Expected all 500 lines to be selected, got %d", n)
+	}
+}
+
+func TestSelectionGroups(t *testing.T) {
+	i, guard := setDummyScreen()
+	defer guard()
+
+	ctx := newCtx(nil, 25)
+	for _, l := range []string{"Alice", "Bob", "Charlie", "Dave"} {
+		ctx.AddRawLine(NewRawLine(l, false))
+	}
+	input := ctx.NewInput()
+
+	// Bob and Dave go into the first group, Alice into the second,
+	// and Charlie into the third
+	for _, n := range []int{1, 3} {
+		ctx.SelectionAdd(n)
+	}
+	doCycleSelectionGroup(input, Event{})
+	ctx.SelectionAdd(0)
+	ctx.SelectionAdd(1) // already selected, stays in its group
+	doCycleSelectionGroup(input, Event{})
+	ctx.SelectionAdd(2)
+
+	var names []string
+	for _, l := range ctx.selection.GroupedLines() {
+		names = append(names, l.DisplayString())
+	}
+	if s := strings.Join(names, ","); s != "Bob,Dave,Alice,Charlie" {
+		t.Errorf("Expected the lines to be grouped as 'Bob,Dave,Alice,Charlie', got '%s'", s)
+	}
+
+	// There are two SelectionGroups styles by default, so there are
+	// three groups in all
+	if g := ctx.CycleSelectionGroup(); g != 0 {
+		t.Errorf("Expected to cycle back to the first group, got %d", g)
+	}
+	ctx.CycleSelectionGroup()
+	ctx.SelectionClear()
+	if g := ctx.selection.CurrentGroup(); g != 1 {
+		t.Errorf("Expected the group to be kept when the selection is cleared, got %d", g)
+	}
+
+	// Each group is drawn in its own style
+	ctx.SelectionClear()
+	ctx.selection.SetGroup(0)
+	ctx.SelectionAdd(1)
+	ctx.selection.SetGroup(1)
+	ctx.SelectionAdd(2)
+	ctx.selection.SetGroup(2)
+	ctx.SelectionAdd(3)
+	NewDefaultLayout(ctx).DrawScreen()
+	bgs := map[int]Attribute{}
+	for _, args := range i.events["SetCell"] {
+		if x, y := args[0].(int), args[1].(int); x == 0 && y >= 2 && y <= 4 {
+			bgs[y] = args[4].(Attribute)
+		}
+	}
+	expected := map[int]Attribute{
+		2: ctx.config.Style.SavedSelection.bg,
+		3: ctx.config.SelectionGroups[0].bg,
+		4: ctx.config.SelectionGroups[1].bg,
+	}
+	if !reflect.DeepEqual(bgs, expected) {
+		t.Errorf("Expected backgrounds %v, got %v", expected, bgs)
+	}
+}
+
+func TestSelectionOrder(t *testing.T) {
+	for _, order := range []string{SelectionOrderBuffer, SelectionOrderPick} {
+		ctx := newCtx(CLIOptions{OptSelectionOrder: order}, 25)
+		for _, l := range []string{"Alice", "Bob", "Charlie", "Dave", "Eve"} {
+			ctx.AddRawLine(NewRawLine(l, false))
+		}
+		input := ctx.NewInput()
+
+		// Eve is selected again after being deselected, and Bob goes
+		// into the second group
+		for _, n := range []int{3, 4, 0} {
+			ctx.SelectionAdd(n)
+		}
+		ctx.SelectionRemove(4)
+		ctx.SelectionAdd(4)
+		ctx.SelectionAdd(3) // already selected, keeps its place
+		doCycleSelectionGroup(input, Event{})
+		ctx.SelectionAdd(1)
+
+		finish(input)
+		var names []string
+		for l := range input.resultCh {
+			names = append(names, l.DisplayString())
+		}
+
+		expected := "Alice,Dave,Eve,Bob"
+		if order == SelectionOrderPick {
+			expected = "Dave,Alice,Eve,Bob"
+		}
+		if s := strings.Join(names, ","); s != expected {
+			t.Errorf("Expected the lines to be output as '%s' with --selection-order %s, got '%s'", expected, order, s)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// +build !windows
+
+package peco
+
+import (
+	"os"
+	"syscall"
+)
+
+// resizeSignals are the signals that notify us that the terminal
+// has been resized
+var resizeSignals = []os.Signal{syscall.SIGWINCH}
+
+// brokenPipeSignals are the signals that are sent when writing to a
+// pipe that was closed
+var brokenPipeSignals = []os.Signal{syscall.SIGPIPE}
+
+// brokenPipeErrors are the errors returned when writing to a pipe
+// that was closed
+var brokenPipeErrors = []error{syscall.EPIPE}
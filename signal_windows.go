@@ -0,0 +1,20 @@
+package peco
+
+import (
+	"os"
+	"syscall"
+)
+
+// resizeSignals are the signals that notify us that the terminal
+// has been resized. Windows doesn't have SIGWINCH, so we rely on
+// the resize events from the screen
+var resizeSignals = []os.Signal{}
+
+// brokenPipeSignals are the signals that are sent when writing to a
+// pipe that was closed. There are none on Windows
+var brokenPipeSignals = []os.Signal{}
+
+// brokenPipeErrors are the errors returned when writing to a pipe
+// that was closed. ERROR_NO_DATA (232) is returned while the pipe is
+// being closed
+var brokenPipeErrors = []error{syscall.ERROR_BROKEN_PIPE, syscall.Errno(232), syscall.EPIPE}
@@ -0,0 +1,35 @@
+package peco
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// shellCommand returns the command line that runs `command` via
+// the shell
+func shellCommand(command string) []string {
+	if runtime.GOOS == "windows" {
+		return []string{"cmd", "/c", command}
+	}
+	return []string{"sh", "-c", command}
+}
+
+// OpenCommand runs `command` via the shell, and returns a reader for
+// its output. Like openInputFile, it waits for the first output of
+// the command before returning, so that the command failing is
+// reported before the UI starts
+func OpenCommand(command string) (io.ReadCloser, error) {
+	args := shellCommand(command)
+	rdr, closer, err := newCommandReader(nil, args[0], args[1:]...)
+	if err != nil {
+		return nil, fmt.Errorf("error: failed to run '%s': %s", command, err)
+	}
+
+	if _, err := rdr.Peek(1); err != nil && err != io.EOF {
+		closer()
+		return nil, fmt.Errorf("error: failed to run '%s': %s", command, err)
+	}
+
+	return &readCloser{rdr, closer}, nil
+}
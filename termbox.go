@@ -0,0 +1,203 @@
+package peco
+
+import (
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/keyseq"
+)
+
+// Termbox just hands out the processing to the termbox library.
+// This is the only place where termbox is used directly
+type Termbox struct{}
+
+// termbox always gives us some sort of warning when we run
+// go run -race cmd/peco/peco.go
+var termboxMutex = newMutex()
+
+// Init initializes termbox
+func (t Termbox) Init() error {
+	return termbox.Init()
+}
+
+// Close restores the terminal. Note that calling it twice blocks
+func (t Termbox) Close() {
+	termbox.Close()
+}
+
+// termboxInputMode is the input mode that was last set, which is set
+// again when the screen is resumed
+var termboxInputMode termbox.InputMode
+
+// Suspend restores the terminal, so that another program can use it.
+// termboxMutex is held until Resume, so that nothing is drawn on the
+// terminal in the meantime
+func (t Termbox) Suspend() {
+	termboxMutex.Lock()
+	termbox.Close()
+}
+
+// Resume takes the terminal over again after Suspend
+func (t Termbox) Resume() error {
+	defer termboxMutex.Unlock()
+	if err := termbox.Init(); err != nil {
+		return err
+	}
+	termbox.SetInputMode(termboxInputMode)
+	return nil
+}
+
+// SendEvent is used to allow programmers generate random
+// events, but it's only useful for testing purposes.
+// When interactiving with termbox-go, this method is a noop
+func (t Termbox) SendEvent(_ Event) {
+	// no op
+}
+
+// Flush calls termbox.Flush
+func (t Termbox) Flush() error {
+	termboxMutex.Lock()
+	defer termboxMutex.Unlock()
+	return termbox.Flush()
+}
+
+// PollEvent returns a channel that you can listen to for
+// termbox's events. The actual polling is done in a
+// separate gouroutine
+func (t Termbox) PollEvent() chan Event {
+	// XXX termbox.PollEvent() can get stuck on unexpected signal
+	// handling cases. We still would like to wait until the user
+	// (termbox) has some event for us to process, but we don't
+	// want to allow termbox to control/block our input loop.
+	//
+	// Solution: put termbox polling in a separate goroutine,
+	// and we just watch for a channel. The loop can now
+	// safely be implemented in terms of select {} which is
+	// safe from being stuck.
+	evCh := make(chan Event)
+	go func() {
+		defer func() { recover() }()
+		defer func() { close(evCh) }()
+		for {
+			evCh <- fromTermboxEvent(termbox.PollEvent())
+		}
+	}()
+	return evCh
+
+}
+
+// TerminalSize asks the terminal for its current size. Size only
+// changes once termbox redraws the screen, so it can't tell that the
+// terminal was resized if the resize was not reported
+func (t Termbox) TerminalSize() (int, int, error) {
+	return ttySize()
+}
+
+// SetCell writes to the terminal
+func (t Termbox) SetCell(x, y int, ch rune, fg, bg Attribute) {
+	termboxMutex.Lock()
+	defer termboxMutex.Unlock()
+	termbox.SetCell(x, y, ch, toTermboxAttribute(fg), toTermboxAttribute(bg))
+}
+
+// SetCursor moves the terminal cursor to (x, y)
+func (t Termbox) SetCursor(x, y int) {
+	termboxMutex.Lock()
+	defer termboxMutex.Unlock()
+	termbox.SetCursor(x, y)
+}
+
+// HideCursor hides the terminal cursor
+func (t Termbox) HideCursor() {
+	termboxMutex.Lock()
+	defer termboxMutex.Unlock()
+	termbox.HideCursor()
+}
+
+// SetInputMode sets how termbox reports Esc and Alt
+func (t Termbox) SetInputMode(mode InputMode) {
+	termboxMutex.Lock()
+	defer termboxMutex.Unlock()
+
+	var m termbox.InputMode
+	if mode&InputEsc != 0 {
+		m |= termbox.InputEsc
+	}
+	if mode&InputAlt != 0 {
+		m |= termbox.InputAlt
+	}
+	termbox.SetInputMode(m)
+	termboxInputMode = m
+}
+
+// Size returns the dimensions of the current terminal
+func (t Termbox) Size() (int, int) {
+	termboxMutex.Lock()
+	defer termboxMutex.Unlock()
+	return termbox.Size()
+}
+
+// toTermboxAttribute converts our attributes to termbox's, whose
+// text attributes use different bits depending on the version
+func toTermboxAttribute(a Attribute) termbox.Attribute {
+	ta := termbox.Attribute(a & colorMask)
+	if a&AttrBold != 0 {
+		ta |= termbox.AttrBold
+	}
+	if a&AttrUnderline != 0 {
+		ta |= termbox.AttrUnderline
+	}
+	if a&AttrReverse != 0 {
+		ta |= termbox.AttrReverse
+	}
+	return ta
+}
+
+// Our keys have the same values as termbox's, so they can be
+// converted as they are
+func fromTermboxEvent(ev termbox.Event) Event {
+	e := Event{
+		Type:   EventType(ev.Type),
+		Key:    Key(ev.Key),
+		Ch:     ev.Ch,
+		Width:  ev.Width,
+		Height: ev.Height,
+		Err:    ev.Err,
+	}
+	if ev.Mod&termbox.ModAlt != 0 {
+		e.Mod |= ModAlt
+	}
+	return e
+}
+
+func toTermboxEvent(ev Event) termbox.Event {
+	e := termbox.Event{
+		Type:   termbox.EventType(ev.Type),
+		Key:    termbox.Key(ev.Key),
+		Ch:     ev.Ch,
+		Width:  ev.Width,
+		Height: ev.Height,
+		Err:    ev.Err,
+	}
+	if ev.Mod&ModAlt != 0 {
+		e.Mod |= termbox.ModAlt
+	}
+	return e
+}
+
+// The keyseq package describes keys in terms of termbox's key codes.
+// These convert our keys and events to keyseq's
+
+func toKeyseqKey(k Key) keyseq.Key {
+	return keyseq.NewKeyFromKey(termbox.Key(k))
+}
+
+func eventToKeyseqKey(ev Event) keyseq.Key {
+	modifier := keyseq.ModNone
+	if (ev.Mod & ModAlt) != 0 {
+		modifier = keyseq.ModAlt
+	}
+	return keyseq.Key{Modifier: modifier, Key: termbox.Key(ev.Key), Ch: ev.Ch}
+}
+
+func eventToString(ev Event) (string, error) {
+	return keyseq.EventToString(toTermboxEvent(ev))
+}
@@ -0,0 +1,149 @@
+package peco
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// traceEnabled is checked before anything else in trace(), so that
+// when tracing is off we don't even pay for formatting the message
+var traceEnabled int32
+
+var traceMutex = &sync.Mutex{}
+var tracer *log.Logger
+var traceOutput io.Closer
+
+// EnableDebugLog opens the file at `path` and routes all trace
+// messages to it. Each message is prefixed with a timestamp, the
+// id of the goroutine that emitted it, and the subsystem it came from
+func EnableDebugLog(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	setTraceOutput(f, f)
+	trace("==== INITIALIZED tracer (peco %s) ====", version)
+	return nil
+}
+
+// DisableDebugLog stops tracing, and closes the file opened by
+// EnableDebugLog, if any
+func DisableDebugLog() {
+	setTraceOutput(nil, nil)
+}
+
+func setTraceOutput(w io.Writer, c io.Closer) {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+
+	atomic.StoreInt32(&traceEnabled, 0)
+	if traceOutput != nil {
+		traceOutput.Close()
+	}
+
+	traceOutput = c
+	if w == nil {
+		tracer = nil
+		return
+	}
+
+	tracer = log.New(w, "peco: ", log.LstdFlags|log.Lmicroseconds)
+	atomic.StoreInt32(&traceEnabled, 1)
+}
+
+func trace(f string, args ...interface{}) {
+	if atomic.LoadInt32(&traceEnabled) == 0 {
+		return
+	}
+
+	subsystem := "-"
+	if pc, _, _, ok := runtime.Caller(1); ok {
+		if fn := runtime.FuncForPC(pc); fn != nil {
+			subsystem = traceSubsystem(fn.Name())
+		}
+	}
+
+	prefix := "[g" + strconv.FormatUint(goroutineID(), 10) + "] [" + subsystem + "] "
+
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	if tracer == nil {
+		return
+	}
+	tracer.Printf(prefix+f, args...)
+}
+
+// goroutineID extracts the id of the current goroutine from the
+// header of runtime.Stack(). Go deliberately doesn't expose this,
+// so it's only meant to be used for debugging
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i > 0 {
+		buf = buf[:i]
+	}
+	id, _ := strconv.ParseUint(string(buf), 10, 64)
+	return id
+}
+
+// traceSubsystems maps the name of the type (or function) that
+// emitted a trace message to the subsystem that it belongs to
+var traceSubsystems = map[string]string{
+	"Ctx":                "ctx",
+	"signalHandler":      "ctx",
+	"Hub":                "hub",
+	"send":               "hub",
+	"Filter":             "filter",
+	"FilterSet":          "filter",
+	"RegexpFilter":       "filter",
+	"ExternalCmdFilter":  "filter",
+	"View":               "view",
+	"BasicLayout":        "view",
+	"ListArea":           "view",
+	"UserPrompt":         "view",
+	"StatusBar":          "view",
+	"verticalScroll":     "view",
+	"horizontalScroll":   "view",
+	"Input":              "input",
+	"Keymap":             "input",
+	"BufferReader":       "reader",
+	"RawLineBuffer":      "buffer",
+	"FilteredLineBuffer": "buffer",
+	"acceptPipeline":     "buffer",
+}
+
+// traceSubsystem converts a fully qualified function name such as
+// "github.com/peco/peco.(*Ctx).ExecQuery" into a subsystem name
+func traceSubsystem(fn string) string {
+	if i := strings.LastIndex(fn, "/"); i > -1 {
+		fn = fn[i+1:]
+	}
+	if i := strings.IndexByte(fn, '.'); i > -1 {
+		fn = fn[i+1:]
+	}
+
+	name := fn
+	if i := strings.IndexByte(fn, '.'); i > -1 {
+		name = fn[:i]
+	}
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "(*"), ")")
+
+	if s, ok := traceSubsystems[name]; ok {
+		return s
+	}
+
+	// Actions are all named doXXX, and are invoked from Input
+	if strings.HasPrefix(name, "do") {
+		return "input"
+	}
+	return "-"
+}
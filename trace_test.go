@@ -0,0 +1,60 @@
+package peco
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTraceSubsystem(t *testing.T) {
+	tests := map[string]string{
+		"github.com/peco/peco.(*Ctx).ExecQuery":              "ctx",
+		"github.com/peco/peco.(*Filter).Work":                "filter",
+		"github.com/peco/peco.(*RawLineBuffer).Replay.func1": "buffer",
+		"github.com/peco/peco.(*ListArea).Draw":              "view",
+		"github.com/peco/peco.doFinish":                      "input",
+		"github.com/peco/peco.send":                          "hub",
+		"github.com/peco/peco.unknownFunction":               "-",
+	}
+
+	for fn, expected := range tests {
+		if s := traceSubsystem(fn); s != expected {
+			t.Errorf("Expected subsystem for %s to be '%s', got '%s'", fn, expected, s)
+		}
+	}
+}
+
+func TestDebugLog(t *testing.T) {
+	f, err := ioutil.TempFile("", "peco-test-debuglog")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %s", err)
+	}
+	fn := f.Name()
+	f.Close()
+	defer os.Remove(fn)
+
+	trace("this should not be logged")
+
+	if err := EnableDebugLog(fn); err != nil {
+		t.Fatalf("Failed to enable debug log: %s", err)
+	}
+	NewCtx(nil).SetQuery([]rune("Hello, World!"))
+	DisableDebugLog()
+
+	trace("this should not be logged either")
+
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Failed to read debug log: %s", err)
+	}
+
+	content := string(buf)
+	if strings.Contains(content, "should not be logged") {
+		t.Errorf("Expected trace() to be disabled, but got '%s'", content)
+	}
+
+	if !strings.Contains(content, "[ctx] Ctx.SetQuery: setting query to 'Hello, World!'") {
+		t.Errorf("Expected trace output from Ctx.SetQuery, got '%s'", content)
+	}
+}
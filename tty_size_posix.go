@@ -0,0 +1,27 @@
+// +build !windows
+
+package peco
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ttySize asks the terminal for its current size
+func ttySize() (int, int, error) {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tty.Close()
+
+	var ws struct {
+		rows, cols, xpixel, ypixel uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return 0, 0, errno
+	}
+	return int(ws.cols), int(ws.rows), nil
+}
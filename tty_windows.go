@@ -7,9 +7,10 @@ import (
 )
 
 var (
-	kernel32           = syscall.MustLoadDLL("kernel32.dll")
-	procSetStdHandle   = kernel32.MustFindProc("SetStdHandle")
-	procGetConsoleMode = kernel32.MustFindProc("GetConsoleMode")
+	kernel32                       = syscall.MustLoadDLL("kernel32.dll")
+	procSetStdHandle               = kernel32.MustFindProc("SetStdHandle")
+	procGetConsoleMode             = kernel32.MustFindProc("GetConsoleMode")
+	procGetConsoleScreenBufferInfo = kernel32.MustFindProc("GetConsoleScreenBufferInfo")
 )
 
 func getStdHandle(h int) (fd syscall.Handle) {
@@ -59,3 +60,28 @@ func TtyTerm() {
 	syscall.Stdin = syscall.Handle(os.Stdin.Fd())
 	setStdHandle(syscall.STD_INPUT_HANDLE, syscall.Stdin)
 }
+
+type consoleScreenBufferInfo struct {
+	sizeX, sizeY                           int16
+	cursorX, cursorY                       int16
+	attributes                             uint16
+	windowLeft, windowTop                  int16
+	windowRight, windowBottom              int16
+	maximumWindowSizeX, maximumWindowSizeY int16
+}
+
+// ttySize asks the console for the current size of its window
+func ttySize() (int, int, error) {
+	out, err := os.OpenFile("CONOUT$", os.O_RDWR, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer out.Close()
+
+	var info consoleScreenBufferInfo
+	r1, _, err := procGetConsoleScreenBufferInfo.Call(out.Fd(), uintptr(unsafe.Pointer(&info)))
+	if r1 == 0 {
+		return 0, 0, err
+	}
+	return int(info.windowRight-info.windowLeft) + 1, int(info.windowBottom-info.windowTop) + 1, nil
+}
@@ -10,6 +10,8 @@ type View struct {
 	*Ctx
 	mutex  sync.Locker
 	layout Layout
+	width  int // the size of the screen when it was last drawn
+	height int
 }
 
 // PagingRequest can be sent to move the selection cursor
@@ -36,45 +38,189 @@ const (
 type StatusMsgRequest struct {
 	message    string
 	clearDelay time.Duration
+	clear      bool // true to clear the message instead, if it is still shown
 }
 
+// loadingIndicatorInterval is how often the loading indicator is
+// redrawn while the input is being read
+const loadingIndicatorInterval = 100 * time.Millisecond
+
+// resizePollInterval is how often the size of the terminal is checked
+// if it doesn't report being resized (see PollResize)
+const resizePollInterval = 500 * time.Millisecond
+
 // Loop receives requests to update the screen
 func (v *View) Loop() {
 	defer v.ReleaseWaitGroup()
+
+	// Animate the loading indicator until the input has been read.
+	// The input is loaded again by peco.ReloadSource, in which case
+	// the indicator is brought back once the screen is drawn
+	var ticker *time.Ticker
+	var tickCh <-chan time.Time
+	startLoadingIndicator := func() {
+		if tickCh != nil || !v.config.ShowLoadingIndicator || !v.IsLoading() {
+			return
+		}
+		ticker = time.NewTicker(loadingIndicatorInterval)
+		tickCh = ticker.C
+	}
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	if v.config.ShowLoadingIndicator {
+		ticker = time.NewTicker(loadingIndicatorInterval)
+		tickCh = ticker.C
+	}
+
+	resizeTicker := time.NewTicker(resizePollInterval)
+	defer resizeTicker.Stop()
+	defer v.layout.StopClearTimer()
+
+	// Draws requested with RequestDraw are done at most once a frame.
+	// The timer only runs while a draw is pending, so that nothing
+	// wakes us up while there is nothing to draw
+	var frameTimer *time.Timer
+	var frameCh <-chan time.Time
+	defer func() {
+		if frameTimer != nil {
+			frameTimer.Stop()
+		}
+	}()
+
 	for {
 		select {
 		case <-v.LoopCh():
 			return
+		case <-tickCh:
+			loading := v.IsLoading()
+			v.drawIdleMessage()
+			if !loading {
+				// One last time to remove the indicator
+				ticker.Stop()
+				tickCh = nil
+			}
+		case <-v.drawRequestCh:
+			if frameCh == nil {
+				frameTimer = time.NewTimer(v.frameInterval())
+				frameCh = frameTimer.C
+			}
+		case <-frameCh:
+			frameCh = nil
+			trace("View.Loop: drawing requested frame")
+			v.drawScreen()
+			startLoadingIndicator()
+		case <-resizeTicker.C:
+			if v.config.PollResize || !v.resizeReported() {
+				v.pollSize()
+			}
 		case m := <-v.StatusMsgCh():
+			trace("View.Loop: received status request")
 			v.printStatus(m.DataInterface().(StatusMsgRequest))
 			m.Done()
 		case r := <-v.PagingCh():
+			trace("View.Loop: received paging request")
 			v.movePage(r.DataInterface().(PagingRequest))
 			r.Done()
 		case lines := <-v.DrawCh():
+			trace("View.Loop: received draw request")
 			tmp := lines.DataInterface()
 			if name, ok := tmp.(string); ok {
-				if name == "prompt" {
+				switch name {
+				case "prompt":
 					v.drawPrompt()
+				case "refresh":
+					v.refreshScreen()
 				}
 			} else {
 				v.drawScreen()
+				startLoadingIndicator()
 			}
 			lines.Done()
 		}
 	}
 }
 
+// frameInterval returns how often the screen may be redrawn for draws
+// requested with RequestDraw (see FrameInterval)
+func (v *View) frameInterval() time.Duration {
+	ms := v.config.FrameInterval
+	if ms <= 0 {
+		ms = DefaultFrameInterval
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
 func (v *View) printStatus(r StatusMsgRequest) {
+	if r.clear {
+		v.layout.ClearStatus(r.message)
+		return
+	}
 	v.layout.PrintStatus(r.message, r.clearDelay)
 }
 
 func (v *View) drawScreen() {
 	v.mutex.Lock()
 	defer v.mutex.Unlock()
+	v.width, v.height = terminalSize()
+	v.layout.DrawScreen()
+}
+
+// terminalSizer is implemented by the screens that can ask the
+// terminal for its size
+type terminalSizer interface {
+	TerminalSize() (int, int, error)
+}
+
+// terminalSize returns the current size of the terminal. The size
+// that termbox reports is only updated when the screen is redrawn, so
+// the terminal is asked directly whenever the screen can do so
+func terminalSize() (int, int) {
+	if s, ok := screen.(terminalSizer); ok {
+		if w, h, err := s.TerminalSize(); err == nil {
+			return w, h
+		}
+	}
+	return screen.Size()
+}
+
+// pollSize redraws the screen if the size of the terminal changed
+// since it was last drawn, for terminals that don't report being
+// resized
+func (v *View) pollSize() {
+	v.mutex.Lock()
+	w, h := terminalSize()
+	changed := w != v.width || h != v.height
+	v.mutex.Unlock()
+
+	if changed {
+		trace("View.pollSize: terminal was resized to %dx%d", w, h)
+		v.drawScreen()
+	}
+}
+
+// refreshScreen redraws the entire screen, regardless of what
+// we think has already been drawn
+func (v *View) refreshScreen() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if s, ok := screen.(interface {
+		Invalidate()
+	}); ok {
+		s.Invalidate()
+	}
+	v.width, v.height = terminalSize()
 	v.layout.DrawScreen()
 }
 
+func (v *View) drawIdleMessage() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.layout.DrawIdleMessage()
+}
+
 func (v *View) drawPrompt() {
 	v.mutex.Lock()
 	defer v.mutex.Unlock()
@@ -1,8 +1,10 @@
 package peco
 
 import (
-	"github.com/nsf/termbox-go"
+	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMergeAttribute(t *testing.T) {
@@ -35,8 +37,117 @@ func TestMergeAttribute(t *testing.T) {
 	}
 
 	// merge attributes
-	if m := mergeAttribute(termbox.AttrBold|colors["red"], termbox.AttrUnderline|colors["cyan"]); m != termbox.AttrBold|termbox.AttrUnderline|colors["white"] {
-		t.Errorf("expected %s, got %s", termbox.AttrBold|termbox.AttrUnderline|colors["white"], m)
+	if m := mergeAttribute(AttrBold|colors["red"], AttrUnderline|colors["cyan"]); m != AttrBold|AttrUnderline|colors["white"] {
+		t.Errorf("expected %s, got %s", AttrBold|AttrUnderline|colors["white"], m)
 	}
 
 }
+
+// slowScreen is a terminal that takes a while to draw, like one at the
+// other end of a slow connection. It counts the times it is drawn
+type slowScreen struct {
+	dummyScreen
+	delay   time.Duration
+	flushes *int32
+}
+
+func (s slowScreen) SetCell(x, y int, ch rune, fg, bg Attribute) {}
+func (s slowScreen) Flush() error {
+	time.Sleep(s.delay)
+	atomic.AddInt32(s.flushes, 1)
+	return nil
+}
+
+// pageWhileMatching matches `lines` lines, all of which are streamed
+// to the view, while keys are pressed to move the cursor. It returns
+// the running view, and how the screen was drawn in the meantime
+func pageWhileMatching(tb testing.TB, lines int, frameInterval int) (ctx *Ctx, r drawStats) {
+	tb.Helper()
+
+	r.flushes = new(int32)
+	screen = slowScreen{screen.(dummyScreen), 5 * time.Millisecond, r.flushes}
+
+	ctx = newCtx(nil, 5)
+	ctx.config.FrameInterval = frameInterval
+	for n := 0; n < lines; n++ {
+		ctx.AddRawLine(NewRawLine(fmt.Sprintf("line %d", n), false))
+	}
+	ctx.AddWaitGroup(2)
+	go ctx.NewView().Loop()
+	go ctx.NewFilter().Loop()
+
+	completed := func() bool {
+		ctx.stats.mutex.Lock()
+		defer ctx.stats.mutex.Unlock()
+		return ctx.stats.completed > 0
+	}
+
+	ctx.SetQuery([]rune("line"))
+	ctx.SendQuery("line")
+
+	start := time.Now()
+	for !completed() {
+		// Waits for the view to handle the key
+		sent := time.Now()
+		send("paging", ctx.PagingCh(), HubReq{ToLineBelow, nil}, true)
+		if latency := time.Since(sent); latency > r.maxLatency {
+			r.maxLatency = latency
+		}
+		r.keys++
+		time.Sleep(20 * time.Millisecond)
+	}
+	r.elapsed = time.Since(start)
+	return ctx, r
+}
+
+type drawStats struct {
+	keys       int
+	maxLatency time.Duration
+	elapsed    time.Duration
+	flushes    *int32
+}
+
+func TestDrawCoalescing(t *testing.T) {
+	_, guard := setDummyScreen()
+	defer guard()
+
+	ctx, r := pageWhileMatching(t, 50000, 20)
+	defer stopLoops(ctx)
+
+	// At most one draw per frame, besides the ones for the keys and
+	// the few that are sent explicitly (e.g. when the query is run).
+	// Each draw flushes the prompt, the status bar, and the lines
+	draws := int32(r.elapsed/(20*time.Millisecond)) + int32(r.keys) + 5
+	if n := atomic.LoadInt32(r.flushes); n > 3*draws {
+		t.Errorf("Expected at most %d draws in %s, got %d flushes", draws, r.elapsed, n)
+	}
+
+	// Once the lines are drawn, nothing is drawn until there is
+	// something new to draw
+	time.Sleep(100 * time.Millisecond)
+	n := atomic.LoadInt32(r.flushes)
+	time.Sleep(100 * time.Millisecond)
+	if m := atomic.LoadInt32(r.flushes); m != n {
+		t.Errorf("Expected nothing to be drawn while idle, got %d flushes", m-n)
+	}
+
+	ctx.RequestDraw()
+	ctx.RequestDraw()
+	time.Sleep(100 * time.Millisecond)
+	if m := atomic.LoadInt32(r.flushes); m == n || m > n+3 {
+		t.Errorf("Expected the requested draws to be done once, got %d flushes", m-n)
+	}
+}
+
+// BenchmarkDrawCoalescing reports how responsive keys are while a
+// million lines are matched and drawn
+func BenchmarkDrawCoalescing(b *testing.B) {
+	_, guard := setDummyScreen()
+	defer guard()
+
+	for i := 0; i < b.N; i++ {
+		ctx, r := pageWhileMatching(b, 1000000, 100)
+		stopLoops(ctx)
+		b.Logf("%d keys, max latency %s, %d flushes in %s", r.keys, r.maxLatency, atomic.LoadInt32(r.flushes), r.elapsed)
+	}
+}